@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"git.neds.sh/matty/entain/api/logging"
+	"git.neds.sh/matty/entain/api/problem"
+)
+
+// APIKeyHeader is the HTTP header an API key is accepted on.
+const APIKeyHeader = "X-API-Key"
+
+// Authenticator verifies the credentials of requests.
+type Authenticator struct {
+	jwt             *jwtVerifier
+	apiKeys         []APIKeyConfig
+	anonymousScopes []string
+}
+
+// NewAuthenticator creates an Authenticator from cfg, loading any key files it refers to.
+func NewAuthenticator(cfg Config) (*Authenticator, error) {
+	verifier, err := newJWTVerifier(cfg.JWT)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range cfg.APIKeys {
+		if k.Key == "" || k.Subject == "" {
+			return nil, errors.New("api keys require a key and subject")
+		}
+	}
+
+	return &Authenticator{
+		jwt:             verifier,
+		apiKeys:         cfg.APIKeys,
+		anonymousScopes: cfg.AnonymousScopes,
+	}, nil
+}
+
+// Authenticate returns the identity of r. Requests without credentials are anonymous; requests with invalid
+// credentials are rejected.
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		const prefix = "bearer "
+
+		if len(authorization) <= len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+			return nil, errors.New("unsupported authorization scheme")
+		}
+
+		if !a.jwt.enabled() {
+			return nil, errors.New("bearer tokens are not accepted")
+		}
+
+		return a.jwt.verify(authorization[len(prefix):])
+	}
+
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		for _, k := range a.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+				return &Identity{Subject: k.Subject, Scopes: k.Scopes, Method: MethodAPIKey}, nil
+			}
+		}
+
+		return nil, errors.New("unknown api key")
+	}
+
+	return &Identity{Scopes: a.anonymousScopes, Method: MethodAnonymous}, nil
+}
+
+// Middleware authenticates each request, attaching its identity to the request context. Requests with invalid
+// credentials are rejected with a 401.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := a.Authenticate(r)
+		if err != nil {
+			logging.FromContext(r.Context()).WithError(err).Info("authentication failed")
+
+			p, _ := problem.New(r.Context(), r, status.Error(codes.Unauthenticated, "invalid credentials"))
+
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			problem.Write(r.Context(), w, p, 0)
+
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), identity)))
+	})
+}
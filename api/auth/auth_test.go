@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticatorAuthenticate(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "rsa.GenerateKey")
+
+	authenticator, err := NewAuthenticator(Config{
+		JWT: JWTConfig{
+			HMACKeys: []HMACKeyConfig{{ID: "hmac", Secret: "secret"}},
+			JWKSFile: writeJWKS(t, "rsa", &rsaKey.PublicKey),
+			Issuer:   "issuer",
+		},
+		APIKeys:         []APIKeyConfig{{Key: "key123", Subject: "partner", Scopes: []string{"races:read"}}},
+		AnonymousScopes: []string{"races:read"},
+	})
+	require.NoError(t, err, "NewAuthenticator")
+
+	validClaims := jwt.MapClaims{
+		"sub":   "trader",
+		"iss":   "issuer",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "races:read races:write",
+	}
+
+	for _, tc := range []struct {
+		name          string
+		giveHeader    http.Header
+		expect        *Identity
+		expectErrored bool
+	}{
+		{
+			name:   "anonymous",
+			expect: &Identity{Scopes: []string{"races:read"}, Method: MethodAnonymous},
+		},
+		{
+			name:       "jwt_hs256",
+			giveHeader: bearer(signToken(t, jwt.SigningMethodHS256, "hmac", []byte("secret"), validClaims)),
+			expect:     &Identity{Subject: "trader", Scopes: []string{"races:read", "races:write"}, Method: MethodJWT},
+		},
+		{
+			name:       "jwt_rs256_jwks",
+			giveHeader: bearer(signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, validClaims)),
+			expect:     &Identity{Subject: "trader", Scopes: []string{"races:read", "races:write"}, Method: MethodJWT},
+		},
+		{
+			name:          "jwt_wrong_secret",
+			giveHeader:    bearer(signToken(t, jwt.SigningMethodHS256, "hmac", []byte("wrong"), validClaims)),
+			expectErrored: true,
+		},
+		{
+			name:          "jwt_unknown_kid",
+			giveHeader:    bearer(signToken(t, jwt.SigningMethodHS256, "unknown", []byte("secret"), validClaims)),
+			expectErrored: true,
+		},
+		{
+			name: "jwt_expired",
+			giveHeader: bearer(signToken(t, jwt.SigningMethodHS256, "hmac", []byte("secret"), jwt.MapClaims{
+				"sub": "trader",
+				"iss": "issuer",
+				"exp": time.Now().Add(-time.Minute).Unix(),
+			})),
+			expectErrored: true,
+		},
+		{
+			name: "jwt_missing_expiry",
+			giveHeader: bearer(signToken(t, jwt.SigningMethodHS256, "hmac", []byte("secret"), jwt.MapClaims{
+				"sub": "trader",
+				"iss": "issuer",
+			})),
+			expectErrored: true,
+		},
+		{
+			name: "jwt_wrong_issuer",
+			giveHeader: bearer(signToken(t, jwt.SigningMethodHS256, "hmac", []byte("secret"), jwt.MapClaims{
+				"sub": "trader",
+				"iss": "other",
+				"exp": time.Now().Add(time.Hour).Unix(),
+			})),
+			expectErrored: true,
+		},
+		{
+			name:          "unsupported_scheme",
+			giveHeader:    http.Header{"Authorization": []string{"Basic dXNlcjpwYXNz"}},
+			expectErrored: true,
+		},
+		{
+			name:       "api_key",
+			giveHeader: http.Header{APIKeyHeader: []string{"key123"}},
+			expect:     &Identity{Subject: "partner", Scopes: []string{"races:read"}, Method: MethodAPIKey},
+		},
+		{
+			name:          "api_key_unknown",
+			giveHeader:    http.Header{APIKeyHeader: []string{"key456"}},
+			expectErrored: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/list-races", nil)
+			for k, values := range tc.giveHeader {
+				for _, v := range values {
+					req.Header.Add(k, v)
+				}
+			}
+
+			actual, actualErr := authenticator.Authenticate(req)
+
+			assert.Equal(t, tc.expect, actual, "identity")
+
+			if tc.expectErrored {
+				assert.Error(t, actualErr, "actualErr")
+			} else {
+				assert.NoError(t, actualErr, "actualErr")
+			}
+		})
+	}
+}
+
+func TestAuthenticatorAuthenticateAllowMissingExpiry(t *testing.T) {
+	t.Parallel()
+
+	authenticator, err := NewAuthenticator(Config{
+		JWT: JWTConfig{
+			HMACKeys:           []HMACKeyConfig{{ID: "hmac", Secret: "secret"}},
+			AllowMissingExpiry: true,
+		},
+	})
+	require.NoError(t, err, "NewAuthenticator")
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/list-races", nil)
+	for k, values := range bearer(signToken(t, jwt.SigningMethodHS256, "hmac", []byte("secret"), jwt.MapClaims{"sub": "trader"})) {
+		req.Header[k] = values
+	}
+
+	actual, err := authenticator.Authenticate(req)
+	require.NoError(t, err, "Authenticate")
+
+	assert.Equal(t, &Identity{Subject: "trader", Method: MethodJWT}, actual, "identity")
+}
+
+func TestHeaderMatcher(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		give     string
+		expect   string
+		expectOK bool
+	}{
+		{give: "Grpc-Metadata-X-Auth-Scopes"},
+		{give: "Grpc-Metadata-X-Auth-Subject"},
+		{give: "Grpc-Metadata-X-Auth-Method"},
+		{give: "Grpc-Metadata-Foo", expect: "Foo", expectOK: true},
+		{give: "Accept", expect: "grpcgateway-Accept", expectOK: true},
+	} {
+		actual, actualOK := HeaderMatcher(tc.give)
+
+		assert.Equal(t, tc.expect, actual, tc.give)
+		assert.Equal(t, tc.expectOK, actualOK, tc.give)
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	require.NoError(t, err, "SignedString")
+
+	return signed
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": []string{"Bearer " + token}}
+}
+
+func writeJWKS(t *testing.T, kid string, key *rsa.PublicKey) string {
+	b, err := json.Marshal(jwks{Keys: []jwk{{
+		Kty: "RSA",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	require.NoError(t, err, "json.Marshal")
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, b, 0o600), "os.WriteFile")
+
+	return path
+}
@@ -0,0 +1,47 @@
+package auth
+
+// Config configures how requests are authenticated.
+type Config struct {
+	// JWT configures the verification of bearer tokens.
+	JWT JWTConfig `yaml:"jwt"`
+	// APIKeys are the static API keys accepted on the X-API-Key header.
+	APIKeys []APIKeyConfig `yaml:"api_keys"`
+	// AnonymousScopes are granted to requests without credentials.
+	AnonymousScopes []string `yaml:"anonymous_scopes"`
+}
+
+// JWTConfig configures the verification of HS256/RS256 bearer tokens. Keys are selected by the "kid" header of the
+// token; a token without a "kid" may be verified by any key.
+type JWTConfig struct {
+	// HMACKeys are the shared secrets HS256 tokens are verified against.
+	HMACKeys []HMACKeyConfig `yaml:"hmac_keys"`
+	// RSAKeys are the PEM encoded public keys RS256 tokens are verified against.
+	RSAKeys []RSAKeyConfig `yaml:"rsa_keys"`
+	// JWKSFile is the path to a JSON Web Key Set file holding further keys.
+	JWKSFile string `yaml:"jwks_file"`
+	// Issuer, if set, must match the "iss" claim.
+	Issuer string `yaml:"issuer"`
+	// Audience, if set, must be one of the "aud" claims.
+	Audience string `yaml:"audience"`
+	// AllowMissingExpiry accepts tokens without an "exp" claim, which are otherwise rejected as they never expire.
+	AllowMissingExpiry bool `yaml:"allow_missing_expiry"`
+}
+
+// HMACKeyConfig is a shared secret for HS256 tokens.
+type HMACKeyConfig struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+// RSAKeyConfig is an RSA public key for RS256 tokens.
+type RSAKeyConfig struct {
+	ID   string `yaml:"id"`
+	File string `yaml:"file"`
+}
+
+// APIKeyConfig is a static API key and the identity it authenticates as.
+type APIKeyConfig struct {
+	Key     string   `yaml:"key"`
+	Subject string   `yaml:"subject"`
+	Scopes  []string `yaml:"scopes"`
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/metadata"
+)
+
+// Methods a request may be authenticated by.
+const (
+	MethodAnonymous = "anonymous"
+	MethodJWT       = "jwt"
+	MethodAPIKey    = "api_key"
+)
+
+// gRPC metadata keys the verified identity is forwarded to backends on.
+const (
+	SubjectMetadataKey = "x-auth-subject"
+	ScopesMetadataKey  = "x-auth-scopes"
+	MethodMetadataKey  = "x-auth-method"
+)
+
+// Identity is the verified identity of a request.
+type Identity struct {
+	// Subject identifies the caller. It is empty for anonymous requests.
+	Subject string
+	// Scopes are the scopes granted to the caller.
+	Scopes []string
+	// Method is how the caller was authenticated.
+	Method string
+}
+
+type identityKey struct{}
+
+// NewContext returns a copy of ctx carrying identity.
+func NewContext(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns the identity carried by ctx, if any.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+
+	return identity, ok
+}
+
+// IdentityMetadata is a runtime.WithMetadata annotator that forwards the verified identity to gRPC backends.
+func IdentityMetadata(ctx context.Context, _ *http.Request) metadata.MD {
+	identity, ok := FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	return metadata.Pairs(
+		SubjectMetadataKey, identity.Subject,
+		ScopesMetadataKey, strings.Join(identity.Scopes, " "),
+		MethodMetadataKey, identity.Method,
+	)
+}
+
+// HeaderMatcher is a runtime.HeaderMatcherFunc that behaves like the default matcher, except that it never forwards
+// identity metadata supplied by the client, which would otherwise be trusted by backends.
+func HeaderMatcher(key string) (string, bool) {
+	mdKey, ok := runtime.DefaultHeaderMatcher(key)
+	if !ok {
+		return "", false
+	}
+
+	switch strings.ToLower(mdKey) {
+	case SubjectMetadataKey, ScopesMetadataKey, MethodMetadataKey:
+		return "", false
+	}
+
+	return mdKey, true
+}
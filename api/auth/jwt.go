@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwtVerifier verifies HS256/RS256 bearer tokens against a fixed set of keys.
+type jwtVerifier struct {
+	hmacKeys map[string][]byte
+	rsaKeys  map[string]*rsa.PublicKey
+	issuer   string
+	audience string
+	// allowMissingExpiry accepts tokens without an "exp" claim.
+	allowMissingExpiry bool
+}
+
+// jwks is a JSON Web Key Set.
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwk is a JSON Web Key. Only RSA ("RSA") and symmetric ("oct") keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	K   string `json:"k"`
+}
+
+// newJWTVerifier loads the keys described by cfg.
+func newJWTVerifier(cfg JWTConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		hmacKeys: map[string][]byte{},
+		rsaKeys:  map[string]*rsa.PublicKey{},
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+
+		allowMissingExpiry: cfg.AllowMissingExpiry,
+	}
+
+	for _, k := range cfg.HMACKeys {
+		if k.Secret == "" {
+			return nil, fmt.Errorf("hmac key %q has no secret", k.ID)
+		}
+
+		v.hmacKeys[k.ID] = []byte(k.Secret)
+	}
+
+	for _, k := range cfg.RSAKeys {
+		b, err := os.ReadFile(k.File)
+		if err != nil {
+			return nil, fmt.Errorf("reading rsa key %q: %w", k.ID, err)
+		}
+
+		key, err := jwt.ParseRSAPublicKeyFromPEM(b)
+		if err != nil {
+			return nil, fmt.Errorf("parsing rsa key %q: %w", k.ID, err)
+		}
+
+		v.rsaKeys[k.ID] = key
+	}
+
+	if cfg.JWKSFile != "" {
+		if err := v.loadJWKS(cfg.JWKSFile); err != nil {
+			return nil, fmt.Errorf("loading jwks: %w", err)
+		}
+	}
+
+	return v, nil
+}
+
+func (v *jwtVerifier) loadJWKS(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var set jwks
+	if err := json.Unmarshal(b, &set); err != nil {
+		return err
+	}
+
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return fmt.Errorf("key %q: decoding n: %w", k.Kid, err)
+			}
+
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return fmt.Errorf("key %q: decoding e: %w", k.Kid, err)
+			}
+
+			v.rsaKeys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return fmt.Errorf("key %q: decoding k: %w", k.Kid, err)
+			}
+
+			v.hmacKeys[k.Kid] = secret
+		default:
+			return fmt.Errorf("key %q: unsupported key type %q", k.Kid, k.Kty)
+		}
+	}
+
+	return nil
+}
+
+// enabled reports whether any keys are configured.
+func (v *jwtVerifier) enabled() bool {
+	return len(v.hmacKeys) > 0 || len(v.rsaKeys) > 0
+}
+
+// verify verifies token and returns the identity it carries.
+func (v *jwtVerifier) verify(token string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+
+	parser := &jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg()}}
+	if _, err := parser.ParseWithClaims(token, claims, v.key); err != nil {
+		return nil, err
+	}
+
+	// The parser only checks the expiry of tokens that have one.
+	if _, ok := claims["exp"]; !ok && !v.allowMissingExpiry {
+		return nil, errors.New("missing expiry")
+	}
+
+	if v.issuer != "" && !claims.VerifyIssuer(v.issuer, true) {
+		return nil, errors.New("invalid issuer")
+	}
+
+	if v.audience != "" && !claims.VerifyAudience(v.audience, true) {
+		return nil, errors.New("invalid audience")
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, errors.New("missing subject")
+	}
+
+	return &Identity{
+		Subject: subject,
+		Scopes:  scopesFromClaims(claims),
+		Method:  MethodJWT,
+	}, nil
+}
+
+// key is a jwt.Keyfunc that selects the key to verify token with. Tokens without a "kid" header can only be
+// verified if there is a single key for their signing method.
+func (v *jwtVerifier) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if key, ok := v.hmacKeys[kid]; ok {
+			return key, nil
+		}
+
+		if kid == "" && len(v.hmacKeys) == 1 {
+			for _, key := range v.hmacKeys {
+				return key, nil
+			}
+		}
+	case *jwt.SigningMethodRSA:
+		if key, ok := v.rsaKeys[kid]; ok {
+			return key, nil
+		}
+
+		if kid == "" && len(v.rsaKeys) == 1 {
+			for _, key := range v.rsaKeys {
+				return key, nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected signing method %q", token.Method.Alg())
+	}
+
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// scopesFromClaims reads scopes from either a space delimited "scope" claim (RFC 8693) or a "scopes" array claim.
+func scopesFromClaims(claims jwt.MapClaims) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+
+	var scopes []string
+
+	if values, ok := claims["scopes"].([]interface{}); ok {
+		for _, value := range values {
+			if scope, ok := value.(string); ok {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	return scopes
+}
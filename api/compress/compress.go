@@ -0,0 +1,295 @@
+// Package compress compresses gateway responses with gzip or brotli, as negotiated by Accept-Encoding.
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Config configures response compression.
+type Config struct {
+	// Enabled turns compression on.
+	Enabled bool `yaml:"enabled"`
+	// MinSize is the smallest response body, in bytes, that is compressed. Smaller responses are not worth the
+	// overhead.
+	MinSize int `yaml:"min_size"`
+	// GzipLevel is the gzip compression level, from 1 (fastest) to 9 (smallest).
+	GzipLevel int `yaml:"gzip_level"`
+	// BrotliLevel is the brotli compression level, from 0 (fastest) to 11 (smallest).
+	BrotliLevel int `yaml:"brotli_level"`
+}
+
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// encoder is a compressing writer that can be reused.
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// Middleware returns a handler that compresses responses of at least cfg.MinSize bytes with the encoding
+// preferred by the client.
+func Middleware(cfg Config, next http.Handler) http.Handler {
+	if !cfg.Enabled {
+		return next
+	}
+
+	pools := map[string]*sync.Pool{
+		encodingBrotli: {New: func() interface{} {
+			return brotli.NewWriterLevel(io.Discard, cfg.BrotliLevel)
+		}},
+		encodingGzip: {New: func() interface{} {
+			// The level has been checked by Validate.
+			w, _ := gzip.NewWriterLevel(io.Discard, cfg.GzipLevel)
+
+			return w
+		}},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			pool:           pools[encoding],
+			minSize:        cfg.MinSize,
+		}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// Validate checks the compression levels in cfg.
+func (c Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.GzipLevel < gzip.BestSpeed || c.GzipLevel > gzip.BestCompression {
+		return fmt.Errorf("invalid gzip level %d", c.GzipLevel)
+	}
+
+	if c.BrotliLevel < brotli.BestSpeed || c.BrotliLevel > brotli.BestCompression {
+		return fmt.Errorf("invalid brotli level %d", c.BrotliLevel)
+	}
+
+	return nil
+}
+
+// negotiate returns the preferred supported encoding in the Accept-Encoding header, or "" if the response should
+// not be compressed. Brotli is preferred over gzip when the client has no preference.
+func negotiate(acceptEncoding string) string {
+	var (
+		best  string
+		bestQ float64
+	)
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, q := parseCoding(part)
+
+		switch coding {
+		case encodingBrotli, encodingGzip, "*":
+		default:
+			continue
+		}
+
+		if coding == "*" {
+			coding = encodingBrotli
+		}
+
+		if q > bestQ || (q == bestQ && q > 0 && coding == encodingBrotli) {
+			best, bestQ = coding, q
+		}
+	}
+
+	return best
+}
+
+// parseCoding parses a content coding and its quality value from an Accept-Encoding element.
+func parseCoding(part string) (string, float64) {
+	coding := strings.TrimSpace(part)
+	q := 1.0
+
+	if i := strings.Index(coding, ";"); i >= 0 {
+		params := coding[i+1:]
+		coding = strings.TrimSpace(coding[:i])
+
+		for _, param := range strings.Split(params, ";") {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			v, err := strconv.ParseFloat(param[len("q="):], 64)
+			if err != nil {
+				return "", 0
+			}
+
+			q = v
+		}
+	}
+
+	return strings.ToLower(coding), q
+}
+
+// compressWriter buffers the start of a response until it knows whether it is large enough to compress.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	pool     *sync.Pool
+	minSize  int
+
+	status  int
+	buf     []byte
+	decided bool
+	encoder encoder
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if w.decided {
+		return w.write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+	if len(w.buf) < w.minSize {
+		return len(b), nil
+	}
+
+	if err := w.decide(true); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Flush sends any buffered response. Streamed responses are not compressed, so each flushed message reaches the
+// client immediately.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		_ = w.decide(false)
+	}
+
+	if w.encoder != nil {
+		if f, ok := w.encoder.(interface{ Flush() error }); ok {
+			_ = f.Flush()
+		}
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets websocket upgrades through.
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	w.decided = true
+
+	return h.Hijack()
+}
+
+// decide writes the response header, compressing the response if compress is set and it is eligible, then writes
+// out anything buffered.
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	h := w.Header()
+	if compress && eligible(w.status, h) {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+
+		w.encoder = w.pool.Get().(encoder)
+		w.encoder.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	_, err := w.write(w.buf)
+	w.buf = nil
+
+	return err
+}
+
+func (w *compressWriter) write(b []byte) (int, error) {
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// close finishes the response.
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.status == 0 {
+			// Nothing was written; leave the default response to net/http.
+			return
+		}
+
+		_ = w.decide(false)
+	}
+
+	if w.encoder != nil {
+		_ = w.encoder.Close()
+		w.encoder.Reset(io.Discard)
+		w.pool.Put(w.encoder)
+		w.encoder = nil
+	}
+}
+
+// eligible reports whether a response with status and header can be compressed.
+func eligible(status int, h http.Header) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	contentType := h.Get("Content-Type")
+
+	return !strings.HasPrefix(contentType, "text/event-stream") && !strings.HasPrefix(contentType, "image/")
+}
@@ -0,0 +1,182 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{Enabled: true, MinSize: 100, GzipLevel: 6, BrotliLevel: 4}
+	large := strings.Repeat(`{"id":"1","name":"race"}`, 20)
+
+	for _, tc := range []struct {
+		name                string
+		giveAcceptEncoding  string
+		giveBody            string
+		giveContentEncoding string
+		giveStatus          int
+		expectEncoding      string
+	}{
+		{
+			name:               "gzip",
+			giveAcceptEncoding: "gzip",
+			giveBody:           large,
+			expectEncoding:     "gzip",
+		},
+		{
+			name:               "brotli_preferred",
+			giveAcceptEncoding: "gzip, deflate, br",
+			giveBody:           large,
+			expectEncoding:     "br",
+		},
+		{
+			name:               "gzip_weighted",
+			giveAcceptEncoding: "br;q=0.5, gzip",
+			giveBody:           large,
+			expectEncoding:     "gzip",
+		},
+		{
+			name:               "below_min_size",
+			giveAcceptEncoding: "gzip",
+			giveBody:           "{}",
+		},
+		{
+			name:               "not_accepted",
+			giveAcceptEncoding: "gzip;q=0, identity",
+			giveBody:           large,
+		},
+		{
+			name:                "already_encoded",
+			giveAcceptEncoding:  "gzip",
+			giveBody:            large,
+			giveContentEncoding: "identity-custom",
+		},
+		{
+			name:               "error_status",
+			giveAcceptEncoding: "gzip",
+			giveBody:           large,
+			giveStatus:         http.StatusServiceUnavailable,
+			expectEncoding:     "gzip",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			handler := Middleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				if tc.giveContentEncoding != "" {
+					w.Header().Set("Content-Encoding", tc.giveContentEncoding)
+				}
+
+				if tc.giveStatus != 0 {
+					w.WriteHeader(tc.giveStatus)
+				}
+
+				// Write in pieces so the response crosses the threshold part way through.
+				for i := 0; i < len(tc.giveBody); i += 10 {
+					end := i + 10
+					if end > len(tc.giveBody) {
+						end = len(tc.giveBody)
+					}
+
+					_, _ = io.WriteString(w, tc.giveBody[i:end])
+				}
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/list-races", nil)
+			req.Header.Set("Accept-Encoding", tc.giveAcceptEncoding)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			expectStatus := tc.giveStatus
+			if expectStatus == 0 {
+				expectStatus = http.StatusOK
+			}
+
+			assert.Equal(t, expectStatus, rec.Code, "status")
+			assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"), "Vary")
+
+			var body io.Reader = rec.Body
+
+			switch tc.expectEncoding {
+			case "gzip":
+				assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"), "Content-Encoding")
+
+				r, err := gzip.NewReader(rec.Body)
+				require.NoError(t, err, "gzip.NewReader")
+
+				body = r
+			case "br":
+				assert.Equal(t, "br", rec.Header().Get("Content-Encoding"), "Content-Encoding")
+
+				body = brotli.NewReader(rec.Body)
+			default:
+				assert.Equal(t, tc.giveContentEncoding, rec.Header().Get("Content-Encoding"), "Content-Encoding")
+			}
+
+			actual, err := io.ReadAll(body)
+			require.NoError(t, err, "io.ReadAll")
+
+			assert.Equal(t, tc.giveBody, string(actual), "body")
+		})
+	}
+}
+
+func TestMiddlewareFlush(t *testing.T) {
+	t.Parallel()
+
+	handler := Middleware(
+		Config{Enabled: true, MinSize: 100, GzipLevel: 6, BrotliLevel: 4},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+
+			_, _ = io.WriteString(w, "data: {}\n\n")
+			w.(http.Flusher).Flush()
+		}),
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/races:watch", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.True(t, rec.Flushed, "flushed")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "Content-Encoding")
+	assert.Equal(t, "data: {}\n\n", rec.Body.String(), "body")
+}
+
+func TestNegotiate(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		give   string
+		expect string
+	}{
+		{give: "", expect: ""},
+		{give: "identity", expect: ""},
+		{give: "gzip", expect: "gzip"},
+		{give: "GZIP", expect: "gzip"},
+		{give: "gzip, br", expect: "br"},
+		{give: "gzip;q=1.0, br;q=0.8", expect: "gzip"},
+		{give: "*", expect: "br"},
+		{give: "br;q=0, gzip;q=0", expect: ""},
+		{give: "gzip;q=bad", expect: ""},
+	} {
+		assert.Equal(t, tc.expect, negotiate(tc.give), tc.give)
+	}
+}
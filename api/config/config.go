@@ -0,0 +1,104 @@
+package config
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"git.neds.sh/matty/entain/api/auth"
+	"git.neds.sh/matty/entain/api/compress"
+	"git.neds.sh/matty/entain/api/cors"
+	"git.neds.sh/matty/entain/api/gql"
+	"git.neds.sh/matty/entain/api/logging"
+	"git.neds.sh/matty/entain/api/precondition"
+	"git.neds.sh/matty/entain/api/ratelimit"
+	"git.neds.sh/matty/entain/api/securityheaders"
+	"git.neds.sh/matty/entain/api/upstream"
+	"git.neds.sh/matty/entain/api/watch"
+)
+
+// Config is the configuration of the api server.
+type Config struct {
+	// Auth configures how requests are authenticated.
+	Auth auth.Config `yaml:"auth"`
+	// RateLimit configures per client rate limiting.
+	RateLimit ratelimit.Config `yaml:"rate_limit"`
+	// CORS configures which other origins may call the api.
+	CORS cors.Config `yaml:"cors"`
+	// Compression configures response compression.
+	Compression compress.Config `yaml:"compression"`
+	// SecurityHeaders are headers added to every response. When unset, securityheaders.Default() is used.
+	SecurityHeaders securityheaders.Config `yaml:"security_headers"`
+	// Watch configures race watches over server-sent events and websockets.
+	Watch watch.Config `yaml:"watch"`
+	// GraphQL configures the limits on GraphQL operations.
+	GraphQL gql.Config `yaml:"graphql"`
+	// Upstreams are the gRPC services requests are routed to. They are reloaded on SIGHUP.
+	Upstreams []upstream.Service `yaml:"upstreams"`
+}
+
+// Default returns the configuration used when no configuration file is given.
+func Default() *Config {
+	return &Config{
+		Auth: auth.Config{
+			AnonymousScopes: []string{"races:read"},
+		},
+		RateLimit: ratelimit.Config{
+			Enabled: true,
+			Default: ratelimit.Limit{Rate: 10, Burst: 20},
+		},
+		CORS: cors.Config{
+			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+			AllowedHeaders: []string{
+				"Authorization", "Content-Type", auth.APIKeyHeader, logging.RequestIDHeader, precondition.IfMatchHeader,
+				"X-Grpc-Web", "X-User-Agent", "Grpc-Timeout", "Connect-Protocol-Version", "Connect-Timeout-Ms",
+				"Last-Event-ID",
+			},
+			ExposedHeaders: []string{
+				logging.RequestIDHeader, "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset",
+				"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin", "X-Cache", "Warning", "Age",
+				precondition.ETagHeader,
+			},
+			MaxAge: 600,
+		},
+		Compression: compress.Config{
+			Enabled:     true,
+			MinSize:     1024,
+			GzipLevel:   6,
+			BrotliLevel: 4,
+		},
+		Watch: watch.Config{
+			HeartbeatInterval:       15 * time.Second,
+			BufferSize:              100,
+			MaxConnectionsPerClient: 5,
+		},
+		GraphQL: gql.Config{
+			MaxDepth: 10,
+			MaxCost:  1000,
+			ListSize: 10,
+		},
+	}
+}
+
+// Load reads the YAML configuration file at path over the top of Default(). If path is empty, Default() is
+// returned.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path == "" {
+		return cfg, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
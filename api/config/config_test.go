@@ -0,0 +1,34 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.neds.sh/matty/entain/api/ratelimit"
+)
+
+func TestDefaultCORSMatchesExample(t *testing.T) {
+	t.Parallel()
+
+	example, err := Load("../config.example.yaml")
+	require.NoError(t, err, "Load")
+
+	// The example allows an origin, which the default leaves unset so that CORS is off.
+	expect := example.CORS
+	expect.AllowedOrigins = nil
+
+	assert.Equal(t, expect, Default().CORS, "expected vs actual")
+}
+
+func TestDefaultRateLimit(t *testing.T) {
+	t.Parallel()
+
+	cfg := Default().RateLimit
+	assert.True(t, cfg.Enabled, "enabled")
+
+	_, err := ratelimit.NewLimiter(cfg, ratelimit.NewMemoryStore(time.Minute))
+	assert.NoError(t, err, "NewLimiter")
+}
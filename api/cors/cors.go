@@ -0,0 +1,159 @@
+// Package cors implements Cross-Origin Resource Sharing for the gateway.
+package cors
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Config configures which cross origin requests are allowed.
+type Config struct {
+	// AllowedOrigins are the origins allowed to make requests. "*" allows any origin, and a leading "*." allows
+	// any subdomain, e.g. "*.example.com". No origins disables CORS.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// AllowedMethods are the methods allowed in cross origin requests.
+	AllowedMethods []string `yaml:"allowed_methods"`
+	// AllowedHeaders are the request headers allowed in cross origin requests.
+	AllowedHeaders []string `yaml:"allowed_headers"`
+	// ExposedHeaders are the response headers made readable to cross origin requests.
+	ExposedHeaders []string `yaml:"exposed_headers"`
+	// AllowCredentials allows cross origin requests to include credentials.
+	AllowCredentials bool `yaml:"allow_credentials"`
+	// MaxAge is how long, in seconds, preflight responses may be cached for.
+	MaxAge int `yaml:"max_age"`
+}
+
+// Middleware returns a handler that adds the CORS headers allowed by cfg to responses and answers preflight
+// requests itself.
+func Middleware(cfg Config, next http.Handler) http.Handler {
+	if len(cfg.AllowedOrigins) == 0 {
+		return next
+	}
+
+	allowedMethods := strings.Join(cfg.AllowedMethods, ", ")
+	allowedHeaders := make(map[string]bool, len(cfg.AllowedHeaders))
+
+	for _, h := range cfg.AllowedHeaders {
+		allowedHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+
+	exposedHeaders := strings.Join(cfg.ExposedHeaders, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+
+		allowedOrigin, ok := matchOrigin(cfg, origin)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+			if ok && methodAllowed(cfg.AllowedMethods, r.Header.Get("Access-Control-Request-Method")) &&
+				headersAllowed(allowedHeaders, r.Header.Get("Access-Control-Request-Headers")) {
+				w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+				w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+
+				if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+					w.Header().Set("Access-Control-Allow-Headers", requested)
+				}
+
+				if cfg.AllowCredentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+
+				if cfg.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cfg.MaxAge))
+				}
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+
+			return
+		}
+
+		if ok {
+			w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+
+			if cfg.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if exposedHeaders != "" {
+				w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// matchOrigin returns the value of the Access-Control-Allow-Origin header for origin, if it is allowed. Browsers
+// refuse a wildcard with credentials, so the origin is echoed back in that case.
+func matchOrigin(cfg Config, origin string) (string, bool) {
+	for _, allowed := range cfg.AllowedOrigins {
+		switch {
+		case allowed == "*":
+			if cfg.AllowCredentials {
+				return origin, true
+			}
+
+			return "*", true
+		case strings.HasPrefix(allowed, "*."):
+			if strings.HasSuffix(origin, allowed[1:]) && strings.Contains(origin, "://") {
+				return origin, true
+			}
+		case strings.EqualFold(allowed, origin):
+			return origin, true
+		}
+	}
+
+	return "", false
+}
+
+// AllowsWebSocket reports whether the websocket upgrade r may be accepted. Browsers don't apply CORS to websockets,
+// so upgrades are only accepted from the origin the api is served from and the origins cfg allows.
+func (c Config) AllowsWebSocket(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	_, ok := matchOrigin(c, origin)
+
+	return ok
+}
+
+// methodAllowed reports whether method is one of allowed.
+func methodAllowed(allowed []string, method string) bool {
+	for _, m := range allowed {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headersAllowed reports whether every header in the comma separated requested list is allowed.
+func headersAllowed(allowed map[string]bool, requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !allowed[http.CanonicalHeaderKey(h)] {
+			return false
+		}
+	}
+
+	return true
+}
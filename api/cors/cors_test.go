@@ -0,0 +1,204 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		AllowedOrigins: []string{"https://app.example.com", "*.partner.com"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPost},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+		ExposedHeaders: []string{"X-Request-ID"},
+		MaxAge:         600,
+	}
+
+	for _, tc := range []struct {
+		name         string
+		giveMethod   string
+		giveHeader   http.Header
+		expectStatus int
+		expectHeader http.Header
+	}{
+		{
+			name:         "same_origin",
+			giveMethod:   http.MethodPost,
+			expectStatus: http.StatusOK,
+			expectHeader: http.Header{},
+		},
+		{
+			name:         "allowed_origin",
+			giveMethod:   http.MethodPost,
+			giveHeader:   http.Header{"Origin": []string{"https://app.example.com"}},
+			expectStatus: http.StatusOK,
+			expectHeader: http.Header{
+				"Vary":                          []string{"Origin"},
+				"Access-Control-Allow-Origin":   []string{"https://app.example.com"},
+				"Access-Control-Expose-Headers": []string{"X-Request-ID"},
+			},
+		},
+		{
+			name:         "allowed_subdomain",
+			giveMethod:   http.MethodPost,
+			giveHeader:   http.Header{"Origin": []string{"https://www.partner.com"}},
+			expectStatus: http.StatusOK,
+			expectHeader: http.Header{
+				"Vary":                          []string{"Origin"},
+				"Access-Control-Allow-Origin":   []string{"https://www.partner.com"},
+				"Access-Control-Expose-Headers": []string{"X-Request-ID"},
+			},
+		},
+		{
+			name:         "disallowed_origin",
+			giveMethod:   http.MethodPost,
+			giveHeader:   http.Header{"Origin": []string{"https://evil.com"}},
+			expectStatus: http.StatusOK,
+			expectHeader: http.Header{"Vary": []string{"Origin"}},
+		},
+		{
+			name:       "preflight",
+			giveMethod: http.MethodOptions,
+			giveHeader: http.Header{
+				"Origin":                         []string{"https://app.example.com"},
+				"Access-Control-Request-Method":  []string{http.MethodPost},
+				"Access-Control-Request-Headers": []string{"content-type, authorization"},
+			},
+			expectStatus: http.StatusNoContent,
+			expectHeader: http.Header{
+				"Vary":                         []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+				"Access-Control-Allow-Origin":  []string{"https://app.example.com"},
+				"Access-Control-Allow-Methods": []string{"GET, POST"},
+				"Access-Control-Allow-Headers": []string{"content-type, authorization"},
+				"Access-Control-Max-Age":       []string{"600"},
+			},
+		},
+		{
+			name:       "preflight_disallowed_header",
+			giveMethod: http.MethodOptions,
+			giveHeader: http.Header{
+				"Origin":                         []string{"https://app.example.com"},
+				"Access-Control-Request-Method":  []string{http.MethodPost},
+				"Access-Control-Request-Headers": []string{"x-other"},
+			},
+			expectStatus: http.StatusNoContent,
+			expectHeader: http.Header{
+				"Vary": []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+			},
+		},
+		{
+			name:       "preflight_disallowed_method",
+			giveMethod: http.MethodOptions,
+			giveHeader: http.Header{
+				"Origin":                        []string{"https://app.example.com"},
+				"Access-Control-Request-Method": []string{http.MethodDelete},
+			},
+			expectStatus: http.StatusNoContent,
+			expectHeader: http.Header{
+				"Vary": []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+			},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			handler := Middleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest(tc.giveMethod, "/v1/list-races", nil)
+			req.Header = tc.giveHeader
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectStatus, rec.Code, "status")
+			assert.Equal(t, tc.expectHeader, rec.Header(), "header")
+		})
+	}
+}
+
+func TestMatchOrigin(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name       string
+		giveConfig Config
+		giveOrigin string
+		expect     string
+		expectOK   bool
+	}{
+		{
+			name:       "wildcard",
+			giveConfig: Config{AllowedOrigins: []string{"*"}},
+			giveOrigin: "https://app.example.com",
+			expect:     "*",
+			expectOK:   true,
+		},
+		{
+			name:       "wildcard_credentials",
+			giveConfig: Config{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+			giveOrigin: "https://app.example.com",
+			expect:     "https://app.example.com",
+			expectOK:   true,
+		},
+		{
+			name:       "subdomain_requires_dot",
+			giveConfig: Config{AllowedOrigins: []string{"*.example.com"}},
+			giveOrigin: "https://appexample.com",
+		},
+		{
+			name:       "exact_case_insensitive",
+			giveConfig: Config{AllowedOrigins: []string{"https://App.Example.com"}},
+			giveOrigin: "https://app.example.com",
+			expect:     "https://app.example.com",
+			expectOK:   true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual, actualOK := matchOrigin(tc.giveConfig, tc.giveOrigin)
+
+			assert.Equal(t, tc.expect, actual, "origin")
+			assert.Equal(t, tc.expectOK, actualOK, "ok")
+		})
+	}
+}
+
+func TestConfigAllowsWebSocket(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{AllowedOrigins: []string{"https://app.example.com"}}
+
+	for _, tc := range []struct {
+		name       string
+		giveOrigin string
+		expect     bool
+	}{
+		{name: "no_origin", expect: true},
+		{name: "same_origin", giveOrigin: "http://api.example.com", expect: true},
+		{name: "allowed_origin", giveOrigin: "https://app.example.com", expect: true},
+		{name: "other_origin", giveOrigin: "https://evil.example.com"},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, "http://api.example.com/v1/races:watch", nil)
+			if tc.giveOrigin != "" {
+				r.Header.Set("Origin", tc.giveOrigin)
+			}
+
+			assert.Equal(t, tc.expect, cfg.AllowsWebSocket(r))
+		})
+	}
+}
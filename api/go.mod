@@ -3,10 +3,29 @@ module git.neds.sh/matty/entain/api
 go 1.16
 
 require (
-	github.com/golang/protobuf v1.4.3
+	git.neds.sh/matty/entain/tlsconfig v0.0.0
+	github.com/andybalholm/brotli v1.0.4
+	github.com/getkin/kin-openapi v0.80.0
+	github.com/golang-jwt/jwt/v4 v4.0.0
+	github.com/golang/protobuf v1.5.2
+	github.com/gorilla/websocket v1.4.2
+	github.com/graphql-go/graphql v0.8.0
 	github.com/grpc-ecosystem/grpc-gateway/v2 v2.3.0
+	github.com/prometheus/client_golang v1.11.0
+	github.com/sirupsen/logrus v1.8.1
+	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc v0.25.0
+	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.25.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
 	google.golang.org/genproto v0.0.0-20210226172003-ab064af71705
-	google.golang.org/grpc v1.36.0
+	google.golang.org/grpc v1.41.0
 	google.golang.org/grpc/cmd/protoc-gen-go-grpc v1.1.0
-	google.golang.org/protobuf v1.25.1-0.20201208041424-160c7477e0e8
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v2 v2.3.0
 )
+
+replace git.neds.sh/matty/entain/tlsconfig => ../tlsconfig
@@ -0,0 +1,31 @@
+package gql
+
+import "fmt"
+
+// Config configures the limits on GraphQL operations.
+type Config struct {
+	// MaxDepth is how deeply fields may be nested.
+	MaxDepth int `yaml:"max_depth"`
+	// MaxCost is the highest cost an operation may have. Each field costs 1, and the fields selected under a list
+	// are counted ListSize times, as they are resolved for each item.
+	MaxCost int `yaml:"max_cost"`
+	// ListSize is the number of items lists are assumed to have when costing an operation.
+	ListSize int `yaml:"list_size"`
+}
+
+// Validate checks the limits in cfg.
+func (c Config) Validate() error {
+	if c.MaxDepth <= 0 {
+		return fmt.Errorf("invalid max depth %d", c.MaxDepth)
+	}
+
+	if c.MaxCost <= 0 {
+		return fmt.Errorf("invalid max cost %d", c.MaxCost)
+	}
+
+	if c.ListSize <= 0 {
+		return fmt.Errorf("invalid list size %d", c.ListSize)
+	}
+
+	return nil
+}
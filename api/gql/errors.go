@@ -0,0 +1,93 @@
+package gql
+
+import (
+	"context"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+
+	"git.neds.sh/matty/entain/api/logging"
+	"git.neds.sh/matty/entain/api/problem"
+)
+
+// resolveError is an error of a resolver. It exposes the gRPC status of the error as the extensions of the GraphQL
+// error, as problem details do for the REST API, without leaking the details of server errors.
+type resolveError struct {
+	status    *status.Status
+	requestID string
+}
+
+// newError converts the gRPC error err into a resolveError.
+func newError(ctx context.Context, err error) error {
+	return &resolveError{status: status.Convert(err), requestID: logging.RequestIDFromContext(ctx)}
+}
+
+// Error implements error.
+func (e *resolveError) Error() string {
+	return problem.Detail(e.status)
+}
+
+// Extensions implements gqlerrors.ExtendedError.
+func (e *resolveError) Extensions() map[string]interface{} {
+	extensions := map[string]interface{}{
+		"code": e.status.Code().String(),
+		"type": problem.TypeURI(e.status.Code()),
+	}
+
+	if e.requestID != "" {
+		extensions["request_id"] = e.requestID
+	}
+
+	var invalidParams []problem.InvalidParam
+
+	for _, detail := range e.status.Details() {
+		if d, ok := detail.(*errdetails.BadRequest); ok {
+			for _, v := range d.GetFieldViolations() {
+				invalidParams = append(invalidParams, problem.InvalidParam{Name: v.GetField(), Reason: v.GetDescription()})
+			}
+		}
+	}
+
+	if len(invalidParams) > 0 {
+		extensions["invalid_params"] = invalidParams
+	}
+
+	return extensions
+}
+
+// withExtensions returns res with the extensions of the resolver errors its errors were made from. graphql-go only
+// keeps the extensions of errors returned by resolvers, and formats those returned by thunks without them, keeping
+// the error they were made from.
+func withExtensions(res *graphql.Result) *graphql.Result {
+	for i, err := range res.Errors {
+		if err.Extensions != nil {
+			continue
+		}
+
+		if extended, ok := extendedError(err.OriginalError()); ok {
+			res.Errors[i].Extensions = extended.Extensions()
+		}
+	}
+
+	return res
+}
+
+// extendedError returns the error with extensions err was made from by graphql-go, if any.
+func extendedError(err error) (gqlerrors.ExtendedError, bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case gqlerrors.ExtendedError:
+			return e, true
+		case gqlerrors.FormattedError:
+			err = e.OriginalError()
+		case *gqlerrors.Error:
+			err = e.OriginalError
+		default:
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,679 @@
+package gql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+)
+
+// racingServer lists two races for each meeting in the filter, or for meetings 1 and 2 without one, and records the
+// meetings of each ListRaces call. The first race of each meeting is open, and the second has no status. Meeting 500
+// fails, and meeting 403 is refused.
+//
+// WatchRaces streams an event for each meeting in the filter, numbered from resume_after, then blocks until the
+// watch is cancelled if the first meeting is 1.
+type racingServer struct {
+	racing.UnimplementedRacingServer
+
+	mu    sync.Mutex
+	calls [][]int64
+}
+
+func (s *racingServer) ListRaces(ctx context.Context, in *racing.ListRacesRequest) (*racing.ListRacesResponse, error) {
+	meetingIDs := in.GetFilter().GetMeetingIds()
+
+	s.mu.Lock()
+	s.calls = append(s.calls, meetingIDs)
+	s.mu.Unlock()
+
+	if len(meetingIDs) == 0 {
+		meetingIDs = []int64{1, 2}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	res := &racing.ListRacesResponse{}
+
+	for _, meetingID := range meetingIDs {
+		switch meetingID {
+		case 500:
+			return nil, status.Error(codes.Internal, "database is down")
+		case 403:
+			return nil, status.Error(codes.PermissionDenied, "missing scope races:read")
+		}
+
+		for i := int64(1); i <= 2; i++ {
+			race := &racing.Race{
+				Id:        meetingID*10 + i,
+				MeetingId: meetingID,
+				Name:      strings.Join(md.Get("x-test"), ","),
+				Number:    i,
+			}
+			if i == 1 {
+				race.Status = racing.Race_OPEN
+			}
+
+			res.Races = append(res.Races, race)
+		}
+	}
+
+	return res, nil
+}
+
+func (s *racingServer) WatchRaces(in *racing.WatchRacesRequest, stream racing.Racing_WatchRacesServer) error {
+	meetingIDs := in.GetFilter().GetMeetingIds()
+	if len(meetingIDs) > 0 && meetingIDs[0] == 403 {
+		return status.Error(codes.PermissionDenied, "missing scope races:read")
+	}
+
+	if err := stream.SendHeader(metadata.Pairs("x-watch-started", "true")); err != nil {
+		return err
+	}
+
+	for i, meetingID := range meetingIDs {
+		if err := stream.Send(&racing.WatchRacesResponse{Event: &racing.RaceEvent{
+			Sequence: in.GetResumeAfter() + uint64(i) + 1,
+			Type:     racing.RaceEvent_CREATED,
+			Race:     &racing.Race{Id: int64(i + 1), MeetingId: meetingID},
+		}}); err != nil {
+			return err
+		}
+	}
+
+	if len(meetingIDs) > 0 && meetingIDs[0] == 1 {
+		<-stream.Context().Done()
+	}
+
+	return nil
+}
+
+// listCalls returns the meetings of each ListRaces call.
+func (s *racingServer) listCalls() [][]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls
+}
+
+func newTestServer(t *testing.T, cfg Config) (*httptest.Server, *racingServer) {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	racingSrv := &racingServer{}
+	server := grpc.NewServer()
+	racing.RegisterRacingServer(server, racingSrv)
+
+	go func() { _ = server.Serve(listener) }()
+
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(
+		"bufconn",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+	)
+	require.NoError(t, err, "grpc.Dial")
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	annotator := func(context.Context, *http.Request) metadata.MD {
+		return metadata.Pairs("x-test", "annotated")
+	}
+
+	handler, err := NewHandler(
+		cfg,
+		racing.NewRacingClient(conn),
+		func(r *http.Request) bool { return r.Header.Get("Origin") == "" },
+		annotator,
+	)
+	require.NoError(t, err, "NewHandler")
+
+	httpServer := httptest.NewServer(handler)
+	t.Cleanup(httpServer.Close)
+
+	return httpServer, racingSrv
+}
+
+func testConfig() Config {
+	return Config{MaxDepth: 5, MaxCost: 200, ListSize: 10}
+}
+
+// result is a GraphQL result.
+type result struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func TestHandlerQuery(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name            string
+		giveMethod      string
+		giveQuery       string
+		giveVariables   map[string]interface{}
+		expectStatus    int
+		expectData      string
+		expectErrors    []string
+		expectErrorCode string
+		expectListCalls [][]int64
+	}{
+		{
+			name:         "success",
+			giveMethod:   http.MethodPost,
+			giveQuery:    `{ races(meetingIds: [3]) { id name number meeting { id } } }`,
+			expectStatus: http.StatusOK,
+			expectData: `{"races":[
+				{"id":"31","name":"annotated","number":1,"meeting":{"id":"3"}},
+				{"id":"32","name":"annotated","number":2,"meeting":{"id":"3"}}
+			]}`,
+			expectListCalls: [][]int64{{3}},
+		},
+		{
+			name:            "success_status",
+			giveMethod:      http.MethodPost,
+			giveQuery:       `{ races(meetingIds: [8]) { id status } }`,
+			expectStatus:    http.StatusOK,
+			expectData:      `{"races":[{"id":"81","status":"OPEN"},{"id":"82","status":null}]}`,
+			expectListCalls: [][]int64{{8}},
+		},
+		{
+			name:            "success_get",
+			giveMethod:      http.MethodGet,
+			giveQuery:       `query Races($ids: [ID!]) { races(meetingIds: $ids) { id } }`,
+			giveVariables:   map[string]interface{}{"ids": []string{"4"}},
+			expectStatus:    http.StatusOK,
+			expectData:      `{"races":[{"id":"41"},{"id":"42"}]}`,
+			expectListCalls: [][]int64{{4}},
+		},
+		{
+			name:         "success_batched",
+			giveMethod:   http.MethodPost,
+			giveQuery:    `{ meetings(ids: [5, 6, 5]) { id races { id } } }`,
+			expectStatus: http.StatusOK,
+			expectData: `{"meetings":[
+				{"id":"5","races":[{"id":"51"},{"id":"52"}]},
+				{"id":"6","races":[{"id":"61"},{"id":"62"}]}
+			]}`,
+			expectListCalls: [][]int64{{5, 6}},
+		},
+		{
+			name:         "success_primed",
+			giveMethod:   http.MethodPost,
+			giveQuery:    `{ races(meetingIds: [7]) { meeting { races { id } } } }`,
+			expectStatus: http.StatusOK,
+			expectData: `{"races":[
+				{"meeting":{"races":[{"id":"71"},{"id":"72"}]}},
+				{"meeting":{"races":[{"id":"71"},{"id":"72"}]}}
+			]}`,
+			expectListCalls: [][]int64{{7}},
+		},
+		{
+			name:         "success_unfiltered_batched",
+			giveMethod:   http.MethodPost,
+			giveQuery:    `{ races { meeting { races { id } } } }`,
+			expectStatus: http.StatusOK,
+			expectData: `{"races":[
+				{"meeting":{"races":[{"id":"11"},{"id":"12"}]}},
+				{"meeting":{"races":[{"id":"11"},{"id":"12"}]}},
+				{"meeting":{"races":[{"id":"21"},{"id":"22"}]}},
+				{"meeting":{"races":[{"id":"21"},{"id":"22"}]}}
+			]}`,
+			expectListCalls: [][]int64{nil, {1, 2}},
+		},
+		{
+			name:            "internal_error",
+			giveMethod:      http.MethodPost,
+			giveQuery:       `{ meetings(ids: [500]) { races { id } } }`,
+			expectStatus:    http.StatusOK,
+			expectData:      `null`,
+			expectErrors:    []string{"An internal error occurred."},
+			expectErrorCode: "Internal",
+			expectListCalls: [][]int64{{500}},
+		},
+		{
+			name:            "permission_denied",
+			giveMethod:      http.MethodPost,
+			giveQuery:       `{ races(meetingIds: [403]) { id } }`,
+			expectStatus:    http.StatusOK,
+			expectData:      `null`,
+			expectErrors:    []string{"missing scope races:read"},
+			expectErrorCode: "PermissionDenied",
+			expectListCalls: [][]int64{{403}},
+		},
+		{
+			name:            "invalid_id",
+			giveMethod:      http.MethodPost,
+			giveQuery:       `{ meetings(ids: ["seven"]) { id } }`,
+			expectStatus:    http.StatusOK,
+			expectData:      `null`,
+			expectErrors:    []string{`invalid ID "seven"`},
+			expectErrorCode: "InvalidArgument",
+		},
+		{
+			name:         "too_deep",
+			giveMethod:   http.MethodPost,
+			giveQuery:    `{ races { meeting { races { meeting { races { id } } } } } }`,
+			expectStatus: http.StatusBadRequest,
+			expectErrors: []string{
+				"query has depth 6, more than the maximum of 5",
+				"query has cost 1221, more than the maximum of 200",
+			},
+		},
+		{
+			name:         "too_costly",
+			giveMethod:   http.MethodPost,
+			giveQuery:    `query Costly { races { id meeting { races { id meeting { id } } } } }`,
+			expectStatus: http.StatusBadRequest,
+			expectErrors: []string{`query "Costly" has cost 331, more than the maximum of 200`},
+		},
+		{
+			name:         "too_costly_fragment",
+			giveMethod:   http.MethodPost,
+			giveQuery:    `{ races { ...race } } fragment race on Race { meeting { races { id name } } }`,
+			expectStatus: http.StatusBadRequest,
+			expectErrors: []string{"query has cost 221, more than the maximum of 200"},
+		},
+		{
+			name:         "subscription",
+			giveMethod:   http.MethodPost,
+			giveQuery:    `subscription { raceEvents { sequence } }`,
+			expectStatus: http.StatusBadRequest,
+			expectErrors: []string{"subscription operations are only served over websockets"},
+		},
+		{
+			name:         "invalid_query",
+			giveMethod:   http.MethodPost,
+			giveQuery:    `{ races { unknown } }`,
+			expectStatus: http.StatusBadRequest,
+			expectErrors: []string{`Cannot query field "unknown" on type "Race".`},
+		},
+		{
+			name:         "missing_query",
+			giveMethod:   http.MethodGet,
+			expectStatus: http.StatusBadRequest,
+			expectErrors: []string{"missing query"},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, racingSrv := newTestServer(t, testConfig())
+
+			var req *http.Request
+
+			if tc.giveMethod == http.MethodGet {
+				query := url.Values{}
+				if tc.giveQuery != "" {
+					query.Set("query", tc.giveQuery)
+				}
+
+				if tc.giveVariables != nil {
+					variables, err := json.Marshal(tc.giveVariables)
+					require.NoError(t, err, "json.Marshal")
+
+					query.Set("variables", string(variables))
+				}
+
+				var err error
+				req, err = http.NewRequest(http.MethodGet, server.URL+Path+"?"+query.Encode(), nil)
+				require.NoError(t, err, "http.NewRequest")
+			} else {
+				body, err := json.Marshal(map[string]interface{}{"query": tc.giveQuery, "variables": tc.giveVariables})
+				require.NoError(t, err, "json.Marshal")
+
+				req, err = http.NewRequest(http.MethodPost, server.URL+Path, bytes.NewReader(body))
+				require.NoError(t, err, "http.NewRequest")
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(t, err, "Do")
+
+			defer res.Body.Close()
+
+			require.Equal(t, tc.expectStatus, res.StatusCode, "status")
+			assert.Equal(t, "application/json", res.Header.Get("Content-Type"), "Content-Type")
+
+			var actual result
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&actual), "Decode")
+
+			if tc.expectData != "" {
+				assert.JSONEq(t, tc.expectData, string(actual.Data), "data")
+			}
+
+			var messages []string
+			for _, e := range actual.Errors {
+				messages = append(messages, e.Message)
+
+				if tc.expectErrorCode != "" {
+					assert.Equal(t, tc.expectErrorCode, e.Extensions["code"], "error code")
+				}
+			}
+
+			assert.Equal(t, tc.expectErrors, messages, "errors")
+			assert.Equal(t, tc.expectListCalls, racingSrv.listCalls(), "ListRaces calls")
+		})
+	}
+}
+
+func TestHandlerMethodNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	server, _ := newTestServer(t, testConfig())
+
+	req, err := http.NewRequest(http.MethodPut, server.URL+Path, nil)
+	require.NoError(t, err, "http.NewRequest")
+
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err, "Do")
+
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode, "status")
+	assert.Equal(t, "GET, POST", res.Header.Get("Allow"), "Allow")
+}
+
+// dialWebSocket opens a graphql-transport-ws connection to server, initialising it if init is set.
+func dialWebSocket(t *testing.T, server *httptest.Server, init bool) *websocket.Conn {
+	t.Helper()
+
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol}}
+
+	conn, res, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+Path, nil)
+	require.NoError(t, err, "Dial")
+
+	_ = res.Body.Close()
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	if init {
+		require.NoError(t, conn.WriteJSON(message{Type: typeConnectionInit}), "WriteJSON connection_init")
+
+		var ack message
+		require.NoError(t, conn.ReadJSON(&ack), "ReadJSON connection_ack")
+		require.Equal(t, typeConnectionAck, ack.Type, "ack type")
+	}
+
+	return conn
+}
+
+func subscribe(t *testing.T, conn *websocket.Conn, id, query string) {
+	t.Helper()
+
+	payload, err := json.Marshal(params{Query: query})
+	require.NoError(t, err, "json.Marshal")
+
+	require.NoError(t, conn.WriteJSON(message{ID: id, Type: typeSubscribe, Payload: payload}), "WriteJSON subscribe")
+}
+
+func TestHandlerWebSocket(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name         string
+		giveQuery    string
+		expectTypes  []string
+		expectData   []string
+		expectErrors []string
+	}{
+		{
+			name:        "success_subscription",
+			giveQuery:   `subscription { raceEvents(meetingIds: [7, 8], resumeAfter: "10") { sequence type race { meeting { races { id } } } } }`,
+			expectTypes: []string{typeNext, typeNext, typeComplete},
+			expectData: []string{
+				`{"raceEvents":{"sequence":"11","type":"CREATED","race":{"meeting":{"races":[{"id":"71"},{"id":"72"}]}}}}`,
+				`{"raceEvents":{"sequence":"12","type":"CREATED","race":{"meeting":{"races":[{"id":"81"},{"id":"82"}]}}}}`,
+			},
+		},
+		{
+			name:        "success_query",
+			giveQuery:   `{ races(meetingIds: [3]) { id } }`,
+			expectTypes: []string{typeNext, typeComplete},
+			expectData:  []string{`{"races":[{"id":"31"},{"id":"32"}]}`},
+		},
+		{
+			name:         "refused",
+			giveQuery:    `subscription { raceEvents(meetingIds: [403]) { sequence } }`,
+			expectTypes:  []string{typeNext, typeComplete},
+			expectErrors: []string{"missing scope races:read"},
+		},
+		{
+			name:         "invalid_query",
+			giveQuery:    `subscription { raceEvents { unknown } }`,
+			expectTypes:  []string{typeError},
+			expectErrors: []string{`Cannot query field "unknown" on type "RaceEvent".`},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, _ := newTestServer(t, testConfig())
+			conn := dialWebSocket(t, server, true)
+
+			subscribe(t, conn, "1", tc.giveQuery)
+
+			var (
+				types  []string
+				data   []string
+				errors []string
+			)
+
+			for len(types) < len(tc.expectTypes) {
+				var msg message
+				require.NoError(t, conn.ReadJSON(&msg), "ReadJSON")
+
+				assert.Equal(t, "1", msg.ID, "id")
+
+				types = append(types, msg.Type)
+
+				switch msg.Type {
+				case typeNext:
+					var actual result
+					require.NoError(t, json.Unmarshal(msg.Payload, &actual), "json.Unmarshal")
+
+					if len(actual.Errors) == 0 {
+						data = append(data, string(actual.Data))
+					}
+
+					for _, e := range actual.Errors {
+						errors = append(errors, e.Message)
+					}
+				case typeError:
+					var actual []struct {
+						Message string `json:"message"`
+					}
+					require.NoError(t, json.Unmarshal(msg.Payload, &actual), "json.Unmarshal")
+
+					for _, e := range actual {
+						errors = append(errors, e.Message)
+					}
+				}
+			}
+
+			assert.Equal(t, tc.expectTypes, types, "types")
+			assert.Equal(t, tc.expectErrors, errors, "errors")
+
+			require.Len(t, data, len(tc.expectData), "data")
+
+			for i := range tc.expectData {
+				assert.JSONEq(t, tc.expectData[i], data[i], "data %d", i)
+			}
+		})
+	}
+}
+
+func TestHandlerWebSocketComplete(t *testing.T) {
+	t.Parallel()
+
+	server, _ := newTestServer(t, testConfig())
+	conn := dialWebSocket(t, server, true)
+
+	// The subscription to meeting 1 stays open until it is completed.
+	subscribe(t, conn, "1", `subscription { raceEvents(meetingIds: [1]) { sequence } }`)
+
+	var next message
+	require.NoError(t, conn.ReadJSON(&next), "ReadJSON next")
+	assert.Equal(t, typeNext, next.Type, "next type")
+
+	subscribe(t, conn, "2", `{ races(meetingIds: [3]) { id } }`)
+	require.NoError(t, conn.WriteJSON(message{ID: "1", Type: typeComplete}), "WriteJSON complete")
+
+	// The completed subscription sends nothing more, while other operations continue.
+	for _, expect := range []message{{ID: "2", Type: typeNext}, {ID: "2", Type: typeComplete}} {
+		var actual message
+		require.NoError(t, conn.ReadJSON(&actual), "ReadJSON")
+
+		assert.Equal(t, expect.ID, actual.ID, "id")
+		assert.Equal(t, expect.Type, actual.Type, "type")
+	}
+
+	require.NoError(t, conn.WriteJSON(message{Type: typePing}), "WriteJSON ping")
+
+	var pong message
+	require.NoError(t, conn.ReadJSON(&pong), "ReadJSON pong")
+	assert.Equal(t, typePong, pong.Type, "pong type")
+}
+
+func TestHandlerWebSocketClose(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name       string
+		giveInit   bool
+		giveWrites []message
+		expectCode int
+	}{
+		{
+			name:       "unauthorized",
+			giveWrites: []message{{ID: "1", Type: typeSubscribe, Payload: json.RawMessage(`{"query":"{ races { id } }"}`)}},
+			expectCode: closeUnauthorized,
+		},
+		{
+			name:       "too_many_inits",
+			giveInit:   true,
+			giveWrites: []message{{Type: typeConnectionInit}},
+			expectCode: closeTooManyInits,
+		},
+		{
+			name:     "subscriber_exists",
+			giveInit: true,
+			giveWrites: []message{
+				{ID: "1", Type: typeSubscribe, Payload: json.RawMessage(`{"query":"subscription { raceEvents(meetingIds: [1]) { sequence } }"}`)},
+				{ID: "1", Type: typeSubscribe, Payload: json.RawMessage(`{"query":"{ races { id } }"}`)},
+			},
+			expectCode: closeSubscriberExists,
+		},
+		{
+			name:       "unknown_type",
+			giveInit:   true,
+			giveWrites: []message{{Type: "unknown"}},
+			expectCode: closeBadRequest,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, _ := newTestServer(t, testConfig())
+			conn := dialWebSocket(t, server, tc.giveInit)
+
+			for _, msg := range tc.giveWrites {
+				require.NoError(t, conn.WriteJSON(msg), "WriteJSON")
+			}
+
+			for {
+				_, _, err := conn.ReadMessage()
+				if err != nil {
+					assert.True(t, websocket.IsCloseError(err, tc.expectCode), "close error %v", err)
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerWebSocketSubprotocol(t *testing.T) {
+	t.Parallel()
+
+	server, _ := newTestServer(t, testConfig())
+
+	conn, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+Path, nil)
+	require.NoError(t, err, "Dial")
+
+	_ = res.Body.Close()
+
+	defer conn.Close()
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, closeSubprotocolNotAcceptable), "close error %v", err)
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		giveConfig  Config
+		expectError bool
+	}{
+		{
+			name:       "success",
+			giveConfig: testConfig(),
+		},
+		{
+			name:        "invalid_max_depth",
+			giveConfig:  Config{MaxCost: 1, ListSize: 1},
+			expectError: true,
+		},
+		{
+			name:        "invalid_max_cost",
+			giveConfig:  Config{MaxDepth: 1, ListSize: 1},
+			expectError: true,
+		},
+		{
+			name:        "invalid_list_size",
+			giveConfig:  Config{MaxDepth: 1, MaxCost: 1},
+			expectError: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := tc.giveConfig.Validate()
+			if tc.expectError {
+				assert.Error(t, err, "Validate")
+			} else {
+				assert.NoError(t, err, "Validate")
+			}
+		})
+	}
+}
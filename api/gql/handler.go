@@ -0,0 +1,209 @@
+// Package gql serves a GraphQL API at /graphql, resolving races and meetings by calling racing.
+//
+// Queries are served over HTTP, as a GET with the query in the query string, or a POST of a JSON request. Queries and
+// subscriptions are served over websockets with the graphql-transport-ws protocol, subscriptions relaying the
+// WatchRaces stream of racing. Operations are rejected before they are executed if they are nested too deeply, or
+// would cost too much to resolve.
+package gql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"google.golang.org/grpc/metadata"
+
+	"git.neds.sh/matty/entain/api/logging"
+	"git.neds.sh/matty/entain/api/metrics"
+	"git.neds.sh/matty/entain/api/proto/racing"
+)
+
+// Path is the path GraphQL is served at.
+const Path = "/graphql"
+
+// maxBodySize is the largest request body accepted.
+const maxBodySize = 1 << 20
+
+// Annotator returns metadata to send with the RPCs called to resolve an operation. It has the signature of the
+// runtime.WithMetadata annotators used by the gateway, so they can be shared.
+type Annotator func(context.Context, *http.Request) metadata.MD
+
+// Handler is a http.Handler that serves GraphQL.
+type Handler struct {
+	cfg        Config
+	schema     graphql.Schema
+	client     racing.RacingClient
+	annotators []Annotator
+	upgrader   websocket.Upgrader
+}
+
+// NewHandler creates a Handler resolving operations by calling client. Websocket upgrades are only accepted if
+// checkOrigin allows them.
+func NewHandler(
+	cfg Config,
+	client racing.RacingClient,
+	checkOrigin func(*http.Request) bool,
+	annotators ...Annotator,
+) (*Handler, error) {
+	schema, err := newSchema(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating schema: %w", err)
+	}
+
+	return &Handler{
+		cfg:        cfg,
+		schema:     schema,
+		client:     client,
+		annotators: annotators,
+		upgrader: websocket.Upgrader{
+			CheckOrigin:  checkOrigin,
+			Subprotocols: []string{subprotocol},
+		},
+	}, nil
+}
+
+// params are the parameters of a GraphQL request.
+type params struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// ServeHTTP serves operations over a websocket if r is a websocket upgrade, and a query over HTTP otherwise.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	metrics.SetRoute(r.Context(), Path)
+
+	if websocket.IsWebSocketUpgrade(r) {
+		h.serveWebSocket(w, r)
+		return
+	}
+
+	var p params
+
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		p.Query = query.Get("query")
+		p.OperationName = query.Get("operationName")
+
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &p.Variables); err != nil {
+				writeErrors(w, r, fmt.Sprintf("invalid variables: %v", err))
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&p); err != nil {
+			writeErrors(w, r, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	doc, op, errs := h.prepare(p)
+	if len(errs) == 0 && op.Operation != ast.OperationTypeQuery {
+		errs = gqlerrors.FormatErrors(fmt.Errorf("%s operations are only served over websockets", op.Operation))
+	}
+
+	if len(errs) > 0 {
+		writeResult(w, r, http.StatusBadRequest, &graphql.Result{Errors: errs})
+		return
+	}
+
+	writeResult(w, r, http.StatusOK, h.execute(h.outgoingContext(r.Context(), r), doc, p))
+}
+
+// prepare parses p and validates it against the schema and limits, returning the document and the operation to
+// execute.
+func (h *Handler) prepare(p params) (*ast.Document, *ast.OperationDefinition, []gqlerrors.FormattedError) {
+	if p.Query == "" {
+		return nil, nil, gqlerrors.FormatErrors(fmt.Errorf("missing query"))
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(p.Query), Name: "GraphQL request"}),
+	})
+	if err != nil {
+		return nil, nil, gqlerrors.FormatErrors(err)
+	}
+
+	if res := graphql.ValidateDocument(&h.schema, doc, nil); !res.IsValid {
+		return nil, nil, res.Errors
+	}
+
+	if errs := checkLimits(h.cfg, &h.schema, doc); len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	var op *ast.OperationDefinition
+
+	for _, def := range doc.Definitions {
+		def, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case p.OperationName == "" && op != nil:
+			return nil, nil, gqlerrors.FormatErrors(fmt.Errorf("operationName is required for multiple operations"))
+		case p.OperationName == "" || (def.Name != nil && def.Name.Value == p.OperationName):
+			op = def
+		}
+	}
+
+	if op == nil {
+		return nil, nil, gqlerrors.FormatErrors(fmt.Errorf("unknown operation %q", p.OperationName))
+	}
+
+	return doc, op, nil
+}
+
+// execute executes the query doc.
+func (h *Handler) execute(ctx context.Context, doc *ast.Document, p params) *graphql.Result {
+	return withExtensions(graphql.Execute(graphql.ExecuteParams{
+		Schema:        h.schema,
+		Root:          &root{loader: newRacesLoader(ctx, h.client)},
+		AST:           doc,
+		OperationName: p.OperationName,
+		Args:          p.Variables,
+		Context:       ctx,
+	}))
+}
+
+// outgoingContext returns ctx with the metadata of the annotators for r, to send with RPCs.
+func (h *Handler) outgoingContext(ctx context.Context, r *http.Request) context.Context {
+	md := metadata.MD{}
+	for _, annotate := range h.annotators {
+		md = metadata.Join(md, annotate(ctx, r))
+	}
+
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// writeErrors writes a result with a single error, for requests that couldn't be parsed.
+func writeErrors(w http.ResponseWriter, r *http.Request, message string) {
+	writeResult(w, r, http.StatusBadRequest, &graphql.Result{
+		Errors: []gqlerrors.FormattedError{gqlerrors.NewFormattedError(message)},
+	})
+}
+
+// writeResult writes res as JSON.
+func writeResult(w http.ResponseWriter, r *http.Request, code int, res *graphql.Result) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		logging.FromContext(r.Context()).WithError(err).Warn("failed writing graphql result")
+	}
+}
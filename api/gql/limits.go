@@ -0,0 +1,140 @@
+package gql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// checkLimits checks the depth and cost of the operations of doc, which must have been validated against schema,
+// returning an error for each operation exceeding the limits of cfg.
+func checkLimits(cfg Config, schema *graphql.Schema, doc *ast.Document) []gqlerrors.FormattedError {
+	m := &measurer{
+		listSize:  cfg.ListSize,
+		fragments: map[string]*ast.FragmentDefinition{},
+	}
+
+	var operations []*ast.OperationDefinition
+
+	for _, def := range doc.Definitions {
+		switch def := def.(type) {
+		case *ast.OperationDefinition:
+			operations = append(operations, def)
+		case *ast.FragmentDefinition:
+			m.fragments[def.Name.Value] = def
+		}
+	}
+
+	var errs []gqlerrors.FormattedError
+
+	for _, op := range operations {
+		var parent *graphql.Object
+
+		switch op.Operation {
+		case ast.OperationTypeQuery:
+			parent = schema.QueryType()
+		case ast.OperationTypeSubscription:
+			parent = schema.SubscriptionType()
+		}
+
+		if parent == nil {
+			continue
+		}
+
+		depth, cost := m.measure(op.SelectionSet, parent)
+
+		if depth > cfg.MaxDepth {
+			errs = append(errs, gqlerrors.NewFormattedError(fmt.Sprintf(
+				"%s has depth %d, more than the maximum of %d", operationName(op), depth, cfg.MaxDepth,
+			)))
+		}
+
+		if cost > cfg.MaxCost {
+			errs = append(errs, gqlerrors.NewFormattedError(fmt.Sprintf(
+				"%s has cost %d, more than the maximum of %d", operationName(op), cost, cfg.MaxCost,
+			)))
+		}
+	}
+
+	return errs
+}
+
+// measurer measures the depth and cost of selections.
+type measurer struct {
+	listSize  int
+	fragments map[string]*ast.FragmentDefinition
+}
+
+// measure returns the depth and cost of the fields selected by set on parent. Each field costs 1, plus the cost of
+// its selections, counted listSize times if the field is a list. Introspection fields are free.
+func (m *measurer) measure(set *ast.SelectionSet, parent *graphql.Object) (depth, cost int) {
+	if set == nil {
+		return 0, 0
+	}
+
+	for _, selection := range set.Selections {
+		var d, c int
+
+		switch selection := selection.(type) {
+		case *ast.Field:
+			d, c = m.measureField(selection, parent)
+		case *ast.InlineFragment:
+			d, c = m.measure(selection.SelectionSet, parent)
+		case *ast.FragmentSpread:
+			if fragment, ok := m.fragments[selection.Name.Value]; ok {
+				d, c = m.measure(fragment.SelectionSet, parent)
+			}
+		}
+
+		if d > depth {
+			depth = d
+		}
+
+		cost += c
+	}
+
+	return depth, cost
+}
+
+// measureField returns the depth and cost of field, selected on parent.
+func (m *measurer) measureField(field *ast.Field, parent *graphql.Object) (depth, cost int) {
+	if strings.HasPrefix(field.Name.Value, "__") {
+		return 0, 0
+	}
+
+	def, ok := parent.Fields()[field.Name.Value]
+	if !ok {
+		return 1, 1
+	}
+
+	t := def.Type
+	if nonNull, ok := t.(*graphql.NonNull); ok {
+		t = nonNull.OfType
+	}
+
+	multiplier := 1
+	if _, ok := t.(*graphql.List); ok {
+		multiplier = m.listSize
+	}
+
+	object, ok := graphql.GetNamed(t).(*graphql.Object)
+	if !ok {
+		return 1, 1
+	}
+
+	depth, cost = m.measure(field.SelectionSet, object)
+
+	return depth + 1, cost*multiplier + 1
+}
+
+// operationName names op in errors.
+func operationName(op *ast.OperationDefinition) string {
+	if op.Name != nil {
+		return fmt.Sprintf("%s %q", op.Operation, op.Name.Value)
+	}
+
+	return op.Operation
+}
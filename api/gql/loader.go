@@ -0,0 +1,109 @@
+package gql
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+)
+
+// racesLoader loads the races of meetings, batching the meetings requested while resolving an operation into a
+// single ListRaces call. Resolvers return thunks calling the function from load, which GraphQL calls once every field
+// at the same depth has been resolved, so the first one called loads the races of every meeting requested so far.
+//
+// Results are kept for the life of the loader, which is one operation, or one event of a subscription.
+type racesLoader struct {
+	ctx    context.Context
+	client racing.RacingClient
+
+	mu      sync.Mutex
+	pending map[int64]struct{}
+	races   map[int64][]*racing.Race
+	errs    map[int64]error
+}
+
+func newRacesLoader(ctx context.Context, client racing.RacingClient) *racesLoader {
+	return &racesLoader{
+		ctx:     ctx,
+		client:  client,
+		pending: map[int64]struct{}{},
+		races:   map[int64][]*racing.Race{},
+		errs:    map[int64]error{},
+	}
+}
+
+// load returns a function returning the races of the meeting.
+func (l *racesLoader) load(meetingID int64) func() ([]*racing.Race, error) {
+	l.mu.Lock()
+	if !l.loaded(meetingID) {
+		l.pending[meetingID] = struct{}{}
+	}
+	l.mu.Unlock()
+
+	return func() ([]*racing.Race, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if !l.loaded(meetingID) {
+			l.dispatch()
+		}
+
+		return l.races[meetingID], l.errs[meetingID]
+	}
+}
+
+// prime records races as every race of the given meetings, so they aren't loaded again.
+func (l *racesLoader) prime(meetingIDs []int64, races []*racing.Race) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.store(meetingIDs, races)
+}
+
+// dispatch loads the races of every pending meeting. l.mu must be held.
+func (l *racesLoader) dispatch() {
+	meetingIDs := make([]int64, 0, len(l.pending))
+	for meetingID := range l.pending {
+		meetingIDs = append(meetingIDs, meetingID)
+	}
+
+	sort.Slice(meetingIDs, func(i, j int) bool { return meetingIDs[i] < meetingIDs[j] })
+
+	l.pending = map[int64]struct{}{}
+
+	res, err := l.client.ListRaces(l.ctx, &racing.ListRacesRequest{
+		Filter: &racing.ListRacesRequestFilter{MeetingIds: meetingIDs},
+	})
+	if err != nil {
+		for _, meetingID := range meetingIDs {
+			l.errs[meetingID] = err
+		}
+
+		return
+	}
+
+	l.store(meetingIDs, res.GetRaces())
+}
+
+// store records races as every race of the given meetings. l.mu must be held.
+func (l *racesLoader) store(meetingIDs []int64, races []*racing.Race) {
+	for _, meetingID := range meetingIDs {
+		l.races[meetingID] = []*racing.Race{}
+		delete(l.pending, meetingID)
+	}
+
+	for _, race := range races {
+		l.races[race.GetMeetingId()] = append(l.races[race.GetMeetingId()], race)
+	}
+}
+
+// loaded reports whether the races of the meeting have been loaded. l.mu must be held.
+func (l *racesLoader) loaded(meetingID int64) bool {
+	_, ok := l.races[meetingID]
+	if !ok {
+		_, ok = l.errs[meetingID]
+	}
+
+	return ok
+}
@@ -0,0 +1,390 @@
+package gql
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/graphql-go/graphql"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+	"git.neds.sh/matty/entain/api/watch"
+)
+
+// root is the root value of queries.
+type root struct {
+	loader *racesLoader
+}
+
+// raceNode is the source of Race fields.
+type raceNode struct {
+	race   *racing.Race
+	loader *racesLoader
+}
+
+// meetingNode is the source of Meeting fields. Meetings have no service of their own, so are identified by the
+// meeting IDs of races.
+type meetingNode struct {
+	id     int64
+	loader *racesLoader
+}
+
+// eventNode is the source of RaceEvent fields, and the payload of raceEvents subscriptions.
+type eventNode struct {
+	event  *racing.RaceEvent
+	loader *racesLoader
+}
+
+// newSchema creates the GraphQL schema, resolved by calling client.
+func newSchema(client racing.RacingClient) (graphql.Schema, error) {
+	meetingType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Meeting",
+		Description: "A race meeting.",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*meetingNode).id, nil
+				},
+			},
+		},
+	})
+
+	raceStatusEnum := graphql.NewEnum(graphql.EnumConfig{
+		Name:        "RaceStatus",
+		Description: "Whether a race is open, derived from its advertised start time when it is read.",
+		Values: graphql.EnumValueConfigMap{
+			"OPEN": &graphql.EnumValueConfig{
+				Value:       racing.Race_OPEN,
+				Description: "The advertised start time of the race hasn't passed.",
+			},
+			"CLOSED": &graphql.EnumValueConfig{
+				Value:       racing.Race_CLOSED,
+				Description: "The advertised start time of the race has passed.",
+			},
+		},
+	})
+
+	raceType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "Race",
+		Description: "A race.",
+		Fields: graphql.Fields{
+			"id": raceField(graphql.NewNonNull(graphql.ID), func(race *racing.Race) interface{} {
+				return race.GetId()
+			}),
+			"meetingId": raceField(graphql.NewNonNull(graphql.ID), func(race *racing.Race) interface{} {
+				return race.GetMeetingId()
+			}),
+			"name": raceField(graphql.NewNonNull(graphql.String), func(race *racing.Race) interface{} {
+				return race.GetName()
+			}),
+			"number": raceField(graphql.NewNonNull(graphql.Int), func(race *racing.Race) interface{} {
+				return race.GetNumber()
+			}),
+			"visible": raceField(graphql.NewNonNull(graphql.Boolean), func(race *racing.Race) interface{} {
+				return race.GetVisible()
+			}),
+			"advertisedStartTime": raceField(graphql.DateTime, func(race *racing.Race) interface{} {
+				if race.GetAdvertisedStartTime() == nil {
+					return nil
+				}
+
+				return race.GetAdvertisedStartTime().AsTime()
+			}),
+			"status": raceField(raceStatusEnum, func(race *racing.Race) interface{} {
+				if race.GetStatus() == racing.Race_STATUS_UNSPECIFIED {
+					return nil
+				}
+
+				return race.GetStatus()
+			}),
+			"externalId": raceField(graphql.String, func(race *racing.Race) interface{} {
+				if race.GetExternalId() == "" {
+					return nil
+				}
+
+				return race.GetExternalId()
+			}),
+			"etag": raceField(graphql.String, func(race *racing.Race) interface{} {
+				if race.GetEtag() == "" {
+					return nil
+				}
+
+				return race.GetEtag()
+			}),
+			"meeting": &graphql.Field{
+				Type: graphql.NewNonNull(meetingType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					node := p.Source.(*raceNode)
+
+					return &meetingNode{id: node.race.GetMeetingId(), loader: node.loader}, nil
+				},
+			},
+		},
+	})
+
+	// Meeting and Race refer to each other, so races are added once both exist.
+	meetingType.AddFieldConfig("races", &graphql.Field{
+		Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(raceType))),
+		Description: "The races of the meeting.",
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			node := p.Source.(*meetingNode)
+			load := node.loader.load(node.id)
+
+			return func() (interface{}, error) {
+				races, err := load()
+				if err != nil {
+					// graphql-go drops the extensions of errors returned by thunks, which withExtensions restores.
+					return nil, newError(p.Context, err)
+				}
+
+				return raceNodes(races, node.loader), nil
+			}, nil
+		},
+	})
+
+	eventTypeEnum := graphql.NewEnum(graphql.EnumConfig{
+		Name:        "RaceEventType",
+		Description: "What happened to the race of a RaceEvent.",
+		Values: graphql.EnumValueConfigMap{
+			"SNAPSHOT": &graphql.EnumValueConfig{
+				Value:       racing.RaceEvent_SNAPSHOT,
+				Description: "The race as it was when the subscription started.",
+			},
+			"CREATED": &graphql.EnumValueConfig{Value: racing.RaceEvent_CREATED},
+			"UPDATED": &graphql.EnumValueConfig{Value: racing.RaceEvent_UPDATED},
+			"DELETED": &graphql.EnumValueConfig{Value: racing.RaceEvent_DELETED},
+		},
+	})
+
+	eventType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "RaceEvent",
+		Description: "A change to a race.",
+		Fields: graphql.Fields{
+			"sequence": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.String),
+				Description: "Orders events, and identifies the last event received when resuming a subscription.",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return strconv.FormatUint(p.Source.(*eventNode).event.GetSequence(), 10), nil
+				},
+			},
+			"type": &graphql.Field{
+				Type: graphql.NewNonNull(eventTypeEnum),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*eventNode).event.GetType(), nil
+				},
+			},
+			"race": &graphql.Field{
+				Type: graphql.NewNonNull(raceType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					node := p.Source.(*eventNode)
+
+					return &raceNode{race: node.event.GetRace(), loader: node.loader}, nil
+				},
+			},
+		},
+	})
+
+	meetingIDsArg := &graphql.ArgumentConfig{
+		Type:        graphql.NewList(graphql.NewNonNull(graphql.ID)),
+		Description: "Only races of these meetings.",
+	}
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"races": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(raceType))),
+				Description: "Lists races.",
+				Args:        graphql.FieldConfigArgument{"meetingIds": meetingIDsArg},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					meetingIDs, err := parseIDs(p.Args["meetingIds"])
+					if err != nil {
+						return nil, newError(p.Context, err)
+					}
+
+					res, err := client.ListRaces(p.Context, &racing.ListRacesRequest{
+						Filter: &racing.ListRacesRequestFilter{MeetingIds: meetingIDs},
+					})
+					if err != nil {
+						return nil, newError(p.Context, err)
+					}
+
+					loader := p.Info.RootValue.(*root).loader
+
+					// Every race of the meetings was listed, so resolving their races needn't list them again.
+					if len(meetingIDs) > 0 {
+						loader.prime(meetingIDs, res.GetRaces())
+					}
+
+					return raceNodes(res.GetRaces(), loader), nil
+				},
+			},
+			"meetings": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(meetingType))),
+				Description: "Looks up meetings by ID.",
+				Args: graphql.FieldConfigArgument{
+					"ids": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.ID))),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					ids, err := parseIDs(p.Args["ids"])
+					if err != nil {
+						return nil, newError(p.Context, err)
+					}
+
+					loader := p.Info.RootValue.(*root).loader
+					meetings := make([]*meetingNode, 0, len(ids))
+					seen := map[int64]bool{}
+
+					for _, id := range ids {
+						if !seen[id] {
+							seen[id] = true
+							meetings = append(meetings, &meetingNode{id: id, loader: loader})
+						}
+					}
+
+					return meetings, nil
+				},
+			},
+		},
+	})
+
+	subscriptionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Subscription",
+		Fields: graphql.Fields{
+			"raceEvents": &graphql.Field{
+				Type:        graphql.NewNonNull(eventType),
+				Description: "Streams changes to races, starting with a SNAPSHOT event for each race.",
+				Args: graphql.FieldConfigArgument{
+					"meetingIds": meetingIDsArg,
+					"resumeAfter": &graphql.ArgumentConfig{
+						Type:        graphql.String,
+						Description: "Resumes a subscription after the sequence of the last event received.",
+					},
+				},
+				Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+					return subscribeRaceEvents(p, client)
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					// A subscription that failed after starting is ended with its error as the last event.
+					if err, ok := p.Source.(error); ok {
+						return nil, newError(p.Context, err)
+					}
+
+					return p.Source, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:        queryType,
+		Subscription: subscriptionType,
+	})
+}
+
+// subscribeRaceEvents starts a WatchRaces call on client, returning a channel of its events. The channel is closed
+// when the call ends, after sending the error it ended with, if any.
+func subscribeRaceEvents(p graphql.ResolveParams, client racing.RacingClient) (interface{}, error) {
+	in := &racing.WatchRacesRequest{}
+
+	meetingIDs, err := parseIDs(p.Args["meetingIds"])
+	if err != nil {
+		return nil, newError(p.Context, err)
+	}
+
+	if len(meetingIDs) > 0 {
+		in.Filter = &racing.ListRacesRequestFilter{MeetingIds: meetingIDs}
+	}
+
+	if resumeAfter, ok := p.Args["resumeAfter"].(string); ok {
+		if in.ResumeAfter, err = strconv.ParseUint(resumeAfter, 10, 64); err != nil {
+			return nil, newError(p.Context, status.Errorf(codes.InvalidArgument, "invalid resumeAfter %q", resumeAfter))
+		}
+	}
+
+	stream, err := watch.Start(p.Context, client, in)
+	if err != nil {
+		return nil, newError(p.Context, err)
+	}
+
+	events := make(chan interface{})
+
+	go func() {
+		defer close(events)
+
+		for {
+			res, err := stream.Recv()
+
+			var event interface{}
+
+			switch {
+			case err == nil:
+				// Each event is resolved as an operation of its own, so has its own loader.
+				event = &eventNode{event: res.GetEvent(), loader: newRacesLoader(p.Context, client)}
+			case errors.Is(err, io.EOF) || p.Context.Err() != nil:
+				return
+			default:
+				event = err
+			}
+
+			select {
+			case events <- event:
+			case <-p.Context.Done():
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// raceField returns a field of Race resolving to the value of the race returned by get.
+func raceField(t graphql.Output, get func(*racing.Race) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Type: t,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*raceNode).race), nil
+		},
+	}
+}
+
+// raceNodes returns races as the sources of Race fields.
+func raceNodes(races []*racing.Race, loader *racesLoader) []*raceNode {
+	nodes := make([]*raceNode, 0, len(races))
+	for _, race := range races {
+		nodes = append(nodes, &raceNode{race: race, loader: loader})
+	}
+
+	return nodes
+}
+
+// parseIDs parses the value of an [ID!] argument, which is nil if the argument was not given.
+func parseIDs(v interface{}) ([]int64, error) {
+	values, _ := v.([]interface{})
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int64, 0, len(values))
+
+	for _, value := range values {
+		id, err := strconv.ParseInt(fmt.Sprint(value), 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid ID %q", fmt.Sprint(value))
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
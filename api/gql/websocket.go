@@ -0,0 +1,302 @@
+package gql
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// subprotocol is the websocket subprotocol operations are served with.
+// See https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md.
+const subprotocol = "graphql-transport-ws"
+
+const (
+	// initTimeout is how long clients have to initialise the connection after it opens.
+	initTimeout = 10 * time.Second
+	// pingInterval is how often clients are pinged. Connections that don't answer before the next ping are closed.
+	pingInterval = 15 * time.Second
+	// writeTimeout is how long a message may take to write.
+	writeTimeout = 10 * time.Second
+)
+
+// Close codes defined by the protocol.
+const (
+	closeBadRequest               = 4400
+	closeUnauthorized             = 4401
+	closeSubprotocolNotAcceptable = 4406
+	closeInitTimeout              = 4408
+	closeSubscriberExists         = 4409
+	closeTooManyInits             = 4429
+)
+
+// Message types defined by the protocol.
+const (
+	typeConnectionInit = "connection_init"
+	typeConnectionAck  = "connection_ack"
+	typePing           = "ping"
+	typePong           = "pong"
+	typeSubscribe      = "subscribe"
+	typeNext           = "next"
+	typeError          = "error"
+	typeComplete       = "complete"
+)
+
+// message is a message of the protocol.
+type message struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// wsConn is a websocket serving operations.
+type wsConn struct {
+	conn *websocket.Conn
+
+	writeMu sync.Mutex
+
+	mu           sync.Mutex
+	acknowledged bool
+	operations   map[string]context.CancelFunc
+}
+
+// serveWebSocket serves operations over a websocket until the client closes it.
+func (h *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has responded with an error.
+		return
+	}
+	defer conn.Close()
+
+	c := &wsConn{conn: conn, operations: map[string]context.CancelFunc{}}
+
+	if conn.Subprotocol() != subprotocol {
+		c.close(closeSubprotocolNotAcceptable, "Subprotocol not acceptable")
+		return
+	}
+
+	var running sync.WaitGroup
+	defer running.Wait()
+
+	ctx, cancel := context.WithCancel(h.outgoingContext(r.Context(), r))
+	defer cancel()
+
+	initTimer := time.AfterFunc(initTimeout, func() {
+		if !c.isAcknowledged() {
+			c.close(closeInitTimeout, "Connection initialisation timeout")
+		}
+	})
+	defer initTimer.Stop()
+
+	// Clients must answer each ping before the next is due.
+	_ = conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	})
+
+	go c.ping(ctx)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			// The client has gone away, or the connection was closed.
+			return
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+
+		var msg message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.close(closeBadRequest, "Invalid message received")
+			return
+		}
+
+		switch msg.Type {
+		case typeConnectionInit:
+			if !c.acknowledge() {
+				c.close(closeTooManyInits, "Too many initialisation requests")
+				return
+			}
+
+			c.write(message{Type: typeConnectionAck})
+		case typePing:
+			c.write(message{Type: typePong})
+		case typePong:
+		case typeSubscribe:
+			var p params
+			if msg.ID == "" || json.Unmarshal(msg.Payload, &p) != nil {
+				c.close(closeBadRequest, "Invalid message received")
+				return
+			}
+
+			if !c.isAcknowledged() {
+				c.close(closeUnauthorized, "Unauthorized")
+				return
+			}
+
+			opCtx, opCancel := context.WithCancel(ctx)
+			if !c.start(msg.ID, opCancel) {
+				opCancel()
+				c.close(closeSubscriberExists, "Subscriber for "+msg.ID+" already exists")
+
+				return
+			}
+
+			running.Add(1)
+
+			go func(id string) {
+				defer running.Done()
+				defer opCancel()
+
+				h.runOperation(opCtx, c, id, p)
+			}(msg.ID)
+		case typeComplete:
+			c.stop(msg.ID)
+		default:
+			c.close(closeBadRequest, "Invalid message received")
+			return
+		}
+	}
+}
+
+// runOperation executes the operation p, sending its results to the client.
+func (h *Handler) runOperation(ctx context.Context, c *wsConn, id string, p params) {
+	doc, op, errs := h.prepare(p)
+	if len(errs) > 0 {
+		if c.finish(id) {
+			c.writePayload(id, typeError, errs)
+		}
+
+		return
+	}
+
+	if op.Operation == ast.OperationTypeQuery {
+		c.writePayload(id, typeNext, h.execute(ctx, doc, p))
+	} else {
+		results := graphql.ExecuteSubscription(graphql.ExecuteParams{
+			Schema:        h.schema,
+			AST:           doc,
+			OperationName: p.OperationName,
+			Args:          p.Variables,
+			Context:       ctx,
+		})
+
+		// The results are drained even once the client has completed the operation, so that execution can end.
+		for res := range results {
+			if ctx.Err() == nil {
+				c.writePayload(id, typeNext, withExtensions(res))
+			}
+		}
+	}
+
+	if c.finish(id) {
+		c.write(message{ID: id, Type: typeComplete})
+	}
+}
+
+// acknowledge records the connection as initialised, reporting false if it already was.
+func (c *wsConn) acknowledge() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.acknowledged {
+		return false
+	}
+
+	c.acknowledged = true
+
+	return true
+}
+
+// isAcknowledged reports whether the connection has been initialised.
+func (c *wsConn) isAcknowledged() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.acknowledged
+}
+
+// start records the operation id as running, reporting false if it already is.
+func (c *wsConn) start(id string, cancel context.CancelFunc) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.operations[id]; ok {
+		return false
+	}
+
+	c.operations[id] = cancel
+
+	return true
+}
+
+// stop cancels the operation id, as the client has completed it.
+func (c *wsConn) stop(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cancel, ok := c.operations[id]; ok {
+		cancel()
+		delete(c.operations, id)
+	}
+}
+
+// finish records the operation id as ended, reporting whether it was still running, and so whether the client must
+// be told it has ended.
+func (c *wsConn) finish(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.operations[id]
+	delete(c.operations, id)
+
+	return ok
+}
+
+// ping pings the client until ctx is done.
+func (c *wsConn) ping(ctx context.Context) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writePayload writes a message with payload v.
+func (c *wsConn) writePayload(id, typ string, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	c.write(message{ID: id, Type: typ, Payload: payload})
+}
+
+// write writes msg. Errors are ignored, as they mean the client has gone away, which ends the connection.
+func (c *wsConn) write(msg message) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_ = c.conn.WriteJSON(msg)
+}
+
+// close closes the connection with code, ending the reads of serveWebSocket.
+func (c *wsConn) close(code int, reason string) {
+	_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeTimeout))
+	_ = c.conn.Close()
+}
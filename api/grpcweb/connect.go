@@ -0,0 +1,256 @@
+package grpcweb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// connectHTTPStatus maps codes to the HTTP status of Connect unary error responses.
+var connectHTTPStatus = map[codes.Code]int{
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+// connectError is the JSON representation of an error in the Connect protocol.
+type connectError struct {
+	Code    string               `json:"code"`
+	Message string               `json:"message,omitempty"`
+	Details []connectErrorDetail `json:"details,omitempty"`
+}
+
+type connectErrorDetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// connectEndStream is the final message of a Connect streaming response.
+type connectEndStream struct {
+	Error    *connectError       `json:"error,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+// serveConnectUnary proxies a Connect unary request, with a JSON rather than binary message if isJSON is set.
+// See https://connect.build/docs/protocol.
+func (p *Proxy) serveConnectUnary(w http.ResponseWriter, r *http.Request, m *method, isJSON bool) {
+	timeout, hasTimeout := connectTimeout(r)
+	ctx, cancel := withTimeout(r.Context(), timeout, hasTimeout)
+	defer cancel()
+
+	if m != nil && m.desc.ServerStreams {
+		writeConnectUnaryError(w, status.New(codes.InvalidArgument, "streaming methods require application/connect+proto"))
+		return
+	}
+
+	req, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageLength))
+	if err != nil {
+		writeConnectUnaryError(w, status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	if isJSON && m != nil {
+		msg := m.input.New().Interface()
+		if err := protojson.Unmarshal(req, msg); err != nil {
+			writeConnectUnaryError(w, status.New(codes.InvalidArgument, err.Error()))
+			return
+		}
+
+		if req, err = proto.Marshal(msg); err != nil {
+			writeConnectUnaryError(w, status.New(codes.Internal, err.Error()))
+			return
+		}
+	}
+
+	var (
+		header metadata.MD
+		res    []byte
+	)
+
+	trailer, err := p.call(ctx, r, m, req, func(md metadata.MD) { header = md }, func(b []byte) error {
+		res = b
+		return nil
+	})
+
+	setMetadataHeaders(w.Header(), header, "")
+	setMetadataHeaders(w.Header(), trailer, "Trailer-")
+
+	if err != nil {
+		writeConnectUnaryError(w, publicStatus(err))
+		return
+	}
+
+	contentType := "application/proto"
+
+	if isJSON {
+		contentType = "application/json"
+
+		msg := m.output.New().Interface()
+		if err := proto.Unmarshal(res, msg); err != nil {
+			writeConnectUnaryError(w, status.New(codes.Internal, "internal error"))
+			return
+		}
+
+		if res, err = protojson.Marshal(msg); err != nil {
+			writeConnectUnaryError(w, status.New(codes.Internal, "internal error"))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(res)
+}
+
+// serveConnectStream proxies a Connect streaming request.
+func (p *Proxy) serveConnectStream(w http.ResponseWriter, r *http.Request, m *method) {
+	timeout, hasTimeout := connectTimeout(r)
+	ctx, cancel := withTimeout(r.Context(), timeout, hasTimeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/connect+proto")
+
+	writeFrame := func(flags byte, b []byte) error {
+		if _, err := w.Write(appendFrame(nil, flags, b)); err != nil {
+			return err
+		}
+
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		return nil
+	}
+
+	var (
+		trailer metadata.MD
+		st      *status.Status
+	)
+
+	req, err := readRequestMessage(http.MaxBytesReader(w, r.Body, maxMessageLength+frameHeaderLength), maxMessageLength)
+	if err != nil {
+		st = status.New(codes.InvalidArgument, err.Error())
+	} else {
+		wroteHeader := false
+
+		trailer, err = p.call(ctx, r, m, req, func(header metadata.MD) {
+			setMetadataHeaders(w.Header(), header, "")
+			w.WriteHeader(http.StatusOK)
+
+			wroteHeader = true
+		}, func(b []byte) error {
+			return writeFrame(0, b)
+		})
+
+		if !wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+
+		st = publicStatus(err)
+	}
+
+	end := connectEndStream{}
+
+	if st.Code() != codes.OK {
+		end.Error = newConnectError(st)
+	}
+
+	if len(trailer) > 0 {
+		h := http.Header{}
+		setMetadataHeaders(h, trailer, "")
+		end.Metadata = h
+	}
+
+	b, err := json.Marshal(end)
+	if err != nil {
+		return
+	}
+
+	_ = writeFrame(flagConnectEndStream, b)
+}
+
+// connectTimeout returns the timeout set by the Connect-Timeout-Ms header, if any.
+func connectTimeout(r *http.Request) (time.Duration, bool) {
+	ms, err := strconv.ParseInt(r.Header.Get("Connect-Timeout-Ms"), 10, 64)
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// writeConnectUnaryError writes st as the error response of a Connect unary request.
+func writeConnectUnaryError(w http.ResponseWriter, st *status.Status) {
+	b, err := json.Marshal(newConnectError(st))
+	if err != nil {
+		b = []byte(`{"code":"internal"}`)
+	}
+
+	httpStatus, ok := connectHTTPStatus[st.Code()]
+	if !ok {
+		httpStatus = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	_, _ = w.Write(b)
+}
+
+func newConnectError(st *status.Status) *connectError {
+	e := &connectError{
+		Code:    connectCode(st.Code()),
+		Message: st.Message(),
+	}
+
+	for _, detail := range st.Proto().GetDetails() {
+		e.Details = append(e.Details, connectErrorDetail{
+			Type:  strings.TrimPrefix(detail.GetTypeUrl(), "type.googleapis.com/"),
+			Value: base64.RawStdEncoding.EncodeToString(detail.GetValue()),
+		})
+	}
+
+	return e
+}
+
+// connectCode returns the Connect name of code, e.g. "invalid_argument" for codes.InvalidArgument.
+func connectCode(code codes.Code) string {
+	var b strings.Builder
+
+	for i, r := range code.String() {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+
+			r = unicode.ToLower(r)
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
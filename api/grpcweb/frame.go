@@ -0,0 +1,128 @@
+package grpcweb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// frameHeaderLength is the length of the flags byte and big endian message length preceding each message.
+	frameHeaderLength = 5
+
+	// flagCompressed marks a compressed message, in both gRPC-Web and Connect.
+	flagCompressed = 0x01
+	// flagConnectEndStream marks the final Connect streaming message, holding the end of stream JSON.
+	flagConnectEndStream = 0x02
+	// flagGRPCWebTrailer marks the gRPC-Web frame holding the trailers.
+	flagGRPCWebTrailer = 0x80
+)
+
+// codec passes messages through as the serialized bytes received from the browser and from the server, so the
+// proxy needs no knowledge of message types. It reports its name as proto so the server decodes them as such.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+
+	return b, nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+
+	*b = append((*b)[:0], data...)
+
+	return nil
+}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+// readFrame reads a single framed message from r.
+func readFrame(r io.Reader, maxLength int) (byte, []byte, error) {
+	var header [frameHeaderLength]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, errors.New("truncated message frame")
+		}
+
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if int64(length) > int64(maxLength) {
+		return 0, nil, fmt.Errorf("message of %d bytes exceeds the limit of %d bytes", length, maxLength)
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, errors.New("truncated message frame")
+	}
+
+	return header[0], b, nil
+}
+
+// readRequestMessage reads the single, uncompressed message of a unary or server streaming request.
+func readRequestMessage(r io.Reader, maxLength int) ([]byte, error) {
+	flags, b, err := readFrame(r, maxLength)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("missing request message")
+		}
+
+		return nil, err
+	}
+
+	if flags&flagCompressed != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+
+	return b, nil
+}
+
+// appendFrame appends b, framed with flags, to dst.
+func appendFrame(dst []byte, flags byte, b []byte) []byte {
+	var header [frameHeaderLength]byte
+	header[0] = flags
+	binary.BigEndian.PutUint32(header[1:], uint32(len(b)))
+
+	return append(append(dst, header[:]...), b...)
+}
+
+// decodeText decodes a gRPC-Web text request body, which may be several concatenated, padded base64 chunks.
+func decodeText(b []byte) ([]byte, error) {
+	var decoded []byte
+
+	for len(b) > 0 {
+		end := len(b)
+		if i := bytes.IndexByte(b, '='); i >= 0 {
+			end = i
+			for end < len(b) && b[end] == '=' {
+				end++
+			}
+		}
+
+		chunk := make([]byte, base64.StdEncoding.DecodedLen(end))
+
+		n, err := base64.StdEncoding.Decode(chunk, b[:end])
+		if err != nil {
+			return nil, err
+		}
+
+		decoded = append(decoded, chunk[:n]...)
+		b = b[end:]
+	}
+
+	return decoded, nil
+}
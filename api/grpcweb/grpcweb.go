@@ -0,0 +1,330 @@
+// Package grpcweb proxies gRPC-Web and Connect requests from browsers to gRPC servers, so they can call RPCs with
+// binary payloads and receive server streams without a separate proxy.
+package grpcweb
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	"git.neds.sh/matty/entain/api/metrics"
+)
+
+// maxMessageLength is the largest request message accepted, matching the default of gRPC servers.
+const maxMessageLength = 4 << 20
+
+// Annotator returns metadata to send with the RPC a request is proxied as. It has the signature of the
+// runtime.WithMetadata annotators used by the gateway, so they can be shared.
+type Annotator func(context.Context, *http.Request) metadata.MD
+
+// Proxy is a http.Handler that proxies gRPC-Web and Connect requests for the RPCs of a set of services.
+type Proxy struct {
+	conn       grpc.ClientConnInterface
+	methods    map[string]*method
+	annotators []Annotator
+}
+
+// method is an RPC that can be proxied.
+type method struct {
+	name   string
+	desc   *grpc.StreamDesc
+	input  protoreflect.MessageType
+	output protoreflect.MessageType
+}
+
+// NewProxy creates a Proxy for the RPCs of services, which are called on conn. The message types of the services
+// must be registered, which they are by importing their generated package.
+func NewProxy(conn grpc.ClientConnInterface, services []*grpc.ServiceDesc, annotators ...Annotator) (*Proxy, error) {
+	p := &Proxy{
+		conn:       conn,
+		methods:    map[string]*method{},
+		annotators: annotators,
+	}
+
+	for _, service := range services {
+		for _, m := range service.Methods {
+			if err := p.addMethod(service.ServiceName, m.MethodName, &grpc.StreamDesc{}); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, s := range service.Streams {
+			desc := &grpc.StreamDesc{ServerStreams: s.ServerStreams, ClientStreams: s.ClientStreams}
+			if err := p.addMethod(service.ServiceName, s.StreamName, desc); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func (p *Proxy) addMethod(serviceName, methodName string, desc *grpc.StreamDesc) error {
+	d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return fmt.Errorf("finding service %s: %w", serviceName, err)
+	}
+
+	service, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return fmt.Errorf("%s is not a service", serviceName)
+	}
+
+	md := service.Methods().ByName(protoreflect.Name(methodName))
+	if md == nil {
+		return fmt.Errorf("finding method %s.%s", serviceName, methodName)
+	}
+
+	input, err := protoregistry.GlobalTypes.FindMessageByName(md.Input().FullName())
+	if err != nil {
+		return fmt.Errorf("finding input of %s.%s: %w", serviceName, methodName, err)
+	}
+
+	output, err := protoregistry.GlobalTypes.FindMessageByName(md.Output().FullName())
+	if err != nil {
+		return fmt.Errorf("finding output of %s.%s: %w", serviceName, methodName, err)
+	}
+
+	name := "/" + serviceName + "/" + methodName
+	p.methods[name] = &method{name: name, desc: desc, input: input, output: output}
+
+	return nil
+}
+
+// ServeHTTP proxies r, choosing the protocol from its content type.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	m := p.methods[r.URL.Path]
+	if m != nil {
+		metrics.SetRoute(r.Context(), m.name)
+	}
+
+	switch contentType {
+	case "application/grpc-web", "application/grpc-web+proto":
+		p.serveGRPCWeb(w, r, m, false)
+	case "application/grpc-web-text", "application/grpc-web-text+proto":
+		p.serveGRPCWeb(w, r, m, true)
+	case "application/proto", "application/json":
+		p.serveConnectUnary(w, r, m, contentType == "application/json")
+	case "application/connect+proto":
+		p.serveConnectStream(w, r, m)
+	default:
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+	}
+}
+
+// call makes the RPC m with the request message req, passing the response header and each response message to
+// the given funcs. onHeader is only called if there is at least one message. It returns the response trailer.
+func (p *Proxy) call(
+	ctx context.Context,
+	r *http.Request,
+	m *method,
+	req []byte,
+	onHeader func(metadata.MD),
+	onMessage func([]byte) error,
+) (metadata.MD, error) {
+	if m == nil {
+		return nil, status.Errorf(codes.Unimplemented, "unknown method %s", r.URL.Path)
+	}
+
+	if m.desc.ClientStreams {
+		return nil, status.Error(codes.Unimplemented, "client streaming is not supported")
+	}
+
+	md := metadata.MD{}
+	for _, annotate := range p.annotators {
+		md = metadata.Join(md, annotate(ctx, r))
+	}
+
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, md))
+	defer cancel()
+
+	stream, err := p.conn.NewStream(ctx, m.desc, m.name, grpc.ForceCodec(codec{}))
+	if err != nil {
+		return nil, err
+	}
+
+	// An error sending means the RPC has failed, which RecvMsg returns.
+	_ = stream.SendMsg(req)
+	_ = stream.CloseSend()
+
+	for first := true; ; first = false {
+		var b []byte
+		if err := stream.RecvMsg(&b); err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			return stream.Trailer(), err
+		}
+
+		// The header is passed on with the first message, as the response is trailers-only if there are none.
+		if first {
+			if header, err := stream.Header(); err == nil {
+				onHeader(header)
+			}
+		}
+
+		if err := onMessage(b); err != nil {
+			// The client has gone away.
+			return nil, status.Error(codes.Canceled, err.Error())
+		}
+
+		if !m.desc.ServerStreams {
+			break
+		}
+	}
+
+	return stream.Trailer(), nil
+}
+
+// withTimeout applies the timeout the client asked for, if any, to ctx.
+func withTimeout(ctx context.Context, timeout time.Duration, ok bool) (context.Context, context.CancelFunc) {
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// parseGRPCTimeout parses a grpc-timeout header, e.g. "100m".
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 {
+		return 0, false
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+
+	unit, ok := units[v[len(v)-1]]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * unit, true
+}
+
+// setMetadataHeaders adds md to h as headers, prefixing each key with prefix. Reserved keys are skipped.
+func setMetadataHeaders(h http.Header, md metadata.MD, prefix string) {
+	for k, values := range md {
+		if strings.HasPrefix(k, "grpc-") || k == "content-type" {
+			continue
+		}
+
+		for _, v := range values {
+			if strings.HasSuffix(k, "-bin") {
+				v = encodeBinaryHeader(v)
+			}
+
+			h.Add(prefix+k, v)
+		}
+	}
+}
+
+// writeStatusTrailer writes the status and trailer metadata of an RPC as a HTTP/1.1 style header block, the
+// encoding gRPC-Web uses for trailers.
+func writeStatusTrailer(b *strings.Builder, st *status.Status, trailer metadata.MD) {
+	h := http.Header{}
+	setMetadataHeaders(h, trailer, "")
+	setStatusHeaders(h, st)
+
+	for k, values := range h {
+		for _, v := range values {
+			b.WriteString(strings.ToLower(k))
+			b.WriteString(": ")
+			b.WriteString(v)
+			b.WriteString("\r\n")
+		}
+	}
+}
+
+// setStatusHeaders sets the grpc-status, grpc-message and grpc-status-details-bin headers describing st.
+func setStatusHeaders(h http.Header, st *status.Status) {
+	h.Set("Grpc-Status", strconv.Itoa(int(st.Code())))
+
+	if st.Message() != "" {
+		h.Set("Grpc-Message", encodeGRPCMessage(st.Message()))
+	}
+
+	if len(st.Details()) > 0 {
+		if b, err := proto.Marshal(st.Proto()); err == nil {
+			h.Set("Grpc-Status-Details-Bin", encodeBinaryHeader(string(b)))
+		}
+	}
+}
+
+// publicStatus returns the status of err to return to clients. The messages of errors that may describe
+// internals, such as the address of the server or a failed query, are replaced.
+func publicStatus(err error) *status.Status {
+	st := status.Convert(err)
+
+	switch st.Code() {
+	case codes.Unavailable:
+		return replaceMessage(st, "service temporarily unavailable")
+	case codes.Unknown, codes.Internal, codes.DataLoss:
+		return replaceMessage(st, "internal error")
+	default:
+		return st
+	}
+}
+
+func replaceMessage(st *status.Status, msg string) *status.Status {
+	p := st.Proto()
+	p.Message = msg
+
+	return status.FromProto(p)
+}
+
+// encodeBinaryHeader encodes the value of a binary ("-bin") metadata key as a header value.
+func encodeBinaryHeader(v string) string {
+	return base64.RawStdEncoding.EncodeToString([]byte(v))
+}
+
+// encodeGRPCMessage percent encodes a grpc-message value.
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
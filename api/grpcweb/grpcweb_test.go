@@ -0,0 +1,355 @@
+package grpcweb
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+)
+
+type racingServer struct {
+	racing.UnimplementedRacingServer
+}
+
+func (racingServer) ListRaces(ctx context.Context, in *racing.ListRacesRequest) (*racing.ListRacesResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	switch {
+	case len(in.GetFilter().GetMeetingIds()) == 0:
+		return &racing.ListRacesResponse{Races: []*racing.Race{{Id: 1, Name: strings.Join(md.Get("x-test"), ",")}}}, nil
+	case in.GetFilter().GetMeetingIds()[0] == 404:
+		return nil, status.Error(codes.NotFound, "no races")
+	default:
+		return nil, status.Error(codes.Internal, "database is on fire")
+	}
+}
+
+func newTestProxy(t *testing.T) *Proxy {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	racing.RegisterRacingServer(server, racingServer{})
+
+	go func() { _ = server.Serve(listener) }()
+
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(
+		"bufconn",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+	)
+	require.NoError(t, err, "grpc.Dial")
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	annotator := func(context.Context, *http.Request) metadata.MD {
+		return metadata.Pairs("x-test", "annotated")
+	}
+
+	proxy, err := NewProxy(conn, []*grpc.ServiceDesc{&racing.Racing_ServiceDesc}, annotator)
+	require.NoError(t, err, "NewProxy")
+
+	return proxy
+}
+
+func marshal(t *testing.T, m proto.Message) []byte {
+	t.Helper()
+
+	b, err := proto.Marshal(m)
+	require.NoError(t, err, "proto.Marshal")
+
+	return b
+}
+
+func TestProxyGRPCWeb(t *testing.T) {
+	t.Parallel()
+
+	proxy := newTestProxy(t)
+
+	for _, tc := range []struct {
+		name              string
+		giveContentType   string
+		giveRequest       *racing.ListRacesRequest
+		expectRaceName    string
+		expectGRPCStatus  string
+		expectGRPCMessage string
+		expectTrailerOnly bool
+	}{
+		{
+			name:             "success",
+			giveContentType:  "application/grpc-web+proto",
+			giveRequest:      &racing.ListRacesRequest{},
+			expectRaceName:   "annotated",
+			expectGRPCStatus: "0",
+		},
+		{
+			name:             "success_text",
+			giveContentType:  "application/grpc-web-text+proto",
+			giveRequest:      &racing.ListRacesRequest{},
+			expectRaceName:   "annotated",
+			expectGRPCStatus: "0",
+		},
+		{
+			name:              "not_found",
+			giveContentType:   "application/grpc-web+proto",
+			giveRequest:       &racing.ListRacesRequest{Filter: &racing.ListRacesRequestFilter{MeetingIds: []int64{404}}},
+			expectGRPCStatus:  "5",
+			expectGRPCMessage: "no races",
+			expectTrailerOnly: true,
+		},
+		{
+			name:              "internal_message_hidden",
+			giveContentType:   "application/grpc-web+proto",
+			giveRequest:       &racing.ListRacesRequest{Filter: &racing.ListRacesRequestFilter{MeetingIds: []int64{500}}},
+			expectGRPCStatus:  "13",
+			expectGRPCMessage: "internal error",
+			expectTrailerOnly: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			text := strings.Contains(tc.giveContentType, "text")
+
+			body := appendFrame(nil, 0, marshal(t, tc.giveRequest))
+			if text {
+				body = []byte(base64.StdEncoding.EncodeToString(body))
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/racing.Racing/ListRaces", bytes.NewReader(body))
+			req.Header.Set("Content-Type", tc.giveContentType)
+
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code, "status")
+			assert.Equal(t, tc.giveContentType, rec.Header().Get("Content-Type"), "Content-Type")
+
+			if tc.expectTrailerOnly {
+				assert.Equal(t, tc.expectGRPCStatus, rec.Header().Get("Grpc-Status"), "Grpc-Status")
+				assert.Equal(t, tc.expectGRPCMessage, rec.Header().Get("Grpc-Message"), "Grpc-Message")
+				assert.Zero(t, rec.Body.Len(), "body")
+
+				return
+			}
+
+			resBody := rec.Body.Bytes()
+			if text {
+				var err error
+				resBody, err = decodeText(resBody)
+				require.NoError(t, err, "decodeText")
+			}
+
+			r := bytes.NewReader(resBody)
+
+			flags, msg, err := readFrame(r, maxMessageLength)
+			require.NoError(t, err, "readFrame message")
+			assert.Zero(t, flags, "message flags")
+
+			var res racing.ListRacesResponse
+			require.NoError(t, proto.Unmarshal(msg, &res), "proto.Unmarshal")
+			require.Len(t, res.Races, 1, "races")
+			assert.Equal(t, tc.expectRaceName, res.Races[0].Name, "race name")
+
+			flags, trailer, err := readFrame(r, maxMessageLength)
+			require.NoError(t, err, "readFrame trailer")
+			assert.Equal(t, byte(flagGRPCWebTrailer), flags, "trailer flags")
+			assert.Contains(t, string(trailer), "grpc-status: "+tc.expectGRPCStatus+"\r\n", "trailer")
+		})
+	}
+}
+
+func TestProxyConnectUnary(t *testing.T) {
+	t.Parallel()
+
+	proxy := newTestProxy(t)
+
+	for _, tc := range []struct {
+		name            string
+		givePath        string
+		giveContentType string
+		giveBody        []byte
+		expectStatus    int
+		expectBody      string
+		expectCode      string
+	}{
+		{
+			name:            "success_json",
+			givePath:        "/racing.Racing/ListRaces",
+			giveContentType: "application/json",
+			giveBody:        []byte(`{}`),
+			expectStatus:    http.StatusOK,
+			expectBody:      `{"races":[{"id":"1","name":"annotated"}]}`,
+		},
+		{
+			name:            "success_proto",
+			givePath:        "/racing.Racing/ListRaces",
+			giveContentType: "application/proto",
+			giveBody:        marshal(t, &racing.ListRacesRequest{}),
+			expectStatus:    http.StatusOK,
+		},
+		{
+			name:            "not_found",
+			givePath:        "/racing.Racing/ListRaces",
+			giveContentType: "application/json",
+			giveBody:        []byte(`{"filter":{"meetingIds":["404"]}}`),
+			expectStatus:    http.StatusNotFound,
+			expectCode:      "not_found",
+		},
+		{
+			name:            "invalid_json",
+			givePath:        "/racing.Racing/ListRaces",
+			giveContentType: "application/json",
+			giveBody:        []byte(`{"filter":`),
+			expectStatus:    http.StatusBadRequest,
+			expectCode:      "invalid_argument",
+		},
+		{
+			name:            "unknown_method",
+			givePath:        "/racing.Racing/DeleteEverything",
+			giveContentType: "application/proto",
+			expectStatus:    http.StatusNotImplemented,
+			expectCode:      "unimplemented",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodPost, tc.givePath, bytes.NewReader(tc.giveBody))
+			req.Header.Set("Content-Type", tc.giveContentType)
+			req.Header.Set("Connect-Protocol-Version", "1")
+
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectStatus, rec.Code, "status")
+
+			if tc.expectCode != "" {
+				var actual connectError
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &actual), "json.Unmarshal")
+
+				assert.Equal(t, "application/json", rec.Header().Get("Content-Type"), "Content-Type")
+				assert.Equal(t, tc.expectCode, actual.Code, "code")
+
+				return
+			}
+
+			assert.Equal(t, tc.giveContentType, rec.Header().Get("Content-Type"), "Content-Type")
+
+			if tc.giveContentType == "application/json" {
+				assert.JSONEq(t, tc.expectBody, rec.Body.String(), "body")
+				return
+			}
+
+			var res racing.ListRacesResponse
+			require.NoError(t, proto.Unmarshal(rec.Body.Bytes(), &res), "proto.Unmarshal")
+			assert.Len(t, res.Races, 1, "races")
+		})
+	}
+}
+
+func TestProxyUnsupported(t *testing.T) {
+	t.Parallel()
+
+	proxy := newTestProxy(t)
+
+	for _, tc := range []struct {
+		name            string
+		giveMethod      string
+		giveContentType string
+		expectStatus    int
+	}{
+		{
+			name:            "method",
+			giveMethod:      http.MethodGet,
+			giveContentType: "application/grpc-web+proto",
+			expectStatus:    http.StatusMethodNotAllowed,
+		},
+		{
+			name:            "content_type",
+			giveMethod:      http.MethodPost,
+			giveContentType: "text/plain",
+			expectStatus:    http.StatusUnsupportedMediaType,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(tc.giveMethod, "/racing.Racing/ListRaces", nil)
+			req.Header.Set("Content-Type", tc.giveContentType)
+
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectStatus, rec.Code, "status")
+		})
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		give     string
+		expect   time.Duration
+		expectOK bool
+	}{
+		{give: "100m", expect: 100 * time.Millisecond, expectOK: true},
+		{give: "2S", expect: 2 * time.Second, expectOK: true},
+		{give: "1H", expect: time.Hour, expectOK: true},
+		{give: ""},
+		{give: "10x"},
+		{give: "-1S"},
+	} {
+		actual, actualOK := parseGRPCTimeout(tc.give)
+
+		assert.Equal(t, tc.expect, actual, tc.give)
+		assert.Equal(t, tc.expectOK, actualOK, tc.give)
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	t.Parallel()
+
+	give := base64.StdEncoding.EncodeToString([]byte("a")) + base64.StdEncoding.EncodeToString([]byte("bcd"))
+
+	actual, err := decodeText([]byte(give))
+	require.NoError(t, err, "decodeText")
+
+	assert.Equal(t, "abcd", string(actual))
+}
+
+func TestConnectCode(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "invalid_argument", connectCode(codes.InvalidArgument))
+	assert.Equal(t, "deadline_exceeded", connectCode(codes.DeadlineExceeded))
+	assert.Equal(t, "unauthenticated", connectCode(codes.Unauthenticated))
+}
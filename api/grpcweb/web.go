@@ -0,0 +1,102 @@
+package grpcweb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// serveGRPCWeb proxies a gRPC-Web request, in the base64 text encoding if text is set.
+// See https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-WEB.md.
+func (p *Proxy) serveGRPCWeb(w http.ResponseWriter, r *http.Request, m *method, text bool) {
+	contentType := "application/grpc-web+proto"
+	if text {
+		contentType = "application/grpc-web-text+proto"
+	}
+
+	timeout, hasTimeout := parseGRPCTimeout(r.Header.Get("Grpc-Timeout"))
+	ctx, cancel := withTimeout(r.Context(), timeout, hasTimeout)
+	defer cancel()
+
+	req, err := readGRPCWebRequest(w, r, text)
+	if err != nil {
+		writeGRPCWebTrailersOnly(w, contentType, status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	writeFrame := func(flags byte, b []byte) error {
+		frame := appendFrame(nil, flags, b)
+		if text {
+			frame = []byte(base64.StdEncoding.EncodeToString(frame))
+		}
+
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		return nil
+	}
+
+	wroteHeader := false
+	writeHeader := func(header metadata.MD) {
+		w.Header().Set("Content-Type", contentType)
+		setMetadataHeaders(w.Header(), header, "")
+		w.WriteHeader(http.StatusOK)
+
+		wroteHeader = true
+	}
+
+	trailer, err := p.call(ctx, r, m, req, writeHeader, func(b []byte) error {
+		return writeFrame(0, b)
+	})
+
+	st := publicStatus(err)
+
+	if !wroteHeader {
+		writeGRPCWebTrailersOnly(w, contentType, st)
+		return
+	}
+
+	var block strings.Builder
+	writeStatusTrailer(&block, st, trailer)
+
+	_ = writeFrame(flagGRPCWebTrailer, []byte(block.String()))
+}
+
+// readGRPCWebRequest reads the request message of a gRPC-Web request.
+func readGRPCWebRequest(w http.ResponseWriter, r *http.Request, text bool) ([]byte, error) {
+	var body io.Reader = http.MaxBytesReader(w, r.Body, int64(base64.StdEncoding.EncodedLen(maxMessageLength+frameHeaderLength)))
+
+	if text {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+
+		decoded, err := decodeText(b)
+		if err != nil {
+			return nil, err
+		}
+
+		body = bytes.NewReader(decoded)
+	}
+
+	return readRequestMessage(body, maxMessageLength)
+}
+
+// writeGRPCWebTrailersOnly writes a response without messages, with the status in the headers.
+func writeGRPCWebTrailersOnly(w http.ResponseWriter, contentType string, st *status.Status) {
+	w.Header().Set("Content-Type", contentType)
+	setStatusHeaders(w.Header(), st)
+	w.WriteHeader(http.StatusOK)
+}
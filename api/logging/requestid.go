@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// RequestIDHeader is the HTTP header a request ID is accepted and returned on.
+	RequestIDHeader = "X-Request-ID"
+
+	// RequestIDMetadataKey is the gRPC metadata key a request ID is forwarded on.
+	RequestIDMetadataKey = "x-request-id"
+
+	// maxRequestIDLength bounds the length of a request ID accepted from a client.
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+// Middleware accepts (or generates) a request ID for each request, attaches a request scoped log entry to the
+// request context and logs the outcome of the request.
+func Middleware(logger *logrus.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = newRequestID()
+		}
+
+		fields := logrus.Fields{
+			"request_id":  requestID,
+			"http_method": r.Method,
+			"http_path":   r.URL.Path,
+		}
+
+		if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.IsValid() {
+			fields["trace_id"] = spanContext.TraceID().String()
+		}
+
+		entry := logger.WithFields(fields)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, requestID)
+		ctx = NewContext(ctx, entry)
+
+		w.Header().Set(RequestIDHeader, requestID)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		entry.WithFields(logrus.Fields{
+			"http_status": recorder.status,
+			"duration_ms": time.Since(start).Milliseconds(),
+		}).Info("finished request")
+	})
+}
+
+// RequestIDFromContext returns the request ID carried by ctx, if any.
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+
+	return requestID
+}
+
+// RequestIDMetadata is a runtime.WithMetadata annotator that forwards the request ID to gRPC backends.
+func RequestIDMetadata(ctx context.Context, _ *http.Request) metadata.MD {
+	requestID := RequestIDFromContext(ctx)
+	if requestID == "" {
+		return nil
+	}
+
+	return metadata.Pairs(RequestIDMetadataKey, requestID)
+}
+
+// statusRecorder records the status code written to a http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher so streamed responses are not buffered.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker so websocket upgrades pass through.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	r.status = http.StatusSwitchingProtocols
+
+	return h.Hijack()
+}
+
+// newRequestID generates a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
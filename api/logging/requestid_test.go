@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name            string
+		giveRequestID   string
+		expectRequestID string
+	}{
+		{
+			name:            "success",
+			giveRequestID:   "abc123",
+			expectRequestID: "abc123",
+		},
+		{
+			name: "success_generated",
+		},
+		{
+			name:          "success_too_long_replaced",
+			giveRequestID: strings.Repeat("a", maxRequestIDLength+1),
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger, hook := test.NewNullLogger()
+
+			var actualMDRequestID []string
+
+			handler := Middleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actualMDRequestID = RequestIDMetadata(r.Context(), r).Get(RequestIDMetadataKey)
+
+				w.WriteHeader(http.StatusTeapot)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/list-races", nil)
+			if tc.giveRequestID != "" {
+				req.Header.Set(RequestIDHeader, tc.giveRequestID)
+			}
+
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			actualRequestID := rec.Header().Get(RequestIDHeader)
+
+			if tc.expectRequestID != "" {
+				assert.Equal(t, tc.expectRequestID, actualRequestID, "response request ID")
+			} else {
+				assert.Len(t, actualRequestID, 32, "response request ID")
+			}
+
+			assert.Equal(t, []string{actualRequestID}, actualMDRequestID, "metadata request ID")
+
+			require.Len(t, hook.AllEntries(), 1, "log entries")
+			assert.Equal(t, actualRequestID, hook.LastEntry().Data["request_id"], "logged request_id")
+			assert.Equal(t, http.StatusTeapot, hook.LastEntry().Data["http_status"], "logged http_status")
+		})
+	}
+}
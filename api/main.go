@@ -3,44 +3,329 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"google.golang.org/grpc"
+	protobuf "google.golang.org/protobuf/proto"
 
+	"git.neds.sh/matty/entain/api/auth"
+	"git.neds.sh/matty/entain/api/compress"
+	"git.neds.sh/matty/entain/api/config"
+	"git.neds.sh/matty/entain/api/cors"
+	"git.neds.sh/matty/entain/api/gql"
+	"git.neds.sh/matty/entain/api/grpcweb"
+	"git.neds.sh/matty/entain/api/logging"
+	"git.neds.sh/matty/entain/api/metrics"
+	"git.neds.sh/matty/entain/api/openapi"
+	"git.neds.sh/matty/entain/api/precondition"
+	"git.neds.sh/matty/entain/api/problem"
+	"git.neds.sh/matty/entain/api/proto"
 	"git.neds.sh/matty/entain/api/proto/racing"
+	"git.neds.sh/matty/entain/api/ratelimit"
+	"git.neds.sh/matty/entain/api/securityheaders"
+	"git.neds.sh/matty/entain/api/tracing"
+	"git.neds.sh/matty/entain/api/upstream"
+	"git.neds.sh/matty/entain/api/watch"
+	"git.neds.sh/matty/entain/tlsconfig"
 )
 
 var (
-	apiEndpoint  = flag.String("api-endpoint", "localhost:8000", "API endpoint")
-	grpcEndpoint = flag.String("grpc-endpoint", "localhost:9000", "gRPC server endpoint")
+	apiEndpoint   = flag.String("api-endpoint", "localhost:8000", "API endpoint")
+	configFile    = flag.String("config", "", "Path to a YAML configuration file")
+	grpcEndpoint  = flag.String("grpc-endpoint", "localhost:9000", "gRPC server endpoint, when no upstreams are configured")
+	logLevel      = flag.String("log-level", "info", "Log level (trace, debug, info, warn, error)")
+	traceExporter = flag.String("trace-exporter", tracing.ExporterNone, "Trace exporter (none, stdout, otlp)")
+	otlpEndpoint  = flag.String("otlp-endpoint", "localhost:4317", "OTLP collector endpoint, used by the otlp trace exporter")
+	tlsCert       = flag.String("tls-cert", "", "PEM certificate chain to serve HTTPS with")
+	tlsKey        = flag.String("tls-key", "", "PEM private key of --tls-cert")
+	grpcTLS       = flag.Bool("grpc-tls", false, "Dial the gRPC server over TLS")
+	grpcCA        = flag.String("grpc-ca", "", "PEM CA bundle to verify the gRPC server against, instead of the system roots")
+	grpcCert      = flag.String("grpc-cert", "", "PEM client certificate chain to present to the gRPC server for mutual TLS")
+	grpcKey       = flag.String("grpc-key", "", "PEM private key of --grpc-cert")
+)
+
+const (
+	// defaultUpstreamTimeout, defaultBreakerFailureThreshold, defaultBreakerOpenTimeout and defaultMaxStaleness
+	// configure racing when no upstreams are configured.
+	defaultUpstreamTimeout         = 10 * time.Second
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerOpenTimeout      = 10 * time.Second
+	defaultMaxStaleness            = 10 * time.Minute
 )
 
 func main() {
 	flag.Parse()
 
-	if err := run(); err != nil {
-		log.Printf("failed running api server: %s\n", err)
+	logger, err := logging.New(*logLevel)
+	if err != nil {
+		logrus.Fatalf("failed creating logger: %s", err)
+	}
+
+	if err := run(logger); err != nil {
+		logger.WithError(err).Error("failed running api server")
 	}
 }
 
-func run() error {
-	ctx := context.Background()
+func run(logger *logrus.Logger) error {
+	ctx := logging.NewContext(context.Background(), logrus.NewEntry(logger))
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	mux := runtime.NewServeMux()
-	if err := racing.RegisterRacingHandlerFromEndpoint(
-		ctx,
-		mux,
-		*grpcEndpoint,
-		[]grpc.DialOption{grpc.WithInsecure()},
-	); err != nil {
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		return err
+	}
+
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		ServiceName:  "api",
+		Exporter:     *traceExporter,
+		OTLPEndpoint: *otlpEndpoint,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.WithError(err).Error("failed flushing traces")
+		}
+	}()
+
+	authenticator, err := auth.NewAuthenticator(cfg.Auth)
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.Compression.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Watch.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.GraphQL.Validate(); err != nil {
+		return err
+	}
+
+	limiter, err := ratelimit.NewLimiter(cfg.RateLimit, ratelimit.NewMemoryStore(time.Minute))
+	if err != nil {
+		return err
+	}
+
+	gatewayMux := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(auth.HeaderMatcher),
+		runtime.WithMetadata(logging.RequestIDMetadata),
+		runtime.WithMetadata(auth.IdentityMetadata),
+		runtime.WithMetadata(metrics.RouteAnnotator),
+		runtime.WithMetadata(precondition.IfMatchMetadata),
+		runtime.WithForwardResponseOption(precondition.ForwardResponse),
+		runtime.WithOutgoingHeaderMatcher(upstream.OutgoingHeaderMatcher),
+		runtime.WithErrorHandler(problem.ErrorHandler),
+	)
+	registry := upstream.NewRegistry(
+		map[string]upstream.Handler{
+			"racing": {
+				Desc: &racing.Racing_ServiceDesc,
+				Register: func(ctx context.Context, mux *runtime.ServeMux, conn grpc.ClientConnInterface) error {
+					return racing.RegisterRacingHandlerClient(ctx, mux, racing.NewRacingClient(conn))
+				},
+				RefreshStale: func(reply protobuf.Message) {
+					racing.DeriveStatuses(reply, time.Now())
+				},
+			},
+		},
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()),
+	)
+	defer registry.Close()
+
+	prometheus.MustRegister(registry)
+
+	if err := registry.Update(ctx, upstreams(cfg)); err != nil {
+		return err
+	}
+
+	if err := registry.Register(ctx, gatewayMux); err != nil {
+		return err
+	}
+
+	go reloadUpstreams(ctx, registry)
+
+	conn := registry.Conn("racing")
+
+	grpcWebProxy, err := grpcweb.NewProxy(
+		conn,
+		[]*grpc.ServiceDesc{&racing.Racing_ServiceDesc},
+		logging.RequestIDMetadata,
+		auth.IdentityMetadata,
+	)
+	if err != nil {
+		return err
+	}
+
+	watchHandler := watch.NewHandler(
+		cfg.Watch,
+		racing.NewRacingClient(conn),
+		limiter.ClientKey,
+		cfg.CORS.AllowsWebSocket,
+		logging.RequestIDMetadata,
+		auth.IdentityMetadata,
+	)
+
+	gqlHandler, err := gql.NewHandler(
+		cfg.GraphQL,
+		racing.NewRacingClient(conn),
+		cfg.CORS.AllowsWebSocket,
+		logging.RequestIDMetadata,
+		auth.IdentityMetadata,
+	)
+	if err != nil {
 		return err
 	}
 
-	log.Printf("API server listening on: %s\n", *apiEndpoint)
+	// Middleware is applied from the inside out, so requests pass through it in the reverse order.
+	middleware := func(handler http.Handler) http.Handler {
+		handler = limiter.Middleware(handler)
+		handler = authenticator.Middleware(handler)
+		handler = limiter.AddressMiddleware(handler)
+		handler = compress.Middleware(cfg.Compression, handler)
+		handler = cors.Middleware(cfg.CORS, handler)
+		handler = securityheaders.Middleware(cfg.SecurityHeaders, handler)
+		handler = metrics.Middleware(handler)
+		handler = logging.Middleware(logger, handler)
 
-	return http.ListenAndServe(*apiEndpoint, mux)
+		return otelhttp.NewHandler(
+			handler,
+			"api",
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+				return r.Method + " " + r.URL.Path
+			}),
+		)
+	}
+
+	doc, err := openapi.New(proto.OpenAPI)
+	if err != nil {
+		return err
+	}
+
+	openAPIHandler, err := openapi.Handler(doc)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle(upstream.ReadyPath, registry.ReadyHandler())
+	mux.Handle("/openapi.json", securityheaders.Middleware(cfg.SecurityHeaders, openAPIHandler))
+	mux.Handle("/docs/", securityheaders.Middleware(docsSecurityHeaders(cfg.SecurityHeaders), openapi.ExplorerHandler()))
+	mux.Handle("/docs", http.RedirectHandler("/docs/", http.StatusMovedPermanently))
+	mux.Handle("/"+racing.Racing_ServiceDesc.ServiceName+"/", middleware(grpcWebProxy))
+	mux.Handle(watch.Path, middleware(watchHandler))
+	mux.Handle(gql.Path, middleware(gqlHandler))
+	mux.Handle("/", middleware(gatewayMux))
+
+	server := &http.Server{Addr: *apiEndpoint, Handler: mux}
+
+	if *tlsCert == "" {
+		logger.Infof("API server listening on: %s", *apiEndpoint)
+
+		return server.ListenAndServe()
+	}
+
+	reloader, err := tlsconfig.NewReloader(tlsconfig.Files{CertFile: *tlsCert, KeyFile: *tlsKey})
+	if err != nil {
+		return err
+	}
+
+	go reloader.Run(ctx, tlsconfig.DefaultReloadInterval, logger)
+
+	server.TLSConfig = reloader.ServerConfig()
+
+	logger.Infof("API server listening on: %s (HTTPS)", *apiEndpoint)
+
+	return server.ListenAndServeTLS("", "")
+}
+
+// docsSecurityHeaders returns the security headers for the API explorer, which unlike the API is a page that loads
+// its own scripts and styles.
+func docsSecurityHeaders(cfg securityheaders.Config) securityheaders.Config {
+	if cfg == nil {
+		cfg = securityheaders.Default()
+	}
+
+	headers := securityheaders.Config{}
+	for k, v := range cfg {
+		headers[http.CanonicalHeaderKey(k)] = v
+	}
+
+	headers["Content-Security-Policy"] = "default-src 'self'; frame-ancestors 'none'"
+
+	return headers
+}
+
+// upstreams returns the upstream services configured by cfg. If there are none, racing is dialed at --grpc-endpoint
+// with the --grpc-* TLS flags, and the default timeout, retries, circuit breaker and stale responses.
+func upstreams(cfg *config.Config) []upstream.Service {
+	if len(cfg.Upstreams) > 0 {
+		return cfg.Upstreams
+	}
+
+	return []upstream.Service{{
+		Name:      "racing",
+		Addresses: []string{*grpcEndpoint},
+		TLS: upstream.TLS{
+			Enabled:  *grpcTLS,
+			CAFile:   *grpcCA,
+			CertFile: *grpcCert,
+			KeyFile:  *grpcKey,
+		},
+		Timeout:     defaultUpstreamTimeout,
+		HealthCheck: true,
+		Retry:       upstream.Retry{Routes: []string{"ListRaces"}},
+		CircuitBreaker: upstream.CircuitBreaker{
+			FailureThreshold: defaultBreakerFailureThreshold,
+			OpenTimeout:      defaultBreakerOpenTimeout,
+		},
+		Stale: upstream.Stale{Routes: []string{"ListRaces"}, MaxStaleness: defaultMaxStaleness},
+	}}
+}
+
+// reloadUpstreams reconfigures registry from the configuration file each time the process is sent SIGHUP, until ctx
+// is done. Only the upstreams are reloaded; other configuration requires a restart.
+func reloadUpstreams(ctx context.Context, registry *upstream.Registry) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	logger := logging.FromContext(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+
+		cfg, err := config.Load(*configFile)
+		if err != nil {
+			logger.WithError(err).Error("failed reloading configuration")
+			continue
+		}
+
+		if err := registry.Update(ctx, upstreams(cfg)); err != nil {
+			logger.WithError(err).Error("failed reloading upstreams")
+			continue
+		}
+
+		logger.Info("reloaded upstreams")
+	}
 }
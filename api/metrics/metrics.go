@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/metadata"
+)
+
+// unmatchedRoute is the route label used for requests that did not match a registered route.
+const unmatchedRoute = "unmatched"
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "api",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of HTTP requests by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "api",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests by route and status code.",
+	}, []string{"route", "method", "code"})
+)
+
+type routeKey struct{}
+
+// route is filled in by RouteAnnotator once the gateway has matched a request to an RPC.
+type route struct {
+	name string
+}
+
+// Middleware records the duration and status code of each request, labelled by the RPC it was routed to.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt := &route{name: unmatchedRoute}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), routeKey{}, rt)))
+
+		labels := prometheus.Labels{
+			"route":  rt.name,
+			"method": r.Method,
+			"code":   strconv.Itoa(recorder.status),
+		}
+
+		requestDuration.With(labels).Observe(time.Since(start).Seconds())
+		requestsTotal.With(labels).Inc()
+	})
+}
+
+// RouteAnnotator is a runtime.WithMetadata annotator that captures the RPC a request was routed to for Middleware.
+// The gateway only exposes the matched route to the handler context, so this is the earliest point it is available.
+func RouteAnnotator(ctx context.Context, _ *http.Request) metadata.MD {
+	if method, ok := runtime.RPCMethod(ctx); ok {
+		SetRoute(ctx, method)
+	}
+
+	return nil
+}
+
+// SetRoute sets the route a request is labelled with, for handlers other than the gateway. ctx must be the
+// context of a request passed through Middleware.
+func SetRoute(ctx context.Context, name string) {
+	if rt, ok := ctx.Value(routeKey{}).(*route); ok {
+		rt.name = name
+	}
+}
+
+// Handler returns the HTTP handler that serves the metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// statusRecorder records the status code written to a http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher so streamed responses are not buffered.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker so websocket upgrades pass through.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	r.status = http.StatusSwitchingProtocols
+
+	return h.Hijack()
+}
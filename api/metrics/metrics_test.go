@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		withRPC     string
+		withStatus  int
+		expectRoute string
+	}{
+		{
+			name:        "success",
+			withRPC:     "/racing.Racing/TestMiddlewareSuccess",
+			withStatus:  http.StatusOK,
+			expectRoute: "/racing.Racing/TestMiddlewareSuccess",
+		},
+		{
+			name:        "success_error_status",
+			withRPC:     "/racing.Racing/TestMiddlewareErrorStatus",
+			withStatus:  http.StatusServiceUnavailable,
+			expectRoute: "/racing.Racing/TestMiddlewareErrorStatus",
+		},
+		{
+			name:        "unmatched",
+			withStatus:  http.StatusTeapot,
+			expectRoute: unmatchedRoute,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			mux := runtime.NewServeMux(runtime.WithMetadata(RouteAnnotator))
+
+			if tc.withRPC != "" {
+				require.NoError(t, mux.HandlePath(http.MethodPost, "/v1/"+tc.name, func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+					_, err := runtime.AnnotateContext(r.Context(), mux, r, tc.withRPC)
+					require.NoError(t, err, "AnnotateContext")
+
+					w.WriteHeader(tc.withStatus)
+				}), "HandlePath")
+			}
+
+			handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.withRPC == "" {
+					w.WriteHeader(tc.withStatus)
+
+					return
+				}
+
+				mux.ServeHTTP(w, r)
+			}))
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/"+tc.name, nil))
+
+			assert.Equal(
+				t,
+				float64(1),
+				testutil.ToFloat64(requestsTotal.WithLabelValues(tc.expectRoute, http.MethodPost, strconv.Itoa(tc.withStatus))),
+				"requests_total",
+			)
+		})
+	}
+}
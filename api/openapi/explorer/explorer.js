@@ -0,0 +1,171 @@
+'use strict';
+
+// A small explorer for the OpenAPI document served at /openapi.json. It lists each operation with an example
+// request body generated from its schema, and sends requests to the API with the given credentials.
+
+async function main() {
+  const response = await fetch('/openapi.json');
+  const doc = await response.json();
+
+  document.title = doc.info.title;
+  document.getElementById('title').textContent = doc.info.title;
+
+  const main = document.getElementById('operations');
+  const byTag = new Map();
+
+  for (const [path, item] of Object.entries(doc.paths)) {
+    for (const [method, operation] of Object.entries(item)) {
+      const tag = (operation.tags || ['default'])[0];
+      if (!byTag.has(tag)) {
+        byTag.set(tag, []);
+      }
+      byTag.get(tag).push({ path, method, operation });
+    }
+  }
+
+  for (const [tag, operations] of byTag) {
+    const heading = document.createElement('h2');
+    heading.textContent = tag;
+    main.appendChild(heading);
+
+    for (const op of operations) {
+      main.appendChild(renderOperation(doc, op));
+    }
+  }
+}
+
+function renderOperation(doc, { path, method, operation }) {
+  const node = document.getElementById('operation').content.cloneNode(true);
+
+  node.querySelector('.method').textContent = method.toUpperCase();
+  node.querySelector('.path').textContent = path;
+  node.querySelector('.summary').textContent = operation.summary || '';
+  node.querySelector('.description').textContent = operation.description || '';
+
+  const schemaRef = requestSchema(operation);
+  const body = node.querySelector('.body');
+  body.value = schemaRef ? JSON.stringify(example(doc, schemaRef, new Set()), null, 2) : '';
+
+  const refs = new Set();
+  collectRefs(doc, schemaRef, refs);
+  collectRefs(doc, responseSchema(operation), refs);
+  node.querySelector('.schemas').textContent = [...refs]
+    .map((name) => `${name}: ${JSON.stringify(doc.components.schemas[name], null, 2)}`)
+    .join('\n\n');
+
+  const output = node.querySelector('.response');
+  node.querySelector('.send').addEventListener('click', () => send(method, path, body.value, output));
+
+  return node;
+}
+
+function requestSchema(operation) {
+  const content = operation.requestBody && operation.requestBody.content;
+  return content && content['application/json'] && content['application/json'].schema;
+}
+
+function responseSchema(operation) {
+  const ok = operation.responses && operation.responses['200'];
+  return ok && ok.content && ok.content['application/json'] && ok.content['application/json'].schema;
+}
+
+function resolve(doc, schema) {
+  if (schema && schema.$ref) {
+    return doc.components.schemas[schema.$ref.split('/').pop()];
+  }
+  return schema;
+}
+
+function collectRefs(doc, schema, refs) {
+  if (!schema) {
+    return;
+  }
+
+  if (schema.$ref) {
+    const name = schema.$ref.split('/').pop();
+    if (refs.has(name)) {
+      return;
+    }
+    refs.add(name);
+  }
+
+  const resolved = resolve(doc, schema);
+  for (const property of Object.values(resolved.properties || {})) {
+    collectRefs(doc, property, refs);
+  }
+  collectRefs(doc, resolved.items, refs);
+}
+
+// example returns a value matching schema, using the first enum value or a zero value for each field.
+function example(doc, schema, seen) {
+  if (schema.$ref) {
+    if (seen.has(schema.$ref)) {
+      return {};
+    }
+    seen = new Set(seen).add(schema.$ref);
+  }
+
+  const resolved = resolve(doc, schema);
+
+  if (resolved.enum) {
+    return resolved.enum[0];
+  }
+
+  switch (resolved.type) {
+    case 'object': {
+      const value = {};
+      for (const [name, property] of Object.entries(resolved.properties || {})) {
+        value[name] = example(doc, property, seen);
+      }
+      return value;
+    }
+    case 'array':
+      return resolved.items ? [example(doc, resolved.items, seen)] : [];
+    case 'boolean':
+      return false;
+    case 'integer':
+    case 'number':
+      return 0;
+    default:
+      return resolved.format === 'date-time' ? new Date().toISOString() : '';
+  }
+}
+
+async function send(method, path, body, output) {
+  const headers = { 'Content-Type': 'application/json' };
+
+  const token = document.getElementById('token').value;
+  if (token) {
+    headers.Authorization = `Bearer ${token}`;
+  }
+
+  const apiKey = document.getElementById('api-key').value;
+  if (apiKey) {
+    headers['X-API-Key'] = apiKey;
+  }
+
+  output.hidden = false;
+  output.textContent = '…';
+
+  try {
+    const response = await fetch(path, { method: method.toUpperCase(), headers, body: body || undefined });
+    const text = await response.text();
+
+    let formatted = text;
+    try {
+      formatted = JSON.stringify(JSON.parse(text), null, 2);
+    } catch (e) {
+      // Not JSON; show it as is.
+    }
+
+    output.classList.toggle('error', !response.ok);
+    output.textContent = `${response.status} ${response.statusText}\n\n${formatted}`;
+  } catch (e) {
+    output.classList.add('error');
+    output.textContent = e.toString();
+  }
+}
+
+main().catch((e) => {
+  document.getElementById('operations').textContent = `Failed loading /openapi.json: ${e}`;
+});
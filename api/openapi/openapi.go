@@ -0,0 +1,187 @@
+// Package openapi merges the OpenAPI specs generated for each service into a single OpenAPI v3 document, and
+// serves it along with an API explorer.
+package openapi
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/getkin/kin-openapi/openapi2"
+	"github.com/getkin/kin-openapi/openapi2conv"
+	"github.com/getkin/kin-openapi/openapi3"
+
+	"git.neds.sh/matty/entain/api/auth"
+	"git.neds.sh/matty/entain/api/problem"
+)
+
+// specPattern matches the OpenAPI v2 specs generated by protoc-gen-openapiv2.
+const specPattern = "*/*.swagger.json"
+
+// problemSchema is the name of the schema describing error responses.
+const problemSchema = "Problem"
+
+//go:embed explorer
+var explorer embed.FS
+
+// New converts each OpenAPI v2 spec in specs to OpenAPI v3 and merges them into a single document.
+func New(specs fs.FS) (*openapi3.T, error) {
+	names, err := fs.Glob(specs, specPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &openapi3.T{
+		OpenAPI: "3.0.3",
+		Info: &openapi3.Info{
+			Title:   "Entain API",
+			Version: "v1",
+		},
+		Components: openapi3.Components{
+			Schemas: openapi3.Schemas{
+				problemSchema: openapi3.NewSchemaRef("", newProblemSchema()),
+			},
+			SecuritySchemes: openapi3.SecuritySchemes{
+				"bearer": &openapi3.SecuritySchemeRef{Value: openapi3.NewJWTSecurityScheme()},
+				"apiKey": &openapi3.SecuritySchemeRef{Value: openapi3.NewSecurityScheme().
+					WithType("apiKey").
+					WithIn("header").
+					WithName(auth.APIKeyHeader)},
+			},
+		},
+		Paths: openapi3.Paths{},
+		Security: openapi3.SecurityRequirements{
+			{},
+			openapi3.NewSecurityRequirement().Authenticate("bearer"),
+			openapi3.NewSecurityRequirement().Authenticate("apiKey"),
+		},
+	}
+
+	for _, name := range names {
+		b, err := fs.ReadFile(specs, name)
+		if err != nil {
+			return nil, err
+		}
+
+		var v2 openapi2.T
+		if err := json.Unmarshal(b, &v2); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", name, err)
+		}
+
+		v3, err := openapi2conv.ToV3(&v2)
+		if err != nil {
+			return nil, fmt.Errorf("converting %s: %w", name, err)
+		}
+
+		if err := merge(doc, v3); err != nil {
+			return nil, fmt.Errorf("merging %s: %w", name, err)
+		}
+	}
+
+	sort.Slice(doc.Tags, func(i, j int) bool {
+		return doc.Tags[i].Name < doc.Tags[j].Name
+	})
+
+	return doc, nil
+}
+
+// merge adds the paths, schemas and tags of src to dst. Paths may only be defined by one spec; schemas shared
+// between specs, such as the well known types, must be identical.
+func merge(dst, src *openapi3.T) error {
+	for path, item := range src.Paths {
+		if _, ok := dst.Paths[path]; ok {
+			return fmt.Errorf("path %s is already defined", path)
+		}
+
+		for _, op := range item.Operations() {
+			useProblemResponse(op)
+		}
+
+		dst.Paths[path] = item
+	}
+
+	for name, schema := range src.Components.Schemas {
+		if name == "rpcStatus" {
+			// Errors are rendered as problems rather than statuses.
+			continue
+		}
+
+		if existing, ok := dst.Components.Schemas[name]; ok && !reflect.DeepEqual(existing, schema) {
+			return fmt.Errorf("schema %s is defined differently", name)
+		}
+
+		dst.Components.Schemas[name] = schema
+	}
+
+	for _, tag := range src.Tags {
+		if dst.Tags.Get(tag.Name) == nil {
+			dst.Tags = append(dst.Tags, tag)
+		}
+	}
+
+	return nil
+}
+
+// useProblemResponse replaces the default response of op with a problem.
+func useProblemResponse(op *openapi3.Operation) {
+	description := "An error, described as an RFC 7807 problem."
+
+	op.Responses["default"] = &openapi3.ResponseRef{Value: &openapi3.Response{
+		Description: &description,
+		Content: openapi3.NewContentWithSchemaRef(
+			openapi3.NewSchemaRef("#/components/schemas/"+problemSchema, nil),
+			[]string{problem.ContentType},
+		),
+	}}
+}
+
+// newProblemSchema describes problem.Problem.
+func newProblemSchema() *openapi3.Schema {
+	schema := openapi3.NewObjectSchema().
+		WithProperty("type", openapi3.NewStringSchema().WithFormat("uri")).
+		WithProperty("title", openapi3.NewStringSchema()).
+		WithProperty("status", openapi3.NewInt32Schema()).
+		WithProperty("detail", openapi3.NewStringSchema()).
+		WithProperty("instance", openapi3.NewStringSchema()).
+		WithProperty("code", openapi3.NewStringSchema()).
+		WithProperty("request_id", openapi3.NewStringSchema()).
+		WithProperty("invalid_params", openapi3.NewArraySchema().WithItems(openapi3.NewObjectSchema().
+			WithProperty("name", openapi3.NewStringSchema()).
+			WithProperty("reason", openapi3.NewStringSchema()))).
+		WithProperty("resource", openapi3.NewObjectSchema().
+			WithProperty("type", openapi3.NewStringSchema()).
+			WithProperty("name", openapi3.NewStringSchema()))
+	schema.Required = []string{"type", "title", "status", "code"}
+	schema.Description = "An RFC 7807 problem detail."
+
+	return schema
+}
+
+// Handler serves doc as JSON.
+func Handler(doc *openapi3.T) (http.Handler, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(b)
+	}), nil
+}
+
+// ExplorerHandler serves the API explorer, which browses the document served at /openapi.json. It should be
+// mounted at /docs/.
+func ExplorerHandler() http.Handler {
+	files, err := fs.Sub(explorer, "explorer")
+	if err != nil {
+		// The directory is embedded, so this can't happen.
+		panic(err)
+	}
+
+	return http.StripPrefix("/docs/", http.FileServer(http.FS(files)))
+}
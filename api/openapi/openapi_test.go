@@ -0,0 +1,157 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.neds.sh/matty/entain/api/proto"
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	doc, err := New(proto.OpenAPI)
+	require.NoError(t, err, "New")
+
+	// 64 bit integers are strings in JSON, with a format the validator doesn't know by default.
+	openapi3.DefineStringFormat("int64", `^-?[0-9]+$`)
+	openapi3.DefineStringFormat("uint64", `^[0-9]+$`)
+
+	require.NoError(t, openapi3.NewLoader().ResolveRefsIn(doc, nil), "ResolveRefsIn")
+	require.NoError(t, doc.Validate(openapi3.NewLoader().Context), "Validate")
+
+	op := doc.Paths.Find("/v1/list-races").Post
+	require.NotNil(t, op, "POST /v1/list-races")
+
+	assert.Equal(t, "Racing_ListRaces", op.OperationID, "operation id")
+	assert.NotNil(t, op.RequestBody.Value.Content.Get("application/json"), "request body")
+	assert.NotNil(t, op.Responses.Default().Value.Content.Get("application/problem+json"), "default response")
+	assert.NotContains(t, doc.Components.Schemas, "rpcStatus", "schemas")
+	assert.NotNil(t, doc.Tags.Get("Racing"), "tag")
+}
+
+func TestNewMerge(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name          string
+		give          fstest.MapFS
+		expectPaths   []string
+		expectErrored bool
+	}{
+		{
+			name: "success",
+			give: fstest.MapFS{
+				"racing/racing.swagger.json": {Data: spec("/v1/list-races", "Racing", "common", "string")},
+				"sports/sports.swagger.json": {Data: spec("/v1/list-events", "Sports", "common", "string")},
+			},
+			expectPaths: []string{"/v1/list-events", "/v1/list-races"},
+		},
+		{
+			name: "duplicate_path",
+			give: fstest.MapFS{
+				"racing/racing.swagger.json": {Data: spec("/v1/list-races", "Racing", "common", "string")},
+				"sports/sports.swagger.json": {Data: spec("/v1/list-races", "Sports", "common", "string")},
+			},
+			expectErrored: true,
+		},
+		{
+			name: "conflicting_schema",
+			give: fstest.MapFS{
+				"racing/racing.swagger.json": {Data: spec("/v1/list-races", "Racing", "common", "string")},
+				"sports/sports.swagger.json": {Data: spec("/v1/list-events", "Sports", "common", "integer")},
+			},
+			expectErrored: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual, actualErr := New(tc.give)
+
+			if tc.expectErrored {
+				assert.Error(t, actualErr, "actualErr")
+				return
+			}
+
+			require.NoError(t, actualErr, "actualErr")
+
+			var paths []string
+			for path := range actual.Paths {
+				paths = append(paths, path)
+			}
+
+			assert.ElementsMatch(t, tc.expectPaths, paths, "paths")
+			assert.Len(t, actual.Tags, 2, "tags")
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	doc, err := New(proto.OpenAPI)
+	require.NoError(t, err, "New")
+
+	handler, err := Handler(doc)
+	require.NoError(t, err, "Handler")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code, "status")
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"), "Content-Type")
+
+	var actual map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &actual), "json.Unmarshal")
+
+	assert.Equal(t, "3.0.3", actual["openapi"], "openapi")
+}
+
+func TestExplorerHandler(t *testing.T) {
+	t.Parallel()
+
+	for _, path := range []string{"/docs/", "/docs/explorer.js", "/docs/explorer.css"} {
+		rec := httptest.NewRecorder()
+		ExplorerHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+	}
+}
+
+// spec returns an OpenAPI v2 spec with a single POST operation at path, tagged with tag and returning the schema
+// named schema of the given type.
+func spec(path, tag, schema, schemaType string) []byte {
+	return []byte(`{
+  "swagger": "2.0",
+  "info": {"title": "` + tag + `", "version": "version not set"},
+  "tags": [{"name": "` + tag + `"}],
+  "consumes": ["application/json"],
+  "produces": ["application/json"],
+  "paths": {
+    "` + path + `": {
+      "post": {
+        "operationId": "` + tag + `_Post",
+        "responses": {
+          "200": {"description": "A successful response.", "schema": {"$ref": "#/definitions/` + schema + `"}},
+          "default": {"description": "An unexpected error response.", "schema": {"$ref": "#/definitions/rpcStatus"}}
+        },
+        "tags": ["` + tag + `"]
+      }
+    }
+  },
+  "definitions": {
+    "` + schema + `": {"type": "` + schemaType + `"},
+    "rpcStatus": {"type": "object"}
+  }
+}`)
+}
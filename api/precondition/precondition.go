@@ -0,0 +1,53 @@
+// Package precondition maps HTTP conditional requests onto the etags of races, so that a client only updates or
+// deletes a race if it hasn't changed since the client read it.
+//
+// Clients send the etag of the race they read in an If-Match header, which is forwarded to the racing service, and
+// are sent the etag of the race they wrote in an ETag header. A write made with a stale etag fails with 412
+// Precondition Failed, rendered by the problem package.
+package precondition
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+)
+
+const (
+	// IfMatchHeader is the header a client sends the etag it read in.
+	IfMatchHeader = "If-Match"
+	// ETagHeader is the header the etag of a race written is sent in.
+	ETagHeader = "ETag"
+	// IfMatchMetadataKey is the metadata key racing reads the etag of a write from, when the request has none.
+	IfMatchMetadataKey = "if-match"
+)
+
+// IfMatchMetadata is a runtime.WithMetadata annotator that forwards the If-Match header to gRPC backends.
+func IfMatchMetadata(_ context.Context, r *http.Request) metadata.MD {
+	etag := r.Header.Get(IfMatchHeader)
+	if etag == "" {
+		return nil
+	}
+
+	return metadata.Pairs(IfMatchMetadataKey, etag)
+}
+
+// raceResponse is a response carrying the race that was written.
+type raceResponse interface {
+	GetRace() *racing.Race
+}
+
+// ForwardResponse is a runtime.WithForwardResponseOption option that sets the ETag header of responses carrying a
+// race to the etag of the race.
+func ForwardResponse(_ context.Context, w http.ResponseWriter, msg proto.Message) error {
+	if response, ok := msg.(raceResponse); ok {
+		if etag := response.GetRace().GetEtag(); etag != "" {
+			w.Header().Set(ETagHeader, etag)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package precondition
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+)
+
+func TestIfMatchMetadata(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		give   string
+		expect []string
+	}{
+		{
+			name:   "success",
+			give:   `"3"`,
+			expect: []string{`"3"`},
+		},
+		{
+			name: "success_unset",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodPut, "/v1/races/1", nil)
+			if tc.give != "" {
+				r.Header.Set(IfMatchHeader, tc.give)
+			}
+
+			assert.Equal(t, tc.expect, IfMatchMetadata(context.Background(), r).Get(IfMatchMetadataKey), "if-match")
+		})
+	}
+}
+
+func TestForwardResponse(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		give   proto.Message
+		expect string
+	}{
+		{
+			name:   "success",
+			give:   &racing.UpdateRaceResponse{Race: &racing.Race{Id: 1, Etag: `"4"`}},
+			expect: `"4"`,
+		},
+		{
+			name:   "success_undelete",
+			give:   &racing.UndeleteRaceResponse{Race: &racing.Race{Id: 1, Etag: `"6"`}},
+			expect: `"6"`,
+		},
+		{
+			name: "success_no_race",
+			give: &racing.DeleteRaceResponse{},
+		},
+		{
+			name: "success_races",
+			give: &racing.ListRacesResponse{Races: []*racing.Race{{Id: 1, Etag: `"4"`}}},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rec := httptest.NewRecorder()
+
+			require.NoError(t, ForwardResponse(context.Background(), rec, tc.give), "ForwardResponse")
+			assert.Equal(t, tc.expect, rec.Header().Get(ETagHeader), "ETag")
+		})
+	}
+}
@@ -0,0 +1,173 @@
+// Package problem renders gRPC errors as RFC 7807 problem details (application/problem+json).
+package problem
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"git.neds.sh/matty/entain/api/logging"
+)
+
+const (
+	// ContentType is the media type problem details are rendered as.
+	ContentType = "application/problem+json"
+
+	// typeURIPrefix prefixes the type URI of every problem. Type URIs are stable identifiers clients may match on.
+	typeURIPrefix = "urn:entain:problem:"
+
+	// internalDetail replaces the detail of server errors, so that internal details are not leaked.
+	internalDetail = "An internal error occurred."
+
+	// unavailableDetail replaces the detail of unavailable errors, so that internal details are not leaked.
+	unavailableDetail = "The service is temporarily unavailable, please retry later."
+
+	// etagPrecondition is the type of the precondition failures of writes made with a stale etag, which are
+	// rendered as 412 Precondition Failed rather than 409 Conflict, as is usual for Aborted errors.
+	etagPrecondition = "ETAG"
+)
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	// Type identifies the problem type, e.g. "urn:entain:problem:invalid-argument".
+	Type string `json:"type"`
+	// Title is a short summary of the problem type.
+	Title string `json:"title"`
+	// Status is the HTTP status code.
+	Status int `json:"status"`
+	// Detail explains this occurrence of the problem.
+	Detail string `json:"detail,omitempty"`
+	// Instance identifies this occurrence of the problem.
+	Instance string `json:"instance,omitempty"`
+	// Code is the gRPC status code name, e.g. "InvalidArgument".
+	Code string `json:"code"`
+	// RequestID is the ID of the request that caused the problem.
+	RequestID string `json:"request_id,omitempty"`
+	// InvalidParams lists the invalid fields of a request, if any.
+	InvalidParams []InvalidParam `json:"invalid_params,omitempty"`
+	// Resource is the resource the problem relates to, if any.
+	Resource *Resource `json:"resource,omitempty"`
+}
+
+// InvalidParam describes an invalid field of a request.
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// Resource describes the resource a problem relates to.
+type Resource struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// TypeURI returns the stable type URI of problems caused by code.
+func TypeURI(code codes.Code) string {
+	return typeURIPrefix + kebabCase(code.String())
+}
+
+// New converts err into a Problem. The second return value is the Retry-After duration in seconds requested by the
+// error, or zero.
+func New(ctx context.Context, r *http.Request, err error) (*Problem, int) {
+	s := status.Convert(err)
+	httpStatus := runtime.HTTPStatusFromCode(s.Code())
+
+	p := &Problem{
+		Type:      TypeURI(s.Code()),
+		Title:     http.StatusText(httpStatus),
+		Status:    httpStatus,
+		Detail:    Detail(s),
+		Instance:  r.URL.Path,
+		Code:      s.Code().String(),
+		RequestID: logging.RequestIDFromContext(ctx),
+	}
+
+	var retryAfter int
+
+	for _, detail := range s.Details() {
+		switch d := detail.(type) {
+		case *errdetails.BadRequest:
+			for _, v := range d.GetFieldViolations() {
+				p.InvalidParams = append(p.InvalidParams, InvalidParam{Name: v.GetField(), Reason: v.GetDescription()})
+			}
+		case *errdetails.ResourceInfo:
+			p.Resource = &Resource{Type: d.GetResourceType(), Name: d.GetResourceName()}
+		case *errdetails.RetryInfo:
+			retryAfter = int(math.Ceil(d.GetRetryDelay().AsDuration().Seconds()))
+		case *errdetails.PreconditionFailure:
+			for _, v := range d.GetViolations() {
+				if s.Code() == codes.Aborted && v.GetType() == etagPrecondition {
+					p.Status = http.StatusPreconditionFailed
+					p.Title = http.StatusText(p.Status)
+				}
+			}
+		}
+	}
+
+	return p, retryAfter
+}
+
+// Detail returns the message of s if it may be shown to clients, or a generic message for server errors, so that
+// internal details are not leaked.
+func Detail(s *status.Status) string {
+	switch {
+	case s.Code() == codes.Unavailable:
+		return unavailableDetail
+	case runtime.HTTPStatusFromCode(s.Code()) >= http.StatusInternalServerError:
+		return internalDetail
+	default:
+		return s.Message()
+	}
+}
+
+// ErrorHandler is a runtime.ErrorHandlerFunc that renders errors as problem details.
+func ErrorHandler(ctx context.Context, _ *runtime.ServeMux, _ runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	p, retryAfter := New(ctx, r, err)
+
+	Write(ctx, w, p, retryAfter)
+}
+
+// Write renders p to w. If retryAfter is positive, it is set as the Retry-After header.
+func Write(ctx context.Context, w http.ResponseWriter, p *Problem, retryAfter int) {
+	w.Header().Del("Trailer")
+	w.Header().Del("Transfer-Encoding")
+	w.Header().Set("Content-Type", ContentType)
+
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+
+	w.WriteHeader(p.Status)
+
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("failed writing problem")
+	}
+}
+
+// kebabCase converts "InvalidArgument" to "invalid-argument".
+func kebabCase(s string) string {
+	var b strings.Builder
+
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('-')
+			}
+
+			r = unicode.ToLower(r)
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
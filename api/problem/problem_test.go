@@ -0,0 +1,148 @@
+package problem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestErrorHandler(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name             string
+		give             error
+		expect           Problem
+		expectRetryAfter string
+	}{
+		{
+			name: "invalid_argument",
+			give: withDetails(t, status.New(codes.InvalidArgument, "invalid argument"), &errdetails.BadRequest{
+				FieldViolations: []*errdetails.BadRequest_FieldViolation{
+					{Field: "filter.meeting_ids[0]", Description: "must be greater than 0"},
+				},
+			}),
+			expect: Problem{
+				Type:     "urn:entain:problem:invalid-argument",
+				Title:    "Bad Request",
+				Status:   http.StatusBadRequest,
+				Detail:   "invalid argument",
+				Instance: "/v1/list-races",
+				Code:     "InvalidArgument",
+				InvalidParams: []InvalidParam{
+					{Name: "filter.meeting_ids[0]", Reason: "must be greater than 0"},
+				},
+			},
+		},
+		{
+			name: "not_found",
+			give: withDetails(t, status.New(codes.NotFound, "not found"), &errdetails.ResourceInfo{
+				ResourceType: "racing.Race",
+				ResourceName: "races/1",
+			}),
+			expect: Problem{
+				Type:     "urn:entain:problem:not-found",
+				Title:    "Not Found",
+				Status:   http.StatusNotFound,
+				Detail:   "not found",
+				Instance: "/v1/list-races",
+				Code:     "NotFound",
+				Resource: &Resource{Type: "racing.Race", Name: "races/1"},
+			},
+		},
+		{
+			name: "aborted_etag",
+			give: withDetails(t, status.New(codes.Aborted, "changed"),
+				&errdetails.ResourceInfo{ResourceType: "racing.Race", ResourceName: "races/1"},
+				&errdetails.PreconditionFailure{Violations: []*errdetails.PreconditionFailure_Violation{
+					{Type: "ETAG", Subject: "races/1", Description: "the etag does not match the current version"},
+				}},
+			),
+			expect: Problem{
+				Type:     "urn:entain:problem:aborted",
+				Title:    "Precondition Failed",
+				Status:   http.StatusPreconditionFailed,
+				Detail:   "changed",
+				Instance: "/v1/list-races",
+				Code:     "Aborted",
+				Resource: &Resource{Type: "racing.Race", Name: "races/1"},
+			},
+		},
+		{
+			name: "aborted",
+			give: status.Error(codes.Aborted, "aborted"),
+			expect: Problem{
+				Type:     "urn:entain:problem:aborted",
+				Title:    "Conflict",
+				Status:   http.StatusConflict,
+				Detail:   "aborted",
+				Instance: "/v1/list-races",
+				Code:     "Aborted",
+			},
+		},
+		{
+			name: "unavailable",
+			give: withDetails(t, status.New(codes.Unavailable, "unavailable"), &errdetails.RetryInfo{
+				RetryDelay: durationpb.New(1500 * time.Millisecond),
+			}),
+			expect: Problem{
+				Type:     "urn:entain:problem:unavailable",
+				Title:    "Service Unavailable",
+				Status:   http.StatusServiceUnavailable,
+				Detail:   unavailableDetail,
+				Instance: "/v1/list-races",
+				Code:     "Unavailable",
+			},
+			expectRetryAfter: "2",
+		},
+		{
+			name: "unknown_detail_hidden",
+			give: errors.New("near \"SELECT\": syntax error"),
+			expect: Problem{
+				Type:     "urn:entain:problem:unknown",
+				Title:    "Internal Server Error",
+				Status:   http.StatusInternalServerError,
+				Detail:   internalDetail,
+				Instance: "/v1/list-races",
+				Code:     "Unknown",
+			},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rec := httptest.NewRecorder()
+
+			ErrorHandler(context.Background(), nil, nil, rec, httptest.NewRequest(http.MethodPost, "/v1/list-races", nil), tc.give)
+
+			var actual Problem
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &actual), "unmarshal body")
+
+			assert.Equal(t, tc.expect, actual, "problem")
+			assert.Equal(t, tc.expect.Status, rec.Code, "status")
+			assert.Equal(t, ContentType, rec.Header().Get("Content-Type"), "Content-Type")
+			assert.Equal(t, tc.expectRetryAfter, rec.Header().Get("Retry-After"), "Retry-After")
+		})
+	}
+}
+
+func withDetails(t *testing.T, s *status.Status, details ...proto.Message) error {
+	s, err := s.WithDetails(details...)
+	require.NoError(t, err, "WithDetails")
+
+	return s.Err()
+}
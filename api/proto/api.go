@@ -1,3 +1,10 @@
 package proto
 
-//go:generate protoc -I . --go_out . --go_opt paths=source_relative --go-grpc_out . --go-grpc_opt paths=source_relative --grpc-gateway_out . --grpc-gateway_opt paths=source_relative racing/racing.proto
+import "embed"
+
+//go:generate protoc -I . --go_out . --go_opt paths=source_relative --go-grpc_out . --go-grpc_opt paths=source_relative --grpc-gateway_out . --grpc-gateway_opt paths=source_relative --openapiv2_out . --openapiv2_opt logtostderr=true racing/racing.proto
+
+// OpenAPI holds the OpenAPI v2 spec generated for each service, at <service>/<service>.swagger.json.
+//
+//go:embed */*.swagger.json
+var OpenAPI embed.FS
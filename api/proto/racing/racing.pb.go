@@ -1,16 +1,16 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // versions:
-// 	protoc-gen-go v1.26.0-devel
+// 	protoc-gen-go v1.27.1
 // 	protoc        v3.13.0
 // source: racing/racing.proto
 
 package racing
 
 import (
-	timestamp "github.com/golang/protobuf/ptypes/timestamp"
 	_ "google.golang.org/genproto/googleapis/api/annotations"
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	reflect "reflect"
 	sync "sync"
 )
@@ -22,6 +22,232 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type ImportRaceResult_Outcome int32
+
+const (
+	ImportRaceResult_OUTCOME_UNSPECIFIED ImportRaceResult_Outcome = 0
+	// CREATED is a race that was, or in a dry run would be, created.
+	ImportRaceResult_CREATED ImportRaceResult_Outcome = 1
+	// UPDATED is a race that was, or in a dry run would be, updated.
+	ImportRaceResult_UPDATED ImportRaceResult_Outcome = 2
+	// INVALID is a race that failed validation, described by errors.
+	ImportRaceResult_INVALID ImportRaceResult_Outcome = 3
+)
+
+// Enum value maps for ImportRaceResult_Outcome.
+var (
+	ImportRaceResult_Outcome_name = map[int32]string{
+		0: "OUTCOME_UNSPECIFIED",
+		1: "CREATED",
+		2: "UPDATED",
+		3: "INVALID",
+	}
+	ImportRaceResult_Outcome_value = map[string]int32{
+		"OUTCOME_UNSPECIFIED": 0,
+		"CREATED":             1,
+		"UPDATED":             2,
+		"INVALID":             3,
+	}
+)
+
+func (x ImportRaceResult_Outcome) Enum() *ImportRaceResult_Outcome {
+	p := new(ImportRaceResult_Outcome)
+	*p = x
+	return p
+}
+
+func (x ImportRaceResult_Outcome) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ImportRaceResult_Outcome) Descriptor() protoreflect.EnumDescriptor {
+	return file_racing_racing_proto_enumTypes[0].Descriptor()
+}
+
+func (ImportRaceResult_Outcome) Type() protoreflect.EnumType {
+	return &file_racing_racing_proto_enumTypes[0]
+}
+
+func (x ImportRaceResult_Outcome) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ImportRaceResult_Outcome.Descriptor instead.
+func (ImportRaceResult_Outcome) EnumDescriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{7, 0}
+}
+
+type Race_Status int32
+
+const (
+	Race_STATUS_UNSPECIFIED Race_Status = 0
+	// OPEN is a race whose advertised start time hasn't passed.
+	Race_OPEN Race_Status = 1
+	// CLOSED is a race whose advertised start time has passed.
+	Race_CLOSED Race_Status = 2
+)
+
+// Enum value maps for Race_Status.
+var (
+	Race_Status_name = map[int32]string{
+		0: "STATUS_UNSPECIFIED",
+		1: "OPEN",
+		2: "CLOSED",
+	}
+	Race_Status_value = map[string]int32{
+		"STATUS_UNSPECIFIED": 0,
+		"OPEN":               1,
+		"CLOSED":             2,
+	}
+)
+
+func (x Race_Status) Enum() *Race_Status {
+	p := new(Race_Status)
+	*p = x
+	return p
+}
+
+func (x Race_Status) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Race_Status) Descriptor() protoreflect.EnumDescriptor {
+	return file_racing_racing_proto_enumTypes[1].Descriptor()
+}
+
+func (Race_Status) Type() protoreflect.EnumType {
+	return &file_racing_racing_proto_enumTypes[1]
+}
+
+func (x Race_Status) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Race_Status.Descriptor instead.
+func (Race_Status) EnumDescriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{19, 0}
+}
+
+type RaceEvent_Type int32
+
+const (
+	RaceEvent_TYPE_UNSPECIFIED RaceEvent_Type = 0
+	// SNAPSHOT is a race as it was when the watch started. A watch that could not be resumed starts over with
+	// snapshots, replacing everything received before.
+	RaceEvent_SNAPSHOT RaceEvent_Type = 1
+	// CREATED is a race that was created.
+	RaceEvent_CREATED RaceEvent_Type = 2
+	// UPDATED is a race that was changed.
+	RaceEvent_UPDATED RaceEvent_Type = 3
+	// DELETED is a race that was deleted.
+	RaceEvent_DELETED RaceEvent_Type = 4
+)
+
+// Enum value maps for RaceEvent_Type.
+var (
+	RaceEvent_Type_name = map[int32]string{
+		0: "TYPE_UNSPECIFIED",
+		1: "SNAPSHOT",
+		2: "CREATED",
+		3: "UPDATED",
+		4: "DELETED",
+	}
+	RaceEvent_Type_value = map[string]int32{
+		"TYPE_UNSPECIFIED": 0,
+		"SNAPSHOT":         1,
+		"CREATED":          2,
+		"UPDATED":          3,
+		"DELETED":          4,
+	}
+)
+
+func (x RaceEvent_Type) Enum() *RaceEvent_Type {
+	p := new(RaceEvent_Type)
+	*p = x
+	return p
+}
+
+func (x RaceEvent_Type) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (RaceEvent_Type) Descriptor() protoreflect.EnumDescriptor {
+	return file_racing_racing_proto_enumTypes[2].Descriptor()
+}
+
+func (RaceEvent_Type) Type() protoreflect.EnumType {
+	return &file_racing_racing_proto_enumTypes[2]
+}
+
+func (x RaceEvent_Type) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use RaceEvent_Type.Descriptor instead.
+func (RaceEvent_Type) EnumDescriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{20, 0}
+}
+
+type AuditEvent_Action int32
+
+const (
+	AuditEvent_ACTION_UNSPECIFIED AuditEvent_Action = 0
+	AuditEvent_CREATED            AuditEvent_Action = 1
+	AuditEvent_UPDATED            AuditEvent_Action = 2
+	AuditEvent_DELETED            AuditEvent_Action = 3
+	// UNDELETED is a deleted resource that was restored.
+	AuditEvent_UNDELETED AuditEvent_Action = 4
+	// PURGED is a deleted resource that was removed for good once its retention period passed.
+	AuditEvent_PURGED AuditEvent_Action = 5
+)
+
+// Enum value maps for AuditEvent_Action.
+var (
+	AuditEvent_Action_name = map[int32]string{
+		0: "ACTION_UNSPECIFIED",
+		1: "CREATED",
+		2: "UPDATED",
+		3: "DELETED",
+		4: "UNDELETED",
+		5: "PURGED",
+	}
+	AuditEvent_Action_value = map[string]int32{
+		"ACTION_UNSPECIFIED": 0,
+		"CREATED":            1,
+		"UPDATED":            2,
+		"DELETED":            3,
+		"UNDELETED":          4,
+		"PURGED":             5,
+	}
+)
+
+func (x AuditEvent_Action) Enum() *AuditEvent_Action {
+	p := new(AuditEvent_Action)
+	*p = x
+	return p
+}
+
+func (x AuditEvent_Action) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (AuditEvent_Action) Descriptor() protoreflect.EnumDescriptor {
+	return file_racing_racing_proto_enumTypes[3].Descriptor()
+}
+
+func (AuditEvent_Action) Type() protoreflect.EnumType {
+	return &file_racing_racing_proto_enumTypes[3]
+}
+
+func (x AuditEvent_Action) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use AuditEvent_Action.Descriptor instead.
+func (AuditEvent_Action) EnumDescriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{21, 0}
+}
+
 // Request for ListRaces call.
 type ListRacesRequest struct {
 	state         protoimpl.MessageState
@@ -29,6 +255,10 @@ type ListRacesRequest struct {
 	unknownFields protoimpl.UnknownFields
 
 	Filter *ListRacesRequestFilter `protobuf:"bytes,1,opt,name=filter,proto3" json:"filter,omitempty"`
+	// OrderBy is the field races are ordered by, ascending unless it is followed by " desc", such as
+	// "advertised_start_time desc". It is one of id, meeting_id, name, number and advertised_start_time, and races that
+	// tie are ordered by ID. Races are ordered by ID if it is unset.
+	OrderBy string `protobuf:"bytes,2,opt,name=order_by,json=orderBy,proto3" json:"order_by,omitempty"`
 }
 
 func (x *ListRacesRequest) Reset() {
@@ -70,6 +300,13 @@ func (x *ListRacesRequest) GetFilter() *ListRacesRequestFilter {
 	return nil
 }
 
+func (x *ListRacesRequest) GetOrderBy() string {
+	if x != nil {
+		return x.OrderBy
+	}
+	return ""
+}
+
 // Response to ListRaces call.
 type ListRacesResponse struct {
 	state         protoimpl.MessageState
@@ -125,6 +362,8 @@ type ListRacesRequestFilter struct {
 	unknownFields protoimpl.UnknownFields
 
 	MeetingIds []int64 `protobuf:"varint,1,rep,packed,name=meeting_ids,json=meetingIds,proto3" json:"meeting_ids,omitempty"`
+	// ShowDeleted includes deleted races that haven't been purged yet.
+	ShowDeleted bool `protobuf:"varint,2,opt,name=show_deleted,json=showDeleted,proto3" json:"show_deleted,omitempty"`
 }
 
 func (x *ListRacesRequestFilter) Reset() {
@@ -166,28 +405,27 @@ func (x *ListRacesRequestFilter) GetMeetingIds() []int64 {
 	return nil
 }
 
-// A race resource.
-type Race struct {
+func (x *ListRacesRequestFilter) GetShowDeleted() bool {
+	if x != nil {
+		return x.ShowDeleted
+	}
+	return false
+}
+
+// Request for WatchRaces call.
+type WatchRacesRequest struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	// ID represents a unique identifier for the race.
-	Id int64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
-	// MeetingID represents a unique identifier for the races meeting.
-	MeetingId int64 `protobuf:"varint,2,opt,name=meeting_id,json=meetingId,proto3" json:"meeting_id,omitempty"`
-	// Name is the official name given to the race.
-	Name string `protobuf:"bytes,3,opt,name=name,proto3" json:"name,omitempty"`
-	// Number represents the number of the race.
-	Number int64 `protobuf:"varint,4,opt,name=number,proto3" json:"number,omitempty"`
-	// Visible represents whether or not the race is visible.
-	Visible bool `protobuf:"varint,5,opt,name=visible,proto3" json:"visible,omitempty"`
-	// AdvertisedStartTime is the time the race is advertised to run.
-	AdvertisedStartTime *timestamp.Timestamp `protobuf:"bytes,6,opt,name=advertised_start_time,json=advertisedStartTime,proto3" json:"advertised_start_time,omitempty"`
+	Filter *ListRacesRequestFilter `protobuf:"bytes,1,opt,name=filter,proto3" json:"filter,omitempty"`
+	// ResumeAfter is the sequence of the last event received by a previous watch. When set, the changes since that
+	// event are sent instead of the current races, if they are still available.
+	ResumeAfter uint64 `protobuf:"varint,2,opt,name=resume_after,json=resumeAfter,proto3" json:"resume_after,omitempty"`
 }
 
-func (x *Race) Reset() {
-	*x = Race{}
+func (x *WatchRacesRequest) Reset() {
+	*x = WatchRacesRequest{}
 	if protoimpl.UnsafeEnabled {
 		mi := &file_racing_racing_proto_msgTypes[3]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -195,13 +433,13 @@ func (x *Race) Reset() {
 	}
 }
 
-func (x *Race) String() string {
+func (x *WatchRacesRequest) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*Race) ProtoMessage() {}
+func (*WatchRacesRequest) ProtoMessage() {}
 
-func (x *Race) ProtoReflect() protoreflect.Message {
+func (x *WatchRacesRequest) ProtoReflect() protoreflect.Message {
 	mi := &file_racing_racing_proto_msgTypes[3]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -213,142 +451,1646 @@ func (x *Race) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use Race.ProtoReflect.Descriptor instead.
-func (*Race) Descriptor() ([]byte, []int) {
+// Deprecated: Use WatchRacesRequest.ProtoReflect.Descriptor instead.
+func (*WatchRacesRequest) Descriptor() ([]byte, []int) {
 	return file_racing_racing_proto_rawDescGZIP(), []int{3}
 }
 
-func (x *Race) GetId() int64 {
+func (x *WatchRacesRequest) GetFilter() *ListRacesRequestFilter {
 	if x != nil {
-		return x.Id
+		return x.Filter
 	}
-	return 0
+	return nil
 }
 
-func (x *Race) GetMeetingId() int64 {
+func (x *WatchRacesRequest) GetResumeAfter() uint64 {
 	if x != nil {
-		return x.MeetingId
+		return x.ResumeAfter
 	}
 	return 0
 }
 
-func (x *Race) GetName() string {
+// Response to WatchRaces call, one per event.
+type WatchRacesResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Event *RaceEvent `protobuf:"bytes,1,opt,name=event,proto3" json:"event,omitempty"`
+}
+
+func (x *WatchRacesResponse) Reset() {
+	*x = WatchRacesResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *WatchRacesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchRacesResponse) ProtoMessage() {}
+
+func (x *WatchRacesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchRacesResponse.ProtoReflect.Descriptor instead.
+func (*WatchRacesResponse) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *WatchRacesResponse) GetEvent() *RaceEvent {
 	if x != nil {
-		return x.Name
+		return x.Event
 	}
-	return ""
+	return nil
 }
 
-func (x *Race) GetNumber() int64 {
+// Request for ImportRaces call, one per race.
+type ImportRacesRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Race is created, or updated if a race with the same external ID exists. Its ID is ignored.
+	Race *Race `protobuf:"bytes,1,opt,name=race,proto3" json:"race,omitempty"`
+	// DryRun reports what the import would do without changing anything. It is read from the first request.
+	DryRun bool `protobuf:"varint,2,opt,name=dry_run,json=dryRun,proto3" json:"dry_run,omitempty"`
+}
+
+func (x *ImportRacesRequest) Reset() {
+	*x = ImportRacesRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ImportRacesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ImportRacesRequest) ProtoMessage() {}
+
+func (x *ImportRacesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ImportRacesRequest.ProtoReflect.Descriptor instead.
+func (*ImportRacesRequest) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ImportRacesRequest) GetRace() *Race {
 	if x != nil {
-		return x.Number
+		return x.Race
 	}
-	return 0
+	return nil
 }
 
-func (x *Race) GetVisible() bool {
+func (x *ImportRacesRequest) GetDryRun() bool {
 	if x != nil {
-		return x.Visible
+		return x.DryRun
 	}
 	return false
 }
 
-func (x *Race) GetAdvertisedStartTime() *timestamp.Timestamp {
-	if x != nil {
-		return x.AdvertisedStartTime
+// Response to ImportRaces call.
+type ImportRacesResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Committed reports whether the races were stored. They are not if it is a dry run, or if any race is invalid.
+	Committed bool  `protobuf:"varint,1,opt,name=committed,proto3" json:"committed,omitempty"`
+	Created   int32 `protobuf:"varint,2,opt,name=created,proto3" json:"created,omitempty"`
+	Updated   int32 `protobuf:"varint,3,opt,name=updated,proto3" json:"updated,omitempty"`
+	Invalid   int32 `protobuf:"varint,4,opt,name=invalid,proto3" json:"invalid,omitempty"`
+	// Rows report on each race, in the order they were sent.
+	Rows []*ImportRaceResult `protobuf:"bytes,5,rep,name=rows,proto3" json:"rows,omitempty"`
+}
+
+func (x *ImportRacesResponse) Reset() {
+	*x = ImportRacesResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
 	}
-	return nil
 }
 
-var File_racing_racing_proto protoreflect.FileDescriptor
+func (x *ImportRacesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
 
-var file_racing_racing_proto_rawDesc = []byte{
-	0x0a, 0x13, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2f, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e,
-	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x06, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x1a, 0x1f, 0x67,
-	0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x74,
-	0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x1c,
-	0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x61, 0x6e, 0x6e, 0x6f, 0x74,
-	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x4a, 0x0a, 0x10,
-	0x4c, 0x69, 0x73, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
-	0x12, 0x36, 0x0a, 0x06, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b,
-	0x32, 0x1e, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x61,
-	0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x46, 0x69, 0x6c, 0x74, 0x65, 0x72,
-	0x52, 0x06, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x22, 0x37, 0x0a, 0x11, 0x4c, 0x69, 0x73, 0x74,
-	0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x22, 0x0a,
-	0x05, 0x72, 0x61, 0x63, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x72,
-	0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x52, 0x61, 0x63, 0x65, 0x52, 0x05, 0x72, 0x61, 0x63, 0x65,
-	0x73, 0x22, 0x39, 0x0a, 0x16, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65,
-	0x71, 0x75, 0x65, 0x73, 0x74, 0x46, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x12, 0x1f, 0x0a, 0x0b, 0x6d,
-	0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x5f, 0x69, 0x64, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x03,
-	0x52, 0x0a, 0x6d, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x49, 0x64, 0x73, 0x22, 0xcb, 0x01, 0x0a,
-	0x04, 0x52, 0x61, 0x63, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
-	0x03, 0x52, 0x02, 0x69, 0x64, 0x12, 0x1d, 0x0a, 0x0a, 0x6d, 0x65, 0x65, 0x74, 0x69, 0x6e, 0x67,
-	0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x6d, 0x65, 0x65, 0x74, 0x69,
-	0x6e, 0x67, 0x49, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01,
-	0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x6e, 0x75, 0x6d, 0x62,
-	0x65, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72,
-	0x12, 0x18, 0x0a, 0x07, 0x76, 0x69, 0x73, 0x69, 0x62, 0x6c, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28,
-	0x08, 0x52, 0x07, 0x76, 0x69, 0x73, 0x69, 0x62, 0x6c, 0x65, 0x12, 0x4e, 0x0a, 0x15, 0x61, 0x64,
-	0x76, 0x65, 0x72, 0x74, 0x69, 0x73, 0x65, 0x64, 0x5f, 0x73, 0x74, 0x61, 0x72, 0x74, 0x5f, 0x74,
-	0x69, 0x6d, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67,
-	0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65,
-	0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x13, 0x61, 0x64, 0x76, 0x65, 0x72, 0x74, 0x69, 0x73, 0x65,
-	0x64, 0x53, 0x74, 0x61, 0x72, 0x74, 0x54, 0x69, 0x6d, 0x65, 0x32, 0x65, 0x0a, 0x06, 0x52, 0x61,
-	0x63, 0x69, 0x6e, 0x67, 0x12, 0x5b, 0x0a, 0x09, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x61, 0x63, 0x65,
-	0x73, 0x12, 0x18, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x52,
-	0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x19, 0x2e, 0x72, 0x61,
-	0x63, 0x69, 0x6e, 0x67, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65,
-	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x19, 0x82, 0xd3, 0xe4, 0x93, 0x02, 0x13, 0x22, 0x0e,
-	0x2f, 0x76, 0x31, 0x2f, 0x6c, 0x69, 0x73, 0x74, 0x2d, 0x72, 0x61, 0x63, 0x65, 0x73, 0x3a, 0x01,
-	0x2a, 0x42, 0x09, 0x5a, 0x07, 0x2f, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x62, 0x06, 0x70, 0x72,
-	0x6f, 0x74, 0x6f, 0x33,
+func (*ImportRacesResponse) ProtoMessage() {}
+
+func (x *ImportRacesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
 }
 
-var (
-	file_racing_racing_proto_rawDescOnce sync.Once
-	file_racing_racing_proto_rawDescData = file_racing_racing_proto_rawDesc
-)
+// Deprecated: Use ImportRacesResponse.ProtoReflect.Descriptor instead.
+func (*ImportRacesResponse) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{6}
+}
 
-func file_racing_racing_proto_rawDescGZIP() []byte {
-	file_racing_racing_proto_rawDescOnce.Do(func() {
-		file_racing_racing_proto_rawDescData = protoimpl.X.CompressGZIP(file_racing_racing_proto_rawDescData)
-	})
-	return file_racing_racing_proto_rawDescData
+func (x *ImportRacesResponse) GetCommitted() bool {
+	if x != nil {
+		return x.Committed
+	}
+	return false
 }
 
-var file_racing_racing_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
-var file_racing_racing_proto_goTypes = []interface{}{
-	(*ListRacesRequest)(nil),       // 0: racing.ListRacesRequest
-	(*ListRacesResponse)(nil),      // 1: racing.ListRacesResponse
-	(*ListRacesRequestFilter)(nil), // 2: racing.ListRacesRequestFilter
-	(*Race)(nil),                   // 3: racing.Race
-	(*timestamp.Timestamp)(nil),    // 4: google.protobuf.Timestamp
+func (x *ImportRacesResponse) GetCreated() int32 {
+	if x != nil {
+		return x.Created
+	}
+	return 0
 }
-var file_racing_racing_proto_depIdxs = []int32{
-	2, // 0: racing.ListRacesRequest.filter:type_name -> racing.ListRacesRequestFilter
-	3, // 1: racing.ListRacesResponse.races:type_name -> racing.Race
-	4, // 2: racing.Race.advertised_start_time:type_name -> google.protobuf.Timestamp
-	0, // 3: racing.Racing.ListRaces:input_type -> racing.ListRacesRequest
-	1, // 4: racing.Racing.ListRaces:output_type -> racing.ListRacesResponse
-	4, // [4:5] is the sub-list for method output_type
-	3, // [3:4] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+
+func (x *ImportRacesResponse) GetUpdated() int32 {
+	if x != nil {
+		return x.Updated
+	}
+	return 0
 }
 
-func init() { file_racing_racing_proto_init() }
-func file_racing_racing_proto_init() {
-	if File_racing_racing_proto != nil {
-		return
+func (x *ImportRacesResponse) GetInvalid() int32 {
+	if x != nil {
+		return x.Invalid
 	}
-	if !protoimpl.UnsafeEnabled {
-		file_racing_racing_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*ListRacesRequest); i {
-			case 0:
-				return &v.state
-			case 1:
-				return &v.sizeCache
+	return 0
+}
+
+func (x *ImportRacesResponse) GetRows() []*ImportRaceResult {
+	if x != nil {
+		return x.Rows
+	}
+	return nil
+}
+
+// The outcome of importing a race.
+type ImportRaceResult struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Row is the position of the race in the import, counting from 1.
+	Row        int32                    `protobuf:"varint,1,opt,name=row,proto3" json:"row,omitempty"`
+	ExternalId string                   `protobuf:"bytes,2,opt,name=external_id,json=externalId,proto3" json:"external_id,omitempty"`
+	Outcome    ImportRaceResult_Outcome `protobuf:"varint,3,opt,name=outcome,proto3,enum=racing.ImportRaceResult_Outcome" json:"outcome,omitempty"`
+	// ID is the ID of the race created or updated. It is not set for dry runs or invalid races.
+	Id int64 `protobuf:"varint,4,opt,name=id,proto3" json:"id,omitempty"`
+	// Errors describe why the race is invalid, one per field.
+	Errors []string `protobuf:"bytes,5,rep,name=errors,proto3" json:"errors,omitempty"`
+}
+
+func (x *ImportRaceResult) Reset() {
+	*x = ImportRaceResult{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ImportRaceResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ImportRaceResult) ProtoMessage() {}
+
+func (x *ImportRaceResult) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ImportRaceResult.ProtoReflect.Descriptor instead.
+func (*ImportRaceResult) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ImportRaceResult) GetRow() int32 {
+	if x != nil {
+		return x.Row
+	}
+	return 0
+}
+
+func (x *ImportRaceResult) GetExternalId() string {
+	if x != nil {
+		return x.ExternalId
+	}
+	return ""
+}
+
+func (x *ImportRaceResult) GetOutcome() ImportRaceResult_Outcome {
+	if x != nil {
+		return x.Outcome
+	}
+	return ImportRaceResult_OUTCOME_UNSPECIFIED
+}
+
+func (x *ImportRaceResult) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *ImportRaceResult) GetErrors() []string {
+	if x != nil {
+		return x.Errors
+	}
+	return nil
+}
+
+// Request for ExportRaces call.
+type ExportRacesRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Filter *ListRacesRequestFilter `protobuf:"bytes,1,opt,name=filter,proto3" json:"filter,omitempty"`
+}
+
+func (x *ExportRacesRequest) Reset() {
+	*x = ExportRacesRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ExportRacesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExportRacesRequest) ProtoMessage() {}
+
+func (x *ExportRacesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExportRacesRequest.ProtoReflect.Descriptor instead.
+func (*ExportRacesRequest) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *ExportRacesRequest) GetFilter() *ListRacesRequestFilter {
+	if x != nil {
+		return x.Filter
+	}
+	return nil
+}
+
+// Response to ExportRaces call, one per race.
+type ExportRacesResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Race *Race `protobuf:"bytes,1,opt,name=race,proto3" json:"race,omitempty"`
+}
+
+func (x *ExportRacesResponse) Reset() {
+	*x = ExportRacesResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[9]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ExportRacesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExportRacesResponse) ProtoMessage() {}
+
+func (x *ExportRacesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[9]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExportRacesResponse.ProtoReflect.Descriptor instead.
+func (*ExportRacesResponse) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *ExportRacesResponse) GetRace() *Race {
+	if x != nil {
+		return x.Race
+	}
+	return nil
+}
+
+// Request for UpdateRace call.
+type UpdateRaceRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Race replaces the meeting ID, name, number, visibility and advertised start time of the race with its ID. Its
+	// external ID, etag and delete time are ignored.
+	Race *Race `protobuf:"bytes,1,opt,name=race,proto3" json:"race,omitempty"`
+	// Etag is the etag of the race the update was made to. The update fails with ABORTED if the race has changed since.
+	// If unset, it is read from the if-match metadata, and the race is updated whatever its version if that is unset
+	// too, or is "*".
+	Etag string `protobuf:"bytes,2,opt,name=etag,proto3" json:"etag,omitempty"`
+}
+
+func (x *UpdateRaceRequest) Reset() {
+	*x = UpdateRaceRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[10]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UpdateRaceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateRaceRequest) ProtoMessage() {}
+
+func (x *UpdateRaceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[10]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateRaceRequest.ProtoReflect.Descriptor instead.
+func (*UpdateRaceRequest) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *UpdateRaceRequest) GetRace() *Race {
+	if x != nil {
+		return x.Race
+	}
+	return nil
+}
+
+func (x *UpdateRaceRequest) GetEtag() string {
+	if x != nil {
+		return x.Etag
+	}
+	return ""
+}
+
+// Response to UpdateRace call.
+type UpdateRaceResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Race is the race as updated, with its new etag.
+	Race *Race `protobuf:"bytes,1,opt,name=race,proto3" json:"race,omitempty"`
+}
+
+func (x *UpdateRaceResponse) Reset() {
+	*x = UpdateRaceResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[11]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UpdateRaceResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateRaceResponse) ProtoMessage() {}
+
+func (x *UpdateRaceResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[11]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateRaceResponse.ProtoReflect.Descriptor instead.
+func (*UpdateRaceResponse) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *UpdateRaceResponse) GetRace() *Race {
+	if x != nil {
+		return x.Race
+	}
+	return nil
+}
+
+// Request for DeleteRace call.
+type DeleteRaceRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id int64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	// Etag is the etag of the race the deletion was decided on. The deletion fails with ABORTED if the race has changed
+	// since. If unset, it is read from the if-match metadata, and the race is deleted whatever its version if that is
+	// unset too, or is "*".
+	Etag string `protobuf:"bytes,2,opt,name=etag,proto3" json:"etag,omitempty"`
+}
+
+func (x *DeleteRaceRequest) Reset() {
+	*x = DeleteRaceRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[12]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeleteRaceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteRaceRequest) ProtoMessage() {}
+
+func (x *DeleteRaceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[12]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteRaceRequest.ProtoReflect.Descriptor instead.
+func (*DeleteRaceRequest) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *DeleteRaceRequest) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *DeleteRaceRequest) GetEtag() string {
+	if x != nil {
+		return x.Etag
+	}
+	return ""
+}
+
+// Response to DeleteRace call.
+type DeleteRaceResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Race is the race as deleted, with its delete time and new etag.
+	Race *Race `protobuf:"bytes,1,opt,name=race,proto3" json:"race,omitempty"`
+}
+
+func (x *DeleteRaceResponse) Reset() {
+	*x = DeleteRaceResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[13]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DeleteRaceResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteRaceResponse) ProtoMessage() {}
+
+func (x *DeleteRaceResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[13]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteRaceResponse.ProtoReflect.Descriptor instead.
+func (*DeleteRaceResponse) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *DeleteRaceResponse) GetRace() *Race {
+	if x != nil {
+		return x.Race
+	}
+	return nil
+}
+
+// Request for UndeleteRace call.
+type UndeleteRaceRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id int64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	// Etag is the etag of the race the restore was decided on. The restore fails with ABORTED if the race has changed
+	// since. If unset, it is read from the if-match metadata, and the race is restored whatever its version if that is
+	// unset too, or is "*".
+	Etag string `protobuf:"bytes,2,opt,name=etag,proto3" json:"etag,omitempty"`
+}
+
+func (x *UndeleteRaceRequest) Reset() {
+	*x = UndeleteRaceRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[14]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UndeleteRaceRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UndeleteRaceRequest) ProtoMessage() {}
+
+func (x *UndeleteRaceRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[14]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UndeleteRaceRequest.ProtoReflect.Descriptor instead.
+func (*UndeleteRaceRequest) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *UndeleteRaceRequest) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *UndeleteRaceRequest) GetEtag() string {
+	if x != nil {
+		return x.Etag
+	}
+	return ""
+}
+
+// Response to UndeleteRace call.
+type UndeleteRaceResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Race is the race as restored, with its new etag.
+	Race *Race `protobuf:"bytes,1,opt,name=race,proto3" json:"race,omitempty"`
+}
+
+func (x *UndeleteRaceResponse) Reset() {
+	*x = UndeleteRaceResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[15]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UndeleteRaceResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UndeleteRaceResponse) ProtoMessage() {}
+
+func (x *UndeleteRaceResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[15]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UndeleteRaceResponse.ProtoReflect.Descriptor instead.
+func (*UndeleteRaceResponse) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *UndeleteRaceResponse) GetRace() *Race {
+	if x != nil {
+		return x.Race
+	}
+	return nil
+}
+
+// Request for ListAuditEvents call.
+type ListAuditEventsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Filter *ListAuditEventsRequestFilter `protobuf:"bytes,1,opt,name=filter,proto3" json:"filter,omitempty"`
+	// PageSize is the most events returned, 100 if unset. It may be at most 1000.
+	PageSize int32 `protobuf:"varint,2,opt,name=page_size,json=pageSize,proto3" json:"page_size,omitempty"`
+	// AfterId lists the events after the event with the ID, such as the last event of the previous page.
+	AfterId int64 `protobuf:"varint,3,opt,name=after_id,json=afterId,proto3" json:"after_id,omitempty"`
+}
+
+func (x *ListAuditEventsRequest) Reset() {
+	*x = ListAuditEventsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[16]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListAuditEventsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListAuditEventsRequest) ProtoMessage() {}
+
+func (x *ListAuditEventsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[16]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListAuditEventsRequest.ProtoReflect.Descriptor instead.
+func (*ListAuditEventsRequest) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *ListAuditEventsRequest) GetFilter() *ListAuditEventsRequestFilter {
+	if x != nil {
+		return x.Filter
+	}
+	return nil
+}
+
+func (x *ListAuditEventsRequest) GetPageSize() int32 {
+	if x != nil {
+		return x.PageSize
+	}
+	return 0
+}
+
+func (x *ListAuditEventsRequest) GetAfterId() int64 {
+	if x != nil {
+		return x.AfterId
+	}
+	return 0
+}
+
+// Response to ListAuditEvents call.
+type ListAuditEventsResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Events []*AuditEvent `protobuf:"bytes,1,rep,name=events,proto3" json:"events,omitempty"`
+}
+
+func (x *ListAuditEventsResponse) Reset() {
+	*x = ListAuditEventsResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[17]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListAuditEventsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListAuditEventsResponse) ProtoMessage() {}
+
+func (x *ListAuditEventsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[17]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListAuditEventsResponse.ProtoReflect.Descriptor instead.
+func (*ListAuditEventsResponse) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *ListAuditEventsResponse) GetEvents() []*AuditEvent {
+	if x != nil {
+		return x.Events
+	}
+	return nil
+}
+
+// Filter for listing audit events.
+type ListAuditEventsRequestFilter struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Resource is the name of the resource changed, such as races/1.
+	Resource string `protobuf:"bytes,1,opt,name=resource,proto3" json:"resource,omitempty"`
+	// Actor is who made the change.
+	Actor string `protobuf:"bytes,2,opt,name=actor,proto3" json:"actor,omitempty"`
+	// StartTime includes the events from the time on.
+	StartTime *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=start_time,json=startTime,proto3" json:"start_time,omitempty"`
+	// EndTime includes the events before the time.
+	EndTime *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=end_time,json=endTime,proto3" json:"end_time,omitempty"`
+}
+
+func (x *ListAuditEventsRequestFilter) Reset() {
+	*x = ListAuditEventsRequestFilter{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[18]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListAuditEventsRequestFilter) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListAuditEventsRequestFilter) ProtoMessage() {}
+
+func (x *ListAuditEventsRequestFilter) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[18]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListAuditEventsRequestFilter.ProtoReflect.Descriptor instead.
+func (*ListAuditEventsRequestFilter) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *ListAuditEventsRequestFilter) GetResource() string {
+	if x != nil {
+		return x.Resource
+	}
+	return ""
+}
+
+func (x *ListAuditEventsRequestFilter) GetActor() string {
+	if x != nil {
+		return x.Actor
+	}
+	return ""
+}
+
+func (x *ListAuditEventsRequestFilter) GetStartTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.StartTime
+	}
+	return nil
+}
+
+func (x *ListAuditEventsRequestFilter) GetEndTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.EndTime
+	}
+	return nil
+}
+
+// A race resource.
+type Race struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// ID represents a unique identifier for the race.
+	Id int64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	// MeetingID represents a unique identifier for the races meeting.
+	MeetingId int64 `protobuf:"varint,2,opt,name=meeting_id,json=meetingId,proto3" json:"meeting_id,omitempty"`
+	// Name is the official name given to the race.
+	Name string `protobuf:"bytes,3,opt,name=name,proto3" json:"name,omitempty"`
+	// Number represents the number of the race.
+	Number int64 `protobuf:"varint,4,opt,name=number,proto3" json:"number,omitempty"`
+	// Visible represents whether or not the race is visible.
+	Visible bool `protobuf:"varint,5,opt,name=visible,proto3" json:"visible,omitempty"`
+	// AdvertisedStartTime is the time the race is advertised to run.
+	AdvertisedStartTime *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=advertised_start_time,json=advertisedStartTime,proto3" json:"advertised_start_time,omitempty"`
+	// ExternalID identifies the race in the systems it is imported from. It is unique when set.
+	ExternalId string `protobuf:"bytes,7,opt,name=external_id,json=externalId,proto3" json:"external_id,omitempty"`
+	// Etag identifies the version of the race, and changes whenever it is updated. It is ignored when writing races.
+	Etag string `protobuf:"bytes,8,opt,name=etag,proto3" json:"etag,omitempty"`
+	// DeleteTime is when the race was deleted, unset unless it is. It is ignored when writing races.
+	DeleteTime *timestamppb.Timestamp `protobuf:"bytes,9,opt,name=delete_time,json=deleteTime,proto3" json:"delete_time,omitempty"`
+	// Status is derived from the advertised start time whenever the race is read, so it is never stale. It is ignored
+	// when writing races.
+	Status Race_Status `protobuf:"varint,10,opt,name=status,proto3,enum=racing.Race_Status" json:"status,omitempty"`
+}
+
+func (x *Race) Reset() {
+	*x = Race{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[19]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Race) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Race) ProtoMessage() {}
+
+func (x *Race) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[19]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Race.ProtoReflect.Descriptor instead.
+func (*Race) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *Race) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Race) GetMeetingId() int64 {
+	if x != nil {
+		return x.MeetingId
+	}
+	return 0
+}
+
+func (x *Race) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Race) GetNumber() int64 {
+	if x != nil {
+		return x.Number
+	}
+	return 0
+}
+
+func (x *Race) GetVisible() bool {
+	if x != nil {
+		return x.Visible
+	}
+	return false
+}
+
+func (x *Race) GetAdvertisedStartTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.AdvertisedStartTime
+	}
+	return nil
+}
+
+func (x *Race) GetExternalId() string {
+	if x != nil {
+		return x.ExternalId
+	}
+	return ""
+}
+
+func (x *Race) GetEtag() string {
+	if x != nil {
+		return x.Etag
+	}
+	return ""
+}
+
+func (x *Race) GetDeleteTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.DeleteTime
+	}
+	return nil
+}
+
+func (x *Race) GetStatus() Race_Status {
+	if x != nil {
+		return x.Status
+	}
+	return Race_STATUS_UNSPECIFIED
+}
+
+// A change to a race.
+type RaceEvent struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Sequence orders events, and identifies the last event received when resuming a watch. Sequences are only
+	// resumed from by the run of racing that sent them; a watch resumed after a restart starts over.
+	Sequence uint64         `protobuf:"varint,1,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	Type     RaceEvent_Type `protobuf:"varint,2,opt,name=type,proto3,enum=racing.RaceEvent_Type" json:"type,omitempty"`
+	Race     *Race          `protobuf:"bytes,3,opt,name=race,proto3" json:"race,omitempty"`
+}
+
+func (x *RaceEvent) Reset() {
+	*x = RaceEvent{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[20]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RaceEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RaceEvent) ProtoMessage() {}
+
+func (x *RaceEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[20]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RaceEvent.ProtoReflect.Descriptor instead.
+func (*RaceEvent) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *RaceEvent) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *RaceEvent) GetType() RaceEvent_Type {
+	if x != nil {
+		return x.Type
+	}
+	return RaceEvent_TYPE_UNSPECIFIED
+}
+
+func (x *RaceEvent) GetRace() *Race {
+	if x != nil {
+		return x.Race
+	}
+	return nil
+}
+
+// A change made to a resource, recorded for auditing.
+type AuditEvent struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// ID orders events, in the order they were recorded.
+	Id int64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	// Time is when the change was made.
+	Time *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=time,proto3" json:"time,omitempty"`
+	// Actor is the subject of the caller who made the change, "anonymous" for callers without one, or the user who ran
+	// a racing command.
+	Actor string `protobuf:"bytes,3,opt,name=actor,proto3" json:"actor,omitempty"`
+	// Rpc is the full name of the RPC that made the change, such as /racing.Racing/UpdateRace, or the racing command
+	// that did, such as "racing import".
+	Rpc string `protobuf:"bytes,4,opt,name=rpc,proto3" json:"rpc,omitempty"`
+	// Resource is the name of the resource changed, such as races/1.
+	Resource string            `protobuf:"bytes,5,opt,name=resource,proto3" json:"resource,omitempty"`
+	Action   AuditEvent_Action `protobuf:"varint,6,opt,name=action,proto3,enum=racing.AuditEvent_Action" json:"action,omitempty"`
+	// Diff is a JSON object of the fields that changed, as named in the JSON form of the resource, each holding its
+	// value before and after the change, such as {"name": {"before": "One", "after": "Two"}}. Values are null before
+	// the resource was created and after it was deleted.
+	Diff string `protobuf:"bytes,7,opt,name=diff,proto3" json:"diff,omitempty"`
+}
+
+func (x *AuditEvent) Reset() {
+	*x = AuditEvent{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[21]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AuditEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AuditEvent) ProtoMessage() {}
+
+func (x *AuditEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[21]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AuditEvent.ProtoReflect.Descriptor instead.
+func (*AuditEvent) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{21}
+}
+
+func (x *AuditEvent) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *AuditEvent) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *AuditEvent) GetActor() string {
+	if x != nil {
+		return x.Actor
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetRpc() string {
+	if x != nil {
+		return x.Rpc
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetResource() string {
+	if x != nil {
+		return x.Resource
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetAction() AuditEvent_Action {
+	if x != nil {
+		return x.Action
+	}
+	return AuditEvent_ACTION_UNSPECIFIED
+}
+
+func (x *AuditEvent) GetDiff() string {
+	if x != nil {
+		return x.Diff
+	}
+	return ""
+}
+
+// A change made to a race, published from the outbox to the sinks of the racing service.
+type RaceChange struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Action AuditEvent_Action `protobuf:"varint,1,opt,name=action,proto3,enum=racing.AuditEvent_Action" json:"action,omitempty"`
+	// Race is the race as changed, without its etag, or as it was before it was purged.
+	Race *Race `protobuf:"bytes,2,opt,name=race,proto3" json:"race,omitempty"`
+	// Time is when the change was made.
+	Time *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=time,proto3" json:"time,omitempty"`
+	// Actor and Rpc attribute the change, as they do its audit event.
+	Actor string `protobuf:"bytes,4,opt,name=actor,proto3" json:"actor,omitempty"`
+	Rpc   string `protobuf:"bytes,5,opt,name=rpc,proto3" json:"rpc,omitempty"`
+}
+
+func (x *RaceChange) Reset() {
+	*x = RaceChange{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_racing_racing_proto_msgTypes[22]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RaceChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RaceChange) ProtoMessage() {}
+
+func (x *RaceChange) ProtoReflect() protoreflect.Message {
+	mi := &file_racing_racing_proto_msgTypes[22]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RaceChange.ProtoReflect.Descriptor instead.
+func (*RaceChange) Descriptor() ([]byte, []int) {
+	return file_racing_racing_proto_rawDescGZIP(), []int{22}
+}
+
+func (x *RaceChange) GetAction() AuditEvent_Action {
+	if x != nil {
+		return x.Action
+	}
+	return AuditEvent_ACTION_UNSPECIFIED
+}
+
+func (x *RaceChange) GetRace() *Race {
+	if x != nil {
+		return x.Race
+	}
+	return nil
+}
+
+func (x *RaceChange) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *RaceChange) GetActor() string {
+	if x != nil {
+		return x.Actor
+	}
+	return ""
+}
+
+func (x *RaceChange) GetRpc() string {
+	if x != nil {
+		return x.Rpc
+	}
+	return ""
+}
+
+var File_racing_racing_proto protoreflect.FileDescriptor
+
+var file_racing_racing_proto_rawDesc = []byte{
+	0x0a, 0x13, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2f, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x06, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x1a, 0x1f, 0x67,
+	0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x74,
+	0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x1c,
+	0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x61, 0x6e, 0x6e, 0x6f, 0x74,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x65, 0x0a, 0x10,
+	0x4c, 0x69, 0x73, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x12, 0x36, 0x0a, 0x06, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x1e, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x61,
+	0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x46, 0x69, 0x6c, 0x74, 0x65, 0x72,
+	0x52, 0x06, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x12, 0x19, 0x0a, 0x08, 0x6f, 0x72, 0x64, 0x65,
+	0x72, 0x5f, 0x62, 0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x6f, 0x72, 0x64, 0x65,
+	0x72, 0x42, 0x79, 0x22, 0x37, 0x0a, 0x11, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73,
+	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x22, 0x0a, 0x05, 0x72, 0x61, 0x63, 0x65,
+	0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67,
+	0x2e, 0x52, 0x61, 0x63, 0x65, 0x52, 0x05, 0x72, 0x61, 0x63, 0x65, 0x73, 0x22, 0x5c, 0x0a, 0x16,
+	0x4c, 0x69, 0x73, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x46, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x12, 0x1f, 0x0a, 0x0b, 0x6d, 0x65, 0x65, 0x74, 0x69, 0x6e,
+	0x67, 0x5f, 0x69, 0x64, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x03, 0x52, 0x0a, 0x6d, 0x65, 0x65,
+	0x74, 0x69, 0x6e, 0x67, 0x49, 0x64, 0x73, 0x12, 0x21, 0x0a, 0x0c, 0x73, 0x68, 0x6f, 0x77, 0x5f,
+	0x64, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0b, 0x73,
+	0x68, 0x6f, 0x77, 0x44, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x64, 0x22, 0x6e, 0x0a, 0x11, 0x57, 0x61,
+	0x74, 0x63, 0x68, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x36, 0x0a, 0x06, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x1e, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x61, 0x63,
+	0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x46, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x52,
+	0x06, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x12, 0x21, 0x0a, 0x0c, 0x72, 0x65, 0x73, 0x75, 0x6d,
+	0x65, 0x5f, 0x61, 0x66, 0x74, 0x65, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0b, 0x72,
+	0x65, 0x73, 0x75, 0x6d, 0x65, 0x41, 0x66, 0x74, 0x65, 0x72, 0x22, 0x3d, 0x0a, 0x12, 0x57, 0x61,
+	0x74, 0x63, 0x68, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x12, 0x27, 0x0a, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x11, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x52, 0x61, 0x63, 0x65, 0x45, 0x76, 0x65,
+	0x6e, 0x74, 0x52, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x22, 0x4f, 0x0a, 0x12, 0x49, 0x6d, 0x70,
+	0x6f, 0x72, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x20, 0x0a, 0x04, 0x72, 0x61, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0c, 0x2e,
+	0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x52, 0x61, 0x63, 0x65, 0x52, 0x04, 0x72, 0x61, 0x63,
+	0x65, 0x12, 0x17, 0x0a, 0x07, 0x64, 0x72, 0x79, 0x5f, 0x72, 0x75, 0x6e, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x06, 0x64, 0x72, 0x79, 0x52, 0x75, 0x6e, 0x22, 0xaf, 0x01, 0x0a, 0x13, 0x49,
+	0x6d, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x63, 0x6f, 0x6d, 0x6d, 0x69, 0x74, 0x74, 0x65, 0x64, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09, 0x63, 0x6f, 0x6d, 0x6d, 0x69, 0x74, 0x74, 0x65, 0x64,
+	0x12, 0x18, 0x0a, 0x07, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x05, 0x52, 0x07, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x75, 0x70,
+	0x64, 0x61, 0x74, 0x65, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x75, 0x70, 0x64,
+	0x61, 0x74, 0x65, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x69, 0x6e, 0x76, 0x61, 0x6c, 0x69, 0x64, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x69, 0x6e, 0x76, 0x61, 0x6c, 0x69, 0x64, 0x12, 0x2c,
+	0x0a, 0x04, 0x72, 0x6f, 0x77, 0x73, 0x18, 0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x72,
+	0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x49, 0x6d, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x61, 0x63, 0x65,
+	0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x52, 0x04, 0x72, 0x6f, 0x77, 0x73, 0x22, 0xf4, 0x01, 0x0a,
+	0x10, 0x49, 0x6d, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x61, 0x63, 0x65, 0x52, 0x65, 0x73, 0x75, 0x6c,
+	0x74, 0x12, 0x10, 0x0a, 0x03, 0x72, 0x6f, 0x77, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x03,
+	0x72, 0x6f, 0x77, 0x12, 0x1f, 0x0a, 0x0b, 0x65, 0x78, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x5f,
+	0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0a, 0x65, 0x78, 0x74, 0x65, 0x72, 0x6e,
+	0x61, 0x6c, 0x49, 0x64, 0x12, 0x3a, 0x0a, 0x07, 0x6f, 0x75, 0x74, 0x63, 0x6f, 0x6d, 0x65, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x20, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x49,
+	0x6d, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x61, 0x63, 0x65, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x2e,
+	0x4f, 0x75, 0x74, 0x63, 0x6f, 0x6d, 0x65, 0x52, 0x07, 0x6f, 0x75, 0x74, 0x63, 0x6f, 0x6d, 0x65,
+	0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02, 0x69, 0x64,
+	0x12, 0x16, 0x0a, 0x06, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x18, 0x05, 0x20, 0x03, 0x28, 0x09,
+	0x52, 0x06, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x73, 0x22, 0x49, 0x0a, 0x07, 0x4f, 0x75, 0x74, 0x63,
+	0x6f, 0x6d, 0x65, 0x12, 0x17, 0x0a, 0x13, 0x4f, 0x55, 0x54, 0x43, 0x4f, 0x4d, 0x45, 0x5f, 0x55,
+	0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07,
+	0x43, 0x52, 0x45, 0x41, 0x54, 0x45, 0x44, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x50, 0x44,
+	0x41, 0x54, 0x45, 0x44, 0x10, 0x02, 0x12, 0x0b, 0x0a, 0x07, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49,
+	0x44, 0x10, 0x03, 0x22, 0x4c, 0x0a, 0x12, 0x45, 0x78, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x61, 0x63,
+	0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x36, 0x0a, 0x06, 0x66, 0x69, 0x6c,
+	0x74, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1e, 0x2e, 0x72, 0x61, 0x63, 0x69,
+	0x6e, 0x67, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x46, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x52, 0x06, 0x66, 0x69, 0x6c, 0x74, 0x65,
+	0x72, 0x22, 0x37, 0x0a, 0x13, 0x45, 0x78, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73,
+	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x20, 0x0a, 0x04, 0x72, 0x61, 0x63, 0x65,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e,
+	0x52, 0x61, 0x63, 0x65, 0x52, 0x04, 0x72, 0x61, 0x63, 0x65, 0x22, 0x49, 0x0a, 0x11, 0x55, 0x70,
+	0x64, 0x61, 0x74, 0x65, 0x52, 0x61, 0x63, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x20, 0x0a, 0x04, 0x72, 0x61, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0c, 0x2e,
+	0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x52, 0x61, 0x63, 0x65, 0x52, 0x04, 0x72, 0x61, 0x63,
+	0x65, 0x12, 0x12, 0x0a, 0x04, 0x65, 0x74, 0x61, 0x67, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x04, 0x65, 0x74, 0x61, 0x67, 0x22, 0x36, 0x0a, 0x12, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x52,
+	0x61, 0x63, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x20, 0x0a, 0x04, 0x72,
+	0x61, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x72, 0x61, 0x63, 0x69,
+	0x6e, 0x67, 0x2e, 0x52, 0x61, 0x63, 0x65, 0x52, 0x04, 0x72, 0x61, 0x63, 0x65, 0x22, 0x37, 0x0a,
+	0x11, 0x44, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x52, 0x61, 0x63, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02,
+	0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x65, 0x74, 0x61, 0x67, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x04, 0x65, 0x74, 0x61, 0x67, 0x22, 0x36, 0x0a, 0x12, 0x44, 0x65, 0x6c, 0x65, 0x74, 0x65,
+	0x52, 0x61, 0x63, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x20, 0x0a, 0x04,
+	0x72, 0x61, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x72, 0x61, 0x63,
+	0x69, 0x6e, 0x67, 0x2e, 0x52, 0x61, 0x63, 0x65, 0x52, 0x04, 0x72, 0x61, 0x63, 0x65, 0x22, 0x39,
+	0x0a, 0x13, 0x55, 0x6e, 0x64, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x52, 0x61, 0x63, 0x65, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x65, 0x74, 0x61, 0x67, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x04, 0x65, 0x74, 0x61, 0x67, 0x22, 0x38, 0x0a, 0x14, 0x55, 0x6e, 0x64,
+	0x65, 0x6c, 0x65, 0x74, 0x65, 0x52, 0x61, 0x63, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x12, 0x20, 0x0a, 0x04, 0x72, 0x61, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x0c, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x52, 0x61, 0x63, 0x65, 0x52, 0x04, 0x72,
+	0x61, 0x63, 0x65, 0x22, 0x8e, 0x01, 0x0a, 0x16, 0x4c, 0x69, 0x73, 0x74, 0x41, 0x75, 0x64, 0x69,
+	0x74, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x3c,
+	0x0a, 0x06, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x24,
+	0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x41, 0x75, 0x64, 0x69,
+	0x74, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x46, 0x69,
+	0x6c, 0x74, 0x65, 0x72, 0x52, 0x06, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x12, 0x1b, 0x0a, 0x09,
+	0x70, 0x61, 0x67, 0x65, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52,
+	0x08, 0x70, 0x61, 0x67, 0x65, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x19, 0x0a, 0x08, 0x61, 0x66, 0x74,
+	0x65, 0x72, 0x5f, 0x69, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x61, 0x66, 0x74,
+	0x65, 0x72, 0x49, 0x64, 0x22, 0x45, 0x0a, 0x17, 0x4c, 0x69, 0x73, 0x74, 0x41, 0x75, 0x64, 0x69,
+	0x74, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12,
+	0x2a, 0x0a, 0x06, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32,
+	0x12, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x41, 0x75, 0x64, 0x69, 0x74, 0x45, 0x76,
+	0x65, 0x6e, 0x74, 0x52, 0x06, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x22, 0xc2, 0x01, 0x0a, 0x1c,
+	0x4c, 0x69, 0x73, 0x74, 0x41, 0x75, 0x64, 0x69, 0x74, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x46, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x12, 0x1a, 0x0a, 0x08,
+	0x72, 0x65, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08,
+	0x72, 0x65, 0x73, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x61, 0x63, 0x74, 0x6f,
+	0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x61, 0x63, 0x74, 0x6f, 0x72, 0x12, 0x39,
+	0x0a, 0x0a, 0x73, 0x74, 0x61, 0x72, 0x74, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x09,
+	0x73, 0x74, 0x61, 0x72, 0x74, 0x54, 0x69, 0x6d, 0x65, 0x12, 0x35, 0x0a, 0x08, 0x65, 0x6e, 0x64,
+	0x5f, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f,
+	0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69,
+	0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x07, 0x65, 0x6e, 0x64, 0x54, 0x69, 0x6d, 0x65,
+	0x22, 0xa2, 0x03, 0x0a, 0x04, 0x52, 0x61, 0x63, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02, 0x69, 0x64, 0x12, 0x1d, 0x0a, 0x0a, 0x6d, 0x65, 0x65,
+	0x74, 0x69, 0x6e, 0x67, 0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x6d,
+	0x65, 0x65, 0x74, 0x69, 0x6e, 0x67, 0x49, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06,
+	0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x6e, 0x75,
+	0x6d, 0x62, 0x65, 0x72, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x69, 0x73, 0x69, 0x62, 0x6c, 0x65, 0x18,
+	0x05, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x76, 0x69, 0x73, 0x69, 0x62, 0x6c, 0x65, 0x12, 0x4e,
+	0x0a, 0x15, 0x61, 0x64, 0x76, 0x65, 0x72, 0x74, 0x69, 0x73, 0x65, 0x64, 0x5f, 0x73, 0x74, 0x61,
+	0x72, 0x74, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e,
+	0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e,
+	0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x13, 0x61, 0x64, 0x76, 0x65, 0x72,
+	0x74, 0x69, 0x73, 0x65, 0x64, 0x53, 0x74, 0x61, 0x72, 0x74, 0x54, 0x69, 0x6d, 0x65, 0x12, 0x1f,
+	0x0a, 0x0b, 0x65, 0x78, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x5f, 0x69, 0x64, 0x18, 0x07, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x0a, 0x65, 0x78, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x49, 0x64, 0x12,
+	0x12, 0x0a, 0x04, 0x65, 0x74, 0x61, 0x67, 0x18, 0x08, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x65,
+	0x74, 0x61, 0x67, 0x12, 0x3b, 0x0a, 0x0b, 0x64, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x5f, 0x74, 0x69,
+	0x6d, 0x65, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
+	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73,
+	0x74, 0x61, 0x6d, 0x70, 0x52, 0x0a, 0x64, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x54, 0x69, 0x6d, 0x65,
+	0x12, 0x2b, 0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0e,
+	0x32, 0x13, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x52, 0x61, 0x63, 0x65, 0x2e, 0x53,
+	0x74, 0x61, 0x74, 0x75, 0x73, 0x52, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x36, 0x0a,
+	0x06, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x16, 0x0a, 0x12, 0x53, 0x54, 0x41, 0x54, 0x55,
+	0x53, 0x5f, 0x55, 0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12,
+	0x08, 0x0a, 0x04, 0x4f, 0x50, 0x45, 0x4e, 0x10, 0x01, 0x12, 0x0a, 0x0a, 0x06, 0x43, 0x4c, 0x4f,
+	0x53, 0x45, 0x44, 0x10, 0x02, 0x22, 0xc8, 0x01, 0x0a, 0x09, 0x52, 0x61, 0x63, 0x65, 0x45, 0x76,
+	0x65, 0x6e, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x12,
+	0x2a, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x16, 0x2e,
+	0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x52, 0x61, 0x63, 0x65, 0x45, 0x76, 0x65, 0x6e, 0x74,
+	0x2e, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x20, 0x0a, 0x04, 0x72,
+	0x61, 0x63, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x72, 0x61, 0x63, 0x69,
+	0x6e, 0x67, 0x2e, 0x52, 0x61, 0x63, 0x65, 0x52, 0x04, 0x72, 0x61, 0x63, 0x65, 0x22, 0x51, 0x0a,
+	0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x14, 0x0a, 0x10, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x55, 0x4e,
+	0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12, 0x0c, 0x0a, 0x08, 0x53,
+	0x4e, 0x41, 0x50, 0x53, 0x48, 0x4f, 0x54, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07, 0x43, 0x52, 0x45,
+	0x41, 0x54, 0x45, 0x44, 0x10, 0x02, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x50, 0x44, 0x41, 0x54, 0x45,
+	0x44, 0x10, 0x03, 0x12, 0x0b, 0x0a, 0x07, 0x44, 0x45, 0x4c, 0x45, 0x54, 0x45, 0x44, 0x10, 0x04,
+	0x22, 0xbb, 0x02, 0x0a, 0x0a, 0x41, 0x75, 0x64, 0x69, 0x74, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12,
+	0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02, 0x69, 0x64, 0x12,
+	0x2e, 0x0a, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e,
+	0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e,
+	0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x12,
+	0x14, 0x0a, 0x05, 0x61, 0x63, 0x74, 0x6f, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
+	0x61, 0x63, 0x74, 0x6f, 0x72, 0x12, 0x10, 0x0a, 0x03, 0x72, 0x70, 0x63, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x03, 0x72, 0x70, 0x63, 0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x73, 0x6f, 0x75,
+	0x72, 0x63, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x72, 0x65, 0x73, 0x6f, 0x75,
+	0x72, 0x63, 0x65, 0x12, 0x31, 0x0a, 0x06, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x06, 0x20,
+	0x01, 0x28, 0x0e, 0x32, 0x19, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x41, 0x75, 0x64,
+	0x69, 0x74, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x2e, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x06,
+	0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x69, 0x66, 0x66, 0x18, 0x07,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x64, 0x69, 0x66, 0x66, 0x22, 0x62, 0x0a, 0x06, 0x41, 0x63,
+	0x74, 0x69, 0x6f, 0x6e, 0x12, 0x16, 0x0a, 0x12, 0x41, 0x43, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x55,
+	0x4e, 0x53, 0x50, 0x45, 0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07,
+	0x43, 0x52, 0x45, 0x41, 0x54, 0x45, 0x44, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x50, 0x44,
+	0x41, 0x54, 0x45, 0x44, 0x10, 0x02, 0x12, 0x0b, 0x0a, 0x07, 0x44, 0x45, 0x4c, 0x45, 0x54, 0x45,
+	0x44, 0x10, 0x03, 0x12, 0x0d, 0x0a, 0x09, 0x55, 0x4e, 0x44, 0x45, 0x4c, 0x45, 0x54, 0x45, 0x44,
+	0x10, 0x04, 0x12, 0x0a, 0x0a, 0x06, 0x50, 0x55, 0x52, 0x47, 0x45, 0x44, 0x10, 0x05, 0x22, 0xb9,
+	0x01, 0x0a, 0x0a, 0x52, 0x61, 0x63, 0x65, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x12, 0x31, 0x0a,
+	0x06, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x19, 0x2e,
+	0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x41, 0x75, 0x64, 0x69, 0x74, 0x45, 0x76, 0x65, 0x6e,
+	0x74, 0x2e, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x06, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e,
+	0x12, 0x20, 0x0a, 0x04, 0x72, 0x61, 0x63, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0c,
+	0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x52, 0x61, 0x63, 0x65, 0x52, 0x04, 0x72, 0x61,
+	0x63, 0x65, 0x12, 0x2e, 0x0a, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
+	0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x04, 0x74, 0x69,
+	0x6d, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x61, 0x63, 0x74, 0x6f, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x05, 0x61, 0x63, 0x74, 0x6f, 0x72, 0x12, 0x10, 0x0a, 0x03, 0x72, 0x70, 0x63, 0x18,
+	0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x72, 0x70, 0x63, 0x32, 0xf0, 0x05, 0x0a, 0x06, 0x52,
+	0x61, 0x63, 0x69, 0x6e, 0x67, 0x12, 0x5b, 0x0a, 0x09, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x61, 0x63,
+	0x65, 0x73, 0x12, 0x18, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x4c, 0x69, 0x73, 0x74,
+	0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x19, 0x2e, 0x72,
+	0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x19, 0x82, 0xd3, 0xe4, 0x93, 0x02, 0x13, 0x22,
+	0x0e, 0x2f, 0x76, 0x31, 0x2f, 0x6c, 0x69, 0x73, 0x74, 0x2d, 0x72, 0x61, 0x63, 0x65, 0x73, 0x3a,
+	0x01, 0x2a, 0x12, 0x47, 0x0a, 0x0a, 0x57, 0x61, 0x74, 0x63, 0x68, 0x52, 0x61, 0x63, 0x65, 0x73,
+	0x12, 0x19, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x57, 0x61, 0x74, 0x63, 0x68, 0x52,
+	0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1a, 0x2e, 0x72, 0x61,
+	0x63, 0x69, 0x6e, 0x67, 0x2e, 0x57, 0x61, 0x74, 0x63, 0x68, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x30, 0x01, 0x12, 0x4a, 0x0a, 0x0b, 0x49,
+	0x6d, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x12, 0x1a, 0x2e, 0x72, 0x61, 0x63,
+	0x69, 0x6e, 0x67, 0x2e, 0x49, 0x6d, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1b, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e,
+	0x49, 0x6d, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x22, 0x00, 0x28, 0x01, 0x12, 0x4a, 0x0a, 0x0b, 0x45, 0x78, 0x70, 0x6f, 0x72,
+	0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x12, 0x1a, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e,
+	0x45, 0x78, 0x70, 0x6f, 0x72, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x1a, 0x1b, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x45, 0x78, 0x70, 0x6f,
+	0x72, 0x74, 0x52, 0x61, 0x63, 0x65, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22,
+	0x00, 0x30, 0x01, 0x12, 0x66, 0x0a, 0x0a, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x52, 0x61, 0x63,
+	0x65, 0x12, 0x19, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x55, 0x70, 0x64, 0x61, 0x74,
+	0x65, 0x52, 0x61, 0x63, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1a, 0x2e, 0x72,
+	0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x52, 0x61, 0x63, 0x65,
+	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x21, 0x82, 0xd3, 0xe4, 0x93, 0x02, 0x1b,
+	0x3a, 0x04, 0x72, 0x61, 0x63, 0x65, 0x1a, 0x13, 0x2f, 0x76, 0x31, 0x2f, 0x72, 0x61, 0x63, 0x65,
+	0x73, 0x2f, 0x7b, 0x72, 0x61, 0x63, 0x65, 0x2e, 0x69, 0x64, 0x7d, 0x12, 0x5b, 0x0a, 0x0a, 0x44,
+	0x65, 0x6c, 0x65, 0x74, 0x65, 0x52, 0x61, 0x63, 0x65, 0x12, 0x19, 0x2e, 0x72, 0x61, 0x63, 0x69,
+	0x6e, 0x67, 0x2e, 0x44, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x52, 0x61, 0x63, 0x65, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x1a, 0x1a, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x44, 0x65,
+	0x6c, 0x65, 0x74, 0x65, 0x52, 0x61, 0x63, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x22, 0x16, 0x82, 0xd3, 0xe4, 0x93, 0x02, 0x10, 0x2a, 0x0e, 0x2f, 0x76, 0x31, 0x2f, 0x72, 0x61,
+	0x63, 0x65, 0x73, 0x2f, 0x7b, 0x69, 0x64, 0x7d, 0x12, 0x6d, 0x0a, 0x0c, 0x55, 0x6e, 0x64, 0x65,
+	0x6c, 0x65, 0x74, 0x65, 0x52, 0x61, 0x63, 0x65, 0x12, 0x1b, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e,
+	0x67, 0x2e, 0x55, 0x6e, 0x64, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x52, 0x61, 0x63, 0x65, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1c, 0x2e, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x2e, 0x55,
+	0x6e, 0x64, 0x65, 0x6c, 0x65, 0x74, 0x65, 0x52, 0x61, 0x63, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x22, 0x22, 0x82, 0xd3, 0xe4, 0x93, 0x02, 0x1c, 0x22, 0x17, 0x2f, 0x76, 0x31,
+	0x2f, 0x72, 0x61, 0x63, 0x65, 0x73, 0x2f, 0x7b, 0x69, 0x64, 0x7d, 0x3a, 0x75, 0x6e, 0x64, 0x65,
+	0x6c, 0x65, 0x74, 0x65, 0x3a, 0x01, 0x2a, 0x12, 0x74, 0x0a, 0x0f, 0x4c, 0x69, 0x73, 0x74, 0x41,
+	0x75, 0x64, 0x69, 0x74, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x12, 0x1e, 0x2e, 0x72, 0x61, 0x63,
+	0x69, 0x6e, 0x67, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x41, 0x75, 0x64, 0x69, 0x74, 0x45, 0x76, 0x65,
+	0x6e, 0x74, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1f, 0x2e, 0x72, 0x61, 0x63,
+	0x69, 0x6e, 0x67, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x41, 0x75, 0x64, 0x69, 0x74, 0x45, 0x76, 0x65,
+	0x6e, 0x74, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x20, 0x82, 0xd3, 0xe4,
+	0x93, 0x02, 0x1a, 0x22, 0x15, 0x2f, 0x76, 0x31, 0x2f, 0x6c, 0x69, 0x73, 0x74, 0x2d, 0x61, 0x75,
+	0x64, 0x69, 0x74, 0x2d, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x3a, 0x01, 0x2a, 0x42, 0x09, 0x5a,
+	0x07, 0x2f, 0x72, 0x61, 0x63, 0x69, 0x6e, 0x67, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_racing_racing_proto_rawDescOnce sync.Once
+	file_racing_racing_proto_rawDescData = file_racing_racing_proto_rawDesc
+)
+
+func file_racing_racing_proto_rawDescGZIP() []byte {
+	file_racing_racing_proto_rawDescOnce.Do(func() {
+		file_racing_racing_proto_rawDescData = protoimpl.X.CompressGZIP(file_racing_racing_proto_rawDescData)
+	})
+	return file_racing_racing_proto_rawDescData
+}
+
+var file_racing_racing_proto_enumTypes = make([]protoimpl.EnumInfo, 4)
+var file_racing_racing_proto_msgTypes = make([]protoimpl.MessageInfo, 23)
+var file_racing_racing_proto_goTypes = []interface{}{
+	(ImportRaceResult_Outcome)(0),        // 0: racing.ImportRaceResult.Outcome
+	(Race_Status)(0),                     // 1: racing.Race.Status
+	(RaceEvent_Type)(0),                  // 2: racing.RaceEvent.Type
+	(AuditEvent_Action)(0),               // 3: racing.AuditEvent.Action
+	(*ListRacesRequest)(nil),             // 4: racing.ListRacesRequest
+	(*ListRacesResponse)(nil),            // 5: racing.ListRacesResponse
+	(*ListRacesRequestFilter)(nil),       // 6: racing.ListRacesRequestFilter
+	(*WatchRacesRequest)(nil),            // 7: racing.WatchRacesRequest
+	(*WatchRacesResponse)(nil),           // 8: racing.WatchRacesResponse
+	(*ImportRacesRequest)(nil),           // 9: racing.ImportRacesRequest
+	(*ImportRacesResponse)(nil),          // 10: racing.ImportRacesResponse
+	(*ImportRaceResult)(nil),             // 11: racing.ImportRaceResult
+	(*ExportRacesRequest)(nil),           // 12: racing.ExportRacesRequest
+	(*ExportRacesResponse)(nil),          // 13: racing.ExportRacesResponse
+	(*UpdateRaceRequest)(nil),            // 14: racing.UpdateRaceRequest
+	(*UpdateRaceResponse)(nil),           // 15: racing.UpdateRaceResponse
+	(*DeleteRaceRequest)(nil),            // 16: racing.DeleteRaceRequest
+	(*DeleteRaceResponse)(nil),           // 17: racing.DeleteRaceResponse
+	(*UndeleteRaceRequest)(nil),          // 18: racing.UndeleteRaceRequest
+	(*UndeleteRaceResponse)(nil),         // 19: racing.UndeleteRaceResponse
+	(*ListAuditEventsRequest)(nil),       // 20: racing.ListAuditEventsRequest
+	(*ListAuditEventsResponse)(nil),      // 21: racing.ListAuditEventsResponse
+	(*ListAuditEventsRequestFilter)(nil), // 22: racing.ListAuditEventsRequestFilter
+	(*Race)(nil),                         // 23: racing.Race
+	(*RaceEvent)(nil),                    // 24: racing.RaceEvent
+	(*AuditEvent)(nil),                   // 25: racing.AuditEvent
+	(*RaceChange)(nil),                   // 26: racing.RaceChange
+	(*timestamppb.Timestamp)(nil),        // 27: google.protobuf.Timestamp
+}
+var file_racing_racing_proto_depIdxs = []int32{
+	6,  // 0: racing.ListRacesRequest.filter:type_name -> racing.ListRacesRequestFilter
+	23, // 1: racing.ListRacesResponse.races:type_name -> racing.Race
+	6,  // 2: racing.WatchRacesRequest.filter:type_name -> racing.ListRacesRequestFilter
+	24, // 3: racing.WatchRacesResponse.event:type_name -> racing.RaceEvent
+	23, // 4: racing.ImportRacesRequest.race:type_name -> racing.Race
+	11, // 5: racing.ImportRacesResponse.rows:type_name -> racing.ImportRaceResult
+	0,  // 6: racing.ImportRaceResult.outcome:type_name -> racing.ImportRaceResult.Outcome
+	6,  // 7: racing.ExportRacesRequest.filter:type_name -> racing.ListRacesRequestFilter
+	23, // 8: racing.ExportRacesResponse.race:type_name -> racing.Race
+	23, // 9: racing.UpdateRaceRequest.race:type_name -> racing.Race
+	23, // 10: racing.UpdateRaceResponse.race:type_name -> racing.Race
+	23, // 11: racing.DeleteRaceResponse.race:type_name -> racing.Race
+	23, // 12: racing.UndeleteRaceResponse.race:type_name -> racing.Race
+	22, // 13: racing.ListAuditEventsRequest.filter:type_name -> racing.ListAuditEventsRequestFilter
+	25, // 14: racing.ListAuditEventsResponse.events:type_name -> racing.AuditEvent
+	27, // 15: racing.ListAuditEventsRequestFilter.start_time:type_name -> google.protobuf.Timestamp
+	27, // 16: racing.ListAuditEventsRequestFilter.end_time:type_name -> google.protobuf.Timestamp
+	27, // 17: racing.Race.advertised_start_time:type_name -> google.protobuf.Timestamp
+	27, // 18: racing.Race.delete_time:type_name -> google.protobuf.Timestamp
+	1,  // 19: racing.Race.status:type_name -> racing.Race.Status
+	2,  // 20: racing.RaceEvent.type:type_name -> racing.RaceEvent.Type
+	23, // 21: racing.RaceEvent.race:type_name -> racing.Race
+	27, // 22: racing.AuditEvent.time:type_name -> google.protobuf.Timestamp
+	3,  // 23: racing.AuditEvent.action:type_name -> racing.AuditEvent.Action
+	3,  // 24: racing.RaceChange.action:type_name -> racing.AuditEvent.Action
+	23, // 25: racing.RaceChange.race:type_name -> racing.Race
+	27, // 26: racing.RaceChange.time:type_name -> google.protobuf.Timestamp
+	4,  // 27: racing.Racing.ListRaces:input_type -> racing.ListRacesRequest
+	7,  // 28: racing.Racing.WatchRaces:input_type -> racing.WatchRacesRequest
+	9,  // 29: racing.Racing.ImportRaces:input_type -> racing.ImportRacesRequest
+	12, // 30: racing.Racing.ExportRaces:input_type -> racing.ExportRacesRequest
+	14, // 31: racing.Racing.UpdateRace:input_type -> racing.UpdateRaceRequest
+	16, // 32: racing.Racing.DeleteRace:input_type -> racing.DeleteRaceRequest
+	18, // 33: racing.Racing.UndeleteRace:input_type -> racing.UndeleteRaceRequest
+	20, // 34: racing.Racing.ListAuditEvents:input_type -> racing.ListAuditEventsRequest
+	5,  // 35: racing.Racing.ListRaces:output_type -> racing.ListRacesResponse
+	8,  // 36: racing.Racing.WatchRaces:output_type -> racing.WatchRacesResponse
+	10, // 37: racing.Racing.ImportRaces:output_type -> racing.ImportRacesResponse
+	13, // 38: racing.Racing.ExportRaces:output_type -> racing.ExportRacesResponse
+	15, // 39: racing.Racing.UpdateRace:output_type -> racing.UpdateRaceResponse
+	17, // 40: racing.Racing.DeleteRace:output_type -> racing.DeleteRaceResponse
+	19, // 41: racing.Racing.UndeleteRace:output_type -> racing.UndeleteRaceResponse
+	21, // 42: racing.Racing.ListAuditEvents:output_type -> racing.ListAuditEventsResponse
+	35, // [35:43] is the sub-list for method output_type
+	27, // [27:35] is the sub-list for method input_type
+	27, // [27:27] is the sub-list for extension type_name
+	27, // [27:27] is the sub-list for extension extendee
+	0,  // [0:27] is the sub-list for field type_name
+}
+
+func init() { file_racing_racing_proto_init() }
+func file_racing_racing_proto_init() {
+	if File_racing_racing_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_racing_racing_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListRacesRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
 			case 2:
 				return &v.unknownFields
 			default:
@@ -380,6 +2122,198 @@ func file_racing_racing_proto_init() {
 			}
 		}
 		file_racing_racing_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*WatchRacesRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*WatchRacesResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ImportRacesRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ImportRacesResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ImportRaceResult); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ExportRacesRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ExportRacesResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UpdateRaceRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UpdateRaceResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DeleteRaceRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[13].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DeleteRaceResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[14].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UndeleteRaceRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[15].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UndeleteRaceResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[16].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListAuditEventsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[17].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListAuditEventsResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[18].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListAuditEventsRequestFilter); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[19].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*Race); i {
 			case 0:
 				return &v.state
@@ -391,19 +2325,56 @@ func file_racing_racing_proto_init() {
 				return nil
 			}
 		}
+		file_racing_racing_proto_msgTypes[20].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*RaceEvent); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[21].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*AuditEvent); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_racing_racing_proto_msgTypes[22].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*RaceChange); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_racing_racing_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   4,
+			NumEnums:      4,
+			NumMessages:   23,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_racing_racing_proto_goTypes,
 		DependencyIndexes: file_racing_racing_proto_depIdxs,
+		EnumInfos:         file_racing_racing_proto_enumTypes,
 		MessageInfos:      file_racing_racing_proto_msgTypes,
 	}.Build()
 	File_racing_racing_proto = out.File
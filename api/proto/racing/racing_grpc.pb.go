@@ -20,6 +20,26 @@ const _ = grpc.SupportPackageIsVersion7
 type RacingClient interface {
 	// ListRaces returns a list of all races.
 	ListRaces(ctx context.Context, in *ListRacesRequest, opts ...grpc.CallOption) (*ListRacesResponse, error)
+	// WatchRaces returns the races matching a filter, followed by changes to them as they happen. It is served at
+	// /v1/races:watch over server-sent events and websockets rather than by the gateway.
+	WatchRaces(ctx context.Context, in *WatchRacesRequest, opts ...grpc.CallOption) (Racing_WatchRacesClient, error)
+	// ImportRaces creates or updates the streamed races by external ID, in a single transaction, and reports on each.
+	// It is not served by the gateway; use the racing import command or call racing directly.
+	ImportRaces(ctx context.Context, opts ...grpc.CallOption) (Racing_ImportRacesClient, error)
+	// ExportRaces streams the races matching a filter. It is not served by the gateway; use the racing export command
+	// or call racing directly.
+	ExportRaces(ctx context.Context, in *ExportRacesRequest, opts ...grpc.CallOption) (Racing_ExportRacesClient, error)
+	// UpdateRace replaces the details of a race, unless it has changed since the version identified by an etag. The
+	// etag may be given by an If-Match header.
+	UpdateRace(ctx context.Context, in *UpdateRaceRequest, opts ...grpc.CallOption) (*UpdateRaceResponse, error)
+	// DeleteRace soft deletes a race, unless it has changed since the version identified by an etag. The etag may be
+	// given by an If-Match header. Deleted races are hidden from listings, and purged after a retention period.
+	DeleteRace(ctx context.Context, in *DeleteRaceRequest, opts ...grpc.CallOption) (*DeleteRaceResponse, error)
+	// UndeleteRace restores a deleted race that hasn't been purged, unless it has changed since the version identified
+	// by an etag. The etag may be given by an If-Match header.
+	UndeleteRace(ctx context.Context, in *UndeleteRaceRequest, opts ...grpc.CallOption) (*UndeleteRaceResponse, error)
+	// ListAuditEvents returns the audit events of changes to races matching a filter, oldest first.
+	ListAuditEvents(ctx context.Context, in *ListAuditEventsRequest, opts ...grpc.CallOption) (*ListAuditEventsResponse, error)
 }
 
 type racingClient struct {
@@ -39,12 +59,166 @@ func (c *racingClient) ListRaces(ctx context.Context, in *ListRacesRequest, opts
 	return out, nil
 }
 
+func (c *racingClient) WatchRaces(ctx context.Context, in *WatchRacesRequest, opts ...grpc.CallOption) (Racing_WatchRacesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Racing_ServiceDesc.Streams[0], "/racing.Racing/WatchRaces", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &racingWatchRacesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Racing_WatchRacesClient interface {
+	Recv() (*WatchRacesResponse, error)
+	grpc.ClientStream
+}
+
+type racingWatchRacesClient struct {
+	grpc.ClientStream
+}
+
+func (x *racingWatchRacesClient) Recv() (*WatchRacesResponse, error) {
+	m := new(WatchRacesResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *racingClient) ImportRaces(ctx context.Context, opts ...grpc.CallOption) (Racing_ImportRacesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Racing_ServiceDesc.Streams[1], "/racing.Racing/ImportRaces", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &racingImportRacesClient{stream}
+	return x, nil
+}
+
+type Racing_ImportRacesClient interface {
+	Send(*ImportRacesRequest) error
+	CloseAndRecv() (*ImportRacesResponse, error)
+	grpc.ClientStream
+}
+
+type racingImportRacesClient struct {
+	grpc.ClientStream
+}
+
+func (x *racingImportRacesClient) Send(m *ImportRacesRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *racingImportRacesClient) CloseAndRecv() (*ImportRacesResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ImportRacesResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *racingClient) ExportRaces(ctx context.Context, in *ExportRacesRequest, opts ...grpc.CallOption) (Racing_ExportRacesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Racing_ServiceDesc.Streams[2], "/racing.Racing/ExportRaces", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &racingExportRacesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Racing_ExportRacesClient interface {
+	Recv() (*ExportRacesResponse, error)
+	grpc.ClientStream
+}
+
+type racingExportRacesClient struct {
+	grpc.ClientStream
+}
+
+func (x *racingExportRacesClient) Recv() (*ExportRacesResponse, error) {
+	m := new(ExportRacesResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *racingClient) UpdateRace(ctx context.Context, in *UpdateRaceRequest, opts ...grpc.CallOption) (*UpdateRaceResponse, error) {
+	out := new(UpdateRaceResponse)
+	err := c.cc.Invoke(ctx, "/racing.Racing/UpdateRace", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *racingClient) DeleteRace(ctx context.Context, in *DeleteRaceRequest, opts ...grpc.CallOption) (*DeleteRaceResponse, error) {
+	out := new(DeleteRaceResponse)
+	err := c.cc.Invoke(ctx, "/racing.Racing/DeleteRace", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *racingClient) UndeleteRace(ctx context.Context, in *UndeleteRaceRequest, opts ...grpc.CallOption) (*UndeleteRaceResponse, error) {
+	out := new(UndeleteRaceResponse)
+	err := c.cc.Invoke(ctx, "/racing.Racing/UndeleteRace", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *racingClient) ListAuditEvents(ctx context.Context, in *ListAuditEventsRequest, opts ...grpc.CallOption) (*ListAuditEventsResponse, error) {
+	out := new(ListAuditEventsResponse)
+	err := c.cc.Invoke(ctx, "/racing.Racing/ListAuditEvents", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // RacingServer is the server API for Racing service.
 // All implementations must embed UnimplementedRacingServer
 // for forward compatibility
 type RacingServer interface {
 	// ListRaces returns a list of all races.
 	ListRaces(context.Context, *ListRacesRequest) (*ListRacesResponse, error)
+	// WatchRaces returns the races matching a filter, followed by changes to them as they happen. It is served at
+	// /v1/races:watch over server-sent events and websockets rather than by the gateway.
+	WatchRaces(*WatchRacesRequest, Racing_WatchRacesServer) error
+	// ImportRaces creates or updates the streamed races by external ID, in a single transaction, and reports on each.
+	// It is not served by the gateway; use the racing import command or call racing directly.
+	ImportRaces(Racing_ImportRacesServer) error
+	// ExportRaces streams the races matching a filter. It is not served by the gateway; use the racing export command
+	// or call racing directly.
+	ExportRaces(*ExportRacesRequest, Racing_ExportRacesServer) error
+	// UpdateRace replaces the details of a race, unless it has changed since the version identified by an etag. The
+	// etag may be given by an If-Match header.
+	UpdateRace(context.Context, *UpdateRaceRequest) (*UpdateRaceResponse, error)
+	// DeleteRace soft deletes a race, unless it has changed since the version identified by an etag. The etag may be
+	// given by an If-Match header. Deleted races are hidden from listings, and purged after a retention period.
+	DeleteRace(context.Context, *DeleteRaceRequest) (*DeleteRaceResponse, error)
+	// UndeleteRace restores a deleted race that hasn't been purged, unless it has changed since the version identified
+	// by an etag. The etag may be given by an If-Match header.
+	UndeleteRace(context.Context, *UndeleteRaceRequest) (*UndeleteRaceResponse, error)
+	// ListAuditEvents returns the audit events of changes to races matching a filter, oldest first.
+	ListAuditEvents(context.Context, *ListAuditEventsRequest) (*ListAuditEventsResponse, error)
 	mustEmbedUnimplementedRacingServer()
 }
 
@@ -55,6 +229,27 @@ type UnimplementedRacingServer struct {
 func (UnimplementedRacingServer) ListRaces(context.Context, *ListRacesRequest) (*ListRacesResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ListRaces not implemented")
 }
+func (UnimplementedRacingServer) WatchRaces(*WatchRacesRequest, Racing_WatchRacesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchRaces not implemented")
+}
+func (UnimplementedRacingServer) ImportRaces(Racing_ImportRacesServer) error {
+	return status.Errorf(codes.Unimplemented, "method ImportRaces not implemented")
+}
+func (UnimplementedRacingServer) ExportRaces(*ExportRacesRequest, Racing_ExportRacesServer) error {
+	return status.Errorf(codes.Unimplemented, "method ExportRaces not implemented")
+}
+func (UnimplementedRacingServer) UpdateRace(context.Context, *UpdateRaceRequest) (*UpdateRaceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateRace not implemented")
+}
+func (UnimplementedRacingServer) DeleteRace(context.Context, *DeleteRaceRequest) (*DeleteRaceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteRace not implemented")
+}
+func (UnimplementedRacingServer) UndeleteRace(context.Context, *UndeleteRaceRequest) (*UndeleteRaceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UndeleteRace not implemented")
+}
+func (UnimplementedRacingServer) ListAuditEvents(context.Context, *ListAuditEventsRequest) (*ListAuditEventsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAuditEvents not implemented")
+}
 func (UnimplementedRacingServer) mustEmbedUnimplementedRacingServer() {}
 
 // UnsafeRacingServer may be embedded to opt out of forward compatibility for this service.
@@ -86,6 +281,146 @@ func _Racing_ListRaces_Handler(srv interface{}, ctx context.Context, dec func(in
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Racing_WatchRaces_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRacesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RacingServer).WatchRaces(m, &racingWatchRacesServer{stream})
+}
+
+type Racing_WatchRacesServer interface {
+	Send(*WatchRacesResponse) error
+	grpc.ServerStream
+}
+
+type racingWatchRacesServer struct {
+	grpc.ServerStream
+}
+
+func (x *racingWatchRacesServer) Send(m *WatchRacesResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Racing_ImportRaces_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RacingServer).ImportRaces(&racingImportRacesServer{stream})
+}
+
+type Racing_ImportRacesServer interface {
+	SendAndClose(*ImportRacesResponse) error
+	Recv() (*ImportRacesRequest, error)
+	grpc.ServerStream
+}
+
+type racingImportRacesServer struct {
+	grpc.ServerStream
+}
+
+func (x *racingImportRacesServer) SendAndClose(m *ImportRacesResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *racingImportRacesServer) Recv() (*ImportRacesRequest, error) {
+	m := new(ImportRacesRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Racing_ExportRaces_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportRacesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RacingServer).ExportRaces(m, &racingExportRacesServer{stream})
+}
+
+type Racing_ExportRacesServer interface {
+	Send(*ExportRacesResponse) error
+	grpc.ServerStream
+}
+
+type racingExportRacesServer struct {
+	grpc.ServerStream
+}
+
+func (x *racingExportRacesServer) Send(m *ExportRacesResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Racing_UpdateRace_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateRaceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RacingServer).UpdateRace(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/racing.Racing/UpdateRace",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RacingServer).UpdateRace(ctx, req.(*UpdateRaceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Racing_DeleteRace_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRaceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RacingServer).DeleteRace(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/racing.Racing/DeleteRace",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RacingServer).DeleteRace(ctx, req.(*DeleteRaceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Racing_UndeleteRace_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UndeleteRaceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RacingServer).UndeleteRace(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/racing.Racing/UndeleteRace",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RacingServer).UndeleteRace(ctx, req.(*UndeleteRaceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Racing_ListAuditEvents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAuditEventsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RacingServer).ListAuditEvents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/racing.Racing/ListAuditEvents",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RacingServer).ListAuditEvents(ctx, req.(*ListAuditEventsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Racing_ServiceDesc is the grpc.ServiceDesc for Racing service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -97,7 +432,39 @@ var Racing_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ListRaces",
 			Handler:    _Racing_ListRaces_Handler,
 		},
+		{
+			MethodName: "UpdateRace",
+			Handler:    _Racing_UpdateRace_Handler,
+		},
+		{
+			MethodName: "DeleteRace",
+			Handler:    _Racing_DeleteRace_Handler,
+		},
+		{
+			MethodName: "UndeleteRace",
+			Handler:    _Racing_UndeleteRace_Handler,
+		},
+		{
+			MethodName: "ListAuditEvents",
+			Handler:    _Racing_ListAuditEvents_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchRaces",
+			Handler:       _Racing_WatchRaces_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ImportRaces",
+			Handler:       _Racing_ImportRaces_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ExportRaces",
+			Handler:       _Racing_ExportRaces_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "racing/racing.proto",
 }
@@ -0,0 +1,45 @@
+package racing
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// DeriveStatus sets the status of x as of now: CLOSED once its advertised start time has passed, and OPEN before.
+func (x *Race) DeriveStatus(now time.Time) {
+	if x.GetAdvertisedStartTime().AsTime().After(now) {
+		x.Status = Race_OPEN
+	} else {
+		x.Status = Race_CLOSED
+	}
+}
+
+// DeriveStatuses derives the status of every race in m as of now, so that a response kept for a while doesn't show
+// races as open once they have started.
+func DeriveStatuses(m proto.Message, now time.Time) {
+	deriveStatuses(m.ProtoReflect(), now)
+}
+
+func deriveStatuses(m protoreflect.Message, now time.Time) {
+	if race, ok := m.Interface().(*Race); ok {
+		race.DeriveStatus(now)
+
+		return
+	}
+
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.Message() == nil || fd.IsMap():
+		case fd.IsList():
+			for i := 0; i < v.List().Len(); i++ {
+				deriveStatuses(v.List().Get(i).Message(), now)
+			}
+		default:
+			deriveStatuses(v.Message(), now)
+		}
+
+		return true
+	})
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Config configures rate limiting.
+type Config struct {
+	// Enabled turns rate limiting on.
+	Enabled bool `yaml:"enabled"`
+	// Default is the limit applied to routes without a limit of their own.
+	Default Limit `yaml:"default"`
+	// Routes are the per route limits. The first route matching a request applies.
+	Routes []RouteConfig `yaml:"routes"`
+	// TrustForwardedFor identifies anonymous clients by the first X-Forwarded-For address rather than the peer
+	// address. Only enable this behind a proxy that sets the header.
+	TrustForwardedFor bool `yaml:"trust_forwarded_for"`
+}
+
+// Limit is a token bucket limit.
+type Limit struct {
+	// Rate is the number of requests per second a client is allowed on average.
+	Rate float64 `yaml:"rate"`
+	// Burst is the number of requests a client may make at once.
+	Burst int `yaml:"burst"`
+}
+
+// RouteConfig is the limit of a route.
+type RouteConfig struct {
+	// Method is the HTTP method of the route. Empty matches any method.
+	Method string `yaml:"method"`
+	// Path is the path of the route. A trailing "*" matches any path with the preceding prefix.
+	Path  string `yaml:"path"`
+	Limit `yaml:",inline"`
+}
+
+// matches reports whether r is a request for the route.
+func (c RouteConfig) matches(r *http.Request) bool {
+	if c.Method != "" && !strings.EqualFold(c.Method, r.Method) {
+		return false
+	}
+
+	if strings.HasSuffix(c.Path, "*") {
+		return strings.HasPrefix(r.URL.Path, strings.TrimSuffix(c.Path, "*"))
+	}
+
+	return r.URL.Path == c.Path
+}
+
+// name identifies the route in bucket keys.
+func (c RouteConfig) name() string {
+	return c.Method + " " + c.Path
+}
+
+// validate checks the limit is usable.
+func (l Limit) validate() error {
+	if l.Rate <= 0 || l.Burst <= 0 {
+		return fmt.Errorf("rate and burst must be greater than 0, got rate %v burst %d", l.Rate, l.Burst)
+	}
+
+	return nil
+}
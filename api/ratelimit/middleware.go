@@ -0,0 +1,148 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"git.neds.sh/matty/entain/api/auth"
+	"git.neds.sh/matty/entain/api/logging"
+	"git.neds.sh/matty/entain/api/problem"
+)
+
+// defaultRouteName identifies the default limit in bucket keys.
+const defaultRouteName = "default"
+
+// Limiter rate limits requests per client and route.
+type Limiter struct {
+	cfg   Config
+	store Store
+	now   func() time.Time
+}
+
+// NewLimiter creates a Limiter that keeps its buckets in store.
+func NewLimiter(cfg Config, store Store) (*Limiter, error) {
+	if cfg.Enabled {
+		if err := cfg.Default.validate(); err != nil {
+			return nil, fmt.Errorf("default rate limit: %w", err)
+		}
+
+		for _, route := range cfg.Routes {
+			if err := route.validate(); err != nil {
+				return nil, fmt.Errorf("rate limit for %s: %w", route.name(), err)
+			}
+		}
+	}
+
+	return &Limiter{cfg: cfg, store: store, now: time.Now}, nil
+}
+
+// AddressMiddleware rejects requests over their limit with a 429, identifying clients by their address. It runs ahead
+// of auth.Authenticator.Middleware, so that every request is counted before any work is done for it, including those
+// whose credentials are rejected, which would otherwise allow credentials to be guessed without limit.
+func (l *Limiter) AddressMiddleware(next http.Handler) http.Handler {
+	if !l.cfg.Enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.serve(w, r, next, l.addressKey(r))
+	})
+}
+
+// Middleware rejects authenticated requests over their limit with a 429, identifying clients by their subject, so
+// that a client is limited across all of its addresses. Requests must have been authenticated by
+// auth.Authenticator.Middleware first; anonymous requests are only limited by AddressMiddleware.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	if !l.cfg.Enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := auth.FromContext(r.Context())
+		if !ok || identity.Subject == "" {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		l.serve(w, r, next, identity.Method+":"+identity.Subject)
+	})
+}
+
+// serve takes a token for the client identified by clientKey from the bucket of the route r is for, passing r on to
+// next if there was one.
+func (l *Limiter) serve(w http.ResponseWriter, r *http.Request, next http.Handler, clientKey string) {
+	routeName, limit := l.limitFor(r)
+
+	result, err := l.store.Take(r.Context(), routeName+"|"+clientKey, limit, l.now())
+	if err != nil {
+		// Fail open, an unavailable store should not take the gateway down with it.
+		logging.FromContext(r.Context()).WithError(err).Error("failed checking rate limit")
+
+		next.ServeHTTP(w, r)
+
+		return
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+
+	if !result.Allowed {
+		p, _ := problem.New(r.Context(), r, status.Error(codes.ResourceExhausted, "rate limit exceeded"))
+		problem.Write(r.Context(), w, p, ceilSeconds(result.RetryAfter))
+
+		return
+	}
+
+	next.ServeHTTP(w, r)
+}
+
+// limitFor returns the name and limit of the route r is for.
+func (l *Limiter) limitFor(r *http.Request) (string, Limit) {
+	for _, route := range l.cfg.Routes {
+		if route.matches(r) {
+			return route.name(), route.Limit
+		}
+	}
+
+	return defaultRouteName, l.cfg.Default
+}
+
+// ClientKey identifies the client making r by its authenticated subject, or by its address if it is anonymous.
+// Requests are only identified by subject once they have been authenticated by auth.Authenticator.Middleware.
+func (l *Limiter) ClientKey(r *http.Request) string {
+	if identity, ok := auth.FromContext(r.Context()); ok && identity.Subject != "" {
+		return identity.Method + ":" + identity.Subject
+	}
+
+	return l.addressKey(r)
+}
+
+// addressKey identifies the client making r by its address.
+func (l *Limiter) addressKey(r *http.Request) string {
+	if l.cfg.TrustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return "ip:" + strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,228 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.neds.sh/matty/entain/api/auth"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	limit := Limit{Rate: 2, Burst: 2}
+
+	for _, tc := range []struct {
+		name   string
+		giveAt []time.Duration
+		expect Result
+	}{
+		{
+			name:   "first",
+			giveAt: []time.Duration{0},
+			expect: Result{Allowed: true, Remaining: 1, ResetAfter: 500 * time.Millisecond},
+		},
+		{
+			name:   "burst_exhausted",
+			giveAt: []time.Duration{0, 0, 0},
+			expect: Result{Allowed: false, Remaining: 0, RetryAfter: 500 * time.Millisecond, ResetAfter: time.Second},
+		},
+		{
+			name:   "refilled",
+			giveAt: []time.Duration{0, 0, 500 * time.Millisecond},
+			expect: Result{Allowed: true, Remaining: 0, ResetAfter: time.Second},
+		},
+		{
+			name:   "refill_capped_at_burst",
+			giveAt: []time.Duration{0, time.Hour},
+			expect: Result{Allowed: true, Remaining: 1, ResetAfter: 500 * time.Millisecond},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			store := NewMemoryStore(time.Minute)
+
+			var actual Result
+
+			for _, at := range tc.giveAt {
+				var err error
+
+				actual, err = store.Take(context.Background(), "key", limit, start.Add(at))
+				require.NoError(t, err, "Take")
+			}
+
+			assert.Equal(t, tc.expect, actual, "result")
+		})
+	}
+}
+
+func TestLimiterMiddleware(t *testing.T) {
+	t.Parallel()
+
+	cfg := Config{
+		Enabled: true,
+		Default: Limit{Rate: 1, Burst: 2},
+		Routes: []RouteConfig{
+			{Method: http.MethodPost, Path: "/v1/list-races", Limit: Limit{Rate: 1, Burst: 1}},
+		},
+	}
+
+	type request struct {
+		path   string
+		remote string
+		// apiKey is sent on the X-API-Key header, if set.
+		apiKey string
+	}
+
+	for _, tc := range []struct {
+		name                string
+		give                []request
+		expectStatus        int
+		expectRemaining     string
+		expectRetryAfter    string
+		expectAuthenticated int
+	}{
+		{
+			name:                "allowed",
+			give:                []request{{path: "/v1/list-races", remote: "10.0.0.1:1234"}},
+			expectStatus:        http.StatusOK,
+			expectRemaining:     "0",
+			expectAuthenticated: 1,
+		},
+		{
+			// Requests over the limit are rejected before they are authenticated.
+			name: "route_limit_exceeded",
+			give: []request{
+				{path: "/v1/list-races", remote: "10.0.0.1:1234"},
+				{path: "/v1/list-races", remote: "10.0.0.1:5678"},
+			},
+			expectStatus:        http.StatusTooManyRequests,
+			expectRemaining:     "0",
+			expectRetryAfter:    "1",
+			expectAuthenticated: 1,
+		},
+		{
+			name: "default_limit",
+			give: []request{
+				{path: "/v1/list-races", remote: "10.0.0.1:1234"},
+				{path: "/v1/other", remote: "10.0.0.1:1234"},
+			},
+			expectStatus:        http.StatusOK,
+			expectRemaining:     "1",
+			expectAuthenticated: 2,
+		},
+		{
+			name: "separate_clients",
+			give: []request{
+				{path: "/v1/list-races", remote: "10.0.0.1:1234"},
+				{path: "/v1/list-races", remote: "10.0.0.2:1234"},
+			},
+			expectStatus:        http.StatusOK,
+			expectRemaining:     "0",
+			expectAuthenticated: 2,
+		},
+		{
+			name: "subject_shared_across_addresses",
+			give: []request{
+				{path: "/v1/list-races", remote: "10.0.0.1:1234", apiKey: "partner-key"},
+				{path: "/v1/list-races", remote: "10.0.0.2:1234", apiKey: "partner-key"},
+			},
+			expectStatus:        http.StatusTooManyRequests,
+			expectRemaining:     "0",
+			expectRetryAfter:    "1",
+			expectAuthenticated: 2,
+		},
+		{
+			name: "address_shared_with_subject",
+			give: []request{
+				{path: "/v1/list-races", remote: "10.0.0.1:1234"},
+				{path: "/v1/list-races", remote: "10.0.0.1:1234", apiKey: "partner-key"},
+			},
+			expectStatus:        http.StatusTooManyRequests,
+			expectRemaining:     "0",
+			expectRetryAfter:    "1",
+			expectAuthenticated: 1,
+		},
+		{
+			// Requests with invalid credentials are limited too, so that credentials can't be guessed without limit.
+			name: "invalid_credentials",
+			give: []request{
+				{path: "/v1/list-races", remote: "10.0.0.1:1234", apiKey: "guess-1"},
+				{path: "/v1/list-races", remote: "10.0.0.1:1234", apiKey: "guess-2"},
+			},
+			expectStatus:        http.StatusTooManyRequests,
+			expectRemaining:     "0",
+			expectRetryAfter:    "1",
+			expectAuthenticated: 1,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			limiter, err := NewLimiter(cfg, NewMemoryStore(time.Minute))
+			require.NoError(t, err, "NewLimiter")
+
+			now := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+			limiter.now = func() time.Time { return now }
+
+			var actualAuthenticated int
+
+			authenticator, err := auth.NewAuthenticator(auth.Config{
+				APIKeys: []auth.APIKeyConfig{{Key: "partner-key", Subject: "partner"}},
+			})
+			require.NoError(t, err, "NewAuthenticator")
+
+			// Requests are limited around authentication as they are by the api server.
+			authenticated := authenticator.Middleware(limiter.Middleware(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+			))
+			handler := limiter.AddressMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actualAuthenticated++
+				authenticated.ServeHTTP(w, r)
+			}))
+
+			var rec *httptest.ResponseRecorder
+
+			for _, give := range tc.give {
+				req := httptest.NewRequest(http.MethodPost, give.path, nil)
+				req.RemoteAddr = give.remote
+
+				if give.apiKey != "" {
+					req.Header.Set(auth.APIKeyHeader, give.apiKey)
+				}
+
+				rec = httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+			}
+
+			assert.Equal(t, tc.expectStatus, rec.Code, "status")
+			assert.Equal(t, tc.expectRemaining, rec.Header().Get("RateLimit-Remaining"), "RateLimit-Remaining")
+			assert.Equal(t, tc.expectRetryAfter, rec.Header().Get("Retry-After"), "Retry-After")
+			assert.Equal(t, tc.expectAuthenticated, actualAuthenticated, "authenticated")
+		})
+	}
+}
+
+func TestNewLimiterInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewLimiter(Config{
+		Enabled: true,
+		Default: Limit{Rate: 1, Burst: 1},
+		Routes:  []RouteConfig{{Path: "/v1/list-races"}},
+	}, NewMemoryStore(time.Minute))
+
+	assert.EqualError(t, err, "rate limit for  /v1/list-races: rate and burst must be greater than 0, got rate 0 burst 0")
+}
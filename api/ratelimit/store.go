@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	// Allowed reports whether a token was taken.
+	Allowed bool
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// RetryAfter is how long until a token is next available. It is zero if Allowed.
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket is full again.
+	ResetAfter time.Duration
+}
+
+// Store holds token buckets. It is an interface so that buckets can be kept in a backend shared between gateway
+// instances.
+type Store interface {
+	// Take takes a token from the bucket identified by key, creating it full if it does not exist.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// fullAt is when the bucket will have refilled.
+	fullAt time.Time
+}
+
+// MemoryStore is a Store holding buckets in memory.
+type MemoryStore struct {
+	mu            sync.Mutex
+	buckets       map[string]*bucket
+	sweepInterval time.Duration
+	lastSweep     time.Time
+}
+
+// NewMemoryStore creates a new MemoryStore. Buckets that have refilled are removed every sweepInterval.
+func NewMemoryStore(sweepInterval time.Duration) *MemoryStore {
+	return &MemoryStore{
+		buckets:       map[string]*bucket{},
+		sweepInterval: sweepInterval,
+	}
+}
+
+// Take implements Store.
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= s.sweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+
+	return take(b, limit, now), nil
+}
+
+// sweep removes the buckets that have refilled, as they are equivalent to a missing bucket.
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if !now.Before(b.fullAt) {
+			delete(s.buckets, key)
+		}
+	}
+
+	s.lastSweep = now
+}
+
+// take refills b for the time elapsed since it was last updated and then takes a token from it, if there is one.
+func take(b *bucket, limit Limit, now time.Time) Result {
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed.Seconds()*limit.Rate)
+		b.updated = now
+	}
+
+	result := Result{Allowed: b.tokens >= 1}
+
+	if result.Allowed {
+		b.tokens--
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / limit.Rate)
+	}
+
+	result.Remaining = int(b.tokens)
+	result.ResetAfter = secondsToDuration((float64(limit.Burst) - b.tokens) / limit.Rate)
+
+	b.fullAt = now.Add(result.ResetAfter)
+
+	return result
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,55 @@
+package securityheaders
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		give   Config
+		expect http.Header
+	}{
+		{
+			name: "default",
+			expect: http.Header{
+				"Content-Security-Policy": []string{"default-src 'none'; frame-ancestors 'none'"},
+				"Referrer-Policy":         []string{"no-referrer"},
+				"X-Content-Type-Options":  []string{"nosniff"},
+				"X-Frame-Options":         []string{"DENY"},
+			},
+		},
+		{
+			name: "configured",
+			give: Config{"strict-transport-security": "max-age=31536000", "X-Content-Type-Options": "nosniff"},
+			expect: http.Header{
+				"Strict-Transport-Security": []string{"max-age=31536000"},
+				"X-Content-Type-Options":    []string{"nosniff"},
+			},
+		},
+		{
+			name:   "none",
+			give:   Config{},
+			expect: http.Header{},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			handler := Middleware(tc.give, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/list-races", nil))
+
+			assert.Equal(t, tc.expect, rec.Header(), "header")
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Setup installs the global provider and propagator, so its tests don't run in parallel, and restore them after.
+func TestSetup(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		giveExporter   string
+		expectExported bool
+		expectError    string
+	}{
+		{
+			name:         "success_none",
+			giveExporter: ExporterNone,
+		},
+		{
+			name: "success_unset",
+		},
+		{
+			name:           "success_stdout",
+			giveExporter:   ExporterStdout,
+			expectExported: true,
+		},
+		{
+			name:         "unknown_exporter",
+			giveExporter: "carrier-pigeon",
+			expectError:  `unknown trace exporter "carrier-pigeon"`,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+
+			t.Cleanup(func() {
+				otel.SetTracerProvider(provider)
+				otel.SetTextMapPropagator(propagator)
+			})
+
+			var written bytes.Buffer
+
+			shutdown, err := Setup(context.Background(), Config{
+				ServiceName: "TestService123",
+				Exporter:    tc.giveExporter,
+				Writer:      &written,
+			})
+
+			if tc.expectError != "" {
+				assert.EqualError(t, err, tc.expectError, "Setup")
+
+				return
+			}
+
+			require.NoError(t, err, "Setup")
+
+			// Spans are recorded with valid IDs whether they are exported or not.
+			ctx, span := otel.Tracer("test").Start(context.Background(), "TestSpan123")
+			assert.True(t, span.SpanContext().IsValid(), "span context valid")
+			span.End()
+
+			carrier := propagation.HeaderCarrier(http.Header{})
+			otel.GetTextMapPropagator().Inject(ctx, carrier)
+			assert.NotEmpty(t, carrier.Get("traceparent"), "traceparent")
+
+			require.NoError(t, shutdown(context.Background()), "shutdown")
+
+			if tc.expectExported {
+				assert.Contains(t, written.String(), "TestSpan123", "span exported")
+				assert.Contains(t, written.String(), "TestService123", "service exported")
+			} else {
+				assert.Empty(t, written.String(), "exported")
+			}
+		})
+	}
+}
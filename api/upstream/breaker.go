@@ -0,0 +1,146 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// State is the state of a circuit breaker.
+type State int
+
+const (
+	// StateClosed lets every call through.
+	StateClosed State = iota
+	// StateHalfOpen lets a single call through, to probe whether the service has recovered.
+	StateHalfOpen
+	// StateOpen fails every call fast.
+	StateOpen
+)
+
+// String returns the name of s.
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateHalfOpen:
+		return "half_open"
+	case StateOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker is a circuit breaker. Its zero value is disabled, always letting calls through.
+type breaker struct {
+	mu       sync.Mutex
+	cfg      CircuitBreaker
+	failures int
+	openedAt time.Time
+	// probe identifies the call probing the service while half open, or is 0 if there is none. probes counts the
+	// probes made, so that each has an ID of its own.
+	probe  uint64
+	probes uint64
+
+	// now is the current time, replaced in tests.
+	now func() time.Time
+}
+
+func newBreaker() *breaker {
+	return &breaker{now: time.Now}
+}
+
+// configure reconfigures b, keeping its state.
+func (b *breaker) configure(cfg CircuitBreaker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cfg = cfg
+}
+
+// permit is a call let through by a breaker.
+type permit struct {
+	// probe identifies the probe the call is, or is 0 if it isn't probing the service.
+	probe uint64
+}
+
+// allow reports whether a call may be made, and if not, how long until one may be. Calls that are allowed must be
+// reported to record with the permit they were given.
+func (b *breaker) allow() (permit, bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state() {
+	case StateOpen:
+		return permit{}, false, b.openedAt.Add(b.cfg.OpenTimeout).Sub(b.now())
+	case StateHalfOpen:
+		if b.probe != 0 {
+			// Another call is probing the service, so others wait until it has finished.
+			return permit{}, false, b.cfg.OpenTimeout
+		}
+
+		b.probes++
+		b.probe = b.probes
+
+		return permit{probe: b.probe}, true, 0
+	case StateClosed:
+	}
+
+	return permit{}, true, 0
+}
+
+// record records the result of the call allowed with p. Only the probe itself finishes probing, so that calls allowed
+// before the breaker opened don't let another probe through while one is still running.
+func (b *breaker) record(p permit, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	probe := p.probe != 0 && p.probe == b.probe
+	if probe {
+		b.probe = 0
+	}
+
+	if !isFailure(err) {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+
+	if b.cfg.FailureThreshold > 0 && (probe || b.failures >= b.cfg.FailureThreshold) {
+		b.openedAt = b.now()
+	}
+}
+
+// State returns the state of b.
+func (b *breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state()
+}
+
+func (b *breaker) state() State {
+	if b.cfg.FailureThreshold == 0 || b.failures < b.cfg.FailureThreshold {
+		return StateClosed
+	}
+
+	if b.now().Sub(b.openedAt) < b.cfg.OpenTimeout {
+		return StateOpen
+	}
+
+	return StateHalfOpen
+}
+
+// isFailure reports whether err means the service is failing, rather than the call being invalid.
+func isFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,130 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBreaker(t *testing.T) {
+	t.Parallel()
+
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	invalid := status.Error(codes.InvalidArgument, "invalid")
+
+	for _, tc := range []struct {
+		name        string
+		giveConfig  CircuitBreaker
+		giveErrs    []error
+		giveElapsed time.Duration
+		expectState State
+		expectAllow bool
+		expectWait  time.Duration
+	}{
+		{
+			name:        "success",
+			giveConfig:  CircuitBreaker{FailureThreshold: 2, OpenTimeout: 10 * time.Second},
+			giveErrs:    []error{unavailable, nil, unavailable},
+			expectState: StateClosed,
+			expectAllow: true,
+		},
+		{
+			name:        "disabled",
+			giveErrs:    []error{unavailable, unavailable, unavailable},
+			expectState: StateClosed,
+			expectAllow: true,
+		},
+		{
+			name:        "client_errors",
+			giveConfig:  CircuitBreaker{FailureThreshold: 2, OpenTimeout: 10 * time.Second},
+			giveErrs:    []error{invalid, invalid, invalid},
+			expectState: StateClosed,
+			expectAllow: true,
+		},
+		{
+			name:        "open",
+			giveConfig:  CircuitBreaker{FailureThreshold: 2, OpenTimeout: 10 * time.Second},
+			giveErrs:    []error{unavailable, unavailable},
+			giveElapsed: 4 * time.Second,
+			expectState: StateOpen,
+			expectWait:  6 * time.Second,
+		},
+		{
+			name:        "half_open",
+			giveConfig:  CircuitBreaker{FailureThreshold: 2, OpenTimeout: 10 * time.Second},
+			giveErrs:    []error{unavailable, unavailable},
+			giveElapsed: 10 * time.Second,
+			expectState: StateHalfOpen,
+			expectAllow: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			now := time.Now()
+			b := newBreaker()
+			b.now = func() time.Time { return now }
+			b.configure(tc.giveConfig)
+
+			for _, err := range tc.giveErrs {
+				b.record(permit{}, err)
+			}
+
+			now = now.Add(tc.giveElapsed)
+
+			assert.Equal(t, tc.expectState, b.State(), "state")
+
+			_, allow, wait := b.allow()
+			assert.Equal(t, tc.expectAllow, allow, "allow")
+			assert.Equal(t, tc.expectWait, wait, "wait")
+		})
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	b := newBreaker()
+	b.now = func() time.Time { return now }
+	b.configure(CircuitBreaker{FailureThreshold: 1, OpenTimeout: time.Second})
+
+	// A call allowed while the breaker was closed finishes after the probe below starts.
+	late, allow, _ := b.allow()
+	assert.True(t, allow, "call allowed while closed")
+
+	b.record(permit{}, status.Error(codes.Unavailable, "unavailable"))
+	now = now.Add(time.Second)
+
+	// A single call probes the service.
+	probe, allow, _ := b.allow()
+	assert.True(t, allow, "probe allowed")
+
+	_, allow, _ = b.allow()
+	assert.False(t, allow, "second call allowed while probing")
+
+	// Calls other than the probe don't finish probing, so no other probe is let through while it runs.
+	b.record(late, status.Error(codes.Unavailable, "unavailable"))
+	now = now.Add(time.Second)
+
+	_, allow, _ = b.allow()
+	assert.False(t, allow, "second probe allowed while probing")
+
+	// A failed probe opens the breaker again.
+	b.record(probe, status.Error(codes.DeadlineExceeded, "deadline exceeded"))
+	assert.Equal(t, StateOpen, b.State(), "state after failed probe")
+
+	now = now.Add(time.Second)
+
+	// A successful probe closes it.
+	probe, allow, _ = b.allow()
+	assert.True(t, allow, "second probe allowed")
+
+	b.record(probe, nil)
+	assert.Equal(t, StateClosed, b.State(), "state after successful probe")
+}
@@ -0,0 +1,212 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Service configures an upstream gRPC service.
+type Service struct {
+	// Name is the service the gateway serves, e.g. "racing".
+	Name string `yaml:"name"`
+	// Addresses are the host:port addresses of the instances of the service. Calls are balanced between them
+	// round-robin.
+	Addresses []string `yaml:"addresses"`
+	// TLS configures how the instances are dialed.
+	TLS TLS `yaml:"tls"`
+	// Timeout is the deadline of unary calls that don't have an earlier one. Zero means no deadline.
+	Timeout time.Duration `yaml:"timeout"`
+	// RouteTimeouts override Timeout for unary RPCs by name, e.g. {"ListRaces": "2s"}.
+	RouteTimeouts map[string]time.Duration `yaml:"route_timeouts"`
+	// Routes are the names of the RPCs that may be called, e.g. "ListRaces". Empty means every RPC.
+	Routes []string `yaml:"routes"`
+	// HealthCheck ejects instances from the balancer while the gRPC health service reports they are not serving.
+	HealthCheck bool `yaml:"health_check"`
+	// Retry configures which RPCs are retried, and how.
+	Retry Retry `yaml:"retry"`
+	// CircuitBreaker configures failing calls fast while the service is failing.
+	CircuitBreaker CircuitBreaker `yaml:"circuit_breaker"`
+	// Stale configures serving the last good responses of RPCs while the service is failing.
+	Stale Stale `yaml:"stale"`
+}
+
+// Retry configures retries of RPCs that fail with a transient error. Retries are made by grpc within the deadline of
+// the call. Unset fields take the values of DefaultRetry.
+type Retry struct {
+	// Routes are the names of the RPCs that are safe to retry, e.g. "ListRaces". No RPC is retried if empty.
+	Routes []string `yaml:"routes"`
+	// MaxAttempts is the most times a call is attempted, including the first. grpc allows at most 5.
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialBackoff and MaxBackoff bound the randomised delay before each retry, which grows by BackoffMultiplier.
+	InitialBackoff    time.Duration `yaml:"initial_backoff"`
+	MaxBackoff        time.Duration `yaml:"max_backoff"`
+	BackoffMultiplier float64       `yaml:"backoff_multiplier"`
+	// Codes are the status codes that are retried, e.g. "UNAVAILABLE".
+	Codes []string `yaml:"codes"`
+}
+
+// DefaultRetry holds the values of unset Retry fields.
+var DefaultRetry = Retry{
+	MaxAttempts:       3,
+	InitialBackoff:    100 * time.Millisecond,
+	MaxBackoff:        time.Second,
+	BackoffMultiplier: 2,
+	Codes:             []string{"UNAVAILABLE"},
+}
+
+// withDefaults returns r with unset fields taken from DefaultRetry.
+func (r Retry) withDefaults() Retry {
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = DefaultRetry.MaxAttempts
+	}
+
+	if r.InitialBackoff == 0 {
+		r.InitialBackoff = DefaultRetry.InitialBackoff
+	}
+
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = DefaultRetry.MaxBackoff
+	}
+
+	if r.BackoffMultiplier == 0 {
+		r.BackoffMultiplier = DefaultRetry.BackoffMultiplier
+	}
+
+	if len(r.Codes) == 0 {
+		r.Codes = DefaultRetry.Codes
+	}
+
+	return r
+}
+
+// CircuitBreaker configures a circuit breaker, which opens after a run of failed calls, failing calls fast with
+// Unavailable until OpenTimeout has passed. A single call is then let through, closing the breaker if it succeeds and
+// opening it again if it fails.
+type CircuitBreaker struct {
+	// FailureThreshold is how many calls in a row must fail for the breaker to open. Zero disables the breaker.
+	FailureThreshold int `yaml:"failure_threshold"`
+	// OpenTimeout is how long the breaker stays open.
+	OpenTimeout time.Duration `yaml:"open_timeout"`
+}
+
+// Stale configures keeping the last good response of calls to unary RPCs, to serve when a later call fails with a
+// transient error or is failed fast by the circuit breaker. Responses are kept for each request and caller scopes.
+type Stale struct {
+	// Routes are the names of the unary RPCs whose responses are kept, e.g. "ListRaces". They must only read.
+	Routes []string `yaml:"routes"`
+	// MaxStaleness is how long after it was received a response may be served.
+	MaxStaleness time.Duration `yaml:"max_staleness"`
+	// MaxEntries is how many responses are kept, evicting the least recently used. Defaults to DefaultStaleMaxEntries.
+	MaxEntries int `yaml:"max_entries"`
+}
+
+// DefaultStaleMaxEntries is how many responses are kept when Stale.MaxEntries is unset.
+const DefaultStaleMaxEntries = 1000
+
+// withDefaults returns s with unset fields defaulted.
+func (s Stale) withDefaults() Stale {
+	if s.MaxEntries == 0 {
+		s.MaxEntries = DefaultStaleMaxEntries
+	}
+
+	return s
+}
+
+// TLS configures TLS to an upstream service.
+type TLS struct {
+	// Enabled dials the service over TLS.
+	Enabled bool `yaml:"enabled"`
+	// CAFile is a PEM CA bundle to verify the service against, instead of the system roots.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are a PEM client certificate chain and private key to present for mutual TLS.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ServerName is the name to verify the service's certificate against, instead of the host of each address.
+	ServerName string `yaml:"server_name"`
+}
+
+// Validate checks s.
+func (s Service) Validate() error {
+	if s.Name == "" {
+		return errors.New("missing name")
+	}
+
+	if len(s.Addresses) == 0 {
+		return fmt.Errorf("%s: missing addresses", s.Name)
+	}
+
+	for _, address := range s.Addresses {
+		if address == "" {
+			return fmt.Errorf("%s: empty address", s.Name)
+		}
+	}
+
+	if s.Timeout < 0 {
+		return fmt.Errorf("%s: invalid timeout %s", s.Name, s.Timeout)
+	}
+
+	if !s.TLS.Enabled && (s.TLS.CAFile != "" || s.TLS.CertFile != "" || s.TLS.KeyFile != "" || s.TLS.ServerName != "") {
+		return fmt.Errorf("%s: tls settings require tls to be enabled", s.Name)
+	}
+
+	if (s.TLS.CertFile == "") != (s.TLS.KeyFile == "") {
+		return fmt.Errorf("%s: a tls certificate and key must be given together", s.Name)
+	}
+
+	for name, timeout := range s.RouteTimeouts {
+		if timeout <= 0 {
+			return fmt.Errorf("%s: invalid timeout %s for route %s", s.Name, timeout, name)
+		}
+	}
+
+	if err := s.Retry.validate(); err != nil {
+		return fmt.Errorf("%s: %w", s.Name, err)
+	}
+
+	if s.CircuitBreaker.FailureThreshold < 0 {
+		return fmt.Errorf("%s: invalid circuit breaker failure threshold %d", s.Name, s.CircuitBreaker.FailureThreshold)
+	}
+
+	if s.CircuitBreaker.FailureThreshold > 0 && s.CircuitBreaker.OpenTimeout <= 0 {
+		return fmt.Errorf("%s: invalid circuit breaker open timeout %s", s.Name, s.CircuitBreaker.OpenTimeout)
+	}
+
+	if len(s.Stale.Routes) > 0 && s.Stale.MaxStaleness <= 0 {
+		return fmt.Errorf("%s: invalid stale max staleness %s", s.Name, s.Stale.MaxStaleness)
+	}
+
+	if s.Stale.MaxEntries < 0 {
+		return fmt.Errorf("%s: invalid stale max entries %d", s.Name, s.Stale.MaxEntries)
+	}
+
+	return nil
+}
+
+func (r Retry) validate() error {
+	r = r.withDefaults()
+
+	if r.MaxAttempts < 2 || r.MaxAttempts > 5 {
+		return fmt.Errorf("invalid retry max attempts %d", r.MaxAttempts)
+	}
+
+	if r.InitialBackoff < 0 || r.MaxBackoff < r.InitialBackoff {
+		return fmt.Errorf("invalid retry backoff %s to %s", r.InitialBackoff, r.MaxBackoff)
+	}
+
+	if r.BackoffMultiplier < 0 {
+		return fmt.Errorf("invalid retry backoff multiplier %g", r.BackoffMultiplier)
+	}
+
+	for _, name := range r.Codes {
+		var code codes.Code
+		if err := code.UnmarshalJSON([]byte(strconv.Quote(name))); err != nil || code == codes.OK {
+			return fmt.Errorf("invalid retry code %q", name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package upstream
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	breakerState = prometheus.NewDesc(
+		"api_upstream_circuit_breaker_state",
+		"State of the circuit breaker of each upstream: 0 closed, 1 half-open, 2 open.",
+		[]string{"upstream"}, nil,
+	)
+
+	breakerRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "api",
+		Subsystem: "upstream",
+		Name:      "circuit_breaker_rejections_total",
+		Help:      "Number of calls failed fast by the circuit breaker of each upstream.",
+	}, []string{"upstream"})
+
+	staleResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "api",
+		Subsystem: "upstream",
+		Name:      "stale_responses_total",
+		Help:      "Number of failed calls answered with the last good response, by upstream and method.",
+	}, []string{"upstream", "method"})
+)
+
+var _ prometheus.Collector = (*Registry)(nil)
+
+// Describe implements prometheus.Collector.
+func (r *Registry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- breakerState
+}
+
+// Collect implements prometheus.Collector, collecting the state of the circuit breaker of each service. States are
+// collected when scraped, as an open breaker becomes half-open without any calls being made.
+func (r *Registry) Collect(ch chan<- prometheus.Metric) {
+	for name, conn := range r.conns {
+		ch <- prometheus.MustNewConstMetric(breakerState, prometheus.GaugeValue, float64(conn.breaker.State()), name)
+	}
+}
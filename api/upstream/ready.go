@@ -0,0 +1,46 @@
+package upstream
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ReadyPath is the path the readiness of the gateway is served at.
+const ReadyPath = "/readyz"
+
+// readiness is the body of readiness responses.
+type readiness struct {
+	Ready     bool                         `json:"ready"`
+	Upstreams map[string]upstreamReadiness `json:"upstreams"`
+}
+
+type upstreamReadiness struct {
+	Configured     bool   `json:"configured"`
+	CircuitBreaker string `json:"circuit_breaker"`
+}
+
+// ReadyHandler returns a handler reporting whether calls can be made to the services, responding 503 Service
+// Unavailable while the circuit breaker of any of them is open, so that load balancers send requests elsewhere.
+func (r *Registry) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		res := readiness{Ready: true, Upstreams: make(map[string]upstreamReadiness, len(r.conns))}
+
+		for name, conn := range r.conns {
+			state := conn.breaker.State()
+			if state == StateOpen {
+				res.Ready = false
+			}
+
+			res.Upstreams[name] = upstreamReadiness{Configured: conn.get() != nil, CircuitBreaker: state.String()}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+
+		if !res.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
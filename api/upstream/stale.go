@@ -0,0 +1,170 @@
+package upstream
+
+import (
+	"container/list"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/api/auth"
+)
+
+// Metadata keys set on the header of responses served from the stale cache, and forwarded to clients as HTTP headers
+// by OutgoingHeaderMatcher.
+const (
+	CacheMetadataKey   = "x-cache"
+	WarningMetadataKey = "warning"
+	AgeMetadataKey     = "age"
+)
+
+// staleWarning is the Warning of responses served from the stale cache. See RFC 7234, section 5.5.1.
+const staleWarning = `110 - "Response is Stale"`
+
+// OutgoingHeaderMatcher is a runtime.HeaderMatcherFunc forwarding the headers of stale responses as HTTP headers,
+// and other metadata as the gateway does by default.
+func OutgoingHeaderMatcher(key string) (string, bool) {
+	switch key {
+	case CacheMetadataKey, WarningMetadataKey, AgeMetadataKey:
+		return key, true
+	}
+
+	return runtime.MetadataHeaderPrefix + key, true
+}
+
+// staleCache holds the last good response of calls, to serve while the service is failing. The least recently used
+// responses are evicted once it is full.
+type staleCache struct {
+	mu      sync.Mutex
+	cfg     Stale
+	entries map[string]*list.Element
+	order   *list.List
+
+	// now is the current time, replaced in tests.
+	now func() time.Time
+}
+
+// staleEntry is a response kept by a staleCache.
+type staleEntry struct {
+	key      string
+	reply    proto.Message
+	received time.Time
+}
+
+func newStaleCache() *staleCache {
+	return &staleCache{entries: map[string]*list.Element{}, order: list.New(), now: time.Now}
+}
+
+// configure reconfigures c, keeping the responses it holds until they are evicted.
+func (c *staleCache) configure(cfg Stale) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cfg = cfg.withDefaults()
+	c.evict()
+}
+
+// store keeps reply as the last good response of the call identified by key.
+func (c *staleCache) store(key string, reply interface{}) {
+	m, ok := reply.(proto.Message)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &staleEntry{key: key, reply: proto.Clone(m), received: c.now()}
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	c.evict()
+}
+
+// load copies the last good response of the call identified by key into reply, returning how old it is, or reports
+// false if there is none that may still be served.
+func (c *staleCache) load(key string, reply interface{}) (time.Duration, bool) {
+	m, ok := reply.(proto.Message)
+	if !ok {
+		return 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+
+	entry := element.Value.(*staleEntry)
+
+	age := c.now().Sub(entry.received)
+	if age > c.cfg.MaxStaleness {
+		c.remove(element)
+		return 0, false
+	}
+
+	c.order.MoveToFront(element)
+
+	proto.Reset(m)
+	proto.Merge(m, entry.reply)
+
+	return age, true
+}
+
+// evict removes the least recently used responses until c holds no more than it may.
+func (c *staleCache) evict() {
+	for c.order.Len() > c.cfg.MaxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *staleCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*staleEntry).key)
+}
+
+// newStaleKey identifies a call to method with args, or returns "" if its response can't be kept. Calls are told apart
+// by the scopes of the caller, as the scopes decide what the service lets them see.
+func newStaleKey(ctx context.Context, method string, args interface{}) string {
+	m, ok := args.(proto.Message)
+	if !ok {
+		return ""
+	}
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return ""
+	}
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	scopes := strings.Join(md.Get(auth.ScopesMetadataKey), " ")
+
+	return method + "\x00" + scopes + "\x00" + string(data)
+}
+
+// setStaleHeader sets the header metadata of a response served from the stale cache, if the call asked for it.
+func setStaleHeader(opts []grpc.CallOption, age time.Duration) {
+	for _, opt := range opts {
+		if header, ok := opt.(grpc.HeaderCallOption); ok {
+			*header.HeaderAddr = metadata.Pairs(
+				CacheMetadataKey, "STALE",
+				WarningMetadataKey, staleWarning,
+				AgeMetadataKey, strconv.Itoa(int(age.Seconds())),
+			)
+		}
+	}
+}
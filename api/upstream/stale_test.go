@@ -0,0 +1,59 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+)
+
+func TestStaleCache(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	c := newStaleCache()
+	c.now = func() time.Time { return now }
+	c.configure(Stale{MaxStaleness: time.Minute, MaxEntries: 2})
+
+	for i, key := range []string{"first", "second"} {
+		c.store(key, &racing.ListRacesResponse{Races: []*racing.Race{{Id: int64(i + 1)}}})
+	}
+
+	now = now.Add(30 * time.Second)
+
+	reply := &racing.ListRacesResponse{Races: []*racing.Race{{Id: 10}, {Id: 11}}}
+	age, ok := c.load("first", reply)
+	require.True(t, ok, "load first")
+	assert.Equal(t, 30*time.Second, age, "age")
+	assert.Equal(t, []int64{1}, raceIDs(reply), "replaces reply")
+
+	// Storing a third response evicts the least recently used.
+	c.store("third", &racing.ListRacesResponse{})
+
+	_, ok = c.load("second", &racing.ListRacesResponse{})
+	assert.False(t, ok, "load evicted")
+
+	_, ok = c.load("first", &racing.ListRacesResponse{})
+	assert.True(t, ok, "load recently used")
+
+	// Responses older than the max staleness aren't served.
+	now = now.Add(31 * time.Second)
+
+	_, ok = c.load("first", &racing.ListRacesResponse{})
+	assert.False(t, ok, "load too stale")
+
+	_, ok = c.load("third", &racing.ListRacesResponse{})
+	assert.True(t, ok, "load fresher")
+}
+
+func raceIDs(res *racing.ListRacesResponse) []int64 {
+	var ids []int64
+	for _, race := range res.GetRaces() {
+		ids = append(ids, race.GetId())
+	}
+
+	return ids
+}
@@ -0,0 +1,600 @@
+// Package upstream is the registry of the gRPC services the gateway calls, dialed from configuration that can be
+// reloaded without a restart.
+//
+// Each service may have several instances, which calls are balanced between round-robin. Instances that can't be
+// connected to, or that the gRPC health service reports are not serving, are ejected until they recover.
+//
+// Unary calls are given a deadline, and idempotent RPCs may be retried by grpc. Each service has a circuit breaker,
+// which fails calls fast with Unavailable, and a RetryInfo detail, while the service is failing. The last good
+// responses of RPCs that only read may be kept, and served in place of those failures for a while.
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	_ "google.golang.org/grpc/health" // Enables client-side health checking.
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"git.neds.sh/matty/entain/api/logging"
+	"git.neds.sh/matty/entain/tlsconfig"
+)
+
+const (
+	// scheme is the resolver scheme upstream addresses are resolved with.
+	scheme = "upstream"
+
+	// drainTimeout is how long connections replaced by a reload are kept open for the calls already made on them.
+	drainTimeout = time.Minute
+)
+
+// Handler registers the gateway handlers of a service, calling it on a connection.
+type Handler struct {
+	// Desc describes the service.
+	Desc *grpc.ServiceDesc
+	// Register registers the handlers of the service on mux, e.g. racing.RegisterRacingHandlerClient.
+	Register func(ctx context.Context, mux *runtime.ServeMux, conn grpc.ClientConnInterface) error
+	// RefreshStale updates a response copied from the stale cache before it is served, such as to re-derive fields
+	// that depend on the time they are read. It may be nil.
+	RefreshStale func(reply proto.Message)
+}
+
+// Registry holds a connection to each configured service.
+type Registry struct {
+	handlers    map[string]Handler
+	dialOptions []grpc.DialOption
+	conns       map[string]*Conn
+
+	// mu serialises updates.
+	mu sync.Mutex
+}
+
+// NewRegistry creates a Registry for the services with handlers, keyed by service name. Services are dialed with
+// dialOptions once configured by Update.
+func NewRegistry(handlers map[string]Handler, dialOptions ...grpc.DialOption) *Registry {
+	conns := make(map[string]*Conn, len(handlers))
+	for name := range handlers {
+		conns[name] = &Conn{
+			name:         name,
+			breaker:      newBreaker(),
+			stale:        newStaleCache(),
+			refreshStale: handlers[name].RefreshStale,
+		}
+	}
+
+	return &Registry{handlers: handlers, dialOptions: dialOptions, conns: conns}
+}
+
+// Conn returns the connection to the service name. It is the same connection however the service is reconfigured.
+// Calls made on it fail with Unavailable while the service is not configured.
+func (r *Registry) Conn(name string) *Conn {
+	return r.conns[name]
+}
+
+// Register registers the handlers of every service on mux.
+func (r *Registry) Register(ctx context.Context, mux *runtime.ServeMux) error {
+	for name, handler := range r.handlers {
+		if err := handler.Register(ctx, mux, r.conns[name]); err != nil {
+			return fmt.Errorf("failed registering %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Update configures the services, dialing those that are new or have changed how they are dialed. Services that are
+// no longer configured are closed. Nothing is changed if any of the services is invalid.
+//
+// TLS files of the services dialed are reloaded when they change, until ctx is done.
+func (r *Registry) Update(ctx context.Context, services []Service) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	configured := make(map[string]Service, len(services))
+
+	for _, s := range services {
+		if err := s.Validate(); err != nil {
+			return err
+		}
+
+		handler, ok := r.handlers[s.Name]
+		if !ok {
+			return fmt.Errorf("unknown service %q", s.Name)
+		}
+
+		if _, ok := configured[s.Name]; ok {
+			return fmt.Errorf("service %q is configured more than once", s.Name)
+		}
+
+		if _, err := routes(handler.Desc, s.Routes); err != nil {
+			return fmt.Errorf("%s: %w", s.Name, err)
+		}
+
+		if _, err := routes(handler.Desc, s.Retry.Routes); err != nil {
+			return fmt.Errorf("%s: retry: %w", s.Name, err)
+		}
+
+		if _, err := routeTimeouts(handler.Desc, s.RouteTimeouts); err != nil {
+			return fmt.Errorf("%s: %w", s.Name, err)
+		}
+
+		if _, err := unaryRoutes(handler.Desc, s.Stale.Routes); err != nil {
+			return fmt.Errorf("%s: stale: %w", s.Name, err)
+		}
+
+		configured[s.Name] = s
+	}
+
+	for name, conn := range r.conns {
+		s, ok := configured[name]
+		if !ok {
+			drain(conn.set(nil))
+			conn.breaker.configure(CircuitBreaker{})
+			conn.stale.configure(Stale{})
+
+			continue
+		}
+
+		if err := r.update(ctx, conn, s); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the connections to every service.
+func (r *Registry) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, conn := range r.conns {
+		if replaced := conn.set(nil); replaced != nil {
+			replaced.close()
+		}
+	}
+}
+
+// update configures conn for s, dialing it again if it is new or s changes how it is dialed.
+func (r *Registry) update(ctx context.Context, conn *Conn, s Service) error {
+	desc := r.handlers[s.Name].Desc
+	enabled, _ := routes(desc, s.Routes)
+	timeouts, _ := routeTimeouts(desc, s.RouteTimeouts)
+	stale, _ := unaryRoutes(desc, s.Stale.Routes)
+	current := conn.get()
+
+	conn.breaker.configure(s.CircuitBreaker)
+	conn.stale.configure(s.Stale)
+
+	// Retries are part of the service config, which is only set when dialing.
+	if current != nil && current.cfg.TLS == s.TLS && current.cfg.HealthCheck == s.HealthCheck &&
+		reflect.DeepEqual(current.cfg.Retry, s.Retry) {
+		if !reflect.DeepEqual(current.cfg.Addresses, s.Addresses) {
+			current.resolver.UpdateState(resolverState(s))
+		}
+
+		conn.set(&dialed{
+			cfg:      s,
+			routes:   enabled,
+			timeouts: timeouts,
+			stale:    stale,
+			cc:       current.cc,
+			resolver: current.resolver,
+			close:    current.close,
+		})
+
+		logging.FromContext(ctx).Infof("updated upstream %s", s.Name)
+
+		return nil
+	}
+
+	d, err := r.dial(ctx, desc, s)
+	if err != nil {
+		return err
+	}
+
+	d.routes = enabled
+	d.timeouts = timeouts
+	d.stale = stale
+	drain(conn.set(d))
+
+	logging.FromContext(ctx).Infof("dialed upstream %s at %v", s.Name, s.Addresses)
+
+	return nil
+}
+
+// dial dials the instances of s, resolving their addresses with a resolver Update can change them through.
+func (r *Registry) dial(ctx context.Context, desc *grpc.ServiceDesc, s Service) (*dialed, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	if !s.TLS.Enabled {
+		logging.FromContext(ctx).Warnf("dialing upstream %s without TLS", s.Name)
+	}
+
+	creds, err := transportCredentials(ctx, s.TLS)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	serviceConfigJSON, err := serviceConfig(desc, s)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	res := manual.NewBuilderWithScheme(scheme)
+	res.InitialState(resolverState(s))
+
+	options := append([]grpc.DialOption{
+		grpc.WithResolvers(res),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultServiceConfig(serviceConfigJSON),
+	}, r.dialOptions...)
+
+	cc, err := grpc.DialContext(ctx, scheme+":///"+s.Name, options...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &dialed{
+		cfg:      s,
+		cc:       cc,
+		resolver: res,
+		close: func() {
+			cancel()
+			_ = cc.Close()
+		},
+	}, nil
+}
+
+// serviceConfig returns the grpc service config to dial s with.
+// See https://github.com/grpc/grpc/blob/master/doc/service_config.md.
+func serviceConfig(desc *grpc.ServiceDesc, s Service) (string, error) {
+	cfg := map[string]interface{}{
+		"loadBalancingConfig": []interface{}{map[string]interface{}{"round_robin": map[string]interface{}{}}},
+	}
+
+	if s.HealthCheck {
+		cfg["healthCheckConfig"] = map[string]interface{}{"serviceName": desc.ServiceName}
+	}
+
+	if len(s.Retry.Routes) > 0 {
+		retry := s.Retry.withDefaults()
+
+		names := make([]interface{}, 0, len(retry.Routes))
+		for _, route := range retry.Routes {
+			names = append(names, map[string]interface{}{"service": desc.ServiceName, "method": route})
+		}
+
+		cfg["methodConfig"] = []interface{}{map[string]interface{}{
+			"name": names,
+			"retryPolicy": map[string]interface{}{
+				"maxAttempts":          retry.MaxAttempts,
+				"initialBackoff":       durationString(retry.InitialBackoff),
+				"maxBackoff":           durationString(retry.MaxBackoff),
+				"backoffMultiplier":    retry.BackoffMultiplier,
+				"retryableStatusCodes": retry.Codes,
+			},
+		}}
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// durationString formats d as a JSON encoded protobuf Duration, as the service config expects.
+func durationString(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// resolverState returns the addresses of the instances of s.
+func resolverState(s Service) resolver.State {
+	state := resolver.State{}
+
+	for _, address := range s.Addresses {
+		// Each instance's certificate is verified against its own host, unless a server name is configured.
+		serverName := s.TLS.ServerName
+		if serverName == "" {
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				serverName = host
+			}
+		}
+
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: address, ServerName: serverName})
+	}
+
+	return state
+}
+
+// transportCredentials returns the transport credentials to dial with cfg. TLS files are reloaded when they change,
+// until ctx is done.
+func transportCredentials(ctx context.Context, cfg TLS) (credentials.TransportCredentials, error) {
+	if !cfg.Enabled {
+		return insecure.NewCredentials(), nil
+	}
+
+	reloader, err := tlsconfig.NewReloader(tlsconfig.Files{
+		CertFile: cfg.CertFile,
+		KeyFile:  cfg.KeyFile,
+		CAFile:   cfg.CAFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go reloader.Run(ctx, tlsconfig.DefaultReloadInterval, logging.FromContext(ctx))
+
+	// The server name is filled in from the address by grpc, unless one is configured.
+	return credentials.NewTLS(reloader.ClientConfig(cfg.ServerName)), nil
+}
+
+// routes returns the full method names of the RPCs of desc named by names, or nil if names is empty, enabling every
+// RPC.
+func routes(desc *grpc.ServiceDesc, names []string) (map[string]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := map[string]bool{}
+	for _, m := range desc.Methods {
+		known[m.MethodName] = true
+	}
+
+	for _, s := range desc.Streams {
+		known[s.StreamName] = true
+	}
+
+	enabled := make(map[string]bool, len(names))
+
+	for _, name := range names {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown route %q", name)
+		}
+
+		enabled["/"+desc.ServiceName+"/"+name] = true
+	}
+
+	return enabled, nil
+}
+
+// routeTimeouts returns timeouts keyed by the full method names of the unary RPCs of desc they are for.
+func routeTimeouts(desc *grpc.ServiceDesc, timeouts map[string]time.Duration) (map[string]time.Duration, error) {
+	byMethod := make(map[string]time.Duration, len(timeouts))
+
+	for name, timeout := range timeouts {
+		if !isUnary(desc, name) {
+			return nil, fmt.Errorf("timeout for unknown unary route %q", name)
+		}
+
+		byMethod["/"+desc.ServiceName+"/"+name] = timeout
+	}
+
+	return byMethod, nil
+}
+
+// unaryRoutes returns the full method names of the unary RPCs of desc named by names.
+func unaryRoutes(desc *grpc.ServiceDesc, names []string) (map[string]bool, error) {
+	enabled := make(map[string]bool, len(names))
+
+	for _, name := range names {
+		if !isUnary(desc, name) {
+			return nil, fmt.Errorf("unknown unary route %q", name)
+		}
+
+		enabled["/"+desc.ServiceName+"/"+name] = true
+	}
+
+	return enabled, nil
+}
+
+// isUnary reports whether desc has a unary RPC called name.
+func isUnary(desc *grpc.ServiceDesc, name string) bool {
+	for _, m := range desc.Methods {
+		if m.MethodName == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dialed is a service dialed with its configuration.
+type dialed struct {
+	cfg      Service
+	routes   map[string]bool
+	timeouts map[string]time.Duration
+	stale    map[string]bool
+	cc       *grpc.ClientConn
+	resolver *manual.Resolver
+	close    func()
+}
+
+// Conn is a grpc.ClientConnInterface calling a service on its current connection.
+type Conn struct {
+	name         string
+	breaker      *breaker
+	stale        *staleCache
+	refreshStale func(reply proto.Message)
+
+	mu      sync.RWMutex
+	current *dialed
+}
+
+var _ grpc.ClientConnInterface = (*Conn)(nil)
+
+// Invoke implements grpc.ClientConnInterface.
+func (c *Conn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	d, err := c.route(method)
+	if err != nil {
+		return err
+	}
+
+	var staleKey string
+	if d.stale[method] {
+		staleKey = newStaleKey(ctx, method, args)
+	}
+
+	p, err := c.allow()
+	if err != nil {
+		return c.serveStale(staleKey, method, reply, opts, err)
+	}
+
+	timeout, ok := d.timeouts[method]
+	if !ok {
+		timeout = d.cfg.Timeout
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err = d.cc.Invoke(ctx, method, args, reply, opts...)
+	c.breaker.record(p, err)
+
+	switch {
+	case staleKey == "":
+	case err == nil:
+		c.stale.store(staleKey, reply)
+	case isFailure(err):
+		return c.serveStale(staleKey, method, reply, opts, err)
+	}
+
+	return err
+}
+
+// serveStale copies the last good response of the call identified by key into reply, in place of the failure err, and
+// refreshes it with the handler's RefreshStale, so fields derived from the time they are read, such as the status of a
+// race, are as of now rather than as of when the response was cached. It returns err if there is no response that may
+// still be served.
+func (c *Conn) serveStale(key, method string, reply interface{}, opts []grpc.CallOption, err error) error {
+	if key == "" {
+		return err
+	}
+
+	age, ok := c.stale.load(key, reply)
+	if !ok {
+		return err
+	}
+
+	if m, ok := reply.(proto.Message); ok && c.refreshStale != nil {
+		c.refreshStale(m)
+	}
+
+	staleResponses.WithLabelValues(c.name, method).Inc()
+	setStaleHeader(opts, age)
+
+	return nil
+}
+
+// NewStream implements grpc.ClientConnInterface. Streams have no deadline unless ctx has one, as they may be long
+// lived.
+func (c *Conn) NewStream(
+	ctx context.Context,
+	desc *grpc.StreamDesc,
+	method string,
+	opts ...grpc.CallOption,
+) (grpc.ClientStream, error) {
+	d, err := c.route(method)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := c.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only failures to start the stream are recorded, as the stream may end with an error long after it has started.
+	stream, err := d.cc.NewStream(ctx, desc, method, opts...)
+	c.breaker.record(p, err)
+
+	return stream, err
+}
+
+// route returns the current connection to call method on, or an error if the service is not configured or the
+// method is not enabled.
+func (c *Conn) route(method string) (*dialed, error) {
+	d := c.get()
+	if d == nil {
+		return nil, status.Errorf(codes.Unavailable, "upstream %s is not configured", c.name)
+	}
+
+	// Disabled routes are reported as the gateway reports routes it doesn't serve.
+	if d.routes != nil && !d.routes[method] {
+		return nil, status.Error(codes.NotFound, "Not Found")
+	}
+
+	return d, nil
+}
+
+// allow returns the permit of a call the circuit breaker lets through, or an Unavailable error, with a RetryInfo detail
+// of when to try again, if it is not letting calls through.
+func (c *Conn) allow() (permit, error) {
+	p, ok, wait := c.breaker.allow()
+	if ok {
+		return p, nil
+	}
+
+	breakerRejections.WithLabelValues(c.name).Inc()
+
+	st := status.Newf(codes.Unavailable, "upstream %s is unavailable", c.name)
+	if withDetails, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)}); err == nil {
+		st = withDetails
+	}
+
+	return permit{}, st.Err()
+}
+
+func (c *Conn) get() *dialed {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.current
+}
+
+// set replaces the current connection with d, returning the replaced connection if it is no longer used.
+func (c *Conn) set(d *dialed) *dialed {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous := c.current
+	c.current = d
+
+	if previous == nil || (d != nil && d.cc == previous.cc) {
+		return nil
+	}
+
+	return previous
+}
+
+// drain closes d, if any, once the calls already made on it have had time to finish.
+func drain(d *dialed) {
+	if d != nil {
+		time.AfterFunc(drainTimeout, d.close)
+	}
+}
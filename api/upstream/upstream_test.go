@@ -0,0 +1,647 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/api/auth"
+	"git.neds.sh/matty/entain/api/proto/racing"
+)
+
+// racingServer counts the ListRaces calls it serves, failing the first failures of them, and any while failing is
+// set, with Unavailable. Calls are answered after delay with a race whose ID is the number of the call.
+type racingServer struct {
+	racing.UnimplementedRacingServer
+
+	calls    int32
+	failures int32
+	failing  int32
+	delay    time.Duration
+}
+
+func (s *racingServer) ListRaces(ctx context.Context, _ *racing.ListRacesRequest) (*racing.ListRacesResponse, error) {
+	call := atomic.AddInt32(&s.calls, 1)
+	if call <= s.failures || atomic.LoadInt32(&s.failing) == 1 {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.delay):
+	}
+
+	return &racing.ListRacesResponse{Races: []*racing.Race{{Id: int64(call)}}}, nil
+}
+
+// setFailing sets whether calls fail.
+func (s *racingServer) setFailing(failing bool) {
+	var v int32
+	if failing {
+		v = 1
+	}
+
+	atomic.StoreInt32(&s.failing, v)
+}
+
+// instance is an instance of racing listening on a local port, serving until its health is changed.
+type instance struct {
+	address string
+	server  *racingServer
+	health  *health.Server
+}
+
+func newInstance(t *testing.T) *instance {
+	t.Helper()
+
+	return newInstanceWithServer(t, &racingServer{})
+}
+
+func newInstanceWithServer(t *testing.T, server *racingServer) *instance {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "net.Listen")
+
+	i := &instance{address: listener.Addr().String(), server: server, health: health.NewServer()}
+	i.health.SetServingStatus(racing.Racing_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+
+	grpcServer := grpc.NewServer()
+	racing.RegisterRacingServer(grpcServer, i.server)
+	healthpb.RegisterHealthServer(grpcServer, i.health)
+
+	go func() { _ = grpcServer.Serve(listener) }()
+
+	t.Cleanup(grpcServer.Stop)
+
+	return i
+}
+
+func (i *instance) calls() int {
+	return int(atomic.LoadInt32(&i.server.calls))
+}
+
+func newTestRegistry(t *testing.T) *Registry {
+	t.Helper()
+
+	return newTestRegistryWithRefresh(t, nil)
+}
+
+func newTestRegistryWithRefresh(t *testing.T, refreshStale func(reply proto.Message)) *Registry {
+	t.Helper()
+
+	registry := NewRegistry(map[string]Handler{
+		"racing": {
+			Desc: &racing.Racing_ServiceDesc,
+			Register: func(ctx context.Context, mux *runtime.ServeMux, conn grpc.ClientConnInterface) error {
+				return racing.RegisterRacingHandlerClient(ctx, mux, racing.NewRacingClient(conn))
+			},
+			RefreshStale: refreshStale,
+		},
+	})
+
+	t.Cleanup(registry.Close)
+
+	return registry
+}
+
+// listRaces calls ListRaces n times.
+func listRaces(t *testing.T, conn grpc.ClientConnInterface, n int) {
+	t.Helper()
+
+	client := racing.NewRacingClient(conn)
+
+	for i := 0; i < n; i++ {
+		_, err := client.ListRaces(context.Background(), &racing.ListRacesRequest{}, grpc.WaitForReady(true))
+		require.NoError(t, err, "ListRaces")
+	}
+}
+
+func TestRegistryRoundRobin(t *testing.T) {
+	t.Parallel()
+
+	first, second := newInstance(t), newInstance(t)
+	registry := newTestRegistry(t)
+
+	require.NoError(t, registry.Update(context.Background(), []Service{{
+		Name:        "racing",
+		Addresses:   []string{first.address, second.address},
+		HealthCheck: true,
+	}}), "Update")
+
+	// Calls are only balanced between instances once both are connected.
+	assert.Eventually(t, func() bool {
+		listRaces(t, registry.Conn("racing"), 2)
+
+		return first.calls() > 0 && second.calls() > 0
+	}, 5*time.Second, 10*time.Millisecond, "both instances called")
+}
+
+func TestRegistryHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	healthy, unhealthy := newInstance(t), newInstance(t)
+	unhealthy.health.SetServingStatus(racing.Racing_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+
+	registry := newTestRegistry(t)
+
+	require.NoError(t, registry.Update(context.Background(), []Service{{
+		Name:        "racing",
+		Addresses:   []string{healthy.address, unhealthy.address},
+		HealthCheck: true,
+	}}), "Update")
+
+	listRaces(t, registry.Conn("racing"), 10)
+
+	assert.Equal(t, 10, healthy.calls(), "healthy calls")
+	assert.Equal(t, 0, unhealthy.calls(), "unhealthy calls")
+
+	// The instance is put back once it is serving again.
+	unhealthy.health.SetServingStatus(racing.Racing_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+
+	assert.Eventually(t, func() bool {
+		listRaces(t, registry.Conn("racing"), 2)
+
+		return unhealthy.calls() > 0
+	}, 5*time.Second, 10*time.Millisecond, "recovered instance called")
+}
+
+func TestRegistryUpdate(t *testing.T) {
+	t.Parallel()
+
+	first, second := newInstance(t), newInstance(t)
+	registry := newTestRegistry(t)
+	conn := registry.Conn("racing")
+
+	// Calls fail until the service is configured.
+	err := conn.Invoke(context.Background(), "/racing.Racing/ListRaces", &racing.ListRacesRequest{}, &racing.ListRacesResponse{})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "code before configured")
+
+	require.NoError(t, registry.Update(context.Background(), []Service{{
+		Name:      "racing",
+		Addresses: []string{first.address},
+	}}), "Update first")
+
+	listRaces(t, conn, 1)
+	assert.Equal(t, 1, first.calls(), "first calls")
+
+	// Changing the addresses moves calls to the new instances on the same connection.
+	require.NoError(t, registry.Update(context.Background(), []Service{{
+		Name:      "racing",
+		Addresses: []string{second.address},
+		Routes:    []string{"ListRaces"},
+	}}), "Update second")
+
+	assert.Eventually(t, func() bool {
+		listRaces(t, conn, 1)
+
+		return second.calls() > 0
+	}, 5*time.Second, 10*time.Millisecond, "second instance called")
+
+	// Routes that aren't enabled aren't called.
+	_, err = racing.NewRacingClient(conn).WatchRaces(context.Background(), &racing.WatchRacesRequest{})
+	assert.Equal(t, codes.NotFound, status.Code(err), "disabled route code")
+
+	// Invalid configuration is rejected without changing anything.
+	assert.Error(t, registry.Update(context.Background(), []Service{{Name: "racing"}}), "Update invalid")
+
+	listRaces(t, conn, 1)
+
+	// Services that are no longer configured can't be called.
+	require.NoError(t, registry.Update(context.Background(), nil), "Update none")
+
+	err = conn.Invoke(context.Background(), "/racing.Racing/ListRaces", &racing.ListRacesRequest{}, &racing.ListRacesResponse{})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "code after removed")
+}
+
+func TestRegistryTimeout(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t)
+
+	// Nothing listens on the address, so calls waiting for a connection run until their deadline.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "net.Listen")
+	require.NoError(t, listener.Close(), "Close")
+
+	require.NoError(t, registry.Update(context.Background(), []Service{{
+		Name:      "racing",
+		Addresses: []string{listener.Addr().String()},
+		Timeout:   50 * time.Millisecond,
+	}}), "Update")
+
+	_, err = racing.NewRacingClient(registry.Conn("racing")).ListRaces(
+		context.Background(), &racing.ListRacesRequest{}, grpc.WaitForReady(true),
+	)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "code")
+}
+
+func TestRegistryRouteTimeout(t *testing.T) {
+	t.Parallel()
+
+	instance := newInstanceWithServer(t, &racingServer{delay: time.Second})
+	registry := newTestRegistry(t)
+
+	require.NoError(t, registry.Update(context.Background(), []Service{{
+		Name:          "racing",
+		Addresses:     []string{instance.address},
+		Timeout:       time.Minute,
+		RouteTimeouts: map[string]time.Duration{"ListRaces": 50 * time.Millisecond},
+	}}), "Update")
+
+	_, err := racing.NewRacingClient(registry.Conn("racing")).ListRaces(
+		context.Background(), &racing.ListRacesRequest{}, grpc.WaitForReady(true),
+	)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "code")
+}
+
+func TestRegistryRetry(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		giveRetry   Retry
+		expectCode  codes.Code
+		expectCalls int
+	}{
+		{
+			name:        "success",
+			giveRetry:   Retry{Routes: []string{"ListRaces"}, InitialBackoff: time.Millisecond},
+			expectCode:  codes.OK,
+			expectCalls: 3,
+		},
+		{
+			name:        "not_retried",
+			giveRetry:   Retry{Routes: []string{"WatchRaces"}},
+			expectCode:  codes.Unavailable,
+			expectCalls: 1,
+		},
+		{
+			name:        "too_few_attempts",
+			giveRetry:   Retry{Routes: []string{"ListRaces"}, MaxAttempts: 2, InitialBackoff: time.Millisecond},
+			expectCode:  codes.Unavailable,
+			expectCalls: 2,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			instance := newInstanceWithServer(t, &racingServer{failures: 2})
+			registry := newTestRegistry(t)
+
+			require.NoError(t, registry.Update(context.Background(), []Service{{
+				Name:      "racing",
+				Addresses: []string{instance.address},
+				Retry:     tc.giveRetry,
+			}}), "Update")
+
+			_, err := racing.NewRacingClient(registry.Conn("racing")).ListRaces(
+				context.Background(), &racing.ListRacesRequest{}, grpc.WaitForReady(true),
+			)
+			assert.Equal(t, tc.expectCode, status.Code(err), "code")
+			assert.Equal(t, tc.expectCalls, instance.calls(), "calls")
+		})
+	}
+}
+
+func TestRegistryCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	instance := newInstanceWithServer(t, &racingServer{failures: 2})
+	registry := newTestRegistry(t)
+	conn := registry.Conn("racing")
+
+	require.NoError(t, registry.Update(context.Background(), []Service{{
+		Name:           "racing",
+		Addresses:      []string{instance.address},
+		CircuitBreaker: CircuitBreaker{FailureThreshold: 2, OpenTimeout: time.Minute},
+	}}), "Update")
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		registry.ReadyHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ReadyPath, nil))
+
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, ready(), "ready status before failures")
+
+	for i := 0; i < 2; i++ {
+		_, err := racing.NewRacingClient(conn).ListRaces(context.Background(), &racing.ListRacesRequest{}, grpc.WaitForReady(true))
+		assert.Equal(t, codes.Unavailable, status.Code(err), "code of failure %d", i)
+	}
+
+	// The breaker is open, so calls fail without reaching the service, saying when to try again.
+	_, err := racing.NewRacingClient(conn).ListRaces(context.Background(), &racing.ListRacesRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "code when open")
+	assert.Equal(t, 2, instance.calls(), "calls")
+
+	details := status.Convert(err).Details()
+	if assert.Len(t, details, 1, "details") {
+		retryInfo, ok := details[0].(*errdetails.RetryInfo)
+		if assert.True(t, ok, "retry info") {
+			assert.InDelta(t, time.Minute, retryInfo.GetRetryDelay().AsDuration(), float64(time.Second), "retry delay")
+		}
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, ready(), "ready status when open")
+
+	// Reconfiguring the service keeps the state of its breaker, unless it is disabled.
+	require.NoError(t, registry.Update(context.Background(), []Service{{
+		Name:           "racing",
+		Addresses:      []string{instance.address},
+		CircuitBreaker: CircuitBreaker{FailureThreshold: 3, OpenTimeout: time.Minute},
+	}}), "Update threshold")
+
+	assert.Equal(t, StateClosed, conn.breaker.State(), "state after raising threshold")
+
+	require.NoError(t, registry.Update(context.Background(), []Service{{
+		Name:      "racing",
+		Addresses: []string{instance.address},
+	}}), "Update disabled")
+
+	listRaces(t, conn, 1)
+	assert.Equal(t, http.StatusOK, ready(), "ready status when disabled")
+}
+
+func TestRegistryStale(t *testing.T) {
+	t.Parallel()
+
+	instance := newInstance(t)
+	registry := newTestRegistry(t)
+
+	require.NoError(t, registry.Update(context.Background(), []Service{{
+		Name:           "racing",
+		Addresses:      []string{instance.address},
+		CircuitBreaker: CircuitBreaker{FailureThreshold: 2, OpenTimeout: time.Minute},
+		Stale:          Stale{Routes: []string{"ListRaces"}, MaxStaleness: time.Minute},
+	}}), "Update")
+
+	mux := runtime.NewServeMux(runtime.WithOutgoingHeaderMatcher(OutgoingHeaderMatcher))
+	require.NoError(t, registry.Register(context.Background(), mux), "Register")
+
+	listRaces := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/list-races", strings.NewReader(body)))
+
+		return rec
+	}
+
+	fresh := listRaces("{}")
+	require.Equal(t, http.StatusOK, fresh.Code, "fresh status")
+	assert.Empty(t, fresh.Header().Get("X-Cache"), "fresh X-Cache")
+
+	instance.server.setFailing(true)
+
+	// Failed calls, and calls failed fast once the breaker opens, are answered with the last good response.
+	for _, name := range []string{"failed", "failed again", "breaker open"} {
+		rec := listRaces("{}")
+
+		assert.Equal(t, http.StatusOK, rec.Code, "%s status", name)
+		assert.Equal(t, fresh.Body.String(), rec.Body.String(), "%s body", name)
+		assert.Equal(t, "STALE", rec.Header().Get("X-Cache"), "%s X-Cache", name)
+		assert.Equal(t, staleWarning, rec.Header().Get("Warning"), "%s Warning", name)
+		assert.Equal(t, "0", rec.Header().Get("Age"), "%s Age", name)
+	}
+
+	assert.Equal(t, 3, instance.calls(), "calls")
+	assert.Equal(t, StateOpen, registry.Conn("racing").breaker.State(), "breaker state")
+
+	// Responses are kept for each request, and the scopes of each caller.
+	rec := listRaces(`{"filter": {"meetingIds": [1]}}`)
+	assert.NotEqual(t, http.StatusOK, rec.Code, "other request status")
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), auth.ScopesMetadataKey, "races:read")
+	_, err := racing.NewRacingClient(registry.Conn("racing")).ListRaces(ctx, &racing.ListRacesRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "other scopes code")
+}
+
+func TestRegistryStaleRefresh(t *testing.T) {
+	t.Parallel()
+
+	instance := newInstance(t)
+	registry := newTestRegistryWithRefresh(t, func(reply proto.Message) {
+		for _, race := range reply.(*racing.ListRacesResponse).GetRaces() {
+			race.Status = racing.Race_CLOSED
+		}
+	})
+
+	require.NoError(t, registry.Update(context.Background(), []Service{{
+		Name:      "racing",
+		Addresses: []string{instance.address},
+		Stale:     Stale{Routes: []string{"ListRaces"}, MaxStaleness: time.Minute},
+	}}), "Update")
+
+	client := racing.NewRacingClient(registry.Conn("racing"))
+
+	fresh, err := client.ListRaces(context.Background(), &racing.ListRacesRequest{})
+	require.NoError(t, err, "fresh ListRaces")
+	assert.Equal(t, racing.Race_STATUS_UNSPECIFIED, fresh.GetRaces()[0].GetStatus(), "fresh status")
+
+	instance.server.setFailing(true)
+
+	// Stale responses are refreshed each time they are served, without changing the cached response.
+	for _, name := range []string{"stale", "stale again"} {
+		stale, err := client.ListRaces(context.Background(), &racing.ListRacesRequest{})
+		require.NoError(t, err, "%s ListRaces", name)
+		assert.Equal(t, fresh.GetRaces()[0].GetId(), stale.GetRaces()[0].GetId(), "%s ID", name)
+		assert.Equal(t, racing.Race_CLOSED, stale.GetRaces()[0].GetStatus(), "%s status", name)
+	}
+
+	var cached *racing.ListRacesResponse
+	for _, entry := range registry.Conn("racing").stale.entries {
+		cached = entry.Value.(*staleEntry).reply.(*racing.ListRacesResponse)
+	}
+	require.NotNil(t, cached, "cached response")
+	assert.Equal(t, racing.Race_STATUS_UNSPECIFIED, cached.GetRaces()[0].GetStatus(), "cached status")
+}
+
+func TestRegistryRegister(t *testing.T) {
+	t.Parallel()
+
+	instance := newInstance(t)
+	registry := newTestRegistry(t)
+
+	require.NoError(t, registry.Update(context.Background(), []Service{{
+		Name:      "racing",
+		Addresses: []string{instance.address},
+	}}), "Update")
+
+	mux := runtime.NewServeMux()
+	require.NoError(t, registry.Register(context.Background(), mux), "Register")
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/list-races", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code, "status")
+	assert.Equal(t, 1, instance.calls(), "calls")
+}
+
+func TestRegistryUpdateInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name         string
+		giveServices []Service
+	}{
+		{
+			name:         "missing_name",
+			giveServices: []Service{{Addresses: []string{"localhost:9000"}}},
+		},
+		{
+			name:         "unknown_service",
+			giveServices: []Service{{Name: "sports", Addresses: []string{"localhost:9000"}}},
+		},
+		{
+			name: "duplicate_service",
+			giveServices: []Service{
+				{Name: "racing", Addresses: []string{"localhost:9000"}},
+				{Name: "racing", Addresses: []string{"localhost:9001"}},
+			},
+		},
+		{
+			name:         "missing_addresses",
+			giveServices: []Service{{Name: "racing"}},
+		},
+		{
+			name:         "empty_address",
+			giveServices: []Service{{Name: "racing", Addresses: []string{""}}},
+		},
+		{
+			name:         "negative_timeout",
+			giveServices: []Service{{Name: "racing", Addresses: []string{"localhost:9000"}, Timeout: -time.Second}},
+		},
+		{
+			name:         "unknown_route",
+			giveServices: []Service{{Name: "racing", Addresses: []string{"localhost:9000"}, Routes: []string{"DeleteRaces"}}},
+		},
+		{
+			name: "unknown_route_timeout",
+			giveServices: []Service{{
+				Name:          "racing",
+				Addresses:     []string{"localhost:9000"},
+				RouteTimeouts: map[string]time.Duration{"DeleteRaces": time.Second},
+			}},
+		},
+		{
+			name: "stream_route_timeout",
+			giveServices: []Service{{
+				Name:          "racing",
+				Addresses:     []string{"localhost:9000"},
+				RouteTimeouts: map[string]time.Duration{"WatchRaces": time.Second},
+			}},
+		},
+		{
+			name: "zero_route_timeout",
+			giveServices: []Service{{
+				Name:          "racing",
+				Addresses:     []string{"localhost:9000"},
+				RouteTimeouts: map[string]time.Duration{"ListRaces": 0},
+			}},
+		},
+		{
+			name: "unknown_retry_route",
+			giveServices: []Service{{
+				Name:      "racing",
+				Addresses: []string{"localhost:9000"},
+				Retry:     Retry{Routes: []string{"DeleteRaces"}},
+			}},
+		},
+		{
+			name: "too_many_retry_attempts",
+			giveServices: []Service{{
+				Name:      "racing",
+				Addresses: []string{"localhost:9000"},
+				Retry:     Retry{Routes: []string{"ListRaces"}, MaxAttempts: 6},
+			}},
+		},
+		{
+			name: "invalid_retry_backoff",
+			giveServices: []Service{{
+				Name:      "racing",
+				Addresses: []string{"localhost:9000"},
+				Retry:     Retry{Routes: []string{"ListRaces"}, InitialBackoff: time.Second, MaxBackoff: time.Millisecond},
+			}},
+		},
+		{
+			name: "unknown_retry_code",
+			giveServices: []Service{{
+				Name:      "racing",
+				Addresses: []string{"localhost:9000"},
+				Retry:     Retry{Routes: []string{"ListRaces"}, Codes: []string{"BROKEN"}},
+			}},
+		},
+		{
+			name: "stale_stream_route",
+			giveServices: []Service{{
+				Name:      "racing",
+				Addresses: []string{"localhost:9000"},
+				Stale:     Stale{Routes: []string{"WatchRaces"}, MaxStaleness: time.Minute},
+			}},
+		},
+		{
+			name: "stale_without_max_staleness",
+			giveServices: []Service{{
+				Name:      "racing",
+				Addresses: []string{"localhost:9000"},
+				Stale:     Stale{Routes: []string{"ListRaces"}},
+			}},
+		},
+		{
+			name: "circuit_breaker_without_open_timeout",
+			giveServices: []Service{{
+				Name:           "racing",
+				Addresses:      []string{"localhost:9000"},
+				CircuitBreaker: CircuitBreaker{FailureThreshold: 5},
+			}},
+		},
+		{
+			name: "tls_disabled",
+			giveServices: []Service{{
+				Name:      "racing",
+				Addresses: []string{"localhost:9000"},
+				TLS:       TLS{CAFile: "ca.pem"},
+			}},
+		},
+		{
+			name: "tls_cert_without_key",
+			giveServices: []Service{{
+				Name:      "racing",
+				Addresses: []string{"localhost:9000"},
+				TLS:       TLS{Enabled: true, CertFile: "cert.pem"},
+			}},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := newTestRegistry(t)
+
+			assert.Error(t, registry.Update(context.Background(), tc.giveServices), "Update")
+			assert.Nil(t, registry.Conn("racing").get(), "conn")
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package watch
+
+import (
+	"fmt"
+	"time"
+)
+
+// Config configures race watches.
+type Config struct {
+	// HeartbeatInterval is how often each connection is sent a heartbeat, so that idle connections are not closed
+	// by proxies and dead ones are noticed.
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	// BufferSize is the number of events a connection may fall behind by before it is dropped.
+	BufferSize int `yaml:"buffer_size"`
+	// MaxConnectionsPerClient is the number of watches a client may have open at once.
+	MaxConnectionsPerClient int `yaml:"max_connections_per_client"`
+}
+
+// Validate checks the limits in cfg.
+func (c Config) Validate() error {
+	if c.HeartbeatInterval <= 0 {
+		return fmt.Errorf("invalid heartbeat interval %s", c.HeartbeatInterval)
+	}
+
+	if c.BufferSize <= 0 {
+		return fmt.Errorf("invalid buffer size %d", c.BufferSize)
+	}
+
+	if c.MaxConnectionsPerClient <= 0 {
+		return fmt.Errorf("invalid max connections per client %d", c.MaxConnectionsPerClient)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"git.neds.sh/matty/entain/api/problem"
+	"git.neds.sh/matty/entain/api/proto/racing"
+)
+
+// serveSSE relays events as server-sent events. A watch that ends with an error is finished with an "error" event
+// holding the problem.
+// See https://html.spec.whatwg.org/multipage/server-sent-events.html.
+func (h *Handler) serveSSE(ctx context.Context, w http.ResponseWriter, r *http.Request, events *relayed) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProblem(w, r, status.Error(codes.Internal, "streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops proxies such as nginx buffering events.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(h.cfg.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+
+		select {
+		case res, ok := <-events.events:
+			if !ok {
+				if err := events.endErr(ctx); err != nil {
+					writeSSEError(w, r, err)
+					flusher.Flush()
+				}
+
+				return
+			}
+
+			err = writeSSEEvent(w, res)
+		case <-heartbeat.C:
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+		}
+
+		if err != nil {
+			// The client has gone away.
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// writeSSEEvent writes res as an event, with the sequence of its race event as the ID.
+func writeSSEEvent(w io.Writer, res *racing.WatchRacesResponse) error {
+	b, err := protojson.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", res.GetEvent().GetSequence(), b)
+
+	return err
+}
+
+// writeSSEError writes err as an "error" event.
+func writeSSEError(w io.Writer, r *http.Request, err error) {
+	p, _ := problem.New(r.Context(), r, err)
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+
+	_, _ = fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+}
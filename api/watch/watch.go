@@ -0,0 +1,262 @@
+// Package watch serves /v1/races:watch, relaying the WatchRaces stream of racing to clients that can't use gRPC-Web,
+// over server-sent events or a websocket.
+//
+// Events are relayed as the JSON of racing.WatchRacesResponse, identified by their sequence. Clients resume a watch
+// after reconnecting from the Last-Event-ID header, which browsers send automatically for server-sent events, or the
+// resume_after query parameter.
+package watch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/utilities"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"git.neds.sh/matty/entain/api/metrics"
+	"git.neds.sh/matty/entain/api/problem"
+	"git.neds.sh/matty/entain/api/proto/racing"
+)
+
+// Path is the path watches are served at.
+const Path = "/v1/races:watch"
+
+// route labels watch requests in metrics, as the gateway labels requests with the RPC they are routed to.
+const route = "/racing.Racing/WatchRaces"
+
+// startedMetadataKey is the header metadata key racing sends once a watch has started.
+const startedMetadataKey = "x-watch-started"
+
+// errFellBehind is the error of a watch dropped because the client did not keep up with events.
+var errFellBehind = status.Error(codes.ResourceExhausted, "client fell behind, resume the watch from the last event received")
+
+// Annotator returns metadata to send with the WatchRaces RPC a request is relayed from. It has the signature of the
+// runtime.WithMetadata annotators used by the gateway, so they can be shared.
+type Annotator func(context.Context, *http.Request) metadata.MD
+
+// Handler is a http.Handler that serves race watches.
+type Handler struct {
+	cfg        Config
+	client     racing.RacingClient
+	clientKey  func(*http.Request) string
+	annotators []Annotator
+	upgrader   websocket.Upgrader
+
+	mu          sync.Mutex
+	connections map[string]int
+}
+
+// NewHandler creates a Handler relaying watches from client. Connections are limited per client, as identified by
+// clientKey, and websocket upgrades are only accepted if checkOrigin allows them.
+func NewHandler(
+	cfg Config,
+	client racing.RacingClient,
+	clientKey func(*http.Request) string,
+	checkOrigin func(*http.Request) bool,
+	annotators ...Annotator,
+) *Handler {
+	return &Handler{
+		cfg:         cfg,
+		client:      client,
+		clientKey:   clientKey,
+		annotators:  annotators,
+		upgrader:    websocket.Upgrader{CheckOrigin: checkOrigin},
+		connections: map[string]int{},
+	}
+}
+
+// ServeHTTP serves a watch over a websocket if r is a websocket upgrade, and over server-sent events otherwise.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	metrics.SetRoute(ctx, route)
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	in, err := parseRequest(r)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+
+	key := h.clientKey(r)
+	if !h.acquire(key) {
+		writeProblem(w, r, status.Errorf(
+			codes.ResourceExhausted, "no more than %d watches may be open at once", h.cfg.MaxConnectionsPerClient,
+		))
+
+		return
+	}
+	defer h.release(key)
+
+	md := metadata.MD{}
+	for _, annotate := range h.annotators {
+		md = metadata.Join(md, annotate(ctx, r))
+	}
+
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, md))
+	defer cancel()
+
+	// Errors such as invalid filters are reported with an error status, rather than in the stream.
+	stream, err := Start(ctx, h.client, in)
+	if err != nil {
+		writeProblem(w, r, err)
+		return
+	}
+
+	events := relay(stream, cancel, h.cfg.BufferSize)
+
+	if websocket.IsWebSocketUpgrade(r) {
+		h.serveWebSocket(ctx, w, r, events)
+	} else {
+		h.serveSSE(ctx, w, r, events)
+	}
+}
+
+// Start calls WatchRaces on client, returning the error the call was refused with, if any, before any event is
+// received.
+func Start(
+	ctx context.Context,
+	client racing.RacingClient,
+	in *racing.WatchRacesRequest,
+) (racing.Racing_WatchRacesClient, error) {
+	stream, err := client.WatchRaces(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+
+	// racing sends a header once the watch has started. Without it, the call was refused and has already ended.
+	header, err := stream.Header()
+	if err == nil && len(header.Get(startedMetadataKey)) == 0 {
+		_, err = stream.Recv()
+		if err == nil || errors.Is(err, io.EOF) {
+			err = status.Error(codes.Internal, "watch ended before it started")
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// acquire counts a connection by the client identified by key, reporting false if it has too many already.
+func (h *Handler) acquire(key string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.connections[key] >= h.cfg.MaxConnectionsPerClient {
+		return false
+	}
+
+	h.connections[key]++
+
+	return true
+}
+
+// release uncounts a connection by the client identified by key.
+func (h *Handler) release(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.connections[key]--
+	if h.connections[key] <= 0 {
+		delete(h.connections, key)
+	}
+}
+
+// parseRequest parses the WatchRaces request from the query parameters of r, e.g.
+// "?filter.meeting_ids=1&filter.meeting_ids=2", resuming from the Last-Event-ID header if set.
+func parseRequest(r *http.Request) (*racing.WatchRacesRequest, error) {
+	in := &racing.WatchRacesRequest{}
+
+	if err := runtime.PopulateQueryParameters(in, r.URL.Query(), utilities.NewDoubleArray(nil)); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if lastEventID := strings.TrimSpace(r.Header.Get("Last-Event-ID")); lastEventID != "" {
+		sequence, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid Last-Event-ID %q", lastEventID)
+		}
+
+		in.ResumeAfter = sequence
+	}
+
+	return in, nil
+}
+
+// relayed is the channel of events received from a stream by relay. Once it is closed, err is why the stream ended.
+type relayed struct {
+	events chan *racing.WatchRacesResponse
+	err    error
+}
+
+// relay receives from stream onto a channel buffering up to size events, so that a slow client doesn't hold up
+// racing. If the client falls further behind than that, the watch is cancelled with errFellBehind.
+func relay(stream racing.Racing_WatchRacesClient, cancel context.CancelFunc, size int) *relayed {
+	r := &relayed{events: make(chan *racing.WatchRacesResponse, size)}
+
+	go func() {
+		defer close(r.events)
+
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				r.err = err
+				return
+			}
+
+			select {
+			case r.events <- res:
+			default:
+				r.err = errFellBehind
+				cancel()
+
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
+// endErr returns the error that ended a watch to report to the client, or nil if the watch ended normally.
+func (r *relayed) endErr(ctx context.Context) error {
+	if r.err == errFellBehind {
+		return r.err
+	}
+
+	if ctx.Err() != nil || errors.Is(r.err, context.Canceled) || status.Code(r.err) == codes.Canceled {
+		// The client has gone away.
+		return nil
+	}
+
+	if r.err == nil || errors.Is(r.err, io.EOF) {
+		return nil
+	}
+
+	return r.err
+}
+
+// writeProblem writes err as a problem, before the watch has started.
+func writeProblem(w http.ResponseWriter, r *http.Request, err error) {
+	p, retryAfter := problem.New(r.Context(), r, err)
+
+	problem.Write(r.Context(), w, p, retryAfter)
+}
@@ -0,0 +1,444 @@
+package watch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"git.neds.sh/matty/entain/api/problem"
+	"git.neds.sh/matty/entain/api/proto/racing"
+)
+
+// racingServer streams an event for each meeting in the filter, numbered from resume_after, then blocks until the
+// watch is cancelled if the first meeting is 1. A first meeting of 403 is refused.
+type racingServer struct {
+	racing.UnimplementedRacingServer
+}
+
+func (racingServer) WatchRaces(in *racing.WatchRacesRequest, stream racing.Racing_WatchRacesServer) error {
+	meetingIDs := in.GetFilter().GetMeetingIds()
+	if len(meetingIDs) > 0 && meetingIDs[0] == 403 {
+		return status.Error(codes.PermissionDenied, "missing scope races:read")
+	}
+
+	if err := stream.SendHeader(metadata.Pairs(startedMetadataKey, "true")); err != nil {
+		return err
+	}
+
+	md, _ := metadata.FromIncomingContext(stream.Context())
+
+	for i, meetingID := range meetingIDs {
+		if err := stream.Send(&racing.WatchRacesResponse{Event: &racing.RaceEvent{
+			Sequence: in.GetResumeAfter() + uint64(i) + 1,
+			Type:     racing.RaceEvent_CREATED,
+			Race:     &racing.Race{Id: int64(i + 1), MeetingId: meetingID, Name: strings.Join(md.Get("x-test"), ",")},
+		}}); err != nil {
+			return err
+		}
+	}
+
+	if len(meetingIDs) > 0 && meetingIDs[0] == 1 {
+		<-stream.Context().Done()
+	}
+
+	return nil
+}
+
+func newTestHandler(t *testing.T, cfg Config) *Handler {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	racing.RegisterRacingServer(server, racingServer{})
+
+	go func() { _ = server.Serve(listener) }()
+
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(
+		"bufconn",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+	)
+	require.NoError(t, err, "grpc.Dial")
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	annotator := func(context.Context, *http.Request) metadata.MD {
+		return metadata.Pairs("x-test", "annotated")
+	}
+
+	return NewHandler(
+		cfg,
+		racing.NewRacingClient(conn),
+		func(*http.Request) string { return "client" },
+		func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+
+			return origin == "" || origin == "https://app.example.com"
+		},
+		annotator,
+	)
+}
+
+func testConfig() Config {
+	return Config{HeartbeatInterval: time.Minute, BufferSize: 10, MaxConnectionsPerClient: 10}
+}
+
+// sseEvent is a server-sent event.
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+func readSSEEvents(t *testing.T, r *bufio.Reader, n int) []sseEvent {
+	t.Helper()
+
+	var (
+		events []sseEvent
+		event  sseEvent
+	)
+
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err, "ReadString")
+
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "":
+			events = append(events, event)
+			event = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			event.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+
+	return events
+}
+
+func TestHandlerSSE(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(newTestHandler(t, testConfig()))
+	t.Cleanup(server.Close)
+
+	for _, tc := range []struct {
+		name              string
+		giveQuery         string
+		giveLastEventID   string
+		expectStatus      int
+		expectIDs         []string
+		expectProblemCode string
+	}{
+		{
+			name:         "success",
+			giveQuery:    "?filter.meeting_ids=7&filter.meeting_ids=8",
+			expectStatus: http.StatusOK,
+			expectIDs:    []string{"1", "2"},
+		},
+		{
+			name:            "success_resume",
+			giveQuery:       "?filter.meeting_ids=7",
+			giveLastEventID: "41",
+			expectStatus:    http.StatusOK,
+			expectIDs:       []string{"42"},
+		},
+		{
+			name:              "invalid_last_event_id",
+			giveLastEventID:   "latest",
+			expectStatus:      http.StatusBadRequest,
+			expectProblemCode: "InvalidArgument",
+		},
+		{
+			name:              "invalid_query",
+			giveQuery:         "?filter.meeting_ids=seven",
+			expectStatus:      http.StatusBadRequest,
+			expectProblemCode: "InvalidArgument",
+		},
+		{
+			name:              "refused",
+			giveQuery:         "?filter.meeting_ids=403",
+			expectStatus:      http.StatusForbidden,
+			expectProblemCode: "PermissionDenied",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req, err := http.NewRequest(http.MethodGet, server.URL+Path+tc.giveQuery, nil)
+			require.NoError(t, err, "http.NewRequest")
+
+			if tc.giveLastEventID != "" {
+				req.Header.Set("Last-Event-ID", tc.giveLastEventID)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(t, err, "Do")
+
+			defer res.Body.Close()
+
+			require.Equal(t, tc.expectStatus, res.StatusCode, "status")
+
+			if tc.expectProblemCode != "" {
+				var actual problem.Problem
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&actual), "Decode")
+
+				assert.Equal(t, tc.expectProblemCode, actual.Code, "code")
+
+				return
+			}
+
+			assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"), "Content-Type")
+
+			events := readSSEEvents(t, bufio.NewReader(res.Body), len(tc.expectIDs))
+
+			var ids []string
+			for _, event := range events {
+				ids = append(ids, event.ID)
+
+				var actual struct {
+					Event struct {
+						Type string `json:"type"`
+						Race struct {
+							Name string `json:"name"`
+						} `json:"race"`
+					} `json:"event"`
+				}
+				require.NoError(t, json.Unmarshal([]byte(event.Data), &actual), "json.Unmarshal")
+
+				assert.Equal(t, "CREATED", actual.Event.Type, "type")
+				assert.Equal(t, "annotated", actual.Event.Race.Name, "name")
+			}
+
+			assert.Equal(t, tc.expectIDs, ids, "ids")
+		})
+	}
+}
+
+func TestHandlerMaxConnectionsPerClient(t *testing.T) {
+	t.Parallel()
+
+	cfg := testConfig()
+	cfg.MaxConnectionsPerClient = 1
+
+	server := httptest.NewServer(newTestHandler(t, cfg))
+	t.Cleanup(server.Close)
+
+	// The first watch stays open until it is closed.
+	first, err := http.Get(server.URL + Path + "?filter.meeting_ids=1")
+	require.NoError(t, err, "Get first")
+
+	readSSEEvents(t, bufio.NewReader(first.Body), 1)
+
+	second, err := http.Get(server.URL + Path + "?filter.meeting_ids=1")
+	require.NoError(t, err, "Get second")
+
+	defer second.Body.Close()
+
+	assert.Equal(t, http.StatusTooManyRequests, second.StatusCode, "second status")
+
+	require.NoError(t, first.Body.Close(), "Close first")
+
+	// The first watch is released once the handler notices it has gone.
+	assert.Eventually(t, func() bool {
+		third, err := http.Get(server.URL + Path + "?filter.meeting_ids=7")
+		if err != nil {
+			return false
+		}
+
+		defer third.Body.Close()
+
+		return third.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond, "third status")
+}
+
+func TestHandlerWebSocket(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(newTestHandler(t, testConfig()))
+	t.Cleanup(server.Close)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + Path
+
+	for _, tc := range []struct {
+		name         string
+		giveQuery    string
+		giveOrigin   string
+		expectStatus int
+		expectEvents int
+	}{
+		{
+			name:         "success",
+			giveQuery:    "?filter.meeting_ids=7&filter.meeting_ids=8",
+			expectStatus: http.StatusSwitchingProtocols,
+			expectEvents: 2,
+		},
+		{
+			name:         "success_allowed_origin",
+			giveQuery:    "?filter.meeting_ids=7&resume_after=10",
+			giveOrigin:   "https://app.example.com",
+			expectStatus: http.StatusSwitchingProtocols,
+			expectEvents: 1,
+		},
+		{
+			name:         "disallowed_origin",
+			giveQuery:    "?filter.meeting_ids=7",
+			giveOrigin:   "https://evil.example.com",
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name:         "refused",
+			giveQuery:    "?filter.meeting_ids=403",
+			expectStatus: http.StatusForbidden,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			header := http.Header{}
+			if tc.giveOrigin != "" {
+				header.Set("Origin", tc.giveOrigin)
+			}
+
+			conn, res, err := websocket.DefaultDialer.Dial(url+tc.giveQuery, header)
+			if res != nil {
+				defer res.Body.Close()
+			}
+
+			require.NotNil(t, res, "response")
+			assert.Equal(t, tc.expectStatus, res.StatusCode, "status")
+
+			if tc.expectStatus != http.StatusSwitchingProtocols {
+				assert.Error(t, err, "Dial")
+				return
+			}
+
+			require.NoError(t, err, "Dial")
+
+			defer conn.Close()
+
+			for i := 0; i < tc.expectEvents; i++ {
+				var actual racingEventJSON
+				require.NoError(t, conn.ReadJSON(&actual), "ReadJSON")
+
+				assert.Equal(t, "CREATED", actual.Event.Type, "type")
+			}
+
+			// The watch ends once racing has sent every event.
+			_, _, err = conn.ReadMessage()
+			assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), "close error %v", err)
+		})
+	}
+}
+
+// racingEventJSON is the JSON of a racing.WatchRacesResponse.
+type racingEventJSON struct {
+	Event struct {
+		Sequence string `json:"sequence"`
+		Type     string `json:"type"`
+	} `json:"event"`
+}
+
+// fakeStream is a racing.Racing_WatchRacesClient receiving n events.
+type fakeStream struct {
+	racing.Racing_WatchRacesClient
+	n int
+}
+
+func (s *fakeStream) Recv() (*racing.WatchRacesResponse, error) {
+	if s.n == 0 {
+		return nil, status.Error(codes.Canceled, "context canceled")
+	}
+
+	s.n--
+
+	return &racing.WatchRacesResponse{Event: &racing.RaceEvent{}}, nil
+}
+
+func TestRelayFellBehind(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := relay(&fakeStream{n: 3}, cancel, 2)
+
+	<-ctx.Done()
+
+	var received int
+	for range events.events {
+		received++
+	}
+
+	assert.Equal(t, 2, received, "received")
+	assert.Equal(t, errFellBehind, events.endErr(ctx), "endErr")
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name          string
+		give          Config
+		expectErrored bool
+	}{
+		{
+			name: "success",
+			give: testConfig(),
+		},
+		{
+			name:          "no_heartbeat",
+			give:          Config{BufferSize: 10, MaxConnectionsPerClient: 1},
+			expectErrored: true,
+		},
+		{
+			name:          "no_buffer",
+			give:          Config{HeartbeatInterval: time.Second, MaxConnectionsPerClient: 1},
+			expectErrored: true,
+		},
+		{
+			name:          "no_connections",
+			give:          Config{HeartbeatInterval: time.Second, BufferSize: 10},
+			expectErrored: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if tc.expectErrored {
+				assert.Error(t, tc.give.Validate())
+			} else {
+				assert.NoError(t, tc.give.Validate())
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"git.neds.sh/matty/entain/api/problem"
+)
+
+// serveWebSocket relays events as websocket text messages. A watch that ends with an error is finished with a
+// {"error": problem} message before the websocket is closed.
+func (h *Handler) serveWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request, events *relayed) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has responded with an error.
+		return
+	}
+	defer conn.Close()
+
+	// Clients must answer each heartbeat ping before the next is due.
+	timeout := 2 * h.cfg.HeartbeatInterval
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(timeout))
+	})
+
+	// Messages from the client are discarded, but must be read for pongs and close messages to be handled.
+	gone := make(chan struct{})
+
+	go func() {
+		defer close(gone)
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(h.cfg.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-gone:
+			return
+		case res, ok := <-events.events:
+			if !ok {
+				closeWebSocket(conn, r, events.endErr(ctx), h.cfg.HeartbeatInterval)
+				return
+			}
+
+			var b []byte
+			if b, err = protojson.Marshal(res); err == nil {
+				_ = conn.SetWriteDeadline(time.Now().Add(h.cfg.HeartbeatInterval))
+				err = conn.WriteMessage(websocket.TextMessage, b)
+			}
+		case <-heartbeat.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(h.cfg.HeartbeatInterval))
+		}
+
+		if err != nil {
+			// The client has gone away.
+			return
+		}
+	}
+}
+
+// closeWebSocket closes conn at the end of a watch, first sending err as a problem if the watch failed.
+func closeWebSocket(conn *websocket.Conn, r *http.Request, err error, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	code := websocket.CloseNormalClosure
+
+	if err != nil {
+		p, _ := problem.New(r.Context(), r, err)
+
+		if b, marshalErr := json.Marshal(map[string]*problem.Problem{"error": p}); marshalErr == nil {
+			_ = conn.SetWriteDeadline(deadline)
+			_ = conn.WriteMessage(websocket.TextMessage, b)
+		}
+
+		switch status.Code(err) {
+		case codes.ResourceExhausted, codes.Unavailable:
+			code = websocket.CloseTryAgainLater
+		default:
+			code = websocket.CloseInternalServerErr
+		}
+	}
+
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), deadline)
+}
@@ -0,0 +1,212 @@
+// Package apperrors defines the errors the racing service reports to its clients and how they map onto gRPC
+// statuses.
+//
+// Errors that are not part of this taxonomy are reported as codes.Internal with a generic message, so that details
+// such as SQL text never leave the service.
+package apperrors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// internalMessage is the message reported for errors outside of the taxonomy.
+const internalMessage = "internal error"
+
+// FieldViolation describes a single invalid field of a request.
+type FieldViolation struct {
+	// Field is the path to the field, e.g. "filter.meeting_ids[0]".
+	Field string
+	// Description describes why the field is invalid.
+	Description string
+}
+
+// InvalidArgumentError is returned when a request is invalid.
+type InvalidArgumentError struct {
+	Violations []FieldViolation
+}
+
+// InvalidArgument creates an InvalidArgumentError.
+func InvalidArgument(violations ...FieldViolation) error {
+	return &InvalidArgumentError{Violations: violations}
+}
+
+func (e *InvalidArgumentError) Error() string {
+	fields := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		fields = append(fields, v.Field+": "+v.Description)
+	}
+
+	return "invalid argument: " + strings.Join(fields, ", ")
+}
+
+// NotFoundError is returned when a requested resource does not exist.
+type NotFoundError struct {
+	// ResourceType is the type of the resource, e.g. "racing.Race".
+	ResourceType string
+	// ResourceName identifies the resource, e.g. "races/1".
+	ResourceName string
+}
+
+// NotFound creates a NotFoundError.
+func NotFound(resourceType, resourceName string) error {
+	return &NotFoundError{ResourceType: resourceType, ResourceName: resourceName}
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %q not found", e.ResourceType, e.ResourceName)
+}
+
+// AlreadyExistsError is returned when a resource a request would create or restore already exists.
+type AlreadyExistsError struct {
+	// ResourceType is the type of the resource, e.g. "racing.Race".
+	ResourceType string
+	// ResourceName identifies the resource, e.g. "races/1".
+	ResourceName string
+}
+
+// AlreadyExists creates an AlreadyExistsError.
+func AlreadyExists(resourceType, resourceName string) error {
+	return &AlreadyExistsError{ResourceType: resourceType, ResourceName: resourceName}
+}
+
+func (e *AlreadyExistsError) Error() string {
+	return fmt.Sprintf("%s %q already exists", e.ResourceType, e.ResourceName)
+}
+
+// EtagPrecondition is the type of the precondition failure reported by AbortedError, which clients may match on.
+const EtagPrecondition = "ETAG"
+
+// AbortedError is returned when a resource has changed since the version a write was made to, as identified by its
+// etag. The client should read the resource again before retrying.
+type AbortedError struct {
+	// ResourceType is the type of the resource, e.g. "racing.Race".
+	ResourceType string
+	// ResourceName identifies the resource, e.g. "races/1".
+	ResourceName string
+}
+
+// Aborted creates an AbortedError.
+func Aborted(resourceType, resourceName string) error {
+	return &AbortedError{ResourceType: resourceType, ResourceName: resourceName}
+}
+
+func (e *AbortedError) Error() string {
+	return fmt.Sprintf("%s %q has changed", e.ResourceType, e.ResourceName)
+}
+
+// UnavailableError is returned when a dependency is temporarily unavailable and the request may be retried.
+type UnavailableError struct {
+	// RetryAfter is how long the client should wait before retrying.
+	RetryAfter time.Duration
+	// Err is the underlying cause. It is not reported to the client.
+	Err error
+}
+
+// Unavailable creates an UnavailableError.
+func Unavailable(err error, retryAfter time.Duration) error {
+	return &UnavailableError{RetryAfter: retryAfter, Err: err}
+}
+
+func (e *UnavailableError) Error() string {
+	return "unavailable: " + e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// ToStatus converts err into the gRPC status reported to clients. The second return value is false if err is not
+// part of the taxonomy and was reported as codes.Internal.
+func ToStatus(err error) (*status.Status, bool) {
+	if err == nil {
+		return nil, true
+	}
+
+	if s, ok := status.FromError(err); ok {
+		return s, true
+	}
+
+	var (
+		invalidArgument *InvalidArgumentError
+		notFound        *NotFoundError
+		alreadyExists   *AlreadyExistsError
+		aborted         *AbortedError
+		unavailable     *UnavailableError
+	)
+
+	switch {
+	case errors.As(err, &invalidArgument):
+		violations := make([]*errdetails.BadRequest_FieldViolation, 0, len(invalidArgument.Violations))
+		for _, v := range invalidArgument.Violations {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{
+				Field:       v.Field,
+				Description: v.Description,
+			})
+		}
+
+		return withDetails(
+			status.New(codes.InvalidArgument, invalidArgument.Error()),
+			&errdetails.BadRequest{FieldViolations: violations},
+		), true
+	case errors.As(err, &notFound):
+		return withDetails(
+			status.New(codes.NotFound, notFound.Error()),
+			&errdetails.ResourceInfo{
+				ResourceType: notFound.ResourceType,
+				ResourceName: notFound.ResourceName,
+			},
+		), true
+	case errors.As(err, &alreadyExists):
+		return withDetails(
+			status.New(codes.AlreadyExists, alreadyExists.Error()),
+			&errdetails.ResourceInfo{
+				ResourceType: alreadyExists.ResourceType,
+				ResourceName: alreadyExists.ResourceName,
+			},
+		), true
+	case errors.As(err, &aborted):
+		return withDetails(
+			status.New(codes.Aborted, aborted.Error()),
+			&errdetails.ResourceInfo{
+				ResourceType: aborted.ResourceType,
+				ResourceName: aborted.ResourceName,
+			},
+			&errdetails.PreconditionFailure{Violations: []*errdetails.PreconditionFailure_Violation{{
+				Type:        EtagPrecondition,
+				Subject:     aborted.ResourceName,
+				Description: "the etag does not match the current version",
+			}}},
+		), true
+	case errors.As(err, &unavailable):
+		return withDetails(
+			status.New(codes.Unavailable, "service temporarily unavailable"),
+			&errdetails.RetryInfo{RetryDelay: durationpb.New(unavailable.RetryAfter)},
+		), true
+	case errors.Is(err, context.Canceled):
+		return status.New(codes.Canceled, "request canceled"), true
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.New(codes.DeadlineExceeded, "deadline exceeded"), true
+	}
+
+	return status.New(codes.Internal, internalMessage), false
+}
+
+// withDetails attaches details to s. If they can't be attached, s is returned without them.
+func withDetails(s *status.Status, details ...proto.Message) *status.Status {
+	withDetails, err := s.WithDetails(details...)
+	if err != nil {
+		return s
+	}
+
+	return withDetails
+}
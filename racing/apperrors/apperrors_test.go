@@ -0,0 +1,130 @@
+package apperrors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestToStatus(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name          string
+		give          error
+		expectCode    codes.Code
+		expectMessage string
+		expectDetails []interface{}
+		expectKnown   bool
+	}{
+		{
+			name:          "invalid_argument",
+			give:          InvalidArgument(FieldViolation{Field: "filter.meeting_ids[0]", Description: "must be greater than 0"}),
+			expectCode:    codes.InvalidArgument,
+			expectMessage: "invalid argument: filter.meeting_ids[0]: must be greater than 0",
+			expectDetails: []interface{}{
+				&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+					{Field: "filter.meeting_ids[0]", Description: "must be greater than 0"},
+				}},
+			},
+			expectKnown: true,
+		},
+		{
+			name:          "not_found_wrapped",
+			give:          fmt.Errorf("get: %w", NotFound("racing.Race", "races/1")),
+			expectCode:    codes.NotFound,
+			expectMessage: `racing.Race "races/1" not found`,
+			expectDetails: []interface{}{
+				&errdetails.ResourceInfo{ResourceType: "racing.Race", ResourceName: "races/1"},
+			},
+			expectKnown: true,
+		},
+		{
+			name:          "already_exists",
+			give:          AlreadyExists("racing.Race", "races/1"),
+			expectCode:    codes.AlreadyExists,
+			expectMessage: `racing.Race "races/1" already exists`,
+			expectDetails: []interface{}{
+				&errdetails.ResourceInfo{ResourceType: "racing.Race", ResourceName: "races/1"},
+			},
+			expectKnown: true,
+		},
+		{
+			name:          "aborted",
+			give:          Aborted("racing.Race", "races/1"),
+			expectCode:    codes.Aborted,
+			expectMessage: `racing.Race "races/1" has changed`,
+			expectDetails: []interface{}{
+				&errdetails.ResourceInfo{ResourceType: "racing.Race", ResourceName: "races/1"},
+				&errdetails.PreconditionFailure{Violations: []*errdetails.PreconditionFailure_Violation{
+					{Type: EtagPrecondition, Subject: "races/1", Description: "the etag does not match the current version"},
+				}},
+			},
+			expectKnown: true,
+		},
+		{
+			name:          "unavailable",
+			give:          Unavailable(errors.New("database is locked"), time.Second),
+			expectCode:    codes.Unavailable,
+			expectMessage: "service temporarily unavailable",
+			expectDetails: []interface{}{
+				&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Second)},
+			},
+			expectKnown: true,
+		},
+		{
+			name:          "canceled",
+			give:          fmt.Errorf("query stopped: %w", context.Canceled),
+			expectCode:    codes.Canceled,
+			expectMessage: "request canceled",
+			expectDetails: []interface{}{},
+			expectKnown:   true,
+		},
+		{
+			name:          "deadline_exceeded",
+			give:          fmt.Errorf("query stopped: %w", context.DeadlineExceeded),
+			expectCode:    codes.DeadlineExceeded,
+			expectMessage: "deadline exceeded",
+			expectDetails: []interface{}{},
+			expectKnown:   true,
+		},
+		{
+			name:          "status",
+			give:          status.Error(codes.PermissionDenied, "TestError123"),
+			expectCode:    codes.PermissionDenied,
+			expectMessage: "TestError123",
+			expectDetails: []interface{}{},
+			expectKnown:   true,
+		},
+		{
+			name:          "internal",
+			give:          errors.New("near \"SELECT\": syntax error"),
+			expectCode:    codes.Internal,
+			expectMessage: internalMessage,
+			expectDetails: []interface{}{},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual, actualKnown := ToStatus(tc.give)
+
+			assert.Equal(t, tc.expectCode, actual.Code(), "code")
+			assert.Equal(t, tc.expectMessage, actual.Message(), "message")
+			assert.Empty(t, cmp.Diff(tc.expectDetails, actual.Details(), protocmp.Transform()), "details")
+			assert.Equal(t, tc.expectKnown, actualKnown, "known")
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package apperrors
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+
+	"git.neds.sh/matty/entain/racing/logging"
+)
+
+// UnaryServerInterceptor converts the errors returned by unary RPCs into gRPC statuses. Errors outside of the
+// taxonomy are logged before being reported as codes.Internal.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return nil, toStatusError(ctx, err)
+		}
+
+		return resp, nil
+	}
+}
+
+// StreamServerInterceptor converts the errors returned by streaming RPCs into gRPC statuses. Errors outside of the
+// taxonomy are logged before being reported as codes.Internal.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := handler(srv, ss); err != nil {
+			return toStatusError(ss.Context(), err)
+		}
+
+		return nil
+	}
+}
+
+func toStatusError(ctx context.Context, err error) error {
+	s, ok := ToStatus(err)
+	if !ok {
+		logging.FromContext(ctx).WithError(err).Error("internal error")
+	}
+
+	return s.Err()
+}
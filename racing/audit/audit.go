@@ -0,0 +1,145 @@
+// Package audit describes who makes changes to resources, and how, for the repository to record them alongside the
+// changes.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/racing/auth"
+)
+
+// AnonymousActor is the actor of changes made by callers without a subject.
+const AnonymousActor = "anonymous"
+
+// ignoredFields are the JSON names of the fields of resources left out of diffs: the etag, as it changes with every
+// write, and the status of races, as it is derived from the time they are read rather than stored.
+var ignoredFields = map[string]bool{"etag": true, "status": true}
+
+// Source describes who made a change, and how.
+type Source struct {
+	// Actor is who made the change.
+	Actor string
+	// RPC is the full name of the RPC that made the change, or the command that did.
+	RPC string
+}
+
+type sourceKey struct{}
+
+// NewContext returns a copy of ctx carrying source.
+func NewContext(ctx context.Context, source Source) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// FromContext returns the source carried by ctx. Changes made with a context without one are made by an anonymous
+// actor, by an unknown RPC.
+func FromContext(ctx context.Context) Source {
+	source, ok := ctx.Value(sourceKey{}).(Source)
+	if !ok {
+		return Source{Actor: AnonymousActor}
+	}
+
+	return source
+}
+
+// UnaryServerInterceptor attaches the source of unary RPCs to the context, from the caller's identity attached by the
+// auth interceptor before it.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(NewContext(ctx, rpcSource(ctx, info.FullMethod)), req)
+	}
+}
+
+// StreamServerInterceptor attaches the source of streaming RPCs to the context, from the caller's identity attached
+// by the auth interceptor before it.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := NewContext(ss.Context(), rpcSource(ss.Context(), info.FullMethod))
+
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// serverStream overrides the context of a grpc.ServerStream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// rpcSource returns the source of changes made by the RPC method called with ctx.
+func rpcSource(ctx context.Context, method string) Source {
+	source := Source{Actor: AnonymousActor, RPC: method}
+
+	if identity, ok := auth.FromContext(ctx); ok && identity.Subject != "" {
+		source.Actor = identity.Subject
+	}
+
+	return source
+}
+
+// Diff returns the fields that differ between before and after as a JSON object, each holding its value before and
+// after, as described by racing.AuditEvent. Either may be nil, for resources that are created or deleted.
+func Diff(before, after proto.Message) (string, error) {
+	beforeFields, err := fields(before)
+	if err != nil {
+		return "", err
+	}
+
+	afterFields, err := fields(after)
+	if err != nil {
+		return "", err
+	}
+
+	type change struct {
+		Before interface{} `json:"before"`
+		After  interface{} `json:"after"`
+	}
+
+	// Fields are encoded ordered by name, as maps are.
+	diff := map[string]change{}
+
+	for _, side := range []map[string]interface{}{beforeFields, afterFields} {
+		for name := range side {
+			if ignoredFields[name] || reflect.DeepEqual(beforeFields[name], afterFields[name]) {
+				continue
+			}
+
+			diff[name] = change{Before: beforeFields[name], After: afterFields[name]}
+		}
+	}
+
+	encoded, err := json.Marshal(diff)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
+
+// fields returns the fields of m in its JSON form, including those unset, or none if m is nil.
+func fields(m proto.Message) (map[string]interface{}, error) {
+	if m == nil || reflect.ValueOf(m).IsNil() {
+		return nil, nil
+	}
+
+	encoded, err := protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return nil, err
+	}
+
+	return decoded, nil
+}
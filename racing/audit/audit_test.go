@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/auth"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name         string
+		giveIdentity *auth.Identity
+		expect       Source
+	}{
+		{
+			name:         "success",
+			giveIdentity: &auth.Identity{Subject: "trader", Method: "jwt"},
+			expect:       Source{Actor: "trader", RPC: "/racing.Racing/UpdateRace"},
+		},
+		{
+			name:         "success_anonymous",
+			giveIdentity: &auth.Identity{Method: "anonymous"},
+			expect:       Source{Actor: AnonymousActor, RPC: "/racing.Racing/UpdateRace"},
+		},
+		{
+			// Scopes aren't enforced, so no identity is attached.
+			name:   "success_no_identity",
+			expect: Source{Actor: AnonymousActor, RPC: "/racing.Racing/UpdateRace"},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			if tc.giveIdentity != nil {
+				ctx = auth.NewContext(ctx, tc.giveIdentity)
+			}
+
+			var actual Source
+
+			_, err := UnaryServerInterceptor()(
+				ctx,
+				nil,
+				&grpc.UnaryServerInfo{FullMethod: "/racing.Racing/UpdateRace"},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					actual = FromContext(ctx)
+
+					return nil, nil
+				},
+			)
+			require.NoError(t, err, "interceptor")
+
+			assert.Equal(t, tc.expect, actual, "source")
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+	race := &racing.Race{Id: 1, MeetingId: 2, Name: "One", Number: 3, AdvertisedStartTime: timestamppb.New(start), Etag: `"1"`}
+
+	renamed := proto.Clone(race).(*racing.Race)
+	renamed.Name = "Two"
+	renamed.Visible = true
+	renamed.Etag = `"2"`
+
+	for _, tc := range []struct {
+		name       string
+		giveBefore *racing.Race
+		giveAfter  *racing.Race
+		expect     string
+	}{
+		{
+			name:       "success_updated",
+			giveBefore: race,
+			giveAfter:  renamed,
+			expect:     `{"name":{"before":"One","after":"Two"},"visible":{"before":false,"after":true}}`,
+		},
+		{
+			name:      "success_created",
+			giveAfter: race,
+			expect: `{"advertised_start_time":{"before":null,"after":"2021-03-04T05:06:07Z"},"external_id":{"before":null,"after":""},` +
+				`"id":{"before":null,"after":"1"},"meeting_id":{"before":null,"after":"2"},"name":{"before":null,"after":"One"},` +
+				`"number":{"before":null,"after":"3"},"visible":{"before":null,"after":false}}`,
+		},
+		{
+			name:       "success_purged",
+			giveBefore: race,
+			expect: `{"advertised_start_time":{"before":"2021-03-04T05:06:07Z","after":null},"external_id":{"before":"","after":null},` +
+				`"id":{"before":"1","after":null},"meeting_id":{"before":"2","after":null},"name":{"before":"One","after":null},` +
+				`"number":{"before":"3","after":null},"visible":{"before":false,"after":null}}`,
+		},
+		{
+			// Only the etag changed, which isn't part of the diff.
+			name:       "success_unchanged",
+			giveBefore: race,
+			giveAfter:  &racing.Race{Id: 1, MeetingId: 2, Name: "One", Number: 3, AdvertisedStartTime: timestamppb.New(start), Etag: `"2"`},
+			expect:     `{}`,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual, err := Diff(tc.giveBefore, tc.giveAfter)
+			require.NoError(t, err, "Diff")
+
+			assert.Equal(t, tc.expect, actual, "diff")
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC metadata keys the api gateway forwards the verified identity on. They are only trusted from peers that
+// presented a client certificate, as any other caller could set them.
+const (
+	SubjectMetadataKey = "x-auth-subject"
+	ScopesMetadataKey  = "x-auth-scopes"
+	MethodMetadataKey  = "x-auth-method"
+)
+
+// Scopes that may be required by RPCs.
+const (
+	ScopeRacesRead  = "races:read"
+	ScopeRacesWrite = "races:write"
+	ScopeAuditRead  = "audit:read"
+)
+
+// ScopeNone is the scope of RPCs any caller may call, even without an identity, such as health checks.
+const ScopeNone = ""
+
+// Policy maps each RPC's full method name to the scope required to call it. RPCs without a policy can't be called.
+type Policy map[string]string
+
+// DefaultPolicy is the scope policy of the racing service.
+var DefaultPolicy = Policy{
+	"/racing.Racing/ListRaces":       ScopeRacesRead,
+	"/racing.Racing/WatchRaces":      ScopeRacesRead,
+	"/racing.Racing/ImportRaces":     ScopeRacesWrite,
+	"/racing.Racing/ExportRaces":     ScopeRacesRead,
+	"/racing.Racing/UpdateRace":      ScopeRacesWrite,
+	"/racing.Racing/DeleteRace":      ScopeRacesWrite,
+	"/racing.Racing/UndeleteRace":    ScopeRacesWrite,
+	"/racing.Racing/ListAuditEvents": ScopeAuditRead,
+	"/grpc.health.v1.Health/Check":   ScopeNone,
+	"/grpc.health.v1.Health/Watch":   ScopeNone,
+}
+
+// Identity is the identity of the caller of an RPC.
+type Identity struct {
+	// Subject identifies the caller. It is empty for anonymous callers.
+	Subject string
+	// Scopes are the scopes granted to the caller.
+	Scopes []string
+	// Method is how the caller was authenticated by the gateway.
+	Method string
+}
+
+// HasScope reports whether the identity was granted scope.
+func (i *Identity) HasScope(scope string) bool {
+	for _, s := range i.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+type identityKey struct{}
+
+// NewContext returns a copy of ctx carrying identity.
+func NewContext(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns the identity carried by ctx, if any.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+
+	return identity, ok
+}
+
+// UnaryServerInterceptor enforces policy on unary RPCs and attaches the caller's identity to the context.
+func UnaryServerInterceptor(policy Policy) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authorize(ctx, policy, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor enforces policy on streaming RPCs and attaches the caller's identity to the context.
+func StreamServerInterceptor(policy Policy) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authorize(ss.Context(), policy, info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// serverStream overrides the context of a grpc.ServerStream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// authorize checks the identity in the incoming metadata of ctx holds the scope policy requires for method.
+func authorize(ctx context.Context, policy Policy, method string) (context.Context, error) {
+	scope, ok := policy[method]
+	if !ok {
+		return nil, status.Errorf(codes.PermissionDenied, "no access policy for %s", method)
+	}
+
+	if scope == ScopeNone {
+		return ctx, nil
+	}
+
+	identity, ok := identityFromMetadata(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing identity")
+	}
+
+	if !identity.HasScope(scope) {
+		return nil, status.Errorf(codes.PermissionDenied, "scope %q is required", scope)
+	}
+
+	return NewContext(ctx, identity), nil
+}
+
+// identityFromMetadata reads the identity forwarded by the gateway from the incoming metadata of ctx, if the peer is
+// trusted to forward one.
+func identityFromMetadata(ctx context.Context) (*Identity, bool) {
+	if !certifiedPeer(ctx) {
+		return nil, false
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	methods := md.Get(MethodMetadataKey)
+	if len(methods) != 1 || methods[0] == "" {
+		return nil, false
+	}
+
+	identity := &Identity{Method: methods[0]}
+
+	if subjects := md.Get(SubjectMetadataKey); len(subjects) == 1 {
+		identity.Subject = subjects[0]
+	}
+
+	for _, scopes := range md.Get(ScopesMetadataKey) {
+		identity.Scopes = append(identity.Scopes, strings.Fields(scopes)...)
+	}
+
+	return identity, true
+}
+
+// certifiedPeer reports whether the peer of ctx is connected over TLS with a client certificate. Servers must verify
+// client certificates as they accept connections, as tlsconfig.Reloader.ServerConfig does when given a CA bundle, so
+// that only the peers they verified have one.
+func certifiedPeer(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+
+	return ok && len(tlsInfo.State.PeerCertificates) > 0
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	t.Parallel()
+
+	policy := Policy{
+		"/racing.Racing/ListRaces":     ScopeRacesRead,
+		"/racing.Racing/UpdateRace":    ScopeRacesWrite,
+		"/grpc.health.v1.Health/Check": ScopeNone,
+	}
+
+	for _, tc := range []struct {
+		name           string
+		giveMD         metadata.MD
+		giveUntrusted  bool
+		giveMethod     string
+		expectIdentity *Identity
+		expectCode     codes.Code
+	}{
+		{
+			name:       "success_read",
+			giveMD:     metadata.Pairs(MethodMetadataKey, "anonymous", ScopesMetadataKey, "races:read"),
+			giveMethod: "/racing.Racing/ListRaces",
+			expectIdentity: &Identity{
+				Scopes: []string{"races:read"},
+				Method: "anonymous",
+			},
+			expectCode: codes.OK,
+		},
+		{
+			name: "success_write",
+			giveMD: metadata.Pairs(
+				MethodMetadataKey, "jwt",
+				SubjectMetadataKey, "trader",
+				ScopesMetadataKey, "races:read races:write",
+			),
+			giveMethod: "/racing.Racing/UpdateRace",
+			expectIdentity: &Identity{
+				Subject: "trader",
+				Scopes:  []string{"races:read", "races:write"},
+				Method:  "jwt",
+			},
+			expectCode: codes.OK,
+		},
+		{
+			name:       "missing_scope",
+			giveMD:     metadata.Pairs(MethodMetadataKey, "anonymous", ScopesMetadataKey, "races:read"),
+			giveMethod: "/racing.Racing/UpdateRace",
+			expectCode: codes.PermissionDenied,
+		},
+		{
+			name:       "no_policy",
+			giveMD:     metadata.Pairs(MethodMetadataKey, "jwt", ScopesMetadataKey, "races:read races:write"),
+			giveMethod: "/racing.Racing/DeleteEverything",
+			expectCode: codes.PermissionDenied,
+		},
+		{
+			name:       "success_no_scope",
+			giveMethod: "/grpc.health.v1.Health/Check",
+			expectCode: codes.OK,
+		},
+		{
+			name:       "no_identity",
+			giveMethod: "/racing.Racing/ListRaces",
+			expectCode: codes.Unauthenticated,
+		},
+		{
+			// Peers without a client certificate can't forward an identity.
+			name: "untrusted_peer",
+			giveMD: metadata.Pairs(
+				MethodMetadataKey, "jwt",
+				SubjectMetadataKey, "trader",
+				ScopesMetadataKey, "races:read races:write",
+			),
+			giveUntrusted: true,
+			giveMethod:    "/racing.Racing/UpdateRace",
+			expectCode:    codes.Unauthenticated,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			if !tc.giveUntrusted {
+				ctx = withCertifiedPeer(ctx)
+			}
+
+			if tc.giveMD != nil {
+				ctx = metadata.NewIncomingContext(ctx, tc.giveMD)
+			}
+
+			var actualIdentity *Identity
+
+			_, actualErr := UnaryServerInterceptor(policy)(
+				ctx,
+				nil,
+				&grpc.UnaryServerInfo{FullMethod: tc.giveMethod},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					actualIdentity, _ = FromContext(ctx)
+
+					return nil, nil
+				},
+			)
+
+			assert.Equal(t, tc.expectCode, status.Code(actualErr), "code")
+			assert.Equal(t, tc.expectIdentity, actualIdentity, "identity")
+		})
+	}
+}
+
+// withCertifiedPeer returns a copy of ctx with a peer that presented a client certificate.
+func withCertifiedPeer(ctx context.Context) context.Context {
+	return peer.NewContext(ctx, &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}},
+	})
+}
@@ -0,0 +1,249 @@
+// Package cache caches listings of races in process, so repeated ListRaces calls don't each query the database.
+//
+// Listings are held in an LRU of limited size, each for a limited time, keyed on their normalized filter and order.
+// Every write through the cache empties it, while the TTL bounds how long changes made elsewhere, such as by another
+// process sharing the database, go unseen. Races are cached as stored, so anything derived from the time they are read,
+// such as their status, must be derived after they are listed from the cache.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// Repo is the repository of races cached.
+type Repo interface {
+	List(ctx context.Context, filter *racing.ListRacesRequestFilter, order racing.RaceOrder) ([]*racing.Race, error)
+	Insert(ctx context.Context, races ...*racing.Race) ([]*racing.Race, error)
+	Import(ctx context.Context, races []*racing.Race, commit bool) ([]*racing.ImportRaceResult, error)
+	Update(ctx context.Context, race *racing.Race, etag string) (*racing.Race, error)
+	Delete(ctx context.Context, id int64, etag string) (*racing.Race, error)
+	Undelete(ctx context.Context, id int64, etag string) (*racing.Race, error)
+	Purge(ctx context.Context, deletedBefore time.Time) (int, error)
+}
+
+// RacesRepo is a Repo caching the listings of another.
+type RacesRepo struct {
+	repo Repo
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu sync.Mutex
+	// generation is incremented by every write, so that listings started before it aren't cached after it.
+	generation uint64
+	entries    map[string]*list.Element
+	// lru orders the entries from the most to the least recently used.
+	lru *list.List
+}
+
+// entry is a cached listing.
+type entry struct {
+	key     string
+	races   []*racing.Race
+	expires time.Time
+}
+
+// NewRacesRepo creates a RacesRepo caching up to size listings of repo, each for ttl.
+func NewRacesRepo(repo Repo, size int, ttl time.Duration) *RacesRepo {
+	return &RacesRepo{
+		repo:    repo,
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// List returns the races matching filter in order, from the cache if they were listed within the TTL.
+func (r *RacesRepo) List(
+	ctx context.Context,
+	filter *racing.ListRacesRequestFilter,
+	order racing.RaceOrder,
+) ([]*racing.Race, error) {
+	key := listingKey(filter, order)
+
+	races, generation, ok := r.get(key)
+	if ok {
+		cacheHits.Inc()
+
+		return races, nil
+	}
+
+	cacheMisses.Inc()
+
+	races, err := r.repo.List(ctx, filter, order)
+	if err != nil {
+		return nil, err
+	}
+
+	r.put(key, races, generation)
+
+	return races, nil
+}
+
+// Insert inserts races into the repository, emptying the cache if any were inserted.
+func (r *RacesRepo) Insert(ctx context.Context, races ...*racing.Race) ([]*racing.Race, error) {
+	inserted, err := r.repo.Insert(ctx, races...)
+	if len(inserted) > 0 {
+		r.Invalidate()
+	}
+
+	return inserted, err
+}
+
+// Import imports races into the repository, emptying the cache if they were committed.
+func (r *RacesRepo) Import(ctx context.Context, races []*racing.Race, commit bool) ([]*racing.ImportRaceResult, error) {
+	// The cache is emptied even if the import fails, as whether a failed commit was applied can't be known.
+	if commit {
+		defer r.Invalidate()
+	}
+
+	return r.repo.Import(ctx, races, commit)
+}
+
+// Update updates a race in the repository, emptying the cache.
+func (r *RacesRepo) Update(ctx context.Context, race *racing.Race, etag string) (*racing.Race, error) {
+	defer r.Invalidate()
+
+	return r.repo.Update(ctx, race, etag)
+}
+
+// Delete deletes a race from the repository, emptying the cache.
+func (r *RacesRepo) Delete(ctx context.Context, id int64, etag string) (*racing.Race, error) {
+	defer r.Invalidate()
+
+	return r.repo.Delete(ctx, id, etag)
+}
+
+// Undelete restores a deleted race in the repository, emptying the cache.
+func (r *RacesRepo) Undelete(ctx context.Context, id int64, etag string) (*racing.Race, error) {
+	defer r.Invalidate()
+
+	return r.repo.Undelete(ctx, id, etag)
+}
+
+// Purge removes deleted races from the repository for good, emptying the cache if any were removed.
+func (r *RacesRepo) Purge(ctx context.Context, deletedBefore time.Time) (int, error) {
+	purged, err := r.repo.Purge(ctx, deletedBefore)
+	if purged > 0 {
+		r.Invalidate()
+	}
+
+	return purged, err
+}
+
+// get returns copies of the races cached under key if they haven't expired, and the generation of the cache.
+func (r *RacesRepo) get(key string) ([]*racing.Race, uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	element, ok := r.entries[key]
+	if !ok {
+		return nil, r.generation, false
+	}
+
+	e := element.Value.(*entry)
+	if !r.now().Before(e.expires) {
+		r.remove(element)
+
+		return nil, r.generation, false
+	}
+
+	r.lru.MoveToFront(element)
+
+	return cloneRaces(e.races), r.generation, true
+}
+
+// put caches copies of races under key, unless the cache was written to since generation, evicting the least
+// recently used listing if the cache is full.
+func (r *RacesRepo) put(key string, races []*racing.Race, generation uint64) {
+	if r.size <= 0 || r.ttl <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if generation != r.generation {
+		return
+	}
+
+	if element, ok := r.entries[key]; ok {
+		r.remove(element)
+	}
+
+	r.entries[key] = r.lru.PushFront(&entry{key: key, races: cloneRaces(races), expires: r.now().Add(r.ttl)})
+
+	for r.lru.Len() > r.size {
+		r.remove(r.lru.Back())
+		cacheEvictions.Inc()
+	}
+
+	cacheEntries.Set(float64(r.lru.Len()))
+}
+
+// remove removes element from the cache.
+func (r *RacesRepo) remove(element *list.Element) {
+	r.lru.Remove(element)
+	delete(r.entries, element.Value.(*entry).key)
+	cacheEntries.Set(float64(r.lru.Len()))
+}
+
+// Invalidate empties the cache, so that the listings that follow see every change made before it.
+func (r *RacesRepo) Invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.generation++
+	r.entries = map[string]*list.Element{}
+	r.lru.Init()
+	cacheEntries.Set(0)
+}
+
+// listingKey returns the key of the listing of filter in order, the same for filters matching the same races regardless
+// of the order of their meeting IDs or repeats of them, and for equal orders however they were written.
+func listingKey(filter *racing.ListRacesRequestFilter, order racing.RaceOrder) string {
+	meetingIDs := append([]int64(nil), filter.GetMeetingIds()...)
+	sort.Slice(meetingIDs, func(i, j int) bool { return meetingIDs[i] < meetingIDs[j] })
+
+	var key strings.Builder
+
+	key.WriteString("meeting_ids=")
+
+	for i, id := range meetingIDs {
+		if i > 0 && id == meetingIDs[i-1] {
+			continue
+		}
+
+		fmt.Fprintf(&key, "%d,", id)
+	}
+
+	fmt.Fprintf(&key, ";show_deleted=%t;order_by=%s", filter.GetShowDeleted(), order)
+
+	return key.String()
+}
+
+// cloneRaces returns copies of races, so that callers can't change those cached.
+func cloneRaces(races []*racing.Race) []*racing.Race {
+	if races == nil {
+		return nil
+	}
+
+	clones := make([]*racing.Race, len(races))
+	for i, race := range races {
+		clones[i] = proto.Clone(race).(*racing.Race)
+	}
+
+	return clones
+}
@@ -0,0 +1,317 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+type fakeRepo struct {
+	mu    sync.Mutex
+	lists int
+	err   error
+	// purged is the number of races Purge reports purging.
+	purged int
+	// during is called while listing, to write to the cache mid-listing.
+	during func()
+}
+
+func (r *fakeRepo) List(_ context.Context, filter *racing.ListRacesRequestFilter, _ racing.RaceOrder) ([]*racing.Race, error) {
+	r.mu.Lock()
+	r.lists++
+	err, during := r.err, r.during
+	r.mu.Unlock()
+
+	if during != nil {
+		during()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	races := []*racing.Race{{Id: 1, Name: "One"}}
+	for _, id := range filter.GetMeetingIds() {
+		races = append(races, &racing.Race{Id: id + 1, MeetingId: id})
+	}
+
+	return races, nil
+}
+
+func (r *fakeRepo) Insert(_ context.Context, races ...*racing.Race) ([]*racing.Race, error) {
+	return races, nil
+}
+
+func (r *fakeRepo) Import(context.Context, []*racing.Race, bool) ([]*racing.ImportRaceResult, error) {
+	return nil, nil
+}
+
+func (r *fakeRepo) Update(_ context.Context, race *racing.Race, _ string) (*racing.Race, error) {
+	return race, nil
+}
+
+func (r *fakeRepo) Delete(_ context.Context, id int64, _ string) (*racing.Race, error) {
+	return &racing.Race{Id: id}, nil
+}
+
+func (r *fakeRepo) Undelete(_ context.Context, id int64, _ string) (*racing.Race, error) {
+	return &racing.Race{Id: id}, nil
+}
+
+func (r *fakeRepo) Purge(context.Context, time.Time) (int, error) {
+	return r.purged, nil
+}
+
+func meetings(ids ...int64) *racing.ListRacesRequestFilter {
+	return &racing.ListRacesRequestFilter{MeetingIds: ids}
+}
+
+func TestRacesRepo(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		giveSize int
+		with     func(ctx context.Context, t *testing.T, cache *RacesRepo, repo *fakeRepo, advance func(time.Duration))
+		expect   int
+	}{
+		{
+			name: "success_hit",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, _ func(time.Duration)) {
+				mustList(ctx, t, cache, meetings(1, 2))
+				mustList(ctx, t, cache, meetings(1, 2))
+			},
+			expect: 1,
+		},
+		{
+			name: "success_normalized_filter",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, _ func(time.Duration)) {
+				mustList(ctx, t, cache, meetings(2, 1))
+				mustList(ctx, t, cache, meetings(1, 2, 1))
+				mustList(ctx, t, cache, nil)
+				mustList(ctx, t, cache, meetings())
+				mustList(ctx, t, cache, &racing.ListRacesRequestFilter{ShowDeleted: true})
+			},
+			expect: 3,
+		},
+		{
+			name: "success_normalized_order",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, _ func(time.Duration)) {
+				mustListInOrder(ctx, t, cache, nil, racing.RaceOrder{})
+				mustListInOrder(ctx, t, cache, nil, racing.RaceOrder{Field: "id"})
+				mustListInOrder(ctx, t, cache, nil, racing.RaceOrder{Field: "id", Desc: true})
+				mustListInOrder(ctx, t, cache, nil, racing.RaceOrder{Field: "name"})
+				mustListInOrder(ctx, t, cache, nil, racing.RaceOrder{Field: "name", Desc: true})
+				mustListInOrder(ctx, t, cache, nil, racing.RaceOrder{Field: "name"})
+			},
+			expect: 4,
+		},
+		{
+			name: "expired",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, advance func(time.Duration)) {
+				mustList(ctx, t, cache, nil)
+				advance(time.Minute - time.Nanosecond)
+				mustList(ctx, t, cache, nil)
+				advance(time.Nanosecond)
+				mustList(ctx, t, cache, nil)
+			},
+			expect: 2,
+		},
+		{
+			name:     "evicted",
+			giveSize: 2,
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, _ func(time.Duration)) {
+				mustList(ctx, t, cache, meetings(1))
+				mustList(ctx, t, cache, meetings(2))
+				mustList(ctx, t, cache, meetings(1))
+				// Meeting 2 is the least recently used, so is evicted.
+				mustList(ctx, t, cache, meetings(3))
+				mustList(ctx, t, cache, meetings(1))
+				mustList(ctx, t, cache, meetings(2))
+			},
+			expect: 4,
+		},
+		{
+			name: "invalidated_by_insert",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, _ func(time.Duration)) {
+				mustList(ctx, t, cache, nil)
+				_, err := cache.Insert(ctx, &racing.Race{Id: 2})
+				require.NoError(t, err, "Insert")
+				mustList(ctx, t, cache, nil)
+			},
+			expect: 2,
+		},
+		{
+			name: "invalidated_by_import",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, _ func(time.Duration)) {
+				mustList(ctx, t, cache, nil)
+				_, err := cache.Import(ctx, nil, true)
+				require.NoError(t, err, "Import")
+				mustList(ctx, t, cache, nil)
+			},
+			expect: 2,
+		},
+		{
+			name: "invalidated_by_update",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, _ func(time.Duration)) {
+				mustList(ctx, t, cache, nil)
+				_, err := cache.Update(ctx, &racing.Race{Id: 1}, "")
+				require.NoError(t, err, "Update")
+				mustList(ctx, t, cache, nil)
+			},
+			expect: 2,
+		},
+		{
+			name: "invalidated_by_delete",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, _ func(time.Duration)) {
+				mustList(ctx, t, cache, nil)
+				_, err := cache.Delete(ctx, 1, "")
+				require.NoError(t, err, "Delete")
+				mustList(ctx, t, cache, nil)
+			},
+			expect: 2,
+		},
+		{
+			name: "invalidated_by_undelete",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, _ func(time.Duration)) {
+				mustList(ctx, t, cache, nil)
+				_, err := cache.Undelete(ctx, 1, "")
+				require.NoError(t, err, "Undelete")
+				mustList(ctx, t, cache, nil)
+			},
+			expect: 2,
+		},
+		{
+			name: "invalidated_by_purge",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, repo *fakeRepo, _ func(time.Duration)) {
+				mustList(ctx, t, cache, nil)
+				// Purges that remove nothing keep the cache.
+				_, err := cache.Purge(ctx, time.Now())
+				require.NoError(t, err, "Purge nothing")
+				mustList(ctx, t, cache, nil)
+				repo.purged = 1
+				_, err = cache.Purge(ctx, time.Now())
+				require.NoError(t, err, "Purge")
+				mustList(ctx, t, cache, nil)
+			},
+			expect: 2,
+		},
+		{
+			name: "invalidated",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, _ func(time.Duration)) {
+				mustList(ctx, t, cache, nil)
+				cache.Invalidate()
+				mustList(ctx, t, cache, nil)
+			},
+			expect: 2,
+		},
+		{
+			name: "success_dry_run_import",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, _ func(time.Duration)) {
+				mustList(ctx, t, cache, nil)
+				_, err := cache.Import(ctx, nil, false)
+				require.NoError(t, err, "Import")
+				mustList(ctx, t, cache, nil)
+			},
+			expect: 1,
+		},
+		{
+			name: "written_while_listing",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, repo *fakeRepo, _ func(time.Duration)) {
+				repo.during = func() {
+					_, err := cache.Import(ctx, nil, true)
+					require.NoError(t, err, "Import")
+				}
+				mustList(ctx, t, cache, nil)
+				repo.during = nil
+				mustList(ctx, t, cache, nil)
+			},
+			expect: 2,
+		},
+		{
+			name: "disabled",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, _ *fakeRepo, _ func(time.Duration)) {
+				cache.size = 0
+				mustList(ctx, t, cache, nil)
+				mustList(ctx, t, cache, nil)
+			},
+			expect: 2,
+		},
+		{
+			name: "list_err",
+			with: func(ctx context.Context, t *testing.T, cache *RacesRepo, repo *fakeRepo, _ func(time.Duration)) {
+				repo.err = errors.New("TestError123")
+				_, err := cache.List(ctx, nil, racing.RaceOrder{})
+				assert.EqualError(t, err, "TestError123", "err")
+				repo.err = nil
+				mustList(ctx, t, cache, nil)
+			},
+			expect: 2,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			size := tc.giveSize
+			if size == 0 {
+				size = 10
+			}
+
+			repo := &fakeRepo{}
+			cache := NewRacesRepo(repo, size, time.Minute)
+
+			now := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+			cache.now = func() time.Time { return now }
+
+			tc.with(context.Background(), t, cache, repo, func(d time.Duration) { now = now.Add(d) })
+
+			assert.Equal(t, tc.expect, repo.lists, "lists")
+		})
+	}
+}
+
+func TestRacesRepoCopies(t *testing.T) {
+	t.Parallel()
+
+	cache := NewRacesRepo(&fakeRepo{}, 10, time.Minute)
+
+	races, err := cache.List(context.Background(), nil, racing.RaceOrder{})
+	require.NoError(t, err, "List")
+
+	races[0].Name = "Changed"
+
+	races, err = cache.List(context.Background(), nil, racing.RaceOrder{})
+	require.NoError(t, err, "List")
+
+	assert.Equal(t, "One", races[0].Name, "cached name")
+}
+
+// mustList lists the races of filter through cache, failing the test on error.
+func mustList(ctx context.Context, t *testing.T, cache *RacesRepo, filter *racing.ListRacesRequestFilter) {
+	t.Helper()
+
+	mustListInOrder(ctx, t, cache, filter, racing.RaceOrder{})
+}
+
+// mustListInOrder lists the races of filter in order through cache, failing the test on error.
+func mustListInOrder(
+	ctx context.Context,
+	t *testing.T,
+	cache *RacesRepo,
+	filter *racing.ListRacesRequestFilter,
+	order racing.RaceOrder,
+) {
+	t.Helper()
+
+	_, err := cache.List(ctx, filter, order)
+	require.NoError(t, err, "List")
+}
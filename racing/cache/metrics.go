@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// cacheHits counts the listings served from the cache.
+	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "racing",
+		Subsystem: "cache",
+		Name:      "hits_total",
+		Help:      "Number of race listings served from the cache.",
+	})
+
+	// cacheMisses counts the listings that weren't cached, and were listed by the repository.
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "racing",
+		Subsystem: "cache",
+		Name:      "misses_total",
+		Help:      "Number of race listings not found in the cache.",
+	})
+
+	// cacheEvictions counts the listings evicted to make room for others.
+	cacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "racing",
+		Subsystem: "cache",
+		Name:      "evictions_total",
+		Help:      "Number of race listings evicted from the full cache.",
+	})
+
+	// cacheEntries is the number of listings cached.
+	cacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "racing",
+		Subsystem: "cache",
+		Name:      "entries",
+		Help:      "Number of race listings cached.",
+	})
+)
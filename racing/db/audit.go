@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/audit"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// auditColumns are the columns of the audit_events table set when recording an event.
+var auditColumns = []string{"occurred_at", "actor", "rpc", "resource", "action", "diff"}
+
+// raceChange returns the audit event of action changing the race with id from before to after, made by the source
+// of ctx. Before is nil for races that are created, and after for races that are purged.
+func raceChange(ctx context.Context, action racing.AuditEvent_Action, id int64, before, after *racing.Race) (*racing.AuditEvent, error) {
+	diff, err := audit.Diff(before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	source := audit.FromContext(ctx)
+
+	return &racing.AuditEvent{
+		Time:     timestamppb.New(storedNow()),
+		Actor:    source.Actor,
+		Rpc:      source.RPC,
+		Resource: raceName(id),
+		Action:   action,
+		Diff:     diff,
+	}, nil
+}
+
+// recordRaceChange records action changing the race with id from before to after in tx, and writes the message
+// publishing it to the outbox, so that both only happen if the change is committed.
+func (r *RacesRepo) recordRaceChange(ctx context.Context, tx *sql.Tx, action racing.AuditEvent_Action, id int64, before, after *racing.Race) error {
+	event, err := raceChange(ctx, action, id, before, after)
+	if err != nil {
+		return err
+	}
+
+	message, err := raceMessage(event, id, before, after)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO audit_events (`+strings.Join(auditColumns, ", ")+`) VALUES (`+placeholders(r.dialect, 0, len(auditColumns))+`)`,
+		r.dialect.Timestamp(event.Time.AsTime()),
+		event.Actor,
+		event.Rpc,
+		event.Resource,
+		event.Action.String(),
+		event.Diff,
+	)
+	if err != nil {
+		return err
+	}
+
+	return r.writeMessage(ctx, tx, message)
+}
+
+// ListAuditEvents returns up to limit of the audit events matching filter after the event with afterID, ordered by
+// ID.
+func (r *RacesRepo) ListAuditEvents(ctx context.Context, filter *racing.ListAuditEventsRequestFilter, afterID int64, limit int) ([]*racing.AuditEvent, error) {
+	query, args := r.applyAuditFilter(getRaceQueries()[auditEventsList], filter, afterID)
+	query += " ORDER BY id LIMIT " + r.dialect.Placeholder(len(args)+1)
+	args = append(args, limit)
+
+	ctx, span := r.startQuerySpan(ctx, "RacesRepo.ListAuditEvents", query)
+	defer span.End()
+
+	queryCtx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+
+	rows, err := r.db.QueryContext(queryCtx, query, args...)
+	if err != nil {
+		err = r.mapError(queryCtx, err)
+		observeQuery(ctx, auditEventsList, query, start, 0, err)
+
+		return nil, err
+	}
+
+	events, err := scanAuditEvents(rows)
+	if err != nil {
+		err = r.mapError(queryCtx, err)
+		observeQuery(ctx, auditEventsList, query, start, 0, err)
+
+		return nil, err
+	}
+
+	observeQuery(ctx, auditEventsList, query, start, len(events), nil)
+
+	return events, nil
+}
+
+func (r *RacesRepo) applyAuditFilter(query string, filter *racing.ListAuditEventsRequestFilter, afterID int64) (string, []interface{}) {
+	var (
+		clauses []string
+		args    []interface{}
+	)
+
+	where := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		clauses = append(clauses, clause+" "+r.dialect.Placeholder(len(args)))
+	}
+
+	where("id >", afterID)
+
+	if filter.GetResource() != "" {
+		where("resource =", filter.GetResource())
+	}
+
+	if filter.GetActor() != "" {
+		where("actor =", filter.GetActor())
+	}
+
+	// Times are compared in UTC, as they are recorded, so that SQLite compares them as they are ordered.
+	if filter.GetStartTime() != nil {
+		where("occurred_at >=", r.dialect.Timestamp(filter.GetStartTime().AsTime().UTC()))
+	}
+
+	if filter.GetEndTime() != nil {
+		where("occurred_at <", r.dialect.Timestamp(filter.GetEndTime().AsTime().UTC()))
+	}
+
+	return query + " WHERE " + strings.Join(clauses, " AND "), args
+}
+
+// scanAuditEvents scans the audit events of rows, closing them.
+func scanAuditEvents(rows *sql.Rows) (events []*racing.AuditEvent, err error) {
+	defer func() {
+		if closeErr := rows.Close(); err == nil && closeErr != nil {
+			events, err = nil, closeErr
+		}
+	}()
+
+	for rows.Next() {
+		var (
+			event    racing.AuditEvent
+			occurred time.Time
+			action   string
+		)
+
+		if err := rows.Scan(&event.Id, &occurred, &event.Actor, &event.Rpc, &event.Resource, &action, &event.Diff); err != nil {
+			return nil, err
+		}
+
+		event.Time = timestamppb.New(occurred)
+		event.Action = racing.AuditEvent_Action(racing.AuditEvent_Action_value[action])
+
+		events = append(events, &event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
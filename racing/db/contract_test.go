@@ -0,0 +1,852 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/apperrors"
+	"git.neds.sh/matty/entain/racing/audit"
+	"git.neds.sh/matty/entain/racing/outbox"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"git.neds.sh/matty/entain/racing/seed"
+	"git.neds.sh/matty/entain/racing/seed/seedtest"
+)
+
+// postgresDSNEnv names the environment variable holding the URL of a PostgreSQL database to run the contract tests
+// against. If it is unset, they are run against an embedded PostgreSQL server started for them instead.
+const postgresDSNEnv = "RACING_TEST_POSTGRES_DSN"
+
+// postgresRequiredEnv names the environment variable that, when true, fails the PostgreSQL contract tests instead of
+// skipping them when there is no database to run them against, so that CI can't pass without running them.
+const postgresRequiredEnv = "RACING_TEST_POSTGRES_REQUIRED"
+
+func TestMemoryContract(t *testing.T) {
+	t.Parallel()
+
+	testRacesRepoConformance(t, func(t *testing.T) conformingRepo {
+		return NewMemoryRacesRepo()
+	})
+}
+
+func TestSQLiteContract(t *testing.T) {
+	t.Parallel()
+
+	testRacesRepoContract(t, SQLite, func(t *testing.T) *sql.DB {
+		t.Helper()
+
+		db, dialect, err := Open(filepath.Join(t.TempDir(), "racing.db"))
+		require.NoError(t, err, "Open")
+		require.Equal(t, SQLite, dialect, "dialect")
+
+		t.Cleanup(func() { _ = db.Close() })
+
+		return db
+	})
+}
+
+func TestPostgresContract(t *testing.T) {
+	t.Parallel()
+
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		dsn = startEmbeddedPostgres(t)
+	}
+
+	testRacesRepoContract(t, Postgres, func(t *testing.T) *sql.DB {
+		t.Helper()
+
+		// Each test has a schema of its own, so that tests can run in parallel against the same database.
+		schema := fmt.Sprintf("races_test_%d", time.Now().UnixNano())
+
+		admin, _, err := Open(dsn)
+		require.NoError(t, err, "Open admin")
+
+		t.Cleanup(func() { _ = admin.Close() })
+
+		_, err = admin.Exec(`CREATE SCHEMA ` + schema)
+		require.NoError(t, err, "CREATE SCHEMA")
+
+		t.Cleanup(func() { _, _ = admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+		u, err := url.Parse(dsn)
+		require.NoError(t, err, "url.Parse")
+
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+
+		db, dialect, err := Open(u.String())
+		require.NoError(t, err, "Open")
+		require.Equal(t, Postgres, dialect, "dialect")
+
+		t.Cleanup(func() { _ = db.Close() })
+
+		return db
+	})
+}
+
+// startEmbeddedPostgres starts a PostgreSQL server in a temporary directory, stopped once t and its subtests finish,
+// and returns its URL. The server's binaries are downloaded on first use and cached, so it is skipped in short mode,
+// and where they can't be downloaded or run, unless PostgreSQL is required.
+func startEmbeddedPostgres(t *testing.T) string {
+	t.Helper()
+
+	if testing.Short() {
+		skipPostgres(t, "%s is not set, and embedded PostgreSQL isn't started in short mode", postgresDSNEnv)
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err, "net.Listen")
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close(), "listener.Close")
+
+	dir := t.TempDir()
+
+	var logs bytes.Buffer
+
+	config := embeddedpostgres.DefaultConfig().
+		Port(uint32(port)).
+		RuntimePath(filepath.Join(dir, "runtime")).
+		DataPath(filepath.Join(dir, "data")).
+		Logger(&logs)
+
+	server := embeddedpostgres.NewDatabase(config)
+	if err := server.Start(); err != nil {
+		skipPostgres(t, "%s is not set, and embedded PostgreSQL failed to start: %v\n%s", postgresDSNEnv, err, logs.String())
+	}
+
+	t.Cleanup(func() { assert.NoError(t, server.Stop(), "Stop") })
+
+	return config.GetConnectionURL() + "?sslmode=disable"
+}
+
+// skipPostgres skips t for the reason formatted from format and args, or fails it if PostgreSQL is required.
+func skipPostgres(t *testing.T, format string, args ...interface{}) {
+	t.Helper()
+
+	if required, _ := strconv.ParseBool(os.Getenv(postgresRequiredEnv)); required {
+		t.Fatalf(format, args...)
+	}
+
+	t.Skipf(format, args...)
+}
+
+// testRacesRepoContract tests the behaviour every dialect must share, on empty databases opened by newDB.
+func testRacesRepoContract(t *testing.T, dialect Dialect, newDB func(t *testing.T) *sql.DB) {
+	t.Helper()
+
+	testRacesRepoConformance(t, func(t *testing.T) conformingRepo {
+		return NewRacesRepo(newDB(t), dialect, time.Second)
+	})
+
+	t.Run("migrate", func(t *testing.T) {
+		t.Parallel()
+
+		db := newDB(t)
+
+		// A database created before migrations were recorded has the races table as the first migration creates it.
+		_, err := db.Exec(dialect.Migrations()[0])
+		require.NoError(t, err, "create races")
+
+		_, err = db.Exec(`INSERT INTO races (id, meeting_id, name, number, visible, advertised_start_time) VALUES (`+
+			placeholders(dialect, 0, 6)+`)`, 1, 1, "One", 1, true, dialect.Timestamp(time.Unix(0, 0)))
+		require.NoError(t, err, "insert race")
+
+		repo := NewRacesRepo(db, dialect, time.Second)
+		require.NoError(t, repo.Init(context.Background()), "Init")
+		require.NoError(t, repo.Init(context.Background()), "Init again")
+
+		actual, err := repo.List(context.Background(), nil, racing.RaceOrder{})
+		require.NoError(t, err, "List")
+
+		expect := []*racing.Race{{Id: 1, MeetingId: 1, Name: "One", Number: 1, Visible: true, AdvertisedStartTime: timestamppb.New(time.Unix(0, 0)), Etag: `"1"`}}
+		assert.Empty(t, cmp.Diff(expect, actual, protocmp.Transform()), "expected vs actual")
+	})
+}
+
+// conformingRepo is a repository of races tested by testRacesRepoConformance.
+type conformingRepo interface {
+	seed.Inserter
+	Init(ctx context.Context) error
+	Import(ctx context.Context, races []*racing.Race, commit bool) ([]*racing.ImportRaceResult, error)
+	List(ctx context.Context, filter *racing.ListRacesRequestFilter, order racing.RaceOrder) ([]*racing.Race, error)
+	Update(ctx context.Context, race *racing.Race, etag string) (*racing.Race, error)
+	Delete(ctx context.Context, id int64, etag string) (*racing.Race, error)
+	Undelete(ctx context.Context, id int64, etag string) (*racing.Race, error)
+	Purge(ctx context.Context, deletedBefore time.Time) (int, error)
+	ListAuditEvents(ctx context.Context, filter *racing.ListAuditEventsRequestFilter, afterID int64, limit int) ([]*racing.AuditEvent, error)
+	outbox.Store
+}
+
+// withEtag returns copies of races with etag, as they are listed.
+func withEtag(etag string, races ...*racing.Race) []*racing.Race {
+	copies := make([]*racing.Race, len(races))
+	for i, race := range races {
+		copies[i] = proto.Clone(race).(*racing.Race)
+		copies[i].Etag = etag
+	}
+
+	return copies
+}
+
+// testRacesRepoConformance tests the behaviour every repository must share, on empty repositories created by newRepo.
+func testRacesRepoConformance(t *testing.T, newRepo func(t *testing.T) conformingRepo) {
+	t.Helper()
+
+	// Timestamps are stored in other zones than UTC, and must come back as the same instant.
+	start := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.FixedZone("AEST", 10*60*60))
+
+	races := []*racing.Race{
+		{Id: 1, MeetingId: 1, Name: "One", Number: 1, Visible: true, AdvertisedStartTime: timestamppb.New(start)},
+		{Id: 2, MeetingId: 2, Name: "Two", Number: 2, Visible: false, AdvertisedStartTime: timestamppb.New(start.Add(time.Hour))},
+		{Id: 3, MeetingId: 3, Name: "Three", Number: 3, Visible: true, AdvertisedStartTime: timestamppb.New(start.Add(-time.Hour))},
+	}
+
+	// Races are inserted out of order, and listed ordered by ID, at their first version.
+	unordered := []*racing.Race{races[2], races[0], races[1]}
+	listed := withEtag(`"1"`, races...)
+
+	// newRepoWith creates a repository holding races.
+	newRepoWith := func(t *testing.T, races ...*racing.Race) conformingRepo {
+		t.Helper()
+
+		repo := newRepo(t)
+		require.NoError(t, repo.Init(context.Background()), "Init")
+
+		_, err := repo.Insert(context.Background(), races...)
+		require.NoError(t, err, "Insert")
+
+		return repo
+	}
+
+	t.Run("list", func(t *testing.T) {
+		t.Parallel()
+
+		for _, tc := range []struct {
+			name       string
+			giveFilter *racing.ListRacesRequestFilter
+			giveOrder  racing.RaceOrder
+			expect     []*racing.Race
+		}{
+			{
+				name:   "success",
+				expect: listed,
+			},
+			{
+				name:       "success_empty_filter",
+				giveFilter: &racing.ListRacesRequestFilter{},
+				expect:     listed,
+			},
+			{
+				name:       "success_meeting_ids",
+				giveFilter: &racing.ListRacesRequestFilter{MeetingIds: []int64{3, 1}},
+				expect:     []*racing.Race{listed[0], listed[2]},
+			},
+			{
+				name:       "success_no_results",
+				giveFilter: &racing.ListRacesRequestFilter{MeetingIds: []int64{4}},
+			},
+			{
+				name:      "success_order_advertised_start_time",
+				giveOrder: racing.RaceOrder{Field: "advertised_start_time"},
+				expect:    []*racing.Race{listed[2], listed[0], listed[1]},
+			},
+			{
+				name:      "success_order_name_desc",
+				giveOrder: racing.RaceOrder{Field: "name", Desc: true},
+				expect:    []*racing.Race{listed[1], listed[2], listed[0]},
+			},
+			{
+				name:      "success_order_id_desc",
+				giveOrder: racing.RaceOrder{Field: "id", Desc: true},
+				expect:    []*racing.Race{listed[2], listed[1], listed[0]},
+			},
+		} {
+			tc := tc
+
+			t.Run(tc.name, func(t *testing.T) {
+				t.Parallel()
+
+				actual, err := newRepoWith(t, unordered...).List(context.Background(), tc.giveFilter, tc.giveOrder)
+				require.NoError(t, err, "List")
+
+				assert.Empty(t, cmp.Diff(tc.expect, actual, protocmp.Transform()), "expected vs actual")
+			})
+		}
+	})
+
+	t.Run("list_order_ties", func(t *testing.T) {
+		t.Parallel()
+
+		// Races with the same start time are ordered by ID, whichever way they are ordered.
+		tied := []*racing.Race{
+			{Id: 5, MeetingId: 1, Name: "Five", Number: 5, AdvertisedStartTime: timestamppb.New(start)},
+			{Id: 4, MeetingId: 1, Name: "Four", Number: 4, AdvertisedStartTime: timestamppb.New(start)},
+			{Id: 6, MeetingId: 1, Name: "Six", Number: 6, AdvertisedStartTime: timestamppb.New(start.Add(time.Hour))},
+		}
+		repo := newRepoWith(t, tied...)
+
+		actual, err := repo.List(context.Background(), nil, racing.RaceOrder{Field: "advertised_start_time", Desc: true})
+		require.NoError(t, err, "List")
+
+		assert.Empty(t, cmp.Diff(withEtag(`"1"`, tied[2], tied[1], tied[0]), actual, protocmp.Transform()), "expected vs actual")
+	})
+
+	t.Run("list_invalid_order", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := newRepoWith(t, races...).List(context.Background(), nil, racing.RaceOrder{Field: "visible"})
+		assert.IsType(t, &apperrors.InvalidArgumentError{}, err, "List: %v", err)
+	})
+
+	t.Run("list_copies", func(t *testing.T) {
+		t.Parallel()
+
+		repo := newRepoWith(t, races...)
+
+		copies, err := repo.List(context.Background(), nil, racing.RaceOrder{})
+		require.NoError(t, err, "List")
+
+		// Changing the races listed doesn't change those held.
+		copies[0].Name = "Changed"
+
+		actual, err := repo.List(context.Background(), nil, racing.RaceOrder{})
+		require.NoError(t, err, "List again")
+
+		assert.Empty(t, cmp.Diff(listed, actual, protocmp.Transform()), "expected vs actual")
+	})
+
+	t.Run("list_canceled", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := newRepoWith(t, races...).List(ctx, nil, racing.RaceOrder{})
+		assert.True(t, errors.Is(err, context.Canceled), "err %v", err)
+	})
+
+	t.Run("insert", func(t *testing.T) {
+		t.Parallel()
+
+		repo := newRepoWith(t)
+
+		inserted, err := repo.Insert(context.Background(), unordered...)
+		require.NoError(t, err, "Insert")
+		assert.Empty(t, cmp.Diff(unordered, inserted, protocmp.Transform()), "inserted")
+
+		// Inserting a race that already exists leaves it as it was.
+		renamed := &racing.Race{Id: 1, MeetingId: 9, Name: "Renamed", AdvertisedStartTime: timestamppb.New(start)}
+		added := &racing.Race{Id: 4, MeetingId: 4, Name: "Four", Number: 4, AdvertisedStartTime: timestamppb.New(start)}
+
+		inserted, err = repo.Insert(context.Background(), renamed, added)
+		require.NoError(t, err, "Insert again")
+		assert.Empty(t, cmp.Diff([]*racing.Race{added}, inserted, protocmp.Transform()), "inserted again")
+
+		actual, err := repo.List(context.Background(), nil, racing.RaceOrder{})
+		require.NoError(t, err, "List")
+
+		assert.Empty(t, cmp.Diff(withEtag(`"1"`, append(races, added)...), actual, protocmp.Transform()), "expected vs actual")
+	})
+
+	t.Run("init_again", func(t *testing.T) {
+		t.Parallel()
+
+		repo := newRepoWith(t, races...)
+
+		// Initialising a repository that holds races keeps them.
+		require.NoError(t, repo.Init(context.Background()), "Init again")
+
+		actual, err := repo.List(context.Background(), nil, racing.RaceOrder{})
+		require.NoError(t, err, "List")
+
+		assert.Empty(t, cmp.Diff(listed, actual, protocmp.Transform()), "expected vs actual")
+	})
+
+	t.Run("import", func(t *testing.T) {
+		t.Parallel()
+
+		repo := newRepoWith(t, races...)
+
+		imported := []*racing.Race{
+			{ExternalId: "A", MeetingId: 4, Name: "A", Number: 1, Visible: true, AdvertisedStartTime: timestamppb.New(start)},
+			{ExternalId: "B", MeetingId: 4, Name: "B", Number: 2, AdvertisedStartTime: timestamppb.New(start)},
+		}
+
+		created := []*racing.ImportRaceResult{
+			{ExternalId: "A", Outcome: racing.ImportRaceResult_CREATED},
+			{ExternalId: "B", Outcome: racing.ImportRaceResult_CREATED},
+		}
+
+		// IDs are given from a sequence, which imports that aren't committed may still move on.
+		ignoreID := protocmp.IgnoreFields(&racing.ImportRaceResult{}, "id")
+
+		// Imports that aren't committed report what they would do, without changing anything.
+		results, err := repo.Import(context.Background(), imported, false)
+		require.NoError(t, err, "Import uncommitted")
+		assert.Empty(t, cmp.Diff(created, results, protocmp.Transform(), ignoreID), "uncommitted results")
+
+		actual, err := repo.List(context.Background(), nil, racing.RaceOrder{})
+		require.NoError(t, err, "List uncommitted")
+		assert.Empty(t, cmp.Diff(listed, actual, protocmp.Transform()), "uncommitted races")
+
+		results, err = repo.Import(context.Background(), imported, true)
+		require.NoError(t, err, "Import")
+		require.Empty(t, cmp.Diff(created, results, protocmp.Transform(), ignoreID), "results")
+
+		idA, idB := results[0].Id, results[1].Id
+		assert.Greater(t, idA, int64(3), "ID after those stored")
+		assert.Greater(t, idB, idA, "IDs in order")
+
+		// Races are updated by external ID, whatever ID they are given.
+		renamed := &racing.Race{Id: 99, ExternalId: "A", MeetingId: 5, Name: "Renamed", Number: 3, AdvertisedStartTime: timestamppb.New(start.Add(time.Hour))}
+		added := &racing.Race{ExternalId: "C", MeetingId: 4, Name: "C", Number: 4, AdvertisedStartTime: timestamppb.New(start)}
+
+		results, err = repo.Import(context.Background(), []*racing.Race{renamed, added}, true)
+		require.NoError(t, err, "Import again")
+		require.Empty(t, cmp.Diff([]*racing.ImportRaceResult{
+			{ExternalId: "A", Outcome: racing.ImportRaceResult_UPDATED},
+			{ExternalId: "C", Outcome: racing.ImportRaceResult_CREATED},
+		}, results, protocmp.Transform(), ignoreID), "results again")
+		assert.Equal(t, idA, results[0].Id, "updated ID")
+
+		idC := results[1].Id
+		assert.Greater(t, idC, idB, "ID of race added")
+
+		actual, err = repo.List(context.Background(), &racing.ListRacesRequestFilter{MeetingIds: []int64{4, 5}}, racing.RaceOrder{})
+		require.NoError(t, err, "List")
+		assert.Empty(t, cmp.Diff([]*racing.Race{
+			{Id: idA, ExternalId: "A", MeetingId: 5, Name: "Renamed", Number: 3, AdvertisedStartTime: timestamppb.New(start.Add(time.Hour)), Etag: `"2"`},
+			{Id: idB, ExternalId: "B", MeetingId: 4, Name: "B", Number: 2, AdvertisedStartTime: timestamppb.New(start), Etag: `"1"`},
+			{Id: idC, ExternalId: "C", MeetingId: 4, Name: "C", Number: 4, AdvertisedStartTime: timestamppb.New(start), Etag: `"1"`},
+		}, actual, protocmp.Transform()), "expected vs actual")
+	})
+
+	t.Run("import_after_purge", func(t *testing.T) {
+		t.Parallel()
+
+		repo := newRepoWith(t, races...)
+
+		// The IDs of races that are purged aren't given to those created after.
+		_, err := repo.Delete(context.Background(), 3, "")
+		require.NoError(t, err, "Delete")
+
+		_, err = repo.Purge(context.Background(), time.Now().Add(time.Hour))
+		require.NoError(t, err, "Purge")
+
+		imported := &racing.Race{ExternalId: "A", MeetingId: 4, Name: "A", Number: 1, AdvertisedStartTime: timestamppb.New(start)}
+
+		results, err := repo.Import(context.Background(), []*racing.Race{imported}, true)
+		require.NoError(t, err, "Import")
+		require.Len(t, results, 1, "results")
+		assert.Greater(t, results[0].Id, int64(3), "ID")
+	})
+
+	t.Run("seeded", func(t *testing.T) {
+		t.Parallel()
+
+		repo := newRepoWith(t)
+
+		seeded := seedtest.Races(t, repo, seed.Config{
+			Seed:      1,
+			Races:     20,
+			FirstID:   1,
+			Meetings:  3,
+			Now:       start,
+			StartFrom: -time.Hour,
+			StartTo:   time.Hour,
+		})
+		require.Len(t, seeded, 20, "seeded")
+
+		actual, err := repo.List(context.Background(), nil, racing.RaceOrder{})
+		require.NoError(t, err, "List")
+
+		assert.Empty(t, cmp.Diff(withEtag(`"1"`, seeded...), actual, protocmp.Transform()), "expected vs actual")
+	})
+
+	t.Run("update", func(t *testing.T) {
+		t.Parallel()
+
+		changed := &racing.Race{Id: 1, MeetingId: 9, Name: "Changed", Number: 9, AdvertisedStartTime: timestamppb.New(start.Add(time.Hour))}
+
+		for _, tc := range []struct {
+			name        string
+			giveRace    *racing.Race
+			giveEtag    string
+			expect      *racing.Race
+			expectError error
+		}{
+			{
+				name:     "success",
+				giveRace: changed,
+				giveEtag: `"1"`,
+				expect:   withEtag(`"2"`, changed)[0],
+			},
+			{
+				name:     "success_unconditional",
+				giveRace: changed,
+				expect:   withEtag(`"2"`, changed)[0],
+			},
+			{
+				name:        "stale_etag",
+				giveRace:    changed,
+				giveEtag:    `"2"`,
+				expectError: &apperrors.AbortedError{},
+			},
+			{
+				name:        "weak_etag",
+				giveRace:    changed,
+				giveEtag:    `W/"1"`,
+				expectError: &apperrors.AbortedError{},
+			},
+			{
+				name:        "not_found",
+				giveRace:    &racing.Race{Id: 9, AdvertisedStartTime: timestamppb.New(start)},
+				expectError: &apperrors.NotFoundError{},
+			},
+		} {
+			tc := tc
+
+			t.Run(tc.name, func(t *testing.T) {
+				t.Parallel()
+
+				repo := newRepoWith(t, races...)
+
+				actual, actualErr := repo.Update(context.Background(), tc.giveRace, tc.giveEtag)
+				assert.Empty(t, cmp.Diff(tc.expect, actual, protocmp.Transform()), "expected vs actual")
+
+				expectListed := listed
+				if tc.expectError != nil {
+					assert.IsType(t, tc.expectError, actualErr, "actualErr %v", actualErr)
+				} else {
+					assert.NoError(t, actualErr, "actualErr")
+
+					expectListed = []*racing.Race{tc.expect, listed[1], listed[2]}
+				}
+
+				stored, err := repo.List(context.Background(), nil, racing.RaceOrder{})
+				require.NoError(t, err, "List")
+				assert.Empty(t, cmp.Diff(expectListed, stored, protocmp.Transform()), "expected vs stored")
+			})
+		}
+	})
+
+	t.Run("update_conflict", func(t *testing.T) {
+		t.Parallel()
+
+		repo := newRepoWith(t, races...)
+
+		// Of two updates made to the same version, the second fails rather than overwriting the first.
+		first := &racing.Race{Id: 2, MeetingId: 2, Name: "First", Number: 2, AdvertisedStartTime: timestamppb.New(start)}
+		second := &racing.Race{Id: 2, MeetingId: 2, Name: "Second", Number: 2, AdvertisedStartTime: timestamppb.New(start)}
+
+		updated, err := repo.Update(context.Background(), first, listed[1].Etag)
+		require.NoError(t, err, "Update first")
+
+		_, err = repo.Update(context.Background(), second, listed[1].Etag)
+		assert.IsType(t, &apperrors.AbortedError{}, err, "Update second: %v", err)
+
+		// The second update succeeds once made to the version the first moved the race on to.
+		_, err = repo.Update(context.Background(), second, updated.Etag)
+		require.NoError(t, err, "Update second again")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		t.Parallel()
+
+		repo := newRepoWith(t, races...)
+
+		_, err := repo.Delete(context.Background(), 1, `"2"`)
+		assert.IsType(t, &apperrors.AbortedError{}, err, "Delete stale: %v", err)
+
+		first, err := repo.Delete(context.Background(), 1, `"1"`)
+		require.NoError(t, err, "Delete")
+		assert.Equal(t, `"2"`, first.Etag, "Etag")
+		assert.NotNil(t, first.DeleteTime, "DeleteTime")
+
+		second, err := repo.Delete(context.Background(), 2, "")
+		require.NoError(t, err, "Delete unconditional")
+
+		// Deleted races can't be deleted again, or updated.
+		_, err = repo.Delete(context.Background(), 1, "")
+		assert.IsType(t, &apperrors.NotFoundError{}, err, "Delete again: %v", err)
+
+		_, err = repo.Update(context.Background(), races[0], "")
+		assert.IsType(t, &apperrors.NotFoundError{}, err, "Update deleted: %v", err)
+
+		actual, err := repo.List(context.Background(), nil, racing.RaceOrder{})
+		require.NoError(t, err, "List")
+		assert.Empty(t, cmp.Diff(listed[2:], actual, protocmp.Transform()), "expected vs actual")
+
+		shown, err := repo.List(context.Background(), &racing.ListRacesRequestFilter{ShowDeleted: true}, racing.RaceOrder{})
+		require.NoError(t, err, "List deleted")
+		assert.Empty(t, cmp.Diff([]*racing.Race{first, second, listed[2]}, shown, protocmp.Transform()), "expected vs shown")
+	})
+
+	t.Run("undelete", func(t *testing.T) {
+		t.Parallel()
+
+		repo := newRepoWith(t, races...)
+
+		deleted, err := repo.Delete(context.Background(), 1, "")
+		require.NoError(t, err, "Delete")
+
+		_, err = repo.Undelete(context.Background(), 2, "")
+		assert.IsType(t, &apperrors.AlreadyExistsError{}, err, "Undelete undeleted: %v", err)
+
+		_, err = repo.Undelete(context.Background(), 9, "")
+		assert.IsType(t, &apperrors.NotFoundError{}, err, "Undelete missing: %v", err)
+
+		_, err = repo.Undelete(context.Background(), 1, `"1"`)
+		assert.IsType(t, &apperrors.AbortedError{}, err, "Undelete stale: %v", err)
+
+		restored, err := repo.Undelete(context.Background(), 1, deleted.Etag)
+		require.NoError(t, err, "Undelete")
+		assert.Empty(t, cmp.Diff(withEtag(`"3"`, races[0])[0], restored, protocmp.Transform()), "expected vs restored")
+
+		actual, err := repo.List(context.Background(), nil, racing.RaceOrder{})
+		require.NoError(t, err, "List")
+		assert.Empty(t, cmp.Diff([]*racing.Race{restored, listed[1], listed[2]}, actual, protocmp.Transform()), "expected vs actual")
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		t.Parallel()
+
+		repo := newRepoWith(t, races...)
+
+		deleted, err := repo.Delete(context.Background(), 1, "")
+		require.NoError(t, err, "Delete")
+
+		_, err = repo.Delete(context.Background(), 2, "")
+		require.NoError(t, err, "Delete second")
+
+		// Races are only purged once they were deleted before the given time.
+		purged, err := repo.Purge(context.Background(), deleted.DeleteTime.AsTime())
+		require.NoError(t, err, "Purge early")
+		assert.Zero(t, purged, "purged early")
+
+		purged, err = repo.Purge(context.Background(), time.Now().Add(time.Hour))
+		require.NoError(t, err, "Purge")
+		assert.Equal(t, 2, purged, "purged")
+
+		_, err = repo.Undelete(context.Background(), 1, "")
+		assert.IsType(t, &apperrors.NotFoundError{}, err, "Undelete purged: %v", err)
+
+		actual, err := repo.List(context.Background(), &racing.ListRacesRequestFilter{ShowDeleted: true}, racing.RaceOrder{})
+		require.NoError(t, err, "List")
+		assert.Empty(t, cmp.Diff(listed[2:], actual, protocmp.Transform()), "expected vs actual")
+	})
+
+	t.Run("audit", func(t *testing.T) {
+		t.Parallel()
+
+		repo := newRepoWith(t, races[0])
+
+		updating := audit.NewContext(context.Background(), audit.Source{Actor: "trader", RPC: "/racing.Racing/UpdateRace"})
+		importing := audit.NewContext(context.Background(), audit.Source{Actor: "ops", RPC: "racing import"})
+		deleting := audit.NewContext(context.Background(), audit.Source{Actor: "trader", RPC: "/racing.Racing/DeleteRace"})
+
+		renamed := &racing.Race{Id: 1, MeetingId: 1, Name: "Renamed", Number: 1, Visible: true, AdvertisedStartTime: timestamppb.New(start.Add(time.Hour))}
+		imported := &racing.Race{ExternalId: "A", MeetingId: 4, Name: "A", Number: 1, AdvertisedStartTime: timestamppb.New(start)}
+
+		_, err := repo.Update(updating, renamed, "")
+		require.NoError(t, err, "Update")
+
+		// Changes that fail, or aren't committed, aren't recorded.
+		_, err = repo.Update(updating, renamed, `"1"`)
+		require.IsType(t, &apperrors.AbortedError{}, err, "Update stale: %v", err)
+
+		_, err = repo.Import(importing, []*racing.Race{imported}, false)
+		require.NoError(t, err, "Import uncommitted")
+
+		_, err = repo.Import(importing, []*racing.Race{imported}, true)
+		require.NoError(t, err, "Import")
+
+		deleted, err := repo.Delete(deleting, 1, "")
+		require.NoError(t, err, "Delete")
+
+		events := []*racing.AuditEvent{
+			{
+				Id:       1,
+				Actor:    audit.AnonymousActor,
+				Resource: "races/1",
+				Action:   racing.AuditEvent_CREATED,
+				Diff: `{"advertised_start_time":{"before":null,"after":"2021-03-03T19:06:07Z"},"external_id":{"before":null,"after":""},` +
+					`"id":{"before":null,"after":"1"},"meeting_id":{"before":null,"after":"1"},"name":{"before":null,"after":"One"},` +
+					`"number":{"before":null,"after":"1"},"visible":{"before":null,"after":true}}`,
+			},
+			{
+				Id:       2,
+				Actor:    "trader",
+				Rpc:      "/racing.Racing/UpdateRace",
+				Resource: "races/1",
+				Action:   racing.AuditEvent_UPDATED,
+				Diff:     `{"advertised_start_time":{"before":"2021-03-03T19:06:07Z","after":"2021-03-03T20:06:07Z"},"name":{"before":"One","after":"Renamed"}}`,
+			},
+			{
+				Id:       3,
+				Actor:    "ops",
+				Rpc:      "racing import",
+				Resource: "races/2",
+				Action:   racing.AuditEvent_CREATED,
+				Diff: `{"advertised_start_time":{"before":null,"after":"2021-03-03T19:06:07Z"},"external_id":{"before":null,"after":"A"},` +
+					`"id":{"before":null,"after":"2"},"meeting_id":{"before":null,"after":"4"},"name":{"before":null,"after":"A"},` +
+					`"number":{"before":null,"after":"1"},"visible":{"before":null,"after":false}}`,
+			},
+			{
+				Id:       4,
+				Actor:    "trader",
+				Rpc:      "/racing.Racing/DeleteRace",
+				Resource: "races/1",
+				Action:   racing.AuditEvent_DELETED,
+				// Races are deleted by setting their delete time, which is all that changes.
+				Diff: `{"delete_time":{"before":null,"after":"` + deleted.DeleteTime.AsTime().Format(time.RFC3339) + `"}}`,
+			},
+		}
+
+		now := time.Now()
+
+		for _, tc := range []struct {
+			name        string
+			giveFilter  *racing.ListAuditEventsRequestFilter
+			giveAfterID int64
+			giveLimit   int
+			expect      []*racing.AuditEvent
+		}{
+			{
+				name:   "success",
+				expect: events,
+			},
+			{
+				name:       "success_resource",
+				giveFilter: &racing.ListAuditEventsRequestFilter{Resource: "races/1"},
+				expect:     []*racing.AuditEvent{events[0], events[1], events[3]},
+			},
+			{
+				name:       "success_actor",
+				giveFilter: &racing.ListAuditEventsRequestFilter{Actor: "trader"},
+				expect:     []*racing.AuditEvent{events[1], events[3]},
+			},
+			{
+				name: "success_time",
+				giveFilter: &racing.ListAuditEventsRequestFilter{
+					StartTime: timestamppb.New(now.Add(-time.Minute)),
+					EndTime:   timestamppb.New(now.Add(time.Minute)),
+				},
+				expect: events,
+			},
+			{
+				name:       "success_before_start_time",
+				giveFilter: &racing.ListAuditEventsRequestFilter{StartTime: timestamppb.New(now.Add(time.Minute))},
+			},
+			{
+				name:       "success_after_end_time",
+				giveFilter: &racing.ListAuditEventsRequestFilter{EndTime: timestamppb.New(now.Add(-time.Minute))},
+			},
+			{
+				name:        "success_page",
+				giveAfterID: 1,
+				giveLimit:   2,
+				expect:      events[1:3],
+			},
+		} {
+			tc := tc
+
+			t.Run(tc.name, func(t *testing.T) {
+				t.Parallel()
+
+				limit := tc.giveLimit
+				if limit == 0 {
+					limit = 10
+				}
+
+				actual, err := repo.ListAuditEvents(context.Background(), tc.giveFilter, tc.giveAfterID, limit)
+				require.NoError(t, err, "ListAuditEvents")
+
+				// Events are recorded at the time they are made, which can only be checked by filtering on it.
+				ignoreTime := protocmp.IgnoreFields(&racing.AuditEvent{}, "time")
+				assert.Empty(t, cmp.Diff(tc.expect, actual, protocmp.Transform(), ignoreTime), "expected vs actual")
+			})
+		}
+	})
+	t.Run("outbox", func(t *testing.T) {
+		t.Parallel()
+
+		repo := newRepoWith(t, races[0])
+
+		updating := audit.NewContext(context.Background(), audit.Source{Actor: "trader", RPC: "/racing.Racing/UpdateRace"})
+		renamed := &racing.Race{Id: 1, MeetingId: 1, Name: "Renamed", Number: 1, Visible: true, AdvertisedStartTime: timestamppb.New(start)}
+
+		_, err := repo.Update(updating, renamed, "")
+		require.NoError(t, err, "Update")
+
+		// Changes that fail aren't published.
+		_, err = repo.Update(updating, renamed, `"1"`)
+		require.IsType(t, &apperrors.AbortedError{}, err, "Update stale: %v", err)
+
+		_, err = repo.Delete(context.Background(), 1, "")
+		require.NoError(t, err, "Delete")
+
+		_, err = repo.Purge(context.Background(), time.Now().Add(time.Hour))
+		require.NoError(t, err, "Purge")
+
+		pending, err := repo.PendingMessages(context.Background(), 10)
+		require.NoError(t, err, "PendingMessages")
+		require.Len(t, pending, 4, "pending")
+
+		var actions []racing.AuditEvent_Action
+
+		for i, message := range pending {
+			assert.Equal(t, int64(i+1), message.ID, "ID")
+			assert.Equal(t, outbox.RacesTopic, message.Topic, "Topic")
+			assert.Equal(t, "races/1", message.Key, "Key")
+			assert.False(t, message.Time.IsZero(), "Time")
+
+			change, err := outbox.RaceChange(message)
+			require.NoError(t, err, "RaceChange")
+
+			actions = append(actions, change.Action)
+
+			if change.Action == racing.AuditEvent_UPDATED {
+				assert.Equal(t, "trader", change.Actor, "Actor")
+				assert.Equal(t, "/racing.Racing/UpdateRace", change.Rpc, "Rpc")
+				assert.Empty(t, cmp.Diff(renamed, change.Race, protocmp.Transform()), "expected vs published")
+			}
+		}
+
+		expectActions := []racing.AuditEvent_Action{
+			racing.AuditEvent_CREATED,
+			racing.AuditEvent_UPDATED,
+			racing.AuditEvent_DELETED,
+			racing.AuditEvent_PURGED,
+		}
+		assert.Equal(t, expectActions, actions, "actions")
+
+		require.NoError(t, repo.MarkDelivered(context.Background(), 1), "MarkDelivered")
+		require.NoError(t, repo.MarkDelivered(context.Background(), 2), "MarkDelivered")
+
+		pending, err = repo.PendingMessages(context.Background(), 1)
+		require.NoError(t, err, "PendingMessages after delivery")
+		require.Len(t, pending, 1, "pending after delivery")
+		assert.Equal(t, int64(3), pending[0].ID, "ID after delivery")
+	})
+}
@@ -1,30 +1,118 @@
 package db
 
 import (
+	"context"
+	"database/sql"
 	"time"
 
-	"syreclabs.com/go/faker"
+	"git.neds.sh/matty/entain/racing/proto/racing"
 )
 
-func (r *RacesRepo) seed() error {
-	statement, err := r.db.Prepare(`CREATE TABLE IF NOT EXISTS races (id INTEGER PRIMARY KEY, meeting_id INTEGER, name TEXT, number INTEGER, visible INTEGER, advertised_start_time DATETIME)`)
-	if err == nil {
-		_, err = statement.Exec()
+// raceColumns are the columns of the races table.
+var raceColumns = []string{"id", "meeting_id", "name", "number", "visible", "advertised_start_time", "external_id"}
+
+// Insert inserts races in a single transaction, keeping any races already stored with the same IDs, recording each
+// race inserted in the audit log. It returns the races it inserted.
+func (r *RacesRepo) Insert(ctx context.Context, races ...*racing.Race) ([]*racing.Race, error) {
+	query := r.dialect.InsertIgnore("races", "id", raceColumns)
+
+	ctx, span := r.startQuerySpan(ctx, "RacesRepo.Insert", query)
+	defer span.End()
+
+	queryCtx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+
+	inserted, err := r.insert(queryCtx, query, races)
+	if err != nil {
+		err = r.mapError(queryCtx, err)
+		observeQuery(ctx, racesInsert, query, start, 0, err)
+
+		return nil, err
+	}
+
+	observeQuery(ctx, racesInsert, query, start, len(inserted), nil)
+
+	return inserted, nil
+}
+
+func (r *RacesRepo) insert(ctx context.Context, query string, races []*racing.Race) (inserted []*racing.Race, err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for _, race := range races {
+		var result sql.Result
+
+		result, err = tx.ExecContext(
+			ctx,
+			query,
+			race.Id,
+			race.MeetingId,
+			race.Name,
+			race.Number,
+			race.Visible,
+			r.dialect.Timestamp(race.AdvertisedStartTime.AsTime()),
+			externalID(race.ExternalId),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		var n int64
+
+		// A race that already exists is ignored, affecting no rows.
+		if n, err = result.RowsAffected(); err != nil {
+			return nil, err
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		if err = r.recordRaceChange(ctx, tx, racing.AuditEvent_CREATED, race.Id, nil, race); err != nil {
+			return nil, err
+		}
+
+		inserted = append(inserted, race)
 	}
 
-	for i := 1; i <= 100; i++ {
-		statement, err = r.db.Prepare(`INSERT OR IGNORE INTO races(id, meeting_id, name, number, visible, advertised_start_time) VALUES (?,?,?,?,?,?)`)
-		if err == nil {
-			_, err = statement.Exec(
-				i,
-				faker.Number().Between(1, 10),
-				faker.Team().Name(),
-				faker.Number().Between(1, 12),
-				faker.Number().Between(0, 1),
-				faker.Time().Between(time.Now().AddDate(0, 0, -1), time.Now().AddDate(0, 0, 2)).Format(time.RFC3339),
-			)
+	// Races inserted with IDs of their own move on the IDs given to those created without.
+	if advance := r.dialect.AdvanceID("races"); advance != "" && len(inserted) > 0 {
+		if _, err = tx.ExecContext(ctx, advance); err != nil {
+			return nil, err
 		}
 	}
 
-	return err
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return inserted, nil
+}
+
+// externalID returns id as the argument of a statement setting the external_id column. Races without an external ID
+// store NULL, which the unique index on the column doesn't compare.
+func externalID(id string) sql.NullString {
+	return sql.NullString{String: id, Valid: id != ""}
+}
+
+// exec runs statement with args, stopping it once the query timeout has passed.
+func (r *RacesRepo) exec(ctx context.Context, statement string, args ...interface{}) error {
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+
+	if _, err := r.db.ExecContext(ctx, statement, args...); err != nil {
+		return r.mapError(ctx, err)
+	}
+
+	return nil
 }
@@ -0,0 +1,228 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/audit"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+func TestRacesRepoInsert(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	races := []*racing.Race{
+		{Id: 1, MeetingId: 2, Name: "3", Number: 4, Visible: true, AdvertisedStartTime: timestamppb.New(start)},
+		{Id: 5, MeetingId: 6, Name: "7", Number: 8, Visible: false, AdvertisedStartTime: timestamppb.New(start), ExternalId: "R-5"},
+	}
+
+	insert := regexp.QuoteMeta(SQLite.InsertIgnore("races", "id", raceColumns))
+	record := regexp.QuoteMeta(`INSERT INTO audit_events (occurred_at, actor, rpc, resource, action, diff) VALUES (?,?,?,?,?,?)`)
+	publish := regexp.QuoteMeta(`INSERT INTO outbox (created_at, topic, message_key, payload) VALUES (?,?,?,?)`)
+
+	for _, tc := range []struct {
+		name        string
+		with        func(mock sqlmock.Sqlmock)
+		expect      []*racing.Race
+		expectError string
+	}{
+		{
+			name: "success",
+			with: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(insert).
+					WithArgs(1, 2, "3", 4, true, start.Format(time.RFC3339), nil).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(record).
+					WithArgs(sqlmock.AnyArg(), "anonymous", "", "races/1", "CREATED", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(publish).
+					WithArgs(sqlmock.AnyArg(), "racing.races", "races/1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(insert).
+					WithArgs(5, 6, "7", 8, false, start.Format(time.RFC3339), "R-5").
+					WillReturnResult(sqlmock.NewResult(5, 1))
+				mock.ExpectExec(record).
+					WithArgs(sqlmock.AnyArg(), "anonymous", "", "races/5", "CREATED", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(2, 1))
+				mock.ExpectExec(publish).
+					WithArgs(sqlmock.AnyArg(), "racing.races", "races/5", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(2, 1))
+				mock.ExpectCommit()
+			},
+			expect: races,
+		},
+		{
+			name: "success_existing",
+			with: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(insert).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(insert).WillReturnResult(sqlmock.NewResult(5, 1))
+				mock.ExpectExec(record).WithArgs(sqlmock.AnyArg(), "anonymous", "", "races/5", "CREATED", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(publish).
+					WithArgs(sqlmock.AnyArg(), "racing.races", "races/5", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			expect: races[1:],
+		},
+		{
+			name: "exec_err",
+			with: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(insert).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(record).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(publish).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(insert).WillReturnError(errors.New("TestError123"))
+				mock.ExpectRollback()
+			},
+			expectError: "TestError123",
+		},
+		{
+			// A change isn't made unless the message publishing it is written with it.
+			name: "publish_err",
+			with: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(insert).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(record).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(publish).WillReturnError(errors.New("TestError123"))
+				mock.ExpectRollback()
+			},
+			expectError: "TestError123",
+		},
+		{
+			name: "commit_err",
+			with: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(insert).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(record).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(publish).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(insert).WillReturnResult(sqlmock.NewResult(5, 1))
+				mock.ExpectExec(record).WillReturnResult(sqlmock.NewResult(2, 1))
+				mock.ExpectExec(publish).WillReturnResult(sqlmock.NewResult(2, 1))
+				mock.ExpectCommit().WillReturnError(errors.New("TestError123"))
+			},
+			expectError: "TestError123",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			db, mock := newSQLMock(t)
+			tc.with(mock)
+
+			actual, actualErr := NewRacesRepo(db, SQLite, 0).Insert(context.Background(), races...)
+			assert.Empty(t, cmp.Diff(tc.expect, actual, protocmp.Transform()), "expected vs actual")
+
+			if tc.expectError != "" {
+				assert.EqualError(t, actualErr, tc.expectError, "actualErr")
+			} else {
+				assert.NoError(t, actualErr, "actualErr")
+			}
+		})
+	}
+}
+
+func TestRacesRepoUpdate(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	race := &racing.Race{Id: 1, MeetingId: 2, Name: "3", Number: 4, Visible: true, AdvertisedStartTime: timestamppb.New(start)}
+
+	find := regexp.QuoteMeta(`SELECT id, meeting_id, name, number, visible, advertised_start_time, external_id, version, delete_time FROM races WHERE id = ?`)
+	update := regexp.QuoteMeta(`UPDATE races SET meeting_id = ?, name = ?, number = ?, visible = ?, advertised_start_time = ?, version = version + 1 WHERE id = ? AND version = ?`)
+	record := regexp.QuoteMeta(`INSERT INTO audit_events (occurred_at, actor, rpc, resource, action, diff) VALUES (?,?,?,?,?,?)`)
+	publish := regexp.QuoteMeta(`INSERT INTO outbox (created_at, topic, message_key, payload) VALUES (?,?,?,?)`)
+
+	findColumns := []string{"id", "meeting_id", "name", "number", "visible", "advertised_start_time", "external_id", "version", "delete_time"}
+	found := func(mock sqlmock.Sqlmock, externalID interface{}) *sqlmock.Rows {
+		return mock.NewRows(findColumns).AddRow(1, 2, "Old", 4, true, start.Add(-time.Hour), externalID, 3, nil)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		with        func(mock sqlmock.Sqlmock)
+		expect      *racing.Race
+		expectError string
+	}{
+		{
+			name: "success",
+			with: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(find).WithArgs(1).WillReturnRows(found(mock, "R-1"))
+				mock.ExpectExec(update).
+					WithArgs(2, "3", 4, true, start.Format(time.RFC3339), 1, 3).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(record).
+					WithArgs(
+						sqlmock.AnyArg(),
+						"trader",
+						"/racing.Racing/UpdateRace",
+						"races/1",
+						"UPDATED",
+						`{"advertised_start_time":{"before":"1999-12-31T23:00:00Z","after":"2000-01-01T00:00:00Z"},"name":{"before":"Old","after":"3"}}`,
+					).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(publish).
+					WithArgs(sqlmock.AnyArg(), "racing.races", "races/1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			expect: &racing.Race{Id: 1, MeetingId: 2, Name: "3", Number: 4, Visible: true, AdvertisedStartTime: timestamppb.New(start), ExternalId: "R-1", Etag: `"4"`},
+		},
+		{
+			// The race was changed by another transaction between being read and updated.
+			name: "changed_concurrently",
+			with: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(find).WillReturnRows(found(mock, nil))
+				mock.ExpectExec(update).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+			},
+			expectError: `racing.Race "races/1" has changed`,
+		},
+		{
+			name: "exec_err",
+			with: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(find).WillReturnRows(found(mock, nil))
+				mock.ExpectExec(update).WillReturnError(errors.New("TestError123"))
+				mock.ExpectRollback()
+			},
+			expectError: "TestError123",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			db, mock := newSQLMock(t)
+			tc.with(mock)
+
+			ctx := audit.NewContext(context.Background(), audit.Source{Actor: "trader", RPC: "/racing.Racing/UpdateRace"})
+
+			actual, actualErr := NewRacesRepo(db, SQLite, 0).Update(ctx, race, `"3"`)
+			assert.Empty(t, cmp.Diff(tc.expect, actual, protocmp.Transform()), "expected vs actual")
+
+			if tc.expectError != "" {
+				assert.EqualError(t, actualErr, tc.expectError, "actualErr")
+			} else {
+				assert.NoError(t, actualErr, "actualErr")
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/apperrors"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// Delete soft deletes the race with id, unless etag is set and the race has changed since the version it identifies,
+// recording the deletion in the audit log. It returns the race as deleted. Deleted races are only listed when the
+// filter shows them, and are kept until they are purged. Races that are already deleted are not found.
+func (r *RacesRepo) Delete(ctx context.Context, id int64, etag string) (*racing.Race, error) {
+	return r.setDeleteTime(ctx, "RacesRepo.Delete", racesDelete, id, etag, storedNow())
+}
+
+// Undelete restores the deleted race with id, unless etag is set and the race has changed since the version it
+// identifies, recording the restore in the audit log. It returns the race as restored. Races that aren't deleted
+// already exist.
+func (r *RacesRepo) Undelete(ctx context.Context, id int64, etag string) (*racing.Race, error) {
+	return r.setDeleteTime(ctx, "RacesRepo.Undelete", racesUndelete, id, etag, time.Time{})
+}
+
+// setDeleteTime deletes the race with id at deleteTime, or restores it if deleteTime is zero, as the query name.
+func (r *RacesRepo) setDeleteTime(ctx context.Context, spanName, name string, id int64, etag string, deleteTime time.Time) (*racing.Race, error) {
+	statement := `UPDATE races SET delete_time = ` + r.dialect.Placeholder(1) + `, version = version + 1 WHERE id = ` +
+		r.dialect.Placeholder(2) + ` AND version = ` + r.dialect.Placeholder(3)
+
+	ctx, span := r.startQuerySpan(ctx, spanName, statement)
+	defer span.End()
+
+	queryCtx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+
+	changed, err := r.changeDeleteTime(queryCtx, statement, id, etag, deleteTime)
+	if err != nil {
+		err = r.mapError(queryCtx, err)
+		observeQuery(ctx, name, statement, start, 0, err)
+
+		return nil, err
+	}
+
+	observeQuery(ctx, name, statement, start, 1, nil)
+
+	return changed, nil
+}
+
+func (r *RacesRepo) changeDeleteTime(ctx context.Context, statement string, id int64, etag string, deleteTime time.Time) (changed *racing.Race, err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	before, version, err := r.findRace(ctx, tx, "id", id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, apperrors.NotFound(raceResourceType, raceName(id))
+		}
+
+		return nil, err
+	}
+
+	deleting := !deleteTime.IsZero()
+
+	switch {
+	case deleting && before.DeleteTime != nil:
+		return nil, apperrors.NotFound(raceResourceType, raceName(id))
+	case !deleting && before.DeleteTime == nil:
+		return nil, apperrors.AlreadyExists(raceResourceType, raceName(id))
+	}
+
+	if !matchesEtag(etag, version) {
+		return nil, apperrors.Aborted(raceResourceType, raceName(id))
+	}
+
+	changed = proto.Clone(before).(*racing.Race)
+	changed.Etag = formatEtag(version + 1)
+	changed.DeleteTime = nil
+
+	action := racing.AuditEvent_UNDELETED
+
+	// Races are restored by clearing their delete time.
+	var deleteTimeArg interface{}
+
+	if deleting {
+		action = racing.AuditEvent_DELETED
+		deleteTimeArg = r.dialect.Timestamp(deleteTime)
+		changed.DeleteTime = timestamppb.New(deleteTime)
+	}
+
+	result, err := tx.ExecContext(ctx, statement, deleteTimeArg, id, version)
+	if err = changedRace(result, err, id); err != nil {
+		return nil, err
+	}
+
+	if err = r.recordRaceChange(ctx, tx, action, id, before, changed); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return changed, nil
+}
+
+// Purge removes the races deleted before deletedBefore for good, recording each in the audit log, and returns how many
+// it removed.
+func (r *RacesRepo) Purge(ctx context.Context, deletedBefore time.Time) (int, error) {
+	statement := `DELETE FROM races WHERE id = ` + r.dialect.Placeholder(1) + ` AND delete_time < ` + r.dialect.Placeholder(2)
+
+	ctx, span := r.startQuerySpan(ctx, "RacesRepo.Purge", statement)
+	defer span.End()
+
+	queryCtx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+
+	purged, err := r.purge(queryCtx, statement, deletedBefore)
+	if err != nil {
+		err = r.mapError(queryCtx, err)
+		observeQuery(ctx, racesPurge, statement, start, 0, err)
+
+		return 0, err
+	}
+
+	observeQuery(ctx, racesPurge, statement, start, purged, nil)
+
+	return purged, nil
+}
+
+func (r *RacesRepo) purge(ctx context.Context, statement string, deletedBefore time.Time) (purged int, err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// Times are compared in UTC, as they are stored, so that SQLite compares them as they are ordered.
+	before := r.dialect.Timestamp(deletedBefore.UTC())
+
+	rows, err := tx.QueryContext(ctx, getRaceQueries()[racesList]+` WHERE delete_time < `+r.dialect.Placeholder(1)+` ORDER BY id`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	races, err := scanRaces(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, race := range races {
+		var result sql.Result
+
+		if result, err = tx.ExecContext(ctx, statement, race.Id, before); err != nil {
+			return 0, err
+		}
+
+		var n int64
+
+		// A race restored since it was read is kept.
+		if n, err = result.RowsAffected(); err != nil {
+			return 0, err
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		if err = r.recordRaceChange(ctx, tx, racing.AuditEvent_PURGED, race.Id, race, nil); err != nil {
+			return 0, err
+		}
+
+		purged++
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// busyRetryAfter is how long clients are asked to wait before retrying when the database is busy.
+const busyRetryAfter = time.Second
+
+// Dialect is the SQL dialect of a database races are stored in.
+type Dialect interface {
+	// Driver is the database/sql driver the dialect is spoken through.
+	Driver() string
+	// System is the OpenTelemetry db.system attribute of the database.
+	System() attribute.KeyValue
+	// Placeholder returns the placeholder of the nth argument of a statement, counting from 1.
+	Placeholder(n int) string
+	// Migrations returns the statements creating and changing the schema, in the order they are applied. Statements
+	// are only ever appended, as those applied are recorded by their position.
+	Migrations() []string
+	// InsertIgnore returns a statement inserting a row of columns into table, unless a row with the same key exists.
+	InsertIgnore(table, key string, columns []string) string
+	// InsertReturningID returns a statement inserting a row of columns into table, which is given the next ID of the
+	// table. IDs are never given twice, even once the rows given them are removed. If returning is set, the statement
+	// returns the ID as a row; otherwise it is the LastInsertId of its result.
+	InsertReturningID(table string, columns []string) (statement string, returning bool)
+	// AdvanceID returns a statement moving the next ID given to the rows of table past the highest stored, run after
+	// rows are inserted with IDs of their own, or an empty string if the database does so itself.
+	AdvanceID(table string) string
+	// Timestamp returns t as the argument of a statement setting a timestamp column.
+	Timestamp(t time.Time) interface{}
+	// MapError converts database errors into the errors of the apperrors taxonomy where there is an equivalent. Other
+	// errors are returned as is and reported as internal errors.
+	MapError(err error) error
+}
+
+// Open opens the database at dsn, returning the dialect it speaks. postgres:// and postgresql:// URLs are opened as
+// PostgreSQL databases, and anything else as a SQLite database file.
+func Open(dsn string) (*sql.DB, Dialect, error) {
+	dialect := SQLite
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		dialect = Postgres
+	}
+
+	db, err := sql.Open(dialect.Driver(), dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return db, dialect, nil
+}
+
+// placeholders returns the comma separated placeholders of n arguments of a statement, counting from the first
+// argument after skip.
+func placeholders(dialect Dialect, skip, n int) string {
+	p := make([]string, n)
+	for i := range p {
+		p[i] = dialect.Placeholder(skip + i + 1)
+	}
+
+	return strings.Join(p, ",")
+}
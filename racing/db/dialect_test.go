@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.neds.sh/matty/entain/racing/apperrors"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+func TestRacesRepoListPostgres(t *testing.T) {
+	t.Parallel()
+
+	db, mock := newSQLMock(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM races WHERE delete_time IS NULL AND meeting_id IN ($1,$2)")).
+		WithArgs(int64(1), int64(2)).
+		WillReturnRows(mock.NewRows(raceColumns))
+
+	_, err := NewRacesRepo(db, Postgres, 0).List(context.Background(), &racing.ListRacesRequestFilter{MeetingIds: []int64{1, 2}}, racing.RaceOrder{})
+	require.NoError(t, err, "List")
+}
+
+func TestDialectMapError(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name              string
+		giveDialect       Dialect
+		giveErr           error
+		expectUnavailable bool
+	}{
+		{
+			name:              "sqlite_busy",
+			giveDialect:       SQLite,
+			giveErr:           sqlite3.Error{Code: sqlite3.ErrBusy},
+			expectUnavailable: true,
+		},
+		{
+			name:        "sqlite_constraint",
+			giveDialect: SQLite,
+			giveErr:     sqlite3.Error{Code: sqlite3.ErrConstraint},
+		},
+		{
+			name:              "postgres_serialization_failure",
+			giveDialect:       Postgres,
+			giveErr:           &pq.Error{Code: "40001"},
+			expectUnavailable: true,
+		},
+		{
+			name:              "postgres_cannot_connect_now",
+			giveDialect:       Postgres,
+			giveErr:           &pq.Error{Code: "57P03"},
+			expectUnavailable: true,
+		},
+		{
+			name:              "postgres_bad_conn",
+			giveDialect:       Postgres,
+			giveErr:           driver.ErrBadConn,
+			expectUnavailable: true,
+		},
+		{
+			name:        "postgres_unique_violation",
+			giveDialect: Postgres,
+			giveErr:     &pq.Error{Code: "23505"},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual := tc.giveDialect.MapError(tc.giveErr)
+
+			var unavailable *apperrors.UnavailableError
+			assert.Equal(t, tc.expectUnavailable, errors.As(actual, &unavailable), "unavailable")
+			assert.True(t, errors.Is(actual, tc.giveErr), "wraps error")
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// Import creates races, or updates the races with the same external IDs, in a single transaction that is only
+// committed if commit is set, along with the record of each change in the audit log. It returns the outcome of each
+// race, in order. Races must have distinct external IDs; their IDs are ignored, and races that are created are given
+// the next IDs of the races table, which are never those of races stored before. The query timeout applies to the
+// statements importing each race rather than to the whole import, so that imports of many races aren't cut short.
+func (r *RacesRepo) Import(ctx context.Context, races []*racing.Race, commit bool) ([]*racing.ImportRaceResult, error) {
+	ctx, span := r.startQuerySpan(ctx, "RacesRepo.Import", r.updateStatement())
+	defer span.End()
+
+	start := time.Now()
+
+	results, err := r.importRaces(ctx, races, commit)
+	if err != nil {
+		observeQuery(ctx, racesImport, r.updateStatement(), start, 0, err)
+
+		return nil, err
+	}
+
+	observeQuery(ctx, racesImport, r.updateStatement(), start, len(results), nil)
+
+	return results, nil
+}
+
+func (r *RacesRepo) importRaces(ctx context.Context, races []*racing.Race, commit bool) (results []*racing.ImportRaceResult, err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, r.mapError(ctx, err)
+	}
+
+	defer func() {
+		if err != nil || !commit {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for _, race := range races {
+		var result *racing.ImportRaceResult
+
+		if result, err = r.importRace(ctx, tx, race); err != nil {
+			return nil, err
+		}
+
+		results = append(results, result)
+	}
+
+	if commit {
+		if err = tx.Commit(); err != nil {
+			return nil, r.mapError(ctx, err)
+		}
+	}
+
+	return results, nil
+}
+
+// importRace creates race in tx, or updates the race with the same external ID, stopping once the query timeout has
+// passed.
+func (r *RacesRepo) importRace(ctx context.Context, tx *sql.Tx, race *racing.Race) (result *racing.ImportRaceResult, err error) {
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+
+	defer func() {
+		if err != nil {
+			err = r.mapError(ctx, err)
+		}
+	}()
+
+	result = &racing.ImportRaceResult{ExternalId: race.ExternalId}
+
+	before, _, err := r.findRace(ctx, tx, "external_id", race.ExternalId)
+
+	action := racing.AuditEvent_UPDATED
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		action = racing.AuditEvent_CREATED
+		result.Outcome = racing.ImportRaceResult_CREATED
+		result.Id, err = r.insertRace(ctx, tx, race)
+	case err == nil:
+		result.Id = before.Id
+		result.Outcome = racing.ImportRaceResult_UPDATED
+
+		_, err = tx.ExecContext(
+			ctx,
+			r.updateStatement(),
+			race.MeetingId,
+			race.Name,
+			race.Number,
+			race.Visible,
+			r.dialect.Timestamp(race.AdvertisedStartTime.AsTime()),
+			result.Id,
+		)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = r.recordRaceChange(ctx, tx, action, result.Id, before, importedRace(race, before, result.Id)); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// insertRace inserts race in tx, returning the ID it is given.
+func (r *RacesRepo) insertRace(ctx context.Context, tx *sql.Tx, race *racing.Race) (int64, error) {
+	statement, returning := r.dialect.InsertReturningID("races", raceColumns[1:])
+	args := []interface{}{
+		race.MeetingId,
+		race.Name,
+		race.Number,
+		race.Visible,
+		r.dialect.Timestamp(race.AdvertisedStartTime.AsTime()),
+		externalID(race.ExternalId),
+	}
+
+	var id int64
+
+	// Inserts that return no row or affect no rows have inserted nothing, and are failed rather than reported created.
+	if returning {
+		if err := tx.QueryRowContext(ctx, statement, args...).Scan(&id); err != nil {
+			return 0, err
+		}
+
+		return id, nil
+	}
+
+	result, err := tx.ExecContext(ctx, statement, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if n == 0 {
+		return 0, errors.New("race not inserted")
+	}
+
+	return result.LastInsertId()
+}
+
+// importedRace returns race as stored by an import under id, over the race stored before, if any. Imports update
+// deleted races without restoring them.
+func importedRace(race, before *racing.Race, id int64) *racing.Race {
+	imported := proto.Clone(race).(*racing.Race)
+	imported.Id = id
+	imported.Etag = ""
+	imported.DeleteTime = before.GetDeleteTime()
+
+	return imported
+}
+
+// updateStatement returns the statement updating the race with an ID, and moving it on to its next version.
+func (r *RacesRepo) updateStatement() string {
+	columns := []string{"meeting_id", "name", "number", "visible", "advertised_start_time"}
+
+	set := make([]string, len(columns))
+	for i, column := range columns {
+		set[i] = column + " = " + r.dialect.Placeholder(i+1)
+	}
+
+	return `UPDATE races SET ` + strings.Join(set, ", ") + `, version = version + 1 WHERE id = ` +
+		r.dialect.Placeholder(len(columns)+1)
+}
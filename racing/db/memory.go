@@ -0,0 +1,419 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/apperrors"
+	"git.neds.sh/matty/entain/racing/outbox"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// MemoryRacesRepo is a repository of races held in memory, for tests and running without a database. It behaves as
+// RacesRepo does, but its races are lost when the process exits.
+type MemoryRacesRepo struct {
+	mu    sync.RWMutex
+	races map[int64]*racing.Race
+	// versions are the versions of the races held, which their etags identify.
+	versions map[int64]int64
+	// events are the audit events of the changes made to races, in the order they were made.
+	events []*racing.AuditEvent
+	// messages are the outbox messages publishing the changes made to races, in the order they were made.
+	messages []*outbox.Message
+	// delivered are the IDs of the messages delivered.
+	delivered map[int64]struct{}
+	// lastID is the highest ID a race has been held under, which races created are given the IDs after, so that the IDs
+	// of purged races aren't given again.
+	lastID int64
+}
+
+// NewMemoryRacesRepo creates a new in-memory races repository holding races.
+func NewMemoryRacesRepo(races ...*racing.Race) *MemoryRacesRepo {
+	r := &MemoryRacesRepo{
+		races:     make(map[int64]*racing.Race, len(races)),
+		versions:  make(map[int64]int64, len(races)),
+		delivered: map[int64]struct{}{},
+	}
+
+	for _, race := range races {
+		r.store(race.Id, race, 1)
+	}
+
+	return r
+}
+
+// record records action changing the race with id from before to after in the audit log, and adds the message
+// publishing it to the outbox. The caller must hold the write lock.
+func (r *MemoryRacesRepo) record(ctx context.Context, action racing.AuditEvent_Action, id int64, before, after *racing.Race) error {
+	event, err := raceChange(ctx, action, id, before, after)
+	if err != nil {
+		return err
+	}
+
+	message, err := raceMessage(event, id, before, after)
+	if err != nil {
+		return err
+	}
+
+	event.Id = int64(len(r.events)) + 1
+	r.events = append(r.events, event)
+
+	message.ID = int64(len(r.messages)) + 1
+	r.messages = append(r.messages, message)
+
+	return nil
+}
+
+// store holds a copy of race with id at version. The caller must hold the write lock.
+func (r *MemoryRacesRepo) store(id int64, race *racing.Race, version int64) {
+	stored := proto.Clone(race).(*racing.Race)
+	stored.Id = id
+	stored.Etag = formatEtag(version)
+
+	r.races[id] = stored
+	r.versions[id] = version
+
+	if id > r.lastID {
+		r.lastID = id
+	}
+}
+
+// Init does nothing, as there is nothing to prepare to hold races in memory.
+func (r *MemoryRacesRepo) Init(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Insert inserts races, keeping any races already held with the same IDs, and returns the races it inserted.
+func (r *MemoryRacesRepo) Insert(ctx context.Context, races ...*racing.Race) ([]*racing.Race, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var inserted []*racing.Race
+
+	for _, race := range races {
+		if _, ok := r.races[race.Id]; ok {
+			continue
+		}
+
+		if err := r.record(ctx, racing.AuditEvent_CREATED, race.Id, nil, race); err != nil {
+			return nil, err
+		}
+
+		r.store(race.Id, race, 1)
+		inserted = append(inserted, race)
+	}
+
+	return inserted, nil
+}
+
+// List returns the races matching filter, in order.
+func (r *MemoryRacesRepo) List(
+	ctx context.Context,
+	filter *racing.ListRacesRequestFilter,
+	order racing.RaceOrder,
+) ([]*racing.Race, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Orders are checked as RacesRepo checks them, so that both refuse the same orders.
+	if _, err := orderColumn(order); err != nil {
+		return nil, err
+	}
+
+	meetingIDs := make(map[int64]bool, len(filter.GetMeetingIds()))
+	for _, id := range filter.GetMeetingIds() {
+		meetingIDs[id] = true
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var races []*racing.Race
+
+	for _, race := range r.races {
+		if len(meetingIDs) > 0 && !meetingIDs[race.MeetingId] {
+			continue
+		}
+
+		if race.DeleteTime != nil && !filter.GetShowDeleted() {
+			continue
+		}
+
+		// Races are copied, so that callers can't change those held.
+		races = append(races, proto.Clone(race).(*racing.Race))
+	}
+
+	sort.Slice(races, func(i, j int) bool { return order.Less(races[i], races[j]) })
+
+	return races, nil
+}
+
+// Import creates races, or updates the races with the same external IDs, only keeping the changes if commit is set.
+// It returns the outcome of each race, in order, as RacesRepo.Import does.
+func (r *MemoryRacesRepo) Import(ctx context.Context, races []*racing.Race, commit bool) ([]*racing.ImportRaceResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lastID := r.lastID
+
+	byExternalID := make(map[string]int64, len(r.races))
+
+	for id, race := range r.races {
+		if race.ExternalId != "" {
+			byExternalID[race.ExternalId] = id
+		}
+	}
+
+	results := make([]*racing.ImportRaceResult, 0, len(races))
+	imported := make(map[int64]*racing.Race, len(races))
+
+	for _, race := range races {
+		result := &racing.ImportRaceResult{ExternalId: race.ExternalId, Outcome: racing.ImportRaceResult_UPDATED}
+
+		id, ok := byExternalID[race.ExternalId]
+		if !ok {
+			lastID++
+			id = lastID
+			byExternalID[race.ExternalId] = id
+			result.Outcome = racing.ImportRaceResult_CREATED
+		}
+
+		result.Id = id
+		imported[id] = race
+
+		results = append(results, result)
+	}
+
+	if !commit {
+		return results, nil
+	}
+
+	// Races are stored in the order they were imported, so that their changes are recorded in that order.
+	for _, result := range results {
+		before := r.races[result.Id]
+		after := importedRace(imported[result.Id], before, result.Id)
+
+		action := racing.AuditEvent_UPDATED
+		if before == nil {
+			action = racing.AuditEvent_CREATED
+		}
+
+		if err := r.record(ctx, action, result.Id, before, after); err != nil {
+			return nil, err
+		}
+
+		r.store(result.Id, after, r.versions[result.Id]+1)
+	}
+
+	return results, nil
+}
+
+// Update replaces the meeting ID, name, number, visibility and advertised start time of the race with the ID of race,
+// unless etag is set and the race has changed since the version it identifies, as RacesRepo.Update does.
+func (r *MemoryRacesRepo) Update(ctx context.Context, race *racing.Race, etag string) (*racing.Race, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	held, ok := r.races[race.Id]
+	if !ok || held.DeleteTime != nil {
+		return nil, apperrors.NotFound(raceResourceType, raceName(race.Id))
+	}
+
+	if !matchesEtag(etag, r.versions[race.Id]) {
+		return nil, apperrors.Aborted(raceResourceType, raceName(race.Id))
+	}
+
+	updated := proto.Clone(race).(*racing.Race)
+	updated.ExternalId = held.ExternalId
+	updated.DeleteTime = nil
+
+	if err := r.record(ctx, racing.AuditEvent_UPDATED, race.Id, held, updated); err != nil {
+		return nil, err
+	}
+
+	r.store(race.Id, updated, r.versions[race.Id]+1)
+
+	return proto.Clone(r.races[race.Id]).(*racing.Race), nil
+}
+
+// Delete soft deletes the race with id, unless etag is set and the race has changed since the version it identifies,
+// as RacesRepo.Delete does.
+func (r *MemoryRacesRepo) Delete(ctx context.Context, id int64, etag string) (*racing.Race, error) {
+	return r.setDeleteTime(ctx, id, etag, storedNow())
+}
+
+// Undelete restores the deleted race with id, unless etag is set and the race has changed since the version it
+// identifies, as RacesRepo.Undelete does.
+func (r *MemoryRacesRepo) Undelete(ctx context.Context, id int64, etag string) (*racing.Race, error) {
+	return r.setDeleteTime(ctx, id, etag, time.Time{})
+}
+
+// setDeleteTime deletes the race with id at deleteTime, or restores it if deleteTime is zero.
+func (r *MemoryRacesRepo) setDeleteTime(ctx context.Context, id int64, etag string, deleteTime time.Time) (*racing.Race, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	held, ok := r.races[id]
+	if !ok {
+		return nil, apperrors.NotFound(raceResourceType, raceName(id))
+	}
+
+	deleting := !deleteTime.IsZero()
+
+	switch {
+	case deleting && held.DeleteTime != nil:
+		return nil, apperrors.NotFound(raceResourceType, raceName(id))
+	case !deleting && held.DeleteTime == nil:
+		return nil, apperrors.AlreadyExists(raceResourceType, raceName(id))
+	}
+
+	if !matchesEtag(etag, r.versions[id]) {
+		return nil, apperrors.Aborted(raceResourceType, raceName(id))
+	}
+
+	changed := proto.Clone(held).(*racing.Race)
+	changed.DeleteTime = nil
+
+	action := racing.AuditEvent_UNDELETED
+
+	if deleting {
+		action = racing.AuditEvent_DELETED
+		changed.DeleteTime = timestamppb.New(deleteTime)
+	}
+
+	if err := r.record(ctx, action, id, held, changed); err != nil {
+		return nil, err
+	}
+
+	r.store(id, changed, r.versions[id]+1)
+
+	return proto.Clone(r.races[id]).(*racing.Race), nil
+}
+
+// Purge removes the races deleted before deletedBefore for good, as RacesRepo.Purge does.
+func (r *MemoryRacesRepo) Purge(ctx context.Context, deletedBefore time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ids []int64
+
+	for id, race := range r.races {
+		if race.DeleteTime != nil && race.DeleteTime.AsTime().Before(deletedBefore) {
+			ids = append(ids, id)
+		}
+	}
+
+	// Races are purged in order of ID, so that they are recorded in that order.
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		if err := r.record(ctx, racing.AuditEvent_PURGED, id, r.races[id], nil); err != nil {
+			return 0, err
+		}
+
+		delete(r.races, id)
+		delete(r.versions, id)
+	}
+
+	return len(ids), nil
+}
+
+// ListAuditEvents returns up to limit of the audit events matching filter after the event with afterID, ordered by
+// ID, as RacesRepo.ListAuditEvents does.
+func (r *MemoryRacesRepo) ListAuditEvents(ctx context.Context, filter *racing.ListAuditEventsRequestFilter, afterID int64, limit int) ([]*racing.AuditEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var events []*racing.AuditEvent
+
+	for _, event := range r.events {
+		if len(events) == limit {
+			break
+		}
+
+		switch {
+		case event.Id <= afterID,
+			filter.GetResource() != "" && event.Resource != filter.GetResource(),
+			filter.GetActor() != "" && event.Actor != filter.GetActor(),
+			filter.GetStartTime() != nil && event.Time.AsTime().Before(filter.GetStartTime().AsTime()),
+			filter.GetEndTime() != nil && !event.Time.AsTime().Before(filter.GetEndTime().AsTime()):
+			continue
+		}
+
+		events = append(events, proto.Clone(event).(*racing.AuditEvent))
+	}
+
+	return events, nil
+}
+
+// PendingMessages returns up to limit of the outbox messages not yet delivered, ordered by ID, as
+// RacesRepo.PendingMessages does.
+func (r *MemoryRacesRepo) PendingMessages(ctx context.Context, limit int) ([]*outbox.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var messages []*outbox.Message
+
+	for _, message := range r.messages {
+		if len(messages) == limit {
+			break
+		}
+
+		if _, ok := r.delivered[message.ID]; ok {
+			continue
+		}
+
+		pending := *message
+		messages = append(messages, &pending)
+	}
+
+	return messages, nil
+}
+
+// MarkDelivered marks the outbox message with id delivered, so that it is no longer pending.
+func (r *MemoryRacesRepo) MarkDelivered(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.delivered[id] = struct{}{}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package db
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// queryDuration records how long each query took, labelled by its name, one of those declared in queries.go.
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "racing",
+		Subsystem: "db",
+		Name:      "query_duration_seconds",
+		Help:      "Duration of repository queries.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"query"})
+
+	// queryErrors counts the queries that failed, labelled by their name, one of those declared in queries.go.
+	queryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "racing",
+		Subsystem: "db",
+		Name:      "query_errors_total",
+		Help:      "Number of repository queries that failed.",
+	}, []string{"query"})
+)
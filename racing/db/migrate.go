@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// migrate applies the migrations of the dialect that haven't been applied yet, each in a transaction of its own.
+// Applied migrations are recorded by their version, counting from 1, in the schema_migrations table.
+func (r *RacesRepo) migrate(ctx context.Context) error {
+	if err := r.exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	var applied int
+
+	queryCtx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+
+	if err := r.db.QueryRowContext(queryCtx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&applied); err != nil {
+		return r.mapError(queryCtx, err)
+	}
+
+	migrations := r.dialect.Migrations()
+	if applied > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than the latest known, %d", applied, len(migrations))
+	}
+
+	for i := applied; i < len(migrations); i++ {
+		if err := r.applyMigration(ctx, i+1, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// applyMigration applies the migration statement with version.
+func (r *RacesRepo) applyMigration(ctx context.Context, version int, statement string) (err error) {
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+
+	defer func() {
+		if err != nil {
+			err = r.mapError(ctx, err)
+		}
+	}()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, statement); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES (`+r.dialect.Placeholder(1)+`)`, version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
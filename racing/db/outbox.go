@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/racing/outbox"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// outboxColumns are the columns of the outbox table set when writing a message.
+var outboxColumns = []string{"created_at", "topic", "message_key", "payload"}
+
+// raceMessage returns the outbox message publishing the change to the race with id from before to after, recorded by
+// event. The race published is the one after the change, or before it for races that are purged.
+func raceMessage(event *racing.AuditEvent, id int64, before, after *racing.Race) (*outbox.Message, error) {
+	race := after
+	if race == nil {
+		race = before
+	}
+
+	published := proto.Clone(race).(*racing.Race)
+	published.Id = id
+	published.Etag = ""
+
+	return outbox.NewRaceMessage(&racing.RaceChange{
+		Action: event.Action,
+		Race:   published,
+		Time:   event.Time,
+		Actor:  event.Actor,
+		Rpc:    event.Rpc,
+	}, event.Resource)
+}
+
+// writeMessage writes message to the outbox in tx, so that it is only written if the change it publishes is
+// committed.
+func (r *RacesRepo) writeMessage(ctx context.Context, tx *sql.Tx, message *outbox.Message) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO outbox (`+strings.Join(outboxColumns, ", ")+`) VALUES (`+placeholders(r.dialect, 0, len(outboxColumns))+`)`,
+		r.dialect.Timestamp(message.Time),
+		message.Topic,
+		message.Key,
+		string(message.Payload),
+	)
+
+	return err
+}
+
+// PendingMessages returns up to limit of the outbox messages not yet delivered, ordered by ID.
+func (r *RacesRepo) PendingMessages(ctx context.Context, limit int) ([]*outbox.Message, error) {
+	query := getRaceQueries()[outboxPending] + " ORDER BY id LIMIT " + r.dialect.Placeholder(1)
+
+	ctx, span := r.startQuerySpan(ctx, "RacesRepo.PendingMessages", query)
+	defer span.End()
+
+	queryCtx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+
+	rows, err := r.db.QueryContext(queryCtx, query, limit)
+	if err != nil {
+		err = r.mapError(queryCtx, err)
+		observeQuery(ctx, outboxPending, query, start, 0, err)
+
+		return nil, err
+	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		err = r.mapError(queryCtx, err)
+		observeQuery(ctx, outboxPending, query, start, 0, err)
+
+		return nil, err
+	}
+
+	observeQuery(ctx, outboxPending, query, start, len(messages), nil)
+
+	return messages, nil
+}
+
+// MarkDelivered marks the outbox message with id delivered, so that it is no longer pending. Delivered messages are
+// kept.
+func (r *RacesRepo) MarkDelivered(ctx context.Context, id int64) error {
+	statement := `UPDATE outbox SET delivered_at = ` + r.dialect.Placeholder(1) + ` WHERE id = ` + r.dialect.Placeholder(2)
+
+	ctx, span := r.startQuerySpan(ctx, "RacesRepo.MarkDelivered", statement)
+	defer span.End()
+
+	queryCtx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+
+	if _, err := r.db.ExecContext(queryCtx, statement, r.dialect.Timestamp(storedNow()), id); err != nil {
+		err = r.mapError(queryCtx, err)
+		observeQuery(ctx, outboxDeliver, statement, start, 0, err)
+
+		return err
+	}
+
+	observeQuery(ctx, outboxDeliver, statement, start, 1, nil)
+
+	return nil
+}
+
+// scanMessages scans the outbox messages of rows, closing them.
+func scanMessages(rows *sql.Rows) (messages []*outbox.Message, err error) {
+	defer func() {
+		if closeErr := rows.Close(); err == nil && closeErr != nil {
+			messages, err = nil, closeErr
+		}
+	}()
+
+	for rows.Next() {
+		var (
+			message outbox.Message
+			payload string
+		)
+
+		if err := rows.Scan(&message.ID, &message.Time, &message.Topic, &message.Key, &payload); err != nil {
+			return nil, err
+		}
+
+		message.Payload = []byte(payload)
+
+		messages = append(messages, &message)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+
+	"git.neds.sh/matty/entain/racing/apperrors"
+)
+
+// Postgres is the dialect of PostgreSQL databases. Timestamps are stored in TIMESTAMPTZ columns.
+var Postgres Dialect = postgresDialect{}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Driver() string {
+	return "postgres"
+}
+
+func (postgresDialect) System() attribute.KeyValue {
+	return semconv.DBSystemPostgreSQL
+}
+
+func (postgresDialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (postgresDialect) Migrations() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS races (id BIGINT PRIMARY KEY, meeting_id BIGINT, name TEXT, number BIGINT, visible BOOLEAN, advertised_start_time TIMESTAMPTZ)`,
+		`ALTER TABLE races ADD COLUMN external_id TEXT`,
+		`CREATE UNIQUE INDEX races_external_id ON races (external_id)`,
+		`ALTER TABLE races ADD COLUMN version BIGINT NOT NULL DEFAULT 1`,
+		`CREATE TABLE audit_events (id BIGSERIAL PRIMARY KEY, occurred_at TIMESTAMPTZ NOT NULL, actor TEXT NOT NULL, rpc TEXT NOT NULL, resource TEXT NOT NULL, action TEXT NOT NULL, diff TEXT NOT NULL)`,
+		`CREATE INDEX audit_events_resource ON audit_events (resource, id)`,
+		`CREATE INDEX audit_events_actor ON audit_events (actor, id)`,
+		`ALTER TABLE races ADD COLUMN delete_time TIMESTAMPTZ`,
+		`CREATE TABLE outbox (id BIGSERIAL PRIMARY KEY, created_at TIMESTAMPTZ NOT NULL, topic TEXT NOT NULL, message_key TEXT NOT NULL, payload TEXT NOT NULL, delivered_at TIMESTAMPTZ)`,
+		`CREATE INDEX outbox_pending ON outbox (id) WHERE delivered_at IS NULL`,
+		// Races are given IDs from a sequence, so that the IDs of purged races aren't given again.
+		`CREATE SEQUENCE races_id_seq OWNED BY races.id`,
+		`SELECT setval('races_id_seq', COALESCE(MAX(id), 0) + 1, false) FROM races`,
+		`ALTER TABLE races ALTER COLUMN id SET DEFAULT nextval('races_id_seq')`,
+	}
+}
+
+func (d postgresDialect) InsertIgnore(table, key string, columns []string) string {
+	return `INSERT INTO ` + table + `(` + strings.Join(columns, ", ") + `) VALUES (` +
+		placeholders(d, 0, len(columns)) + `) ON CONFLICT (` + key + `) DO NOTHING`
+}
+
+func (d postgresDialect) InsertReturningID(table string, columns []string) (string, bool) {
+	return `INSERT INTO ` + table + `(` + strings.Join(columns, ", ") + `) VALUES (` + placeholders(d, 0, len(columns)) +
+		`) RETURNING id`, true
+}
+
+// AdvanceID returns a statement moving the sequence of table on to the highest ID stored, unless it is already past
+// it, as the sequence isn't moved by rows inserted with IDs of their own.
+func (postgresDialect) AdvanceID(table string) string {
+	sequence := table + "_id_seq"
+
+	return `SELECT setval('` + sequence + `', GREATEST((SELECT COALESCE(MAX(id), 0) FROM ` + table + `), ` +
+		`(SELECT last_value FROM ` + sequence + `)))`
+}
+
+func (postgresDialect) Timestamp(t time.Time) interface{} {
+	return t
+}
+
+func (postgresDialect) MapError(err error) error {
+	if errors.Is(err, driver.ErrBadConn) {
+		return apperrors.Unavailable(err, busyRetryAfter)
+	}
+
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	// Conflicts between transactions, and a server that is starting, stopping or out of connections, are transient.
+	switch pqErr.Code.Class() {
+	case "08", "40", "53", "57":
+		return apperrors.Unavailable(err, busyRetryAfter)
+	}
+
+	return err
+}
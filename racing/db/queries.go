@@ -1,7 +1,20 @@
 package db
 
+// The names of the repository's queries, which label their metrics and log lines. The SELECTs are keys of
+// getRaceQueries(); the other statements are built for the dialect of the database when they are run.
 const (
-	racesList = "list"
+	racesList     = "list"
+	racesInsert   = "insert"
+	racesImport   = "import"
+	racesUpdate   = "update"
+	racesDelete   = "delete"
+	racesUndelete = "undelete"
+	racesPurge    = "purge"
+
+	auditEventsList = "list_audit_events"
+
+	outboxPending = "outbox_pending"
+	outboxDeliver = "outbox_deliver"
 )
 
 func getRaceQueries() map[string]string {
@@ -13,8 +26,32 @@ func getRaceQueries() map[string]string {
 				name, 
 				number, 
 				visible, 
-				advertised_start_time 
+				advertised_start_time,
+				external_id,
+				version,
+				delete_time
 			FROM races
 		`,
+		auditEventsList: `
+			SELECT
+				id,
+				occurred_at,
+				actor,
+				rpc,
+				resource,
+				action,
+				diff
+			FROM audit_events
+		`,
+		outboxPending: `
+			SELECT
+				id,
+				created_at,
+				topic,
+				message_key,
+				payload
+			FROM outbox
+			WHERE delivered_at IS NULL
+		`,
 	}
 }
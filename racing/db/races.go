@@ -1,57 +1,162 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
-	_ "github.com/mattn/go-sqlite3" // Imported for side effects
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"git.neds.sh/matty/entain/racing/apperrors"
+	"git.neds.sh/matty/entain/racing/logging"
 	"git.neds.sh/matty/entain/racing/proto/racing"
 )
 
+// tracerName identifies the spans created by the repository.
+const tracerName = "git.neds.sh/matty/entain/racing/db"
+
 // RacesRepo provides repository access to races.
 type RacesRepo struct {
-	db   *sql.DB
-	init sync.Once
+	db           *sql.DB
+	dialect      Dialect
+	queryTimeout time.Duration
 }
 
-// NewRacesRepo creates a new races repository.
-func NewRacesRepo(db *sql.DB) *RacesRepo {
-	return &RacesRepo{db: db}
+// NewRacesRepo creates a new races repository, storing races in db, which speaks dialect. Each query is stopped if
+// it runs for longer than queryTimeout, unless it is zero.
+func NewRacesRepo(db *sql.DB, dialect Dialect, queryTimeout time.Duration) *RacesRepo {
+	return &RacesRepo{db: db, dialect: dialect, queryTimeout: queryTimeout}
 }
 
-// Init prepares the race repository dummy data.
-func (r *RacesRepo) Init() error {
-	var err error
-
-	r.init.Do(func() {
-		// For test/example purposes, we seed the DB with some dummy races.
-		err = r.seed()
-	})
-
-	return err
+// Init creates the races table unless it exists, and migrates it to the latest schema.
+func (r *RacesRepo) Init(ctx context.Context) error {
+	return r.migrate(ctx)
 }
 
-func (r *RacesRepo) List(filter *racing.ListRacesRequestFilter) ([]*racing.Race, error) {
+// List returns the races matching filter, in order.
+func (r *RacesRepo) List(
+	ctx context.Context,
+	filter *racing.ListRacesRequestFilter,
+	order racing.RaceOrder,
+) ([]*racing.Race, error) {
 	var (
 		err   error
 		query string
 		args  []interface{}
 	)
 
+	orderBy, err := orderByClause(order)
+	if err != nil {
+		return nil, err
+	}
+
 	query = getRaceQueries()[racesList]
 
 	query, args = r.applyFilter(query, filter)
+	query += orderBy
+
+	ctx, span := r.startQuerySpan(ctx, "RacesRepo.List", query)
+	defer span.End()
+
+	queryCtx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
 
-	rows, err := r.db.Query(query, args...)
+	start := time.Now()
+
+	rows, err := r.db.QueryContext(queryCtx, query, args...)
 	if err != nil {
+		err = r.mapError(queryCtx, err)
+		observeQuery(ctx, racesList, query, start, 0, err)
+
 		return nil, err
 	}
 
-	return scanRaces(rows)
+	races, err := scanRaces(rows)
+	if err != nil {
+		err = r.mapError(queryCtx, err)
+		observeQuery(ctx, racesList, query, start, 0, err)
+
+		return nil, err
+	}
+
+	observeQuery(ctx, racesList, query, start, len(races), nil)
+
+	return races, nil
+}
+
+// withQueryTimeout returns a copy of ctx to run a query with, which is done once the query timeout has passed.
+func (r *RacesRepo) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, r.queryTimeout)
+}
+
+// mapError converts err, returned by a query run with ctx, into the errors of the apperrors taxonomy. A query that
+// failed because ctx is done is reported as the error of ctx, whatever the driver returned, so that it is reported
+// as Canceled or DeadlineExceeded.
+func (r *RacesRepo) mapError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w: %s", ctxErr, err)
+	}
+
+	return r.dialect.MapError(err)
+}
+
+// orderColumns are the columns races are ordered by, keyed by the field of a racing.RaceOrder.
+var orderColumns = map[string]string{
+	"id":                    "id",
+	"meeting_id":            "meeting_id",
+	"name":                  "name",
+	"number":                "number",
+	"advertised_start_time": "advertised_start_time",
+}
+
+// orderColumn returns the column races are ordered by in order, or an apperrors.InvalidArgumentError if its field
+// isn't one races can be ordered by.
+func orderColumn(order racing.RaceOrder) (string, error) {
+	if order.Field == "" {
+		return "id", nil
+	}
+
+	column, ok := orderColumns[order.Field]
+	if !ok {
+		return "", apperrors.InvalidArgument(apperrors.FieldViolation{
+			Field:       "order_by",
+			Description: fmt.Sprintf("can't order by %q", order.Field),
+		})
+	}
+
+	return column, nil
+}
+
+// orderByClause returns the ORDER BY clause listing races in order, and then by ID.
+func orderByClause(order racing.RaceOrder) (string, error) {
+	column, err := orderColumn(order)
+	if err != nil {
+		return "", err
+	}
+
+	clause := " ORDER BY " + column
+	if order.Desc {
+		clause += " DESC"
+	}
+
+	if column != "id" {
+		clause += ", id"
+	}
+
+	return clause, nil
 }
 
 func (r *RacesRepo) applyFilter(query string, filter *racing.ListRacesRequestFilter) (string, []interface{}) {
@@ -60,12 +165,12 @@ func (r *RacesRepo) applyFilter(query string, filter *racing.ListRacesRequestFil
 		args    []interface{}
 	)
 
-	if filter == nil {
-		return query, args
+	if !filter.GetShowDeleted() {
+		clauses = append(clauses, "delete_time IS NULL")
 	}
 
-	if len(filter.MeetingIds) > 0 {
-		clauses = append(clauses, "meeting_id IN ("+strings.Repeat("?,", len(filter.MeetingIds)-1)+"?)")
+	if len(filter.GetMeetingIds()) > 0 {
+		clauses = append(clauses, "meeting_id IN ("+placeholders(r.dialect, len(args), len(filter.MeetingIds))+")")
 
 		for _, meetingID := range filter.MeetingIds {
 			args = append(args, meetingID)
@@ -79,32 +184,115 @@ func (r *RacesRepo) applyFilter(query string, filter *racing.ListRacesRequestFil
 	return query, args
 }
 
+// scanRaces scans the races of rows, closing them.
 func scanRaces(
 	rows *sql.Rows,
-) ([]*racing.Race, error) {
-	var races []*racing.Race
-
-	for rows.Next() {
-		var race racing.Race
-		var advertisedStart time.Time
-
-		if err := rows.Scan(&race.Id, &race.MeetingId, &race.Name, &race.Number, &race.Visible, &advertisedStart); err != nil {
-			if err == sql.ErrNoRows {
-				return nil, nil
-			}
-
-			return nil, err
+) (races []*racing.Race, err error) {
+	defer func() {
+		if closeErr := rows.Close(); err == nil && closeErr != nil {
+			races, err = nil, closeErr
 		}
+	}()
 
-		ts, err := ptypes.TimestampProto(advertisedStart)
+	for rows.Next() {
+		race, _, err := scanRace(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		race.AdvertisedStartTime = ts
+		races = append(races, race)
+	}
 
-		races = append(races, &race)
+	// Rows stop early when reading them fails, including when the query is stopped.
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
 	return races, nil
 }
+
+// rowScanner is a row of the results of a query, as *sql.Row and *sql.Rows are.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRace scans a race selected by the list query from row, returning the version it is at too.
+func scanRace(row rowScanner) (*racing.Race, int64, error) {
+	var race racing.Race
+	var advertisedStart time.Time
+	var externalID sql.NullString
+	var version int64
+	var deleteTime sql.NullTime
+
+	if err := row.Scan(&race.Id, &race.MeetingId, &race.Name, &race.Number, &race.Visible, &advertisedStart, &externalID, &version, &deleteTime); err != nil {
+		return nil, 0, err
+	}
+
+	race.ExternalId = externalID.String
+	race.Etag = formatEtag(version)
+
+	if deleteTime.Valid {
+		race.DeleteTime = timestamppb.New(deleteTime.Time)
+	}
+
+	ts, err := ptypes.TimestampProto(advertisedStart)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	race.AdvertisedStartTime = ts
+
+	return &race, version, nil
+}
+
+// findRace returns the race whose column holds value in tx, and the version it is at, or sql.ErrNoRows if there is
+// none.
+func (r *RacesRepo) findRace(ctx context.Context, tx *sql.Tx, column string, value interface{}) (*racing.Race, int64, error) {
+	query := getRaceQueries()[racesList] + ` WHERE ` + column + ` = ` + r.dialect.Placeholder(1)
+
+	return scanRace(tx.QueryRowContext(ctx, query, value))
+}
+
+// startQuerySpan starts a child span for a repository call that runs query.
+func (r *RacesRepo) startQuerySpan(ctx context.Context, name, query string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(
+		ctx,
+		name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			r.dialect.System(),
+			semconv.DBStatementKey.String(strings.Join(strings.Fields(query), " ")),
+		),
+	)
+}
+
+// observeQuery records metrics and span attributes for a query and logs its outcome against the request scoped
+// logger.
+func observeQuery(ctx context.Context, name, query string, start time.Time, rows int, err error) {
+	duration := time.Since(start)
+	span := trace.SpanFromContext(ctx)
+
+	span.SetAttributes(attribute.Int("db.rows", rows))
+
+	queryDuration.WithLabelValues(name).Observe(duration.Seconds())
+
+	entry := logging.FromContext(ctx).WithFields(logrus.Fields{
+		"query":       name,
+		"sql":         strings.Join(strings.Fields(query), " "),
+		"duration_ms": duration.Milliseconds(),
+		"rows":        rows,
+	})
+
+	if err != nil {
+		queryErrors.WithLabelValues(name).Inc()
+
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		entry.WithError(err).Warn("query failed")
+
+		return
+	}
+
+	entry.Info("executed query")
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"testing"
@@ -11,6 +12,12 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"google.golang.org/protobuf/testing/protocmp"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
@@ -27,6 +34,9 @@ func TestRacesRepoList(t *testing.T) {
 		"number",
 		"visible",
 		"advertised_start_time",
+		"external_id",
+		"version",
+		"delete_time",
 	}
 
 	for _, tc := range []struct {
@@ -43,10 +53,10 @@ func TestRacesRepoList(t *testing.T) {
 
 				mock.ExpectQuery(getRaceQueries()[racesList]).
 					WillReturnRows(
-						mock.NewRows(listColumns).AddRow(1, 2, "3", 4, true, time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)),
+						mock.NewRows(listColumns).AddRow(1, 2, "3", 4, true, time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC), nil, 1, nil),
 					)
 
-				return NewRacesRepo(db)
+				return NewRacesRepo(db, SQLite, 0)
 			}(),
 			give: &racing.ListRacesRequestFilter{},
 			expect: []*racing.Race{
@@ -57,6 +67,7 @@ func TestRacesRepoList(t *testing.T) {
 					Number:              4,
 					Visible:             true,
 					AdvertisedStartTime: timeToTimestampPB(t, time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)),
+					Etag:                `"1"`,
 				},
 			},
 		},
@@ -67,10 +78,10 @@ func TestRacesRepoList(t *testing.T) {
 
 				mock.ExpectQuery(getRaceQueries()[racesList]).
 					WillReturnRows(
-						mock.NewRows(listColumns).AddRow(1, 2, "3", 4, true, time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)),
+						mock.NewRows(listColumns).AddRow(1, 2, "3", 4, true, time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC), nil, 1, nil),
 					)
 
-				return NewRacesRepo(db)
+				return NewRacesRepo(db, SQLite, 0)
 			}(),
 			give: nil,
 			expect: []*racing.Race{
@@ -81,6 +92,7 @@ func TestRacesRepoList(t *testing.T) {
 					Number:              4,
 					Visible:             true,
 					AdvertisedStartTime: timeToTimestampPB(t, time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)),
+					Etag:                `"1"`,
 				},
 			},
 		},
@@ -91,7 +103,7 @@ func TestRacesRepoList(t *testing.T) {
 
 				mock.ExpectQuery(getRaceQueries()[racesList]).WillReturnRows(mock.NewRows(listColumns))
 
-				return NewRacesRepo(db)
+				return NewRacesRepo(db, SQLite, 0)
 			}(),
 			give: &racing.ListRacesRequestFilter{},
 		},
@@ -103,11 +115,11 @@ func TestRacesRepoList(t *testing.T) {
 				mock.ExpectQuery(getRaceQueries()[racesList]).
 					WillReturnRows(
 						mock.NewRows(listColumns).
-							AddRow(1, 2, "3", 4, true, time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)).
-							AddRow(5, 6, "7", 8, false, time.Date(2001, time.February, 2, 0, 0, 0, 0, time.UTC)),
+							AddRow(1, 2, "3", 4, true, time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC), nil, 1, nil).
+							AddRow(5, 6, "7", 8, false, time.Date(2001, time.February, 2, 0, 0, 0, 0, time.UTC), "R-5", 3, nil),
 					)
 
-				return NewRacesRepo(db)
+				return NewRacesRepo(db, SQLite, 0)
 			}(),
 			give: &racing.ListRacesRequestFilter{
 				MeetingIds: []int64{1},
@@ -120,6 +132,7 @@ func TestRacesRepoList(t *testing.T) {
 					Number:              4,
 					Visible:             true,
 					AdvertisedStartTime: timeToTimestampPB(t, time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)),
+					Etag:                `"1"`,
 				},
 				{
 					Id:                  5,
@@ -128,6 +141,8 @@ func TestRacesRepoList(t *testing.T) {
 					Number:              8,
 					Visible:             false,
 					AdvertisedStartTime: timeToTimestampPB(t, time.Date(2001, time.February, 2, 0, 0, 0, 0, time.UTC)),
+					ExternalId:          "R-5",
+					Etag:                `"3"`,
 				},
 			},
 		},
@@ -138,7 +153,38 @@ func TestRacesRepoList(t *testing.T) {
 
 				mock.ExpectQuery(getRaceQueries()[racesList]).WillReturnError(errors.New("TestError123"))
 
-				return NewRacesRepo(db)
+				return NewRacesRepo(db, SQLite, 0)
+			}(),
+			give:        &racing.ListRacesRequestFilter{},
+			expectError: "TestError123",
+		},
+		{
+			name: "rows_err",
+			with: func() *RacesRepo {
+				db, mock := newSQLMock(t)
+
+				mock.ExpectQuery(getRaceQueries()[racesList]).
+					WillReturnRows(
+						mock.NewRows(listColumns).
+							AddRow(1, 2, "3", 4, true, time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC), nil, 1, nil).
+							AddRow(5, 6, "7", 8, false, time.Date(2001, time.February, 2, 0, 0, 0, 0, time.UTC), "R-5", 3, nil).
+							RowError(1, errors.New("TestError123")),
+					)
+
+				return NewRacesRepo(db, SQLite, 0)
+			}(),
+			give:        &racing.ListRacesRequestFilter{},
+			expectError: "TestError123",
+		},
+		{
+			name: "rows_close_err",
+			with: func() *RacesRepo {
+				db, mock := newSQLMock(t)
+
+				mock.ExpectQuery(getRaceQueries()[racesList]).
+					WillReturnRows(mock.NewRows(listColumns).CloseError(errors.New("TestError123")))
+
+				return NewRacesRepo(db, SQLite, 0)
 			}(),
 			give:        &racing.ListRacesRequestFilter{},
 			expectError: "TestError123",
@@ -149,7 +195,7 @@ func TestRacesRepoList(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			actual, actualErr := tc.with.List(tc.give)
+			actual, actualErr := tc.with.List(context.Background(), tc.give, racing.RaceOrder{})
 
 			if tc.expect != nil {
 				assert.Empty(t, cmp.Diff(tc.expect, actual, cmp.Options{protocmp.Transform(), protocmp.IgnoreUnknown()}), "expected vs actual")
@@ -166,6 +212,81 @@ func TestRacesRepoList(t *testing.T) {
 	}
 }
 
+func TestRacesRepoListStopped(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		giveCtx     func() context.Context
+		giveTimeout time.Duration
+		expectError error
+	}{
+		{
+			name: "canceled",
+			giveCtx: func() context.Context {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(10*time.Millisecond, cancel)
+
+				return ctx
+			},
+			expectError: context.Canceled,
+		},
+		{
+			name:        "query_timeout",
+			giveCtx:     context.Background,
+			giveTimeout: 10 * time.Millisecond,
+			expectError: context.DeadlineExceeded,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			db, mock := newSQLMock(t)
+
+			mock.ExpectQuery(getRaceQueries()[racesList]).WillDelayFor(time.Minute).WillReturnRows(mock.NewRows(nil))
+
+			_, actualErr := NewRacesRepo(db, SQLite, tc.giveTimeout).List(tc.giveCtx(), nil, racing.RaceOrder{})
+			assert.True(t, errors.Is(actualErr, tc.expectError), "actualErr %v", actualErr)
+		})
+	}
+}
+
+// The global tracer provider is replaced to record spans, so this test doesn't run in parallel, and restores it after.
+func TestRacesRepoListSpan(t *testing.T) {
+	provider := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(provider) })
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	db, mock := newSQLMock(t)
+
+	mock.ExpectQuery(getRaceQueries()[racesList]).WillReturnError(errors.New("TestError123"))
+
+	_, actualErr := NewRacesRepo(db, SQLite, 0).List(context.Background(), nil, racing.RaceOrder{})
+	assert.EqualError(t, actualErr, "TestError123", "actualErr")
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1, "spans")
+
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range spans[0].Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+
+	assert.Equal(t, "RacesRepo.List", spans[0].Name(), "name")
+	assert.Equal(t, codes.Error, spans[0].Status().Code, "status")
+	assert.Equal(t, "sqlite", attributes[semconv.DBSystemKey].AsString(), "db.system")
+	assert.Equal(
+		t,
+		"SELECT id, meeting_id, name, number, visible, advertised_start_time, external_id, version, delete_time FROM races WHERE delete_time IS NULL ORDER BY id",
+		attributes[semconv.DBStatementKey].AsString(),
+		"db.statement",
+	)
+}
+
 func timeToTimestampPB(t *testing.T, tt time.Time) *timestamppb.Timestamp {
 	ts, err := ptypes.TimestampProto(tt)
 	require.NoError(t, err, "TimeToTimestampProto")
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+
+	"git.neds.sh/matty/entain/racing/apperrors"
+)
+
+// SQLite is the dialect of SQLite databases. Timestamps are stored as RFC 3339 strings in DATETIME columns.
+var SQLite Dialect = sqliteDialect{}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Driver() string {
+	return "sqlite3"
+}
+
+func (sqliteDialect) System() attribute.KeyValue {
+	return semconv.DBSystemSqlite
+}
+
+func (sqliteDialect) Placeholder(int) string {
+	return "?"
+}
+
+func (sqliteDialect) Migrations() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS races (id INTEGER PRIMARY KEY, meeting_id INTEGER, name TEXT, number INTEGER, visible INTEGER, advertised_start_time DATETIME)`,
+		`ALTER TABLE races ADD COLUMN external_id TEXT`,
+		`CREATE UNIQUE INDEX races_external_id ON races (external_id)`,
+		`ALTER TABLE races ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		`CREATE TABLE audit_events (id INTEGER PRIMARY KEY AUTOINCREMENT, occurred_at DATETIME NOT NULL, actor TEXT NOT NULL, rpc TEXT NOT NULL, resource TEXT NOT NULL, action TEXT NOT NULL, diff TEXT NOT NULL)`,
+		`CREATE INDEX audit_events_resource ON audit_events (resource, id)`,
+		`CREATE INDEX audit_events_actor ON audit_events (actor, id)`,
+		`ALTER TABLE races ADD COLUMN delete_time DATETIME`,
+		`CREATE TABLE outbox (id INTEGER PRIMARY KEY AUTOINCREMENT, created_at DATETIME NOT NULL, topic TEXT NOT NULL, message_key TEXT NOT NULL, payload TEXT NOT NULL, delivered_at DATETIME)`,
+		`CREATE INDEX outbox_pending ON outbox (id) WHERE delivered_at IS NULL`,
+		// Races are moved to a table whose IDs autoincrement, so that the IDs of purged races aren't given again.
+		`CREATE TABLE races_autoincrement (id INTEGER PRIMARY KEY AUTOINCREMENT, meeting_id INTEGER, name TEXT, number INTEGER, visible INTEGER, advertised_start_time DATETIME, external_id TEXT, version INTEGER NOT NULL DEFAULT 1, delete_time DATETIME)`,
+		`INSERT INTO races_autoincrement (id, meeting_id, name, number, visible, advertised_start_time, external_id, version, delete_time) SELECT id, meeting_id, name, number, visible, advertised_start_time, external_id, version, delete_time FROM races`,
+		`DROP TABLE races`,
+		`ALTER TABLE races_autoincrement RENAME TO races`,
+		`CREATE UNIQUE INDEX races_external_id ON races (external_id)`,
+	}
+}
+
+func (d sqliteDialect) InsertIgnore(table, _ string, columns []string) string {
+	return `INSERT OR IGNORE INTO ` + table + `(` + strings.Join(columns, ", ") + `) VALUES (` +
+		placeholders(d, 0, len(columns)) + `)`
+}
+
+func (d sqliteDialect) InsertReturningID(table string, columns []string) (string, bool) {
+	return `INSERT INTO ` + table + `(` + strings.Join(columns, ", ") + `) VALUES (` +
+		placeholders(d, 0, len(columns)) + `)`, false
+}
+
+// AdvanceID returns nothing, as SQLite moves the IDs of AUTOINCREMENT tables past those inserted.
+func (sqliteDialect) AdvanceID(string) string {
+	return ""
+}
+
+func (sqliteDialect) Timestamp(t time.Time) interface{} {
+	return t.Format(time.RFC3339)
+}
+
+func (sqliteDialect) MapError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked) {
+		return apperrors.Unavailable(err, busyRetryAfter)
+	}
+
+	return err
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/racing/apperrors"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// raceResourceType is the resource type of races in errors.
+const raceResourceType = "racing.Race"
+
+// formatEtag returns the etag of the version of a race, a quoted string as in an HTTP ETag header.
+func formatEtag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// matchesEtag reports whether etag identifies version. An empty etag matches every version, while etags of another
+// form, such as weak HTTP etags, match none.
+func matchesEtag(etag string, version int64) bool {
+	return etag == "" || etag == formatEtag(version)
+}
+
+// storedNow returns the current time as it is stored, to the second as SQLite stores timestamps.
+func storedNow() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+// raceName returns the resource name of the race with id in errors.
+func raceName(id int64) string {
+	return fmt.Sprintf("races/%d", id)
+}
+
+// Update replaces the meeting ID, name, number, visibility and advertised start time of the race with the ID of race,
+// unless etag is set and the race has changed since the version it identifies, recording the change in the audit log.
+// It returns the race as updated. Deleted races are not found.
+func (r *RacesRepo) Update(ctx context.Context, race *racing.Race, etag string) (*racing.Race, error) {
+	// The version is checked again by the statement, as another transaction may have changed the race since it was
+	// read.
+	statement := r.updateStatement() + ` AND version = ` + r.dialect.Placeholder(7)
+
+	ctx, span := r.startQuerySpan(ctx, "RacesRepo.Update", statement)
+	defer span.End()
+
+	queryCtx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+
+	updated, err := r.update(queryCtx, statement, race, etag)
+	if err != nil {
+		err = r.mapError(queryCtx, err)
+		observeQuery(ctx, racesUpdate, statement, start, 0, err)
+
+		return nil, err
+	}
+
+	observeQuery(ctx, racesUpdate, statement, start, 1, nil)
+
+	return updated, nil
+}
+
+func (r *RacesRepo) update(ctx context.Context, statement string, race *racing.Race, etag string) (updated *racing.Race, err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	before, version, err := r.findRace(ctx, tx, "id", race.Id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, apperrors.NotFound(raceResourceType, raceName(race.Id))
+		}
+
+		return nil, err
+	}
+
+	// Deleted races can't be updated until they are restored.
+	if before.DeleteTime != nil {
+		return nil, apperrors.NotFound(raceResourceType, raceName(race.Id))
+	}
+
+	if !matchesEtag(etag, version) {
+		return nil, apperrors.Aborted(raceResourceType, raceName(race.Id))
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		statement,
+		race.MeetingId,
+		race.Name,
+		race.Number,
+		race.Visible,
+		r.dialect.Timestamp(race.AdvertisedStartTime.AsTime()),
+		race.Id,
+		version,
+	)
+	if err = changedRace(result, err, race.Id); err != nil {
+		return nil, err
+	}
+
+	updated = proto.Clone(race).(*racing.Race)
+	updated.ExternalId = before.ExternalId
+	updated.Etag = formatEtag(version + 1)
+	updated.DeleteTime = nil
+
+	if err = r.recordRaceChange(ctx, tx, racing.AuditEvent_UPDATED, race.Id, before, updated); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+// changedRace returns the error of a statement changing the race with id at the version it was read at, reporting the
+// race as changed if the statement found it at another version.
+func changedRace(result sql.Result, err error, id int64) error {
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return apperrors.Aborted(raceResourceType, raceName(id))
+	}
+
+	return nil
+}
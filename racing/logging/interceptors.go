@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor attaches a request scoped log entry to the context of each unary RPC and logs its outcome.
+func UnaryServerInterceptor(logger *logrus.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		entry := newRPCEntry(ctx, logger, info.FullMethod)
+		start := time.Now()
+
+		resp, err := handler(NewContext(ctx, entry), req)
+
+		logRPC(entry, start, err)
+
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor attaches a request scoped log entry to the context of each streaming RPC and logs its
+// outcome.
+func StreamServerInterceptor(logger *logrus.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		entry := newRPCEntry(ss.Context(), logger, info.FullMethod)
+		start := time.Now()
+
+		err := handler(srv, &serverStream{ServerStream: ss, ctx: NewContext(ss.Context(), entry)})
+
+		logRPC(entry, start, err)
+
+		return err
+	}
+}
+
+// serverStream overrides the context of a grpc.ServerStream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// newRPCEntry creates a log entry for an RPC, using the request ID from the incoming metadata if there is one.
+func newRPCEntry(ctx context.Context, logger *logrus.Logger, method string) *logrus.Entry {
+	requestID := ""
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(RequestIDKey); len(values) > 0 {
+			requestID = values[0]
+		}
+	}
+
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+
+	fields := logrus.Fields{
+		"request_id":  requestID,
+		"grpc_method": method,
+	}
+
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		fields["trace_id"] = spanContext.TraceID().String()
+	}
+
+	return logger.WithFields(fields)
+}
+
+func logRPC(entry *logrus.Entry, start time.Time, err error) {
+	entry = entry.WithFields(logrus.Fields{
+		"grpc_code":   status.Code(err).String(),
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+
+	if err != nil {
+		entry.WithError(err).Warn("finished rpc")
+
+		return
+	}
+
+	entry.Info("finished rpc")
+}
@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name            string
+		give            context.Context
+		withHandlerErr  error
+		expectRequestID string
+		expectCode      string
+		expectLevel     logrus.Level
+	}{
+		{
+			name:            "success",
+			give:            metadata.NewIncomingContext(context.Background(), metadata.Pairs(RequestIDKey, "abc123")),
+			expectRequestID: "abc123",
+			expectCode:      "OK",
+			expectLevel:     logrus.InfoLevel,
+		},
+		{
+			name:        "success_generated_request_id",
+			give:        context.Background(),
+			expectCode:  "OK",
+			expectLevel: logrus.InfoLevel,
+		},
+		{
+			name:            "handler_err",
+			give:            metadata.NewIncomingContext(context.Background(), metadata.Pairs(RequestIDKey, "abc123")),
+			withHandlerErr:  errors.New("TestError123"),
+			expectRequestID: "abc123",
+			expectCode:      "Unknown",
+			expectLevel:     logrus.WarnLevel,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger, hook := test.NewNullLogger()
+
+			var handlerEntry *logrus.Entry
+
+			_, actualErr := UnaryServerInterceptor(logger)(
+				tc.give,
+				nil,
+				&grpc.UnaryServerInfo{FullMethod: "/racing.Racing/ListRaces"},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					handlerEntry = FromContext(ctx)
+
+					return nil, tc.withHandlerErr
+				},
+			)
+
+			assert.Equal(t, tc.withHandlerErr, actualErr, "actualErr")
+
+			require.NotNil(t, handlerEntry, "handlerEntry")
+			require.Len(t, hook.AllEntries(), 1, "log entries")
+
+			actual := hook.LastEntry()
+
+			if tc.expectRequestID != "" {
+				assert.Equal(t, tc.expectRequestID, actual.Data["request_id"], "request_id")
+			} else {
+				assert.NotEmpty(t, actual.Data["request_id"], "request_id")
+			}
+
+			assert.Equal(t, actual.Data["request_id"], handlerEntry.Data["request_id"], "handler request_id")
+			assert.Equal(t, "/racing.Racing/ListRaces", actual.Data["grpc_method"], "grpc_method")
+			assert.Equal(t, tc.expectCode, actual.Data["grpc_code"], "grpc_code")
+			assert.Equal(t, tc.expectLevel, actual.Level, "level")
+		})
+	}
+}
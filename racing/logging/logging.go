@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDKey is the gRPC metadata key the request ID is received on.
+const RequestIDKey = "x-request-id"
+
+type loggerKey struct{}
+
+// New creates a new logger that writes JSON formatted lines to stdout at the given level.
+func New(level string) (*logrus.Logger, error) {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(os.Stdout)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(lvl)
+
+	return logger, nil
+}
+
+// NewContext returns a copy of ctx carrying entry.
+func NewContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, entry)
+}
+
+// FromContext returns the log entry carried by ctx. If there isn't one, an entry of the standard logger is returned.
+func FromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// newRequestID generates a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
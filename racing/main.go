@@ -1,54 +1,281 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
 	"net"
+	"net/http"
+	"os/user"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
+	"git.neds.sh/matty/entain/racing/apperrors"
+	"git.neds.sh/matty/entain/racing/audit"
+	"git.neds.sh/matty/entain/racing/auth"
+	"git.neds.sh/matty/entain/racing/cache"
 	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/logging"
+	"git.neds.sh/matty/entain/racing/metrics"
+	"git.neds.sh/matty/entain/racing/outbox"
 	"git.neds.sh/matty/entain/racing/proto/racing"
+	"git.neds.sh/matty/entain/racing/purge"
+	"git.neds.sh/matty/entain/racing/seed"
 	"git.neds.sh/matty/entain/racing/service"
+	"git.neds.sh/matty/entain/racing/tracing"
+	"git.neds.sh/matty/entain/racing/watch"
+	"git.neds.sh/matty/entain/tlsconfig"
 )
 
-var grpcEndpoint = flag.String("grpc-endpoint", "localhost:9000", "gRPC server endpoint")
+var (
+	grpcEndpoint    = flag.String("grpc-endpoint", "localhost:9000", "gRPC server endpoint")
+	metricsEndpoint = flag.String("metrics-endpoint", "localhost:9100", "Prometheus metrics endpoint")
+	storage         = flag.String("storage", storageDatabase, "Where races are stored (database, memory)")
+	database        = flag.String("database", "./db/racing.db", "Database to store races in: a postgres:// URL, or a SQLite file")
+	seedValue       = flag.Int64("seed", 0, "Seed value the dummy races stored on startup are generated from (0 for a random one, which is logged)")
+	fixture         = flag.String("fixture", "", "Name of a fixture set in --fixtures-dir to store on startup instead of dummy races")
+	fixturesDir     = flag.String("fixtures-dir", "./fixtures", "Directory of fixture sets, as <name>.yaml, <name>.yml or <name>.json")
+	queryTimeout    = flag.Duration("query-timeout", 5*time.Second, "How long a database query may run before it is stopped (0 for no limit)")
+	cacheSize       = flag.Int("cache-size", 1000, "Number of race listings cached (0 to disable the cache)")
+	cacheTTL        = flag.Duration("cache-ttl", 10*time.Second, "How long a race listing is cached for, bounding how long changes made by other processes go unseen")
+	enforceScopes   = flag.String("enforce-scopes", enforceScopesAuto, "Whether callers must hold the scope each RPC requires (auto, true, false); auto enforces them when --tls-client-ca is set")
+	logLevel        = flag.String("log-level", "info", "Log level (trace, debug, info, warn, error)")
+	traceExporter   = flag.String("trace-exporter", tracing.ExporterNone, "Trace exporter (none, stdout, otlp)")
+	otlpEndpoint    = flag.String("otlp-endpoint", "localhost:4317", "OTLP collector endpoint, used by the otlp trace exporter")
+	tlsCert         = flag.String("tls-cert", "", "PEM certificate chain to serve gRPC over TLS with")
+	tlsKey          = flag.String("tls-key", "", "PEM private key of --tls-cert")
+	tlsClientCA     = flag.String("tls-client-ca", "", "PEM CA bundle to verify client certificates against, enabling mutual TLS")
+	watchInterval   = flag.Duration("watch-interval", 2*time.Second, "How often races are checked for changes to stream to watchers")
+	watchRetain     = flag.Int("watch-retain", 1000, "Number of race events retained for watchers to resume from")
+	watchBuffer     = flag.Int("watch-buffer", 100, "Number of race events a watcher may fall behind by before it is dropped")
+	purgeRetention  = flag.Duration("purge-retention", 30*24*time.Hour, "How long deleted races are kept before they are purged (0 to never purge them)")
+	purgeInterval   = flag.Duration("purge-interval", time.Hour, "How often races deleted for longer than --purge-retention are purged")
+	outboxInterval  = flag.Duration("outbox-interval", time.Second, "How often changes to races written to the outbox are dispatched to its sinks (0 to not dispatch them)")
+	outboxBatch     = flag.Int("outbox-batch", 100, "Number of outbox messages read at a time when dispatching")
+	outboxBackoff   = flag.Duration("outbox-max-backoff", time.Minute, "Longest delay before a failed outbox dispatch is retried")
+	outboxFile      = flag.String("outbox-file", "", "File to append outbox messages to as JSON lines, in addition to the in-process bus")
+)
+
+// Values of --storage.
+const (
+	// storageDatabase stores races in --database.
+	storageDatabase = "database"
+	// storageMemory holds races in memory, losing them on exit.
+	storageMemory = "memory"
+)
+
+// Values of --enforce-scopes.
+const (
+	// enforceScopesAuto enforces scopes when clients are verified with --tls-client-ca, and warns that they aren't
+	// otherwise.
+	enforceScopesAuto = "auto"
+	// enforceScopesAlways enforces scopes, refusing to start unless clients are verified with --tls-client-ca.
+	enforceScopesAlways = "true"
+	// enforceScopesNever lets every caller call every RPC.
+	enforceScopesNever = "false"
+)
 
 func main() {
 	flag.Parse()
 
-	if err := run(); err != nil {
-		log.Fatalf("failed running grpc server: %s\n", err)
+	logger, err := logging.New(*logLevel)
+	if err != nil {
+		logrus.Fatalf("failed creating logger: %s", err)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+		if err := run(logger); err != nil {
+			logger.WithError(err).Fatal("failed running grpc server")
+		}
+	case "seed":
+		if err := runSeed(logger, flag.Args()[1:]); err != nil {
+			logger.WithError(err).Fatal("failed seeding races")
+		}
+	case "import":
+		if err := runImport(logger, flag.Args()[1:]); err != nil {
+			logger.WithError(err).Fatal("failed importing races")
+		}
+	case "export":
+		if err := runExport(logger, flag.Args()[1:]); err != nil {
+			logger.WithError(err).Fatal("failed exporting races")
+		}
+	default:
+		logger.Fatalf("unknown command %q", flag.Arg(0))
 	}
 }
 
-func run() error {
+func run(logger *logrus.Logger) error {
+	ctx, cancel := context.WithCancel(logging.NewContext(context.Background(), logrus.NewEntry(logger)))
+	defer cancel()
+
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		ServiceName:  "racing",
+		Exporter:     *traceExporter,
+		OTLPEndpoint: *otlpEndpoint,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.WithError(err).Error("failed flushing traces")
+		}
+	}()
+
 	conn, err := net.Listen("tcp", "localhost:9000")
 	if err != nil {
 		return err
 	}
 
-	racingDB, err := sql.Open("sqlite3", "./db/racing.db")
+	racesRepo, err := openRacesRepo(logger)
+	if err != nil {
+		return err
+	}
+
+	if err := racesRepo.Init(ctx); err != nil {
+		return err
+	}
+
+	// For test/example purposes, we seed the repository with some dummy races.
+	if err := seedRaces(commandContext(ctx, "racing"), logger, racesRepo); err != nil {
+		return err
+	}
+
+	// Watchers poll the repository itself, so that they see changes made by other processes as soon as they can.
+	racesHub := watch.NewHub(racesRepo, *watchRetain, *watchBuffer)
+	if err := racesHub.Refresh(ctx); err != nil {
+		return err
+	}
+
+	go racesHub.Run(ctx, *watchInterval)
+
+	// Purges go through the cache, so that listings showing deleted races don't keep showing purged ones.
+	cachedRaces := cache.NewRacesRepo(racesRepo, *cacheSize, *cacheTTL)
+
+	if *purgeRetention > 0 {
+		if *purgeInterval <= 0 {
+			return errors.New("--purge-interval must be positive")
+		}
+
+		go purge.Run(commandContext(ctx, "racing purge"), cachedRaces, *purgeRetention, *purgeInterval)
+	}
+
+	sinks, err := outboxSinks(cachedRaces)
 	if err != nil {
 		return err
 	}
 
-	racesRepo := db.NewRacesRepo(racingDB)
-	if err := racesRepo.Init(); err != nil {
+	if *outboxInterval > 0 {
+		if *outboxBatch <= 0 {
+			return errors.New("--outbox-batch must be positive")
+		}
+
+		if *outboxBackoff <= 0 {
+			return errors.New("--outbox-max-backoff must be positive")
+		}
+
+		dispatcher, err := outbox.NewDispatcher(racesRepo, sinks, *outboxBatch, outbox.Backoff{
+			Initial: outbox.DefaultBackoff.Initial,
+			Max:     *outboxBackoff,
+		})
+		if err != nil {
+			return err
+		}
+
+		go dispatcher.Run(ctx, *outboxInterval)
+	}
+
+	unaryInterceptors := append(
+		metrics.UnaryServerInterceptors(),
+		otelgrpc.UnaryServerInterceptor(),
+		logging.UnaryServerInterceptor(logger),
+	)
+	streamInterceptors := append(
+		metrics.StreamServerInterceptors(),
+		otelgrpc.StreamServerInterceptor(),
+		logging.StreamServerInterceptor(logger),
+	)
+
+	enforce, err := shouldEnforceScopes(logger, *enforceScopes, *tlsClientCA)
+	if err != nil {
 		return err
 	}
 
-	grpcServer := grpc.NewServer()
+	if enforce {
+		unaryInterceptors = append(unaryInterceptors, auth.UnaryServerInterceptor(auth.DefaultPolicy))
+		streamInterceptors = append(streamInterceptors, auth.StreamServerInterceptor(auth.DefaultPolicy))
+	}
+
+	// Changes are attributed to the identity attached by the auth interceptors, so the audit interceptors follow them.
+	unaryInterceptors = append(unaryInterceptors, audit.UnaryServerInterceptor())
+	streamInterceptors = append(streamInterceptors, audit.StreamServerInterceptor())
+
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(append(unaryInterceptors, apperrors.UnaryServerInterceptor())...),
+		grpc.ChainStreamInterceptor(append(streamInterceptors, apperrors.StreamServerInterceptor())...),
+	}
+
+	if *tlsCert != "" {
+		reloader, err := tlsconfig.NewReloader(tlsconfig.Files{
+			CertFile: *tlsCert,
+			KeyFile:  *tlsKey,
+			CAFile:   *tlsClientCA,
+		})
+		if err != nil {
+			return err
+		}
+
+		go reloader.Run(ctx, tlsconfig.DefaultReloadInterval, logging.FromContext(ctx))
+
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(reloader.ServerConfig())))
+	} else {
+		if *tlsClientCA != "" {
+			return errors.New("--tls-client-ca requires --tls-cert")
+		}
+
+		logger.Warn("serving gRPC without TLS")
+	}
+
+	grpcServer := grpc.NewServer(serverOptions...)
 
 	racing.RegisterRacingServer(
 		grpcServer,
 		service.NewRacingService(
+			cachedRaces,
+			racesHub,
 			racesRepo,
 		),
 	)
 
-	log.Printf("gRPC server listening on: %s\n", *grpcEndpoint)
+	// Health is reported per service, so the gateway can stop sending calls to an instance that can't serve them.
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(racing.Racing_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+
+	metrics.Register(grpcServer)
+
+	go func() {
+		logger.Infof("metrics server listening on: %s", *metricsEndpoint)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+
+		if err := http.ListenAndServe(*metricsEndpoint, mux); err != nil {
+			logger.WithError(err).Error("failed running metrics server")
+		}
+	}()
+
+	logger.Infof("gRPC server listening on: %s", *grpcEndpoint)
 
 	if err := grpcServer.Serve(conn); err != nil {
 		return err
@@ -56,3 +283,152 @@ func run() error {
 
 	return nil
 }
+
+// shouldEnforceScopes reports whether callers must hold the scope each RPC requires, as set by mode, a value of
+// --enforce-scopes. The identity api forwards is only trusted from clients with a certificate verified against
+// tlsClientCA, so scopes can't be enforced without one, and the default only enforces them when it is set.
+func shouldEnforceScopes(logger logrus.FieldLogger, mode, tlsClientCA string) (bool, error) {
+	switch mode {
+	case enforceScopesAuto:
+		if tlsClientCA == "" {
+			logger.Warn("SCOPES ARE NOT BEING ENFORCED: every caller may call every RPC, as clients can't be verified " +
+				"without --tls-client-ca")
+
+			return false, nil
+		}
+
+		return true, nil
+	case enforceScopesAlways:
+		if tlsClientCA == "" {
+			return false, errors.New("--enforce-scopes=true requires --tls-client-ca")
+		}
+
+		return true, nil
+	case enforceScopesNever:
+		logger.Warn("SCOPES ARE NOT BEING ENFORCED: every caller may call every RPC")
+
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown --enforce-scopes %q", mode)
+	}
+}
+
+// racesRepo is a repository of races, prepared by Init.
+type racesRepo interface {
+	service.RacesRepo
+	service.AuditLog
+	purge.Purger
+	outbox.Store
+	seed.Inserter
+	Init(ctx context.Context) error
+}
+
+// outboxSinks returns the sinks outbox messages are dispatched to: an in-process bus, and the file of --outbox-file if
+// it is set.
+func outboxSinks(cachedRaces *cache.RacesRepo) ([]outbox.Sink, error) {
+	bus := outbox.NewBus()
+
+	// The cache is emptied as messages are dispatched. Only one process dispatches the messages of a database, so the
+	// caches of other processes sharing it aren't emptied, and go on serving listings until their TTL passes.
+	bus.Subscribe(outbox.RacesTopic, func(context.Context, *outbox.Message) error {
+		cachedRaces.Invalidate()
+
+		return nil
+	})
+
+	sinks := []outbox.Sink{bus}
+
+	if *outboxFile != "" {
+		fileSink, err := outbox.OpenFileSink(*outboxFile)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, fileSink)
+	}
+
+	return sinks, nil
+}
+
+// openRacesRepo opens the repository of races selected by --storage.
+func openRacesRepo(logger *logrus.Logger) (racesRepo, error) {
+	switch *storage {
+	case storageDatabase:
+		racingDB, dialect, err := db.Open(*database)
+		if err != nil {
+			return nil, err
+		}
+
+		prometheus.MustRegister(collectors.NewDBStatsCollector(racingDB, "racing"))
+
+		return db.NewRacesRepo(racingDB, dialect, *queryTimeout), nil
+	case storageMemory:
+		logger.Warn("holding races in memory, they will be lost on exit")
+
+		return db.NewMemoryRacesRepo(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q", *storage)
+	}
+}
+
+// seedRaces stores the races of --fixture in repo, or dummy races generated from --seed if it is unset, keeping any
+// races it already has.
+func seedRaces(ctx context.Context, logger *logrus.Logger, repo racesRepo) error {
+	if *fixture != "" {
+		races, err := seed.InsertFixture(ctx, repo, *fixturesDir, *fixture, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		logger.WithField("fixture", *fixture).Infof("stored %d races", len(races))
+
+		return nil
+	}
+
+	cfg := seed.Default
+	cfg.Seed = *seedValue
+
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+
+	races, err := seed.Insert(ctx, repo, cfg)
+	if err != nil {
+		return err
+	}
+
+	// The seed is logged, so that the same races can be generated again with --seed.
+	logger.WithField("seed", cfg.Seed).Infof("stored %d dummy races", len(races))
+
+	return nil
+}
+
+// commandContext returns a copy of ctx attributing the changes made with it to command, run by the current user.
+func commandContext(ctx context.Context, command string) context.Context {
+	source := audit.Source{Actor: audit.AnonymousActor, RPC: command}
+
+	if u, err := user.Current(); err == nil {
+		source.Actor = u.Username
+	}
+
+	return audit.NewContext(ctx, source)
+}
+
+// openStoredRaces opens and initialises the repository of races stored in --database, for commands that work on it
+// without serving it.
+func openStoredRaces(ctx context.Context, logger *logrus.Logger) (racesRepo, error) {
+	if *storage != storageDatabase {
+		return nil, errors.New("commands require --storage=database")
+	}
+
+	repo, err := openRacesRepo(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := repo.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldEnforceScopes(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name          string
+		giveMode      string
+		giveClientCA  string
+		expect        bool
+		expectErr     string
+		expectWarning bool
+	}{
+		{
+			// The defaults serve plaintext, as api dials by default, so they must start.
+			name:          "default_flags",
+			giveMode:      flag.Lookup("enforce-scopes").DefValue,
+			giveClientCA:  flag.Lookup("tls-client-ca").DefValue,
+			expectWarning: true,
+		},
+		{
+			name:         "auto_mtls",
+			giveMode:     enforceScopesAuto,
+			giveClientCA: "ca.pem",
+			expect:       true,
+		},
+		{
+			name:         "always_mtls",
+			giveMode:     enforceScopesAlways,
+			giveClientCA: "ca.pem",
+			expect:       true,
+		},
+		{
+			name:      "always_without_mtls",
+			giveMode:  enforceScopesAlways,
+			expectErr: "--enforce-scopes=true requires --tls-client-ca",
+		},
+		{
+			name:          "never",
+			giveMode:      enforceScopesNever,
+			giveClientCA:  "ca.pem",
+			expectWarning: true,
+		},
+		{
+			name:      "unknown",
+			giveMode:  "sometimes",
+			expectErr: `unknown --enforce-scopes "sometimes"`,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			logger, hook := test.NewNullLogger()
+
+			actual, actualErr := shouldEnforceScopes(logger, tc.giveMode, tc.giveClientCA)
+			if tc.expectErr != "" {
+				assert.EqualError(t, actualErr, tc.expectErr, "error")
+			} else {
+				assert.NoError(t, actualErr, "error")
+			}
+
+			assert.Equal(t, tc.expect, actual, "enforce")
+
+			if tc.expectWarning {
+				if assert.Len(t, hook.AllEntries(), 1, "log entries") {
+					assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level, "level")
+				}
+			} else {
+				assert.Empty(t, hook.AllEntries(), "log entries")
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"net/http"
+
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+)
+
+// activeStreams is the number of streaming RPCs currently being served, i.e. active streaming subscribers.
+var activeStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "racing",
+	Name:      "active_stream_subscribers",
+	Help:      "Number of streaming RPCs currently being served.",
+}, []string{"grpc_method"})
+
+func init() {
+	grpc_prometheus.EnableHandlingTimeHistogram()
+}
+
+// UnaryServerInterceptors returns the interceptors that record metrics for unary RPCs.
+func UnaryServerInterceptors() []grpc.UnaryServerInterceptor {
+	return []grpc.UnaryServerInterceptor{grpc_prometheus.UnaryServerInterceptor}
+}
+
+// StreamServerInterceptors returns the interceptors that record metrics for streaming RPCs.
+func StreamServerInterceptors() []grpc.StreamServerInterceptor {
+	return []grpc.StreamServerInterceptor{grpc_prometheus.StreamServerInterceptor, activeStreamsInterceptor}
+}
+
+// Register initialises the per RPC metrics of all services registered on server, so they are reported before they
+// are first called.
+func Register(server *grpc.Server) {
+	grpc_prometheus.Register(server)
+}
+
+// Handler returns the HTTP handler that serves the metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// activeStreamsInterceptor tracks the number of streams being served.
+func activeStreamsInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	gauge := activeStreams.WithLabelValues(info.FullMethod)
+
+	gauge.Inc()
+	defer gauge.Dec()
+
+	return handler(srv, ss)
+}
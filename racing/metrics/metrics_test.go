@@ -0,0 +1,25 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestActiveStreamsInterceptor(t *testing.T) {
+	t.Parallel()
+
+	info := &grpc.StreamServerInfo{FullMethod: "/racing.Racing/TestActiveStreamsInterceptor"}
+	gauge := activeStreams.WithLabelValues(info.FullMethod)
+
+	err := activeStreamsInterceptor(nil, nil, info, func(srv interface{}, stream grpc.ServerStream) error {
+		assert.Equal(t, float64(1), testutil.ToFloat64(gauge), "active during stream")
+
+		return nil
+	})
+
+	assert.NoError(t, err, "err")
+	assert.Equal(t, float64(0), testutil.ToFloat64(gauge), "active after stream")
+}
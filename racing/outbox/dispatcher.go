@@ -0,0 +1,162 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"git.neds.sh/matty/entain/racing/logging"
+)
+
+var (
+	// deliveredMessages counts the messages delivered to every sink.
+	deliveredMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "racing",
+		Subsystem: "outbox",
+		Name:      "delivered_total",
+		Help:      "Number of outbox messages delivered to every sink.",
+	})
+
+	// failedDispatches counts the dispatches that failed, and will be retried.
+	failedDispatches = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "racing",
+		Subsystem: "outbox",
+		Name:      "dispatch_failures_total",
+		Help:      "Number of outbox dispatches that failed and were retried.",
+	})
+)
+
+// Backoff bounds the delay before a failed dispatch is retried, which starts at Initial and doubles with each
+// consecutive failure up to Max.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// DefaultBackoff is the backoff of dispatchers that aren't given one.
+var DefaultBackoff = Backoff{Initial: time.Second, Max: time.Minute}
+
+// delay returns the delay before retrying after failures consecutive failures.
+func (b Backoff) delay(failures int) time.Duration {
+	delay := b.Initial
+	for i := 1; i < failures && delay < b.Max; i++ {
+		delay *= 2
+	}
+
+	if delay > b.Max {
+		return b.Max
+	}
+
+	return delay
+}
+
+// Dispatcher publishes the messages of a Store to sinks.
+type Dispatcher struct {
+	store     Store
+	sinks     []Sink
+	batchSize int
+	backoff   Backoff
+}
+
+// NewDispatcher creates a Dispatcher publishing the messages of store to sinks, reading up to batchSize messages at a
+// time and retrying failed dispatches after backoff. The batch size and the delays of backoff must be positive, so that
+// dispatches make progress and failed ones aren't retried in a tight loop.
+func NewDispatcher(store Store, sinks []Sink, batchSize int, backoff Backoff) (*Dispatcher, error) {
+	if backoff == (Backoff{}) {
+		backoff = DefaultBackoff
+	}
+
+	if batchSize <= 0 {
+		return nil, errors.New("batch size must be positive")
+	}
+
+	if backoff.Initial <= 0 || backoff.Max <= 0 {
+		return nil, errors.New("backoff must be positive")
+	}
+
+	return &Dispatcher{
+		store:     store,
+		sinks:     sinks,
+		batchSize: batchSize,
+		backoff:   backoff,
+	}, nil
+}
+
+// Run dispatches the pending messages every interval until ctx is done. A failed dispatch is retried after the
+// backoff instead, growing until a dispatch succeeds.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	failures := 0
+
+	for {
+		wait := interval
+
+		if _, err := d.Dispatch(ctx); err != nil && ctx.Err() == nil {
+			failures++
+			failedDispatches.Inc()
+
+			wait = d.backoff.delay(failures)
+			logging.FromContext(ctx).WithError(err).WithField("retry_in", wait.String()).Error("failed dispatching outbox messages")
+		} else {
+			failures = 0
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Dispatch publishes the pending messages in order, marking each delivered once every sink has it, and returns how
+// many it delivered. It stops at the first message it fails to deliver, so that no message is delivered before those
+// written earlier.
+func (d *Dispatcher) Dispatch(ctx context.Context) (int, error) {
+	delivered := 0
+
+	for {
+		messages, err := d.store.PendingMessages(ctx, d.batchSize)
+		if err != nil {
+			return delivered, err
+		}
+
+		for _, message := range messages {
+			if err := d.publish(ctx, message); err != nil {
+				return delivered, fmt.Errorf("message %d: %w", message.ID, err)
+			}
+
+			if err := d.store.MarkDelivered(ctx, message.ID); err != nil {
+				return delivered, fmt.Errorf("message %d: %w", message.ID, err)
+			}
+
+			deliveredMessages.Inc()
+
+			delivered++
+		}
+
+		// A batch that isn't full, or is empty, holds the last of the pending messages.
+		if len(messages) == 0 || len(messages) < d.batchSize {
+			return delivered, nil
+		}
+	}
+}
+
+// publish publishes message to every sink in turn. If one fails, the message is published to every sink again when it
+// is retried, so the sinks before it are sent it twice.
+func (d *Dispatcher) publish(ctx context.Context, message *Message) error {
+	for _, sink := range d.sinks {
+		if err := sink.Publish(ctx, message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+// Package outbox publishes the changes made to races to sinks outside the database, such as message brokers.
+//
+// Each change is written to the outbox table in the same transaction as the change itself, so a message is written if
+// and only if the change is committed. A Dispatcher reads the messages in the order they were written, publishes each
+// to every sink and marks it delivered. A message is marked delivered only once every sink has it, so a sink may be
+// sent a message more than once, after a failure, but is never missed one: delivery is at least once, and consumers
+// tell repeats apart by message ID.
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// RacesTopic is the topic changes to races are published to, as racing.RaceChange messages.
+const RacesTopic = "racing.races"
+
+// Message is a message in the outbox.
+type Message struct {
+	// ID orders messages in the order they were written, and identifies messages delivered more than once.
+	ID int64
+	// Time is when the message was written.
+	Time time.Time
+	// Topic is what the message is about, such as RacesTopic.
+	Topic string
+	// Key identifies the resource the message is about, such as races/1, so that brokers can keep the messages about
+	// each resource in order.
+	Key string
+	// Payload is the JSON form of the message.
+	Payload []byte
+}
+
+// Store holds the messages of the outbox.
+type Store interface {
+	// PendingMessages should return up to limit of the messages not yet delivered, ordered by ID.
+	PendingMessages(ctx context.Context, limit int) ([]*Message, error)
+	// MarkDelivered should mark the message with id delivered, so that it isn't dispatched again.
+	MarkDelivered(ctx context.Context, id int64) error
+}
+
+// Sink is somewhere messages are published to.
+type Sink interface {
+	// Publish should publish message, returning an error unless it is certain to have been published.
+	Publish(ctx context.Context, message *Message) error
+}
+
+// NewRaceMessage returns the message publishing change to RacesTopic, keyed on the resource name of the race. The
+// message has no ID until it is written.
+func NewRaceMessage(change *racing.RaceChange, resource string) (*Message, error) {
+	payload, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(change)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Time:    change.GetTime().AsTime(),
+		Topic:   RacesTopic,
+		Key:     resource,
+		Payload: payload,
+	}, nil
+}
+
+// RaceChange returns the change published by message, a message of RacesTopic.
+func RaceChange(message *Message) (*racing.RaceChange, error) {
+	var change racing.RaceChange
+	if err := protojson.Unmarshal(message.Payload, &change); err != nil {
+		return nil, err
+	}
+
+	return &change, nil
+}
@@ -0,0 +1,312 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStore is a Store of messages, failing to list them with listErr and to mark them with markErr.
+type fakeStore struct {
+	messages  []*Message
+	delivered []int64
+	listErr   error
+	markErr   error
+}
+
+func (s *fakeStore) PendingMessages(_ context.Context, limit int) ([]*Message, error) {
+	if s.listErr != nil {
+		return nil, s.listErr
+	}
+
+	var pending []*Message
+
+	for _, message := range s.messages[len(s.delivered):] {
+		if len(pending) == limit {
+			break
+		}
+
+		pending = append(pending, message)
+	}
+
+	return pending, nil
+}
+
+func (s *fakeStore) MarkDelivered(_ context.Context, id int64) error {
+	if s.markErr != nil {
+		return s.markErr
+	}
+
+	s.delivered = append(s.delivered, id)
+
+	return nil
+}
+
+// fakeSink is a Sink recording the IDs of the messages published to it, failing to publish the message with failID.
+type fakeSink struct {
+	published []int64
+	failID    int64
+}
+
+func (s *fakeSink) Publish(_ context.Context, message *Message) error {
+	if message.ID == s.failID {
+		return errors.New("TestError123")
+	}
+
+	s.published = append(s.published, message.ID)
+
+	return nil
+}
+
+func TestDispatcherDispatch(t *testing.T) {
+	t.Parallel()
+
+	messages := []*Message{{ID: 1}, {ID: 2}, {ID: 3}}
+
+	for _, tc := range []struct {
+		name            string
+		giveStore       *fakeStore
+		giveSink        *fakeSink
+		expect          int
+		expectDelivered []int64
+		expectPublished []int64
+		expectError     string
+	}{
+		{
+			name:            "success",
+			giveStore:       &fakeStore{messages: messages},
+			giveSink:        &fakeSink{},
+			expect:          3,
+			expectDelivered: []int64{1, 2, 3},
+			expectPublished: []int64{1, 2, 3},
+		},
+		{
+			name:      "success_none",
+			giveStore: &fakeStore{},
+			giveSink:  &fakeSink{},
+		},
+		{
+			// Messages after one that fails aren't delivered before it.
+			name:            "publish_err",
+			giveStore:       &fakeStore{messages: messages},
+			giveSink:        &fakeSink{failID: 2},
+			expect:          1,
+			expectDelivered: []int64{1},
+			expectPublished: []int64{1},
+			expectError:     "message 2: TestError123",
+		},
+		{
+			name:        "list_err",
+			giveStore:   &fakeStore{messages: messages, listErr: errors.New("TestError123")},
+			giveSink:    &fakeSink{},
+			expectError: "TestError123",
+		},
+		{
+			// A message published but not marked delivered is published again when retried.
+			name:            "mark_err",
+			giveStore:       &fakeStore{messages: messages, markErr: errors.New("TestError123")},
+			giveSink:        &fakeSink{},
+			expectPublished: []int64{1},
+			expectError:     "message 1: TestError123",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Two sinks are given the same messages, read two at a time.
+			other := &fakeSink{}
+
+			dispatcher, err := NewDispatcher(tc.giveStore, []Sink{other, tc.giveSink}, 2, Backoff{})
+			require.NoError(t, err, "NewDispatcher")
+
+			actual, actualErr := dispatcher.Dispatch(context.Background())
+			assert.Equal(t, tc.expect, actual, "delivered")
+			assert.Equal(t, tc.expectDelivered, tc.giveStore.delivered, "marked delivered")
+			assert.Equal(t, tc.expectPublished, tc.giveSink.published, "published")
+
+			if tc.expectError != "" {
+				assert.EqualError(t, actualErr, tc.expectError, "actualErr")
+			} else {
+				assert.NoError(t, actualErr, "actualErr")
+				assert.Equal(t, tc.expectPublished, other.published, "published to other")
+			}
+		})
+	}
+}
+
+func TestNewDispatcher(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name          string
+		giveBatchSize int
+		giveBackoff   Backoff
+		expectError   string
+	}{
+		{
+			name:          "success",
+			giveBatchSize: 1,
+			giveBackoff:   Backoff{Initial: time.Second, Max: time.Minute},
+		},
+		{
+			name:          "success_default_backoff",
+			giveBatchSize: 1,
+		},
+		{
+			name:        "zero_batch_size",
+			giveBackoff: DefaultBackoff,
+			expectError: "batch size must be positive",
+		},
+		{
+			name:          "negative_batch_size",
+			giveBatchSize: -1,
+			expectError:   "batch size must be positive",
+		},
+		{
+			name:          "zero_max_backoff",
+			giveBatchSize: 1,
+			giveBackoff:   Backoff{Initial: time.Second},
+			expectError:   "backoff must be positive",
+		},
+		{
+			name:          "zero_initial_backoff",
+			giveBatchSize: 1,
+			giveBackoff:   Backoff{Max: time.Minute},
+			expectError:   "backoff must be positive",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual, actualErr := NewDispatcher(&fakeStore{}, nil, tc.giveBatchSize, tc.giveBackoff)
+
+			if tc.expectError != "" {
+				assert.EqualError(t, actualErr, tc.expectError, "actualErr")
+				assert.Nil(t, actual, "actual")
+			} else {
+				assert.NoError(t, actualErr, "actualErr")
+				assert.NotNil(t, actual, "actual")
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	t.Parallel()
+
+	backoff := Backoff{Initial: time.Second, Max: 10 * time.Second}
+
+	for _, tc := range []struct {
+		name         string
+		giveFailures int
+		expect       time.Duration
+	}{
+		{
+			name:         "success_first",
+			giveFailures: 1,
+			expect:       time.Second,
+		},
+		{
+			name:         "success_doubled",
+			giveFailures: 3,
+			expect:       4 * time.Second,
+		},
+		{
+			name:         "success_max",
+			giveFailures: 50,
+			expect:       10 * time.Second,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tc.expect, backoff.delay(tc.giveFailures), "delay")
+		})
+	}
+}
+
+func TestBus(t *testing.T) {
+	t.Parallel()
+
+	bus := NewBus()
+
+	var handled []int64
+
+	bus.Subscribe(RacesTopic, func(_ context.Context, message *Message) error {
+		handled = append(handled, message.ID)
+
+		return nil
+	})
+	bus.Subscribe("other", func(context.Context, *Message) error {
+		return errors.New("TestError123")
+	})
+
+	require.NoError(t, bus.Publish(context.Background(), &Message{ID: 1, Topic: RacesTopic}), "Publish")
+	require.NoError(t, bus.Publish(context.Background(), &Message{ID: 2, Topic: "unsubscribed"}), "Publish unsubscribed")
+	assert.EqualError(t, bus.Publish(context.Background(), &Message{ID: 3, Topic: "other"}), "TestError123", "Publish other")
+
+	assert.Equal(t, []int64{1}, handled, "handled")
+}
+
+// fakeProducer is a Producer recording what it produced.
+type fakeProducer struct {
+	produced []string
+}
+
+func (p *fakeProducer) Produce(_ context.Context, topic string, key, value []byte) error {
+	p.produced = append(p.produced, topic+" "+string(key)+" "+string(value))
+
+	return nil
+}
+
+func TestBrokerSink(t *testing.T) {
+	t.Parallel()
+
+	producer := &fakeProducer{}
+
+	err := NewBrokerSink(producer).Publish(context.Background(), &Message{ID: 1, Topic: RacesTopic, Key: "races/1", Payload: []byte(`{}`)})
+	require.NoError(t, err, "Publish")
+
+	assert.Equal(t, []string{"racing.races races/1 {}"}, producer.produced, "produced")
+}
+
+func TestFileSink(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "outbox.ndjson")
+	written := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+	sink, err := OpenFileSink(path)
+	require.NoError(t, err, "OpenFileSink")
+
+	for _, message := range []*Message{
+		{ID: 1, Time: written, Topic: RacesTopic, Key: "races/1", Payload: []byte(`{"action":"CREATED"}`)},
+		{ID: 2, Time: written, Topic: RacesTopic, Key: "races/2", Payload: []byte(`{"action":"UPDATED"}`)},
+	} {
+		require.NoError(t, sink.Publish(context.Background(), message), "Publish")
+	}
+
+	require.NoError(t, sink.Close(), "Close")
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err, "os.ReadFile")
+
+	expect := []string{
+		`{"id":1,"time":"2021-03-04T05:06:07Z","topic":"racing.races","key":"races/1","payload":{"action":"CREATED"}}`,
+		`{"id":2,"time":"2021-03-04T05:06:07Z","topic":"racing.races","key":"races/2","payload":{"action":"UPDATED"}}`,
+	}
+	assert.Equal(t, expect, strings.Split(strings.TrimSpace(string(b)), "\n"), "lines")
+}
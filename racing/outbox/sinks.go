@@ -0,0 +1,123 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Handler handles the messages published to a Bus.
+type Handler func(ctx context.Context, message *Message) error
+
+// Bus is a Sink publishing messages to handlers in process.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+// NewBus creates a Bus without handlers.
+func NewBus() *Bus {
+	return &Bus{handlers: map[string][]Handler{}}
+}
+
+// Subscribe has handler handle the messages of topic published from now on.
+func (b *Bus) Subscribe(topic string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers[topic] = append(b.handlers[topic], handler)
+}
+
+// Publish has every handler of the topic of message handle it, in the order they subscribed, stopping at the first
+// that fails.
+func (b *Bus) Publish(ctx context.Context, message *Message) error {
+	b.mu.RLock()
+	handlers := b.handlers[message.Topic]
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		if err := handler(ctx, message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Producer produces records to a message broker, such as a NATS subject or a Kafka topic. It is implemented by
+// adapters of the broker's client.
+type Producer interface {
+	// Produce should produce value with key to topic, returning once the broker has acknowledged it.
+	Produce(ctx context.Context, topic string, key, value []byte) error
+}
+
+// BrokerSink is a Sink producing messages to a message broker, each to its topic, keyed so that the broker keeps the
+// messages about each resource in order.
+type BrokerSink struct {
+	producer Producer
+}
+
+// NewBrokerSink creates a BrokerSink producing messages with producer.
+func NewBrokerSink(producer Producer) *BrokerSink {
+	return &BrokerSink{producer: producer}
+}
+
+// Publish produces the payload of message to its topic, keyed on its key.
+func (s *BrokerSink) Publish(ctx context.Context, message *Message) error {
+	return s.producer.Produce(ctx, message.Topic, []byte(message.Key), message.Payload)
+}
+
+// fileRecord is the form a message is written to a file in.
+type fileRecord struct {
+	ID      int64           `json:"id"`
+	Time    time.Time       `json:"time"`
+	Topic   string          `json:"topic"`
+	Key     string          `json:"key"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// FileSink is a Sink appending messages to a file, as a JSON object per line.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenFileSink opens a FileSink appending to the file at path, creating it if it doesn't exist.
+func OpenFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{file: file}, nil
+}
+
+// Publish appends message to the file, syncing it so that the message isn't lost once it is marked delivered.
+func (s *FileSink) Publish(_ context.Context, message *Message) error {
+	line, err := json.Marshal(fileRecord{
+		ID:      message.ID,
+		Time:    message.Time.UTC(),
+		Topic:   message.Topic,
+		Key:     message.Key,
+		Payload: message.Payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
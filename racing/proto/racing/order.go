@@ -0,0 +1,106 @@
+package racing
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RaceOrder is an order to list races in: by a field, descending if Desc is set, and then by ID.
+type RaceOrder struct {
+	// Field is the name of the field in the proto, one of RaceOrderFields. Races are ordered by ID if it is empty.
+	Field string
+	Desc  bool
+}
+
+// RaceOrderFields are the fields races can be ordered by.
+var RaceOrderFields = []string{"id", "meeting_id", "name", "number", "advertised_start_time"}
+
+// ParseRaceOrder parses the order_by of a ListRacesRequest: one of RaceOrderFields, optionally followed by "asc" or
+// "desc". An empty orderBy orders races by ID.
+func ParseRaceOrder(orderBy string) (RaceOrder, error) {
+	words := strings.Fields(orderBy)
+	if len(words) == 0 {
+		return RaceOrder{Field: "id"}, nil
+	}
+
+	order := RaceOrder{Field: words[0]}
+	if !isRaceOrderField(order.Field) {
+		return RaceOrder{}, fmt.Errorf("must be one of %s", strings.Join(RaceOrderFields, ", "))
+	}
+
+	switch {
+	case len(words) == 1:
+	case len(words) == 2 && words[1] == "asc":
+	case len(words) == 2 && words[1] == "desc":
+		order.Desc = true
+	default:
+		return RaceOrder{}, fmt.Errorf(`must be a field, optionally followed by "asc" or "desc"`)
+	}
+
+	return order, nil
+}
+
+func isRaceOrderField(field string) bool {
+	for _, f := range RaceOrderFields {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns o in the form of an order_by, the same for equal orders, such as "name desc".
+func (o RaceOrder) String() string {
+	field := o.Field
+	if field == "" {
+		field = "id"
+	}
+
+	if o.Desc {
+		return field + " desc"
+	}
+
+	return field
+}
+
+// Less reports whether a is listed before b.
+func (o RaceOrder) Less(a, b *Race) bool {
+	c := o.compare(a, b)
+	if o.Desc {
+		c = -c
+	}
+
+	if c != 0 {
+		return c < 0
+	}
+
+	return a.GetId() < b.GetId()
+}
+
+// compare returns -1, 0 or 1 as the field of a is less than, equal to or greater than that of b.
+func (o RaceOrder) compare(a, b *Race) int {
+	switch o.Field {
+	case "meeting_id":
+		return compareInts(a.GetMeetingId(), b.GetMeetingId())
+	case "name":
+		return strings.Compare(a.GetName(), b.GetName())
+	case "number":
+		return compareInts(a.GetNumber(), b.GetNumber())
+	case "advertised_start_time":
+		return compareInts(a.GetAdvertisedStartTime().AsTime().UnixNano(), b.GetAdvertisedStartTime().AsTime().UnixNano())
+	default:
+		return compareInts(a.GetId(), b.GetId())
+	}
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,12 @@
+package racing
+
+import "time"
+
+// DeriveStatus sets the status of x as of now: CLOSED once its advertised start time has passed, and OPEN before.
+func (x *Race) DeriveStatus(now time.Time) {
+	if x.GetAdvertisedStartTime().AsTime().After(now) {
+		x.Status = Race_OPEN
+	} else {
+		x.Status = Race_CLOSED
+	}
+}
@@ -0,0 +1,61 @@
+// Package purge removes deleted races for good once they have been deleted for longer than a retention period, in
+// the style of AIP-164.
+package purge
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"git.neds.sh/matty/entain/racing/logging"
+)
+
+// purgedRaces counts the deleted races removed for good.
+var purgedRaces = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "racing",
+	Subsystem: "purge",
+	Name:      "races_total",
+	Help:      "Number of deleted races purged once their retention period passed.",
+})
+
+// Purger removes deleted races for good.
+type Purger interface {
+	// Purge should remove the races deleted before deletedBefore, returning how many it removed.
+	Purge(ctx context.Context, deletedBefore time.Time) (int, error)
+}
+
+// Run purges the races deleted for longer than retention, straight away and then every interval, until ctx is done.
+func Run(ctx context.Context, purger Purger, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := Once(ctx, purger, retention, time.Now()); err != nil {
+			logging.FromContext(ctx).WithError(err).Error("failed purging deleted races")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Once purges the races deleted for longer than retention at now, returning how many it removed.
+func Once(ctx context.Context, purger Purger, retention time.Duration, now time.Time) (int, error) {
+	purged, err := purger.Purge(ctx, now.Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+
+	purgedRaces.Add(float64(purged))
+
+	if purged > 0 {
+		logging.FromContext(ctx).WithField("retention", retention.String()).Infof("purged %d deleted races", purged)
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,66 @@
+package purge
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakePurger struct {
+	deletedBefore time.Time
+	purged        int
+	err           error
+}
+
+func (p *fakePurger) Purge(_ context.Context, deletedBefore time.Time) (int, error) {
+	p.deletedBefore = deletedBefore
+
+	return p.purged, p.err
+}
+
+func TestOnce(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name        string
+		givePurger  *fakePurger
+		expect      int
+		expectError string
+	}{
+		{
+			name:       "success",
+			givePurger: &fakePurger{purged: 3},
+			expect:     3,
+		},
+		{
+			name:       "success_none",
+			givePurger: &fakePurger{},
+		},
+		{
+			name:        "purge_err",
+			givePurger:  &fakePurger{purged: 3, err: errors.New("TestError123")},
+			expectError: "TestError123",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual, actualErr := Once(context.Background(), tc.givePurger, 24*time.Hour, now)
+			assert.Equal(t, tc.expect, actual, "purged")
+			assert.Equal(t, now.Add(-24*time.Hour), tc.givePurger.deletedBefore, "deletedBefore")
+
+			if tc.expectError != "" {
+				assert.EqualError(t, actualErr, tc.expectError, "actualErr")
+			} else {
+				assert.NoError(t, actualErr, "actualErr")
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"git.neds.sh/matty/entain/racing/logging"
+	"git.neds.sh/matty/entain/racing/seed"
+)
+
+// runSeed runs the seed command, storing generated races or the races of a fixture set in the database, e.g.
+//
+//	racing --database ./db/racing.db seed --seed 42 --races 20 --meetings 2 --now 2021-03-04T00:00:00Z
+//	racing seed --fixture demo
+func runSeed(logger *logrus.Logger, args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+
+	var (
+		seedValue = flags.Int64("seed", 0, "Seed value the races are generated from (0 for a random one, which is logged)")
+		races     = flags.Int("races", seed.Default.Races, "Number of races to generate")
+		firstID   = flags.Int64("first-id", seed.Default.FirstID, "ID of the first race generated")
+		meetings  = flags.Int("meetings", seed.Default.Meetings, "Number of meetings to spread the races across")
+		now       = flags.String("now", "", "RFC 3339 time the start times are relative to (default the current time)")
+		startFrom = flags.Duration("start-from", seed.Default.StartFrom, "Earliest start time, relative to --now")
+		startTo   = flags.Duration("start-to", seed.Default.StartTo, "Latest start time, relative to --now")
+		fixture   = flags.String("fixture", "", "Name of a fixture set in --fixtures-dir to store instead of generated races")
+	)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", flags.Args())
+	}
+
+	cfg := seed.Config{
+		Seed:      *seedValue,
+		Races:     *races,
+		FirstID:   *firstID,
+		Meetings:  *meetings,
+		StartFrom: *startFrom,
+		StartTo:   *startTo,
+	}
+
+	if *now != "" {
+		t, err := time.Parse(time.RFC3339, *now)
+		if err != nil {
+			return fmt.Errorf("invalid --now: %w", err)
+		}
+
+		cfg.Now = t
+	}
+
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+
+	ctx := commandContext(logging.NewContext(context.Background(), logrus.NewEntry(logger)), "racing seed")
+
+	repo, err := openStoredRaces(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	if *fixture != "" {
+		inserted, err := seed.InsertFixture(ctx, repo, *fixturesDir, *fixture, cfg.Now)
+		if err != nil {
+			return err
+		}
+
+		logger.WithField("fixture", *fixture).Infof("stored %d races", len(inserted))
+
+		return nil
+	}
+
+	inserted, err := seed.Insert(ctx, repo, cfg)
+	if err != nil {
+		return err
+	}
+
+	// Races with IDs that are already stored are kept, so fewer races may be stored than were generated.
+	logger.WithField("seed", cfg.Seed).Infof("stored %d of %d generated races", len(inserted), cfg.Races)
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package seed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gopkg.in/yaml.v2"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// fixtureExtensions are the extensions of fixture files, in the order they are looked for. JSON is read as YAML,
+// which it is a subset of.
+var fixtureExtensions = []string{".yaml", ".yml", ".json"}
+
+// fixture is the content of a fixture file.
+type fixture struct {
+	Races []fixtureRace `yaml:"races"`
+}
+
+// fixtureRace is a race in a fixture file. Its start is either an absolute AdvertisedStartTime, or StartsIn relative
+// to the time the fixture is loaded at.
+type fixtureRace struct {
+	ID                  int64          `yaml:"id"`
+	MeetingID           int64          `yaml:"meeting_id"`
+	Name                string         `yaml:"name"`
+	Number              int64          `yaml:"number"`
+	Visible             bool           `yaml:"visible"`
+	AdvertisedStartTime *time.Time     `yaml:"advertised_start_time"`
+	StartsIn            *time.Duration `yaml:"starts_in"`
+}
+
+// LoadFixture loads the races of the fixture set named name, from the file name.yaml, name.yml or name.json in dir.
+// Start times given relative are relative to now, or to the current time if now is zero.
+func LoadFixture(dir, name string, now time.Time) ([]*racing.Race, error) {
+	if name == "" || filepath.Base(name) != name {
+		return nil, fmt.Errorf("invalid fixture name %q", name)
+	}
+
+	for _, ext := range fixtureExtensions {
+		data, err := os.ReadFile(filepath.Join(dir, name+ext))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		races, err := ParseFixture(data, now)
+		if err != nil {
+			return nil, fmt.Errorf("fixture %s: %w", name+ext, err)
+		}
+
+		return races, nil
+	}
+
+	return nil, fmt.Errorf("fixture %s not found in %s", name, dir)
+}
+
+// ParseFixture parses the races of a fixture file. Start times given relative are relative to now, or to the current
+// time if now is zero.
+func ParseFixture(data []byte, now time.Time) ([]*racing.Race, error) {
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var f fixture
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, err
+	}
+
+	races := make([]*racing.Race, 0, len(f.Races))
+	ids := make(map[int64]bool, len(f.Races))
+
+	for i, r := range f.Races {
+		if r.ID < 1 {
+			return nil, fmt.Errorf("race %d: invalid id %d", i, r.ID)
+		}
+
+		if ids[r.ID] {
+			return nil, fmt.Errorf("race %d: duplicate id %d", i, r.ID)
+		}
+
+		ids[r.ID] = true
+
+		var start time.Time
+
+		switch {
+		case r.AdvertisedStartTime != nil && r.StartsIn != nil:
+			return nil, fmt.Errorf("race %d: advertised_start_time and starts_in must not be given together", r.ID)
+		case r.AdvertisedStartTime != nil:
+			start = *r.AdvertisedStartTime
+		case r.StartsIn != nil:
+			start = now.Add(*r.StartsIn)
+		default:
+			return nil, fmt.Errorf("race %d: missing advertised_start_time or starts_in", r.ID)
+		}
+
+		races = append(races, &racing.Race{
+			Id:                  r.ID,
+			MeetingId:           r.MeetingID,
+			Name:                r.Name,
+			Number:              r.Number,
+			Visible:             r.Visible,
+			AdvertisedStartTime: timestamppb.New(start.UTC().Truncate(time.Second)),
+		})
+	}
+
+	return races, nil
+}
+
+// InsertFixture loads the races of the fixture set named name from dir, as LoadFixture does, and inserts them into
+// repo, returning those inserted. Races already stored with the same IDs are kept.
+func InsertFixture(ctx context.Context, repo Inserter, dir, name string, now time.Time) ([]*racing.Race, error) {
+	races, err := LoadFixture(dir, name, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.Insert(ctx, races...)
+}
@@ -0,0 +1,119 @@
+// Package seed generates dummy races for demos and tests, reproducibly from a seed value, and loads races from named
+// fixture files.
+package seed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"syreclabs.com/go/faker"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// Config configures the races generated by Races.
+type Config struct {
+	// Seed decides the races generated; the same Config always generates the same races.
+	Seed int64
+	// Races is how many races are generated.
+	Races int
+	// FirstID is the ID of the first race generated, the others taking the IDs after it.
+	FirstID int64
+	// Meetings is how many meetings the races are spread across, with IDs from 1.
+	Meetings int
+	// Now is the time the start times of the races are relative to. The zero time means the current time.
+	Now time.Time
+	// StartFrom and StartTo bound the advertised start times of the races, relative to Now.
+	StartFrom time.Duration
+	StartTo   time.Duration
+}
+
+// Default is the Config that repositories are seeded with, but for Seed and Now.
+var Default = Config{
+	Races:     100,
+	FirstID:   1,
+	Meetings:  10,
+	StartFrom: -24 * time.Hour,
+	StartTo:   48 * time.Hour,
+}
+
+// maxNumber is the highest number a race is given within its meeting.
+const maxNumber = 12
+
+// Inserter inserts races, returning those it inserted. It is implemented by the repositories of package db.
+type Inserter interface {
+	Insert(ctx context.Context, races ...*racing.Race) ([]*racing.Race, error)
+}
+
+// fakerMu serialises generating races, as faker draws from a single random source that is reseeded each time.
+var fakerMu sync.Mutex
+
+// Validate checks c.
+func (c Config) Validate() error {
+	if c.Races < 0 {
+		return fmt.Errorf("invalid race count %d", c.Races)
+	}
+
+	if c.FirstID < 1 {
+		return fmt.Errorf("invalid first id %d", c.FirstID)
+	}
+
+	if c.Meetings < 1 {
+		return fmt.Errorf("invalid meeting count %d", c.Meetings)
+	}
+
+	if c.StartTo < c.StartFrom {
+		return errors.New("start to must not be before start from")
+	}
+
+	return nil
+}
+
+// Races generates the races configured by cfg. Their start times are whole seconds, as that is all SQLite stores.
+func Races(cfg Config) ([]*racing.Race, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	now := cfg.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	from, to := now.Add(cfg.StartFrom), now.Add(cfg.StartTo)
+
+	fakerMu.Lock()
+	defer fakerMu.Unlock()
+
+	faker.Seed(cfg.Seed)
+
+	races := make([]*racing.Race, cfg.Races)
+
+	for i := range races {
+		races[i] = &racing.Race{
+			Id:                  cfg.FirstID + int64(i),
+			MeetingId:           faker.RandomInt64(1, int64(cfg.Meetings)),
+			Name:                faker.Team().Name(),
+			Number:              faker.RandomInt64(1, maxNumber),
+			Visible:             faker.RandomInt(0, 1) == 1,
+			AdvertisedStartTime: timestamppb.New(faker.Time().Between(from, to).UTC()),
+		}
+	}
+
+	return races, nil
+}
+
+// Insert generates the races configured by cfg and inserts them into repo, returning those inserted. Races already
+// stored with the same IDs are kept.
+func Insert(ctx context.Context, repo Inserter, cfg Config) ([]*racing.Race, error) {
+	races, err := Races(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.Insert(ctx, races...)
+}
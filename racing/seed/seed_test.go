@@ -0,0 +1,202 @@
+package seed
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+func TestRaces(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+	cfg := Config{Seed: 42, Races: 50, FirstID: 11, Meetings: 3, Now: now, StartFrom: -time.Hour, StartTo: 2 * time.Hour}
+
+	races, err := Races(cfg)
+	require.NoError(t, err, "Races")
+	require.Len(t, races, 50, "races")
+
+	for i, race := range races {
+		assert.Equal(t, int64(11+i), race.Id, "id")
+		assert.True(t, race.MeetingId >= 1 && race.MeetingId <= 3, "meeting id %d", race.MeetingId)
+		assert.True(t, race.Number >= 1 && race.Number <= maxNumber, "number %d", race.Number)
+		assert.NotEmpty(t, race.Name, "name")
+
+		start := race.AdvertisedStartTime.AsTime()
+		assert.False(t, start.Before(now.Add(-time.Hour)) || start.After(now.Add(2*time.Hour)), "start %s", start)
+		assert.Equal(t, start.Truncate(time.Second), start, "start whole seconds")
+	}
+
+	// The same config generates the same races, and another seed other races.
+	again, err := Races(cfg)
+	require.NoError(t, err, "Races again")
+	assert.Empty(t, cmp.Diff(races, again, protocmp.Transform()), "races vs again")
+
+	cfg.Seed++
+
+	other, err := Races(cfg)
+	require.NoError(t, err, "Races other seed")
+	assert.NotEmpty(t, cmp.Diff(races, other, protocmp.Transform()), "races vs other")
+}
+
+func TestRacesInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		give        func(cfg *Config)
+		expectError string
+	}{
+		{
+			name:        "races",
+			give:        func(cfg *Config) { cfg.Races = -1 },
+			expectError: "invalid race count -1",
+		},
+		{
+			name:        "first_id",
+			give:        func(cfg *Config) { cfg.FirstID = 0 },
+			expectError: "invalid first id 0",
+		},
+		{
+			name:        "meetings",
+			give:        func(cfg *Config) { cfg.Meetings = 0 },
+			expectError: "invalid meeting count 0",
+		},
+		{
+			name:        "start",
+			give:        func(cfg *Config) { cfg.StartFrom, cfg.StartTo = time.Hour, -time.Hour },
+			expectError: "start to must not be before start from",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := Default
+			tc.give(&cfg)
+
+			_, actualErr := Races(cfg)
+			assert.EqualError(t, actualErr, tc.expectError, "actualErr")
+		})
+	}
+}
+
+func TestLoadFixture(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, time.March, 4, 0, 0, 0, 0, time.UTC)
+
+	expect := []*racing.Race{
+		{
+			Id:                  1,
+			MeetingId:           1,
+			Name:                "One",
+			Number:              1,
+			Visible:             true,
+			AdvertisedStartTime: timestamppb.New(time.Date(2021, time.March, 3, 19, 6, 7, 0, time.UTC)),
+		},
+		{
+			Id:                  2,
+			MeetingId:           1,
+			Name:                "Two",
+			Number:              2,
+			AdvertisedStartTime: timestamppb.New(now.Add(90 * time.Minute)),
+		},
+	}
+
+	for _, tc := range []struct {
+		name        string
+		give        string
+		expect      []*racing.Race
+		expectError string
+	}{
+		{
+			name:   "success_yaml",
+			give:   "meeting",
+			expect: expect,
+		},
+		{
+			name:   "success_json",
+			give:   "meeting_json",
+			expect: expect,
+		},
+		{
+			name:        "not_found",
+			give:        "missing",
+			expectError: "fixture missing not found in testdata",
+		},
+		{
+			name:        "invalid_name",
+			give:        "../meeting",
+			expectError: `invalid fixture name "../meeting"`,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual, actualErr := LoadFixture("testdata", tc.give, now)
+			assert.Empty(t, cmp.Diff(tc.expect, actual, protocmp.Transform()), "expected vs actual")
+
+			if tc.expectError != "" {
+				assert.EqualError(t, actualErr, tc.expectError, "actualErr")
+			} else {
+				assert.NoError(t, actualErr, "actualErr")
+			}
+		})
+	}
+}
+
+func TestParseFixtureInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		give        string
+		expectError string
+	}{
+		{
+			name:        "unknown_field",
+			give:        "races: [{id: 1, starts_in: 1h, colour: red}]",
+			expectError: "yaml: unmarshal errors:\n  line 1: field colour not found in type seed.fixtureRace",
+		},
+		{
+			name:        "invalid_id",
+			give:        "races: [{id: 0, starts_in: 1h}]",
+			expectError: "race 0: invalid id 0",
+		},
+		{
+			name:        "duplicate_id",
+			give:        "races: [{id: 1, starts_in: 1h}, {id: 1, starts_in: 2h}]",
+			expectError: "race 1: duplicate id 1",
+		},
+		{
+			name:        "missing_start",
+			give:        "races: [{id: 1}]",
+			expectError: "race 1: missing advertised_start_time or starts_in",
+		},
+		{
+			name:        "both_starts",
+			give:        "races: [{id: 1, starts_in: 1h, advertised_start_time: 2021-03-04T00:00:00Z}]",
+			expectError: "race 1: advertised_start_time and starts_in must not be given together",
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, actualErr := ParseFixture([]byte(tc.give), time.Now())
+			assert.EqualError(t, actualErr, tc.expectError, "actualErr")
+		})
+	}
+}
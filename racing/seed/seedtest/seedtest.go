@@ -0,0 +1,36 @@
+// Package seedtest seeds repositories for tests, failing the test if it can't.
+package seedtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"git.neds.sh/matty/entain/racing/seed"
+)
+
+// Races generates the races configured by cfg, inserts them into repo, and returns the races inserted.
+func Races(t testing.TB, repo seed.Inserter, cfg seed.Config) []*racing.Race {
+	t.Helper()
+
+	races, err := seed.Insert(context.Background(), repo, cfg)
+	if err != nil {
+		t.Fatalf("seeding races: %s", err)
+	}
+
+	return races
+}
+
+// Fixture loads the fixture set named name from dir, inserts its races into repo, and returns the races inserted.
+// Start times given relative are relative to now.
+func Fixture(t testing.TB, repo seed.Inserter, dir, name string, now time.Time) []*racing.Race {
+	t.Helper()
+
+	races, err := seed.InsertFixture(context.Background(), repo, dir, name, now)
+	if err != nil {
+		t.Fatalf("loading fixture %s: %s", name, err)
+	}
+
+	return races
+}
@@ -1,37 +1,501 @@
 package service
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/apperrors"
 	"git.neds.sh/matty/entain/racing/proto/racing"
+	"git.neds.sh/matty/entain/racing/transfer"
+	"git.neds.sh/matty/entain/racing/watch"
 
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // RacesRepo will be used as repository access to races.
 type RacesRepo interface {
-	// List should return a list of races.
-	List(filter *racing.ListRacesRequestFilter) ([]*racing.Race, error)
+	// List should return a list of races, in order.
+	List(ctx context.Context, filter *racing.ListRacesRequestFilter, order racing.RaceOrder) ([]*racing.Race, error)
+	// Import should create races, or update the races with the same external IDs, committing only if commit is set.
+	Import(ctx context.Context, races []*racing.Race, commit bool) ([]*racing.ImportRaceResult, error)
+	// Update should replace the details of a race, unless etag is set and the race has changed since.
+	Update(ctx context.Context, race *racing.Race, etag string) (*racing.Race, error)
+	// Delete should soft delete a race, unless etag is set and the race has changed since.
+	Delete(ctx context.Context, id int64, etag string) (*racing.Race, error)
+	// Undelete should restore a deleted race, unless etag is set and the race has changed since.
+	Undelete(ctx context.Context, id int64, etag string) (*racing.Race, error)
+}
+
+// AuditLog will be used to read the audit events of changes to races.
+type AuditLog interface {
+	// ListAuditEvents should return up to limit of the audit events matching filter after the event with afterID.
+	ListAuditEvents(ctx context.Context, filter *racing.ListAuditEventsRequestFilter, afterID int64, limit int) ([]*racing.AuditEvent, error)
+}
+
+// RacesWatcher will be used to follow changes to races.
+type RacesWatcher interface {
+	// Watch should return the events to start a watch with, and a stream of the events after them.
+	Watch(resumeAfter uint64) ([]*watch.Event, watch.Stream)
 }
 
 type Racing interface {
 	// ListRaces will return a collection of races.
 	ListRaces(ctx context.Context, in *racing.ListRacesRequest) (*racing.ListRacesResponse, error)
+	// WatchRaces will stream the races, followed by changes to them.
+	WatchRaces(in *racing.WatchRacesRequest, stream racing.Racing_WatchRacesServer) error
+	// ImportRaces will create or update the streamed races by external ID.
+	ImportRaces(stream racing.Racing_ImportRacesServer) error
+	// ExportRaces will stream the races.
+	ExportRaces(in *racing.ExportRacesRequest, stream racing.Racing_ExportRacesServer) error
+	// UpdateRace will replace the details of a race, unless it has changed since the given etag.
+	UpdateRace(ctx context.Context, in *racing.UpdateRaceRequest) (*racing.UpdateRaceResponse, error)
+	// DeleteRace will soft delete a race, unless it has changed since the given etag.
+	DeleteRace(ctx context.Context, in *racing.DeleteRaceRequest) (*racing.DeleteRaceResponse, error)
+	// UndeleteRace will restore a deleted race, unless it has changed since the given etag.
+	UndeleteRace(ctx context.Context, in *racing.UndeleteRaceRequest) (*racing.UndeleteRaceResponse, error)
+	// ListAuditEvents will return the audit events of changes to races.
+	ListAuditEvents(ctx context.Context, in *racing.ListAuditEventsRequest) (*racing.ListAuditEventsResponse, error)
 }
 
+// WatchStartedMetadataKey is the header metadata key WatchRaces sends once a watch has started. A call refused
+// before then is trailers-only, which clients can't otherwise tell apart from an empty header.
+const WatchStartedMetadataKey = "x-watch-started"
+
+// IfMatchMetadataKey is the request metadata key the etag of UpdateRace, DeleteRace and UndeleteRace is read from
+// when the request doesn't set one, as the gateway forwards If-Match headers.
+const IfMatchMetadataKey = "if-match"
+
+// anyEtag is the etag matching every version, as in an If-Match header.
+const anyEtag = "*"
+
+// maxImportRows is the most races ImportRaces takes in a single call.
+const maxImportRows = 10000
+
+// Page sizes of ListAuditEvents.
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// watchRetryAfter is how long a watcher that fell behind is asked to wait before resuming.
+const watchRetryAfter = time.Second
+
 // racingService implements the Racing interface.
 type racingService struct {
-	racesRepo RacesRepo
+	racesRepo    RacesRepo
+	racesWatcher RacesWatcher
+	auditLog     AuditLog
+	// now is the time the statuses of races are derived at, replaced in tests.
+	now func() time.Time
 }
 
 // NewRacingService instantiates and returns a new racingService.
-func NewRacingService(racesRepo RacesRepo) Racing {
-	return &racingService{racesRepo}
+func NewRacingService(racesRepo RacesRepo, racesWatcher RacesWatcher, auditLog AuditLog) Racing {
+	return &racingService{racesRepo, racesWatcher, auditLog, time.Now}
 }
 
 func (s *racingService) ListRaces(ctx context.Context, in *racing.ListRacesRequest) (*racing.ListRacesResponse, error) {
-	races, err := s.racesRepo.List(in.Filter)
+	if err := validateListRacesRequest(in); err != nil {
+		return nil, err
+	}
+
+	// The order was checked by validateListRacesRequest.
+	order, _ := racing.ParseRaceOrder(in.GetOrderBy())
+
+	races, err := s.racesRepo.List(ctx, in.Filter, order)
 	if err != nil {
 		return nil, err
 	}
 
+	s.deriveStatuses(races...)
+
 	return &racing.ListRacesResponse{Races: races}, nil
 }
+
+func (s *racingService) WatchRaces(in *racing.WatchRacesRequest, stream racing.Racing_WatchRacesServer) error {
+	if err := validateWatchRacesRequest(in); err != nil {
+		return err
+	}
+
+	initial, watcher := s.racesWatcher.Watch(in.GetResumeAfter())
+	defer watcher.Stop()
+
+	// Send the header straight away, so the client knows the watch has started even if there are no events yet.
+	if err := stream.SendHeader(metadata.Pairs(WatchStartedMetadataKey, "true")); err != nil {
+		return err
+	}
+
+	send := func(event *watch.Event) error {
+		filtered, ok := filterEvent(event, in.GetFilter())
+		if !ok {
+			return nil
+		}
+
+		return stream.Send(&racing.WatchRacesResponse{Event: filtered})
+	}
+
+	for _, event := range initial {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+
+	ctx := stream.Context()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case event, ok := <-watcher.Events():
+			if !ok {
+				if err := watcher.Err(); errors.Is(err, watch.ErrFellBehind) {
+					return apperrors.Unavailable(err, watchRetryAfter)
+				}
+
+				return nil
+			}
+
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *racingService) ImportRaces(stream racing.Racing_ImportRacesServer) error {
+	var (
+		rows   []transfer.Row
+		dryRun bool
+	)
+
+	for {
+		in, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if len(rows) == maxImportRows {
+			return apperrors.InvalidArgument(apperrors.FieldViolation{
+				Field:       "race",
+				Description: fmt.Sprintf("must not be sent more than %d times", maxImportRows),
+			})
+		}
+
+		if len(rows) == 0 {
+			dryRun = in.GetDryRun()
+		}
+
+		rows = append(rows, transfer.Row{Race: in.GetRace()})
+	}
+
+	response, err := transfer.Import(stream.Context(), s.racesRepo, rows, dryRun)
+	if err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(response)
+}
+
+func (s *racingService) ExportRaces(in *racing.ExportRacesRequest, stream racing.Racing_ExportRacesServer) error {
+	if err := validateFilter(in.GetFilter()); err != nil {
+		return err
+	}
+
+	races, err := s.racesRepo.List(stream.Context(), in.GetFilter(), racing.RaceOrder{})
+	if err != nil {
+		return err
+	}
+
+	s.deriveStatuses(races...)
+
+	for _, race := range races {
+		if err := stream.Send(&racing.ExportRacesResponse{Race: race}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *racingService) UpdateRace(ctx context.Context, in *racing.UpdateRaceRequest) (*racing.UpdateRaceResponse, error) {
+	if err := validateUpdateRaceRequest(in); err != nil {
+		return nil, err
+	}
+
+	etag, err := requestEtag(ctx, in.GetEtag())
+	if err != nil {
+		return nil, err
+	}
+
+	race, err := s.racesRepo.Update(ctx, in.GetRace(), etag)
+	if err != nil {
+		return nil, err
+	}
+
+	s.deriveStatuses(race)
+
+	return &racing.UpdateRaceResponse{Race: race}, nil
+}
+
+func (s *racingService) DeleteRace(ctx context.Context, in *racing.DeleteRaceRequest) (*racing.DeleteRaceResponse, error) {
+	if in.GetId() <= 0 {
+		return nil, apperrors.InvalidArgument(apperrors.FieldViolation{Field: "id", Description: "must be greater than 0"})
+	}
+
+	etag, err := requestEtag(ctx, in.GetEtag())
+	if err != nil {
+		return nil, err
+	}
+
+	race, err := s.racesRepo.Delete(ctx, in.GetId(), etag)
+	if err != nil {
+		return nil, err
+	}
+
+	s.deriveStatuses(race)
+
+	return &racing.DeleteRaceResponse{Race: race}, nil
+}
+
+func (s *racingService) UndeleteRace(ctx context.Context, in *racing.UndeleteRaceRequest) (*racing.UndeleteRaceResponse, error) {
+	if in.GetId() <= 0 {
+		return nil, apperrors.InvalidArgument(apperrors.FieldViolation{Field: "id", Description: "must be greater than 0"})
+	}
+
+	etag, err := requestEtag(ctx, in.GetEtag())
+	if err != nil {
+		return nil, err
+	}
+
+	race, err := s.racesRepo.Undelete(ctx, in.GetId(), etag)
+	if err != nil {
+		return nil, err
+	}
+
+	s.deriveStatuses(race)
+
+	return &racing.UndeleteRaceResponse{Race: race}, nil
+}
+
+func (s *racingService) ListAuditEvents(ctx context.Context, in *racing.ListAuditEventsRequest) (*racing.ListAuditEventsResponse, error) {
+	if err := validateListAuditEventsRequest(in); err != nil {
+		return nil, err
+	}
+
+	pageSize := int(in.GetPageSize())
+	if pageSize == 0 {
+		pageSize = defaultAuditPageSize
+	}
+
+	events, err := s.auditLog.ListAuditEvents(ctx, in.GetFilter(), in.GetAfterId(), pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &racing.ListAuditEventsResponse{Events: events}, nil
+}
+
+// deriveStatuses derives the statuses of races as they are read, after any cache of the repository, so that they
+// are never stale.
+func (s *racingService) deriveStatuses(races ...*racing.Race) {
+	now := s.now()
+
+	for _, race := range races {
+		race.DeriveStatus(now)
+	}
+}
+
+// requestEtag returns the etag a write must match, which is etag if set, or the if-match metadata of ctx otherwise.
+// It is empty if the write is unconditional.
+func requestEtag(ctx context.Context, etag string) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if values := md.Get(IfMatchMetadataKey); len(values) > 0 {
+		switch {
+		case len(values) > 1:
+			return "", apperrors.InvalidArgument(apperrors.FieldViolation{Field: IfMatchMetadataKey, Description: "must be set once"})
+		case etag == "":
+			etag = values[0]
+		case etag != values[0]:
+			return "", apperrors.InvalidArgument(apperrors.FieldViolation{Field: "etag", Description: "must match " + IfMatchMetadataKey})
+		}
+	}
+
+	if etag == anyEtag {
+		return "", nil
+	}
+
+	return etag, nil
+}
+
+// filterEvent returns event as seen by a watch of the races included by filter, and whether it is seen at all. A race
+// updated so that it is no longer included is seen as deleted, and one updated so that it is included is seen as
+// created.
+func filterEvent(event *watch.Event, filter *racing.ListRacesRequestFilter) (*racing.RaceEvent, bool) {
+	matches := matchesFilter(event.Race, filter)
+
+	if event.Type != racing.RaceEvent_UPDATED || event.Previous == nil {
+		return event.RaceEvent, matches
+	}
+
+	switch matched := matchesFilter(event.Previous, filter); {
+	case matched && !matches:
+		return &racing.RaceEvent{Sequence: event.Sequence, Type: racing.RaceEvent_DELETED, Race: event.Race}, true
+	case !matched && matches:
+		return &racing.RaceEvent{Sequence: event.Sequence, Type: racing.RaceEvent_CREATED, Race: event.Race}, true
+	}
+
+	return event.RaceEvent, matches
+}
+
+// matchesFilter reports whether race is included by filter.
+func matchesFilter(race *racing.Race, filter *racing.ListRacesRequestFilter) bool {
+	if len(filter.GetMeetingIds()) == 0 {
+		return true
+	}
+
+	for _, meetingID := range filter.GetMeetingIds() {
+		if race.GetMeetingId() == meetingID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateListRacesRequest returns an apperrors.InvalidArgumentError describing each invalid field of in.
+func validateListRacesRequest(in *racing.ListRacesRequest) error {
+	violations := filterViolations(in.GetFilter())
+
+	if _, err := racing.ParseRaceOrder(in.GetOrderBy()); err != nil {
+		violations = append(violations, apperrors.FieldViolation{Field: "order_by", Description: err.Error()})
+	}
+
+	if len(violations) > 0 {
+		return apperrors.InvalidArgument(violations...)
+	}
+
+	return nil
+}
+
+// validateWatchRacesRequest returns an apperrors.InvalidArgumentError describing each invalid field of in.
+func validateWatchRacesRequest(in *racing.WatchRacesRequest) error {
+	// Watches follow the races that aren't deleted, which see deleted races as removed.
+	if in.GetFilter().GetShowDeleted() {
+		return apperrors.InvalidArgument(apperrors.FieldViolation{Field: "filter.show_deleted", Description: "must not be set when watching"})
+	}
+
+	return validateFilter(in.GetFilter())
+}
+
+// validateUpdateRaceRequest returns an apperrors.InvalidArgumentError describing each invalid field of in.
+func validateUpdateRaceRequest(in *racing.UpdateRaceRequest) error {
+	race := in.GetRace()
+	if race == nil {
+		return apperrors.InvalidArgument(apperrors.FieldViolation{Field: "race", Description: "must be set"})
+	}
+
+	var violations []apperrors.FieldViolation
+
+	invalid := func(field, description string) {
+		violations = append(violations, apperrors.FieldViolation{Field: "race." + field, Description: description})
+	}
+
+	if race.GetId() <= 0 {
+		invalid("id", "must be greater than 0")
+	}
+
+	if race.GetMeetingId() <= 0 {
+		invalid("meeting_id", "must be greater than 0")
+	}
+
+	if race.GetName() == "" {
+		invalid("name", "must be set")
+	}
+
+	if race.GetNumber() <= 0 {
+		invalid("number", "must be greater than 0")
+	}
+
+	if start := race.GetAdvertisedStartTime(); start == nil {
+		invalid("advertised_start_time", "must be set")
+	} else if err := start.CheckValid(); err != nil {
+		invalid("advertised_start_time", err.Error())
+	}
+
+	if len(violations) > 0 {
+		return apperrors.InvalidArgument(violations...)
+	}
+
+	return nil
+}
+
+// validateListAuditEventsRequest returns an apperrors.InvalidArgumentError describing each invalid field of in.
+func validateListAuditEventsRequest(in *racing.ListAuditEventsRequest) error {
+	var violations []apperrors.FieldViolation
+
+	invalid := func(field, description string) {
+		violations = append(violations, apperrors.FieldViolation{Field: field, Description: description})
+	}
+
+	if size := in.GetPageSize(); size < 0 || size > maxAuditPageSize {
+		invalid("page_size", fmt.Sprintf("must be between 0 and %d", maxAuditPageSize))
+	}
+
+	if in.GetAfterId() < 0 {
+		invalid("after_id", "must not be negative")
+	}
+
+	filter := in.GetFilter()
+
+	if err := filter.GetStartTime().CheckValid(); filter.GetStartTime() != nil && err != nil {
+		invalid("filter.start_time", err.Error())
+	}
+
+	if err := filter.GetEndTime().CheckValid(); filter.GetEndTime() != nil && err != nil {
+		invalid("filter.end_time", err.Error())
+	}
+
+	if start, end := filter.GetStartTime(), filter.GetEndTime(); start != nil && end != nil && !start.AsTime().Before(end.AsTime()) {
+		invalid("filter.end_time", "must be after filter.start_time")
+	}
+
+	if len(violations) > 0 {
+		return apperrors.InvalidArgument(violations...)
+	}
+
+	return nil
+}
+
+// validateFilter returns an apperrors.InvalidArgumentError describing each invalid field of filter.
+func validateFilter(filter *racing.ListRacesRequestFilter) error {
+	if violations := filterViolations(filter); len(violations) > 0 {
+		return apperrors.InvalidArgument(violations...)
+	}
+
+	return nil
+}
+
+// filterViolations returns a violation for each invalid field of filter.
+func filterViolations(filter *racing.ListRacesRequestFilter) []apperrors.FieldViolation {
+	var violations []apperrors.FieldViolation
+
+	for i, meetingID := range filter.GetMeetingIds() {
+		if meetingID <= 0 {
+			violations = append(violations, apperrors.FieldViolation{
+				Field:       fmt.Sprintf("filter.meeting_ids[%d]", i),
+				Description: "must be greater than 0",
+			})
+		}
+	}
+
+	return violations
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/cache"
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"git.neds.sh/matty/entain/racing/watch"
+)
+
+func TestFilterEvent(t *testing.T) {
+	t.Parallel()
+
+	filter := &racing.ListRacesRequestFilter{MeetingIds: []int64{1}}
+	included := &racing.Race{Id: 1, MeetingId: 1}
+	excluded := &racing.Race{Id: 1, MeetingId: 2}
+
+	for _, tc := range []struct {
+		name         string
+		giveType     racing.RaceEvent_Type
+		giveRace     *racing.Race
+		givePrevious *racing.Race
+		expectType   racing.RaceEvent_Type
+		expectOK     bool
+	}{
+		{
+			name:       "success_created",
+			giveType:   racing.RaceEvent_CREATED,
+			giveRace:   included,
+			expectType: racing.RaceEvent_CREATED,
+			expectOK:   true,
+		},
+		{
+			name:     "created_excluded",
+			giveType: racing.RaceEvent_CREATED,
+			giveRace: excluded,
+		},
+		{
+			name:         "success_updated",
+			giveType:     racing.RaceEvent_UPDATED,
+			giveRace:     included,
+			givePrevious: included,
+			expectType:   racing.RaceEvent_UPDATED,
+			expectOK:     true,
+		},
+		{
+			name:         "updated_excluded",
+			giveType:     racing.RaceEvent_UPDATED,
+			giveRace:     excluded,
+			givePrevious: excluded,
+		},
+		{
+			// A race that leaves the filter is deleted from the watch.
+			name:         "success_updated_out",
+			giveType:     racing.RaceEvent_UPDATED,
+			giveRace:     excluded,
+			givePrevious: included,
+			expectType:   racing.RaceEvent_DELETED,
+			expectOK:     true,
+		},
+		{
+			// A race that enters the filter is created in the watch.
+			name:         "success_updated_in",
+			giveType:     racing.RaceEvent_UPDATED,
+			giveRace:     included,
+			givePrevious: excluded,
+			expectType:   racing.RaceEvent_CREATED,
+			expectOK:     true,
+		},
+		{
+			name:       "success_deleted",
+			giveType:   racing.RaceEvent_DELETED,
+			giveRace:   included,
+			expectType: racing.RaceEvent_DELETED,
+			expectOK:   true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			event := &watch.Event{
+				RaceEvent: &racing.RaceEvent{Sequence: 7, Type: tc.giveType, Race: tc.giveRace},
+				Previous:  tc.givePrevious,
+			}
+
+			actual, actualOK := filterEvent(event, filter)
+			assert.Equal(t, tc.expectOK, actualOK, "ok")
+
+			if tc.expectOK {
+				assert.Equal(t, tc.expectType, actual.Type, "type")
+				assert.Equal(t, uint64(7), actual.Sequence, "sequence")
+				assert.Equal(t, tc.giveRace, actual.Race, "race")
+			}
+		})
+	}
+}
+
+// fakeRacesRepo is a RacesRepo listing races, recording the order of the last listing.
+type fakeRacesRepo struct {
+	RacesRepo
+	races []*racing.Race
+	order racing.RaceOrder
+}
+
+func (r *fakeRacesRepo) List(_ context.Context, _ *racing.ListRacesRequestFilter, order racing.RaceOrder) ([]*racing.Race, error) {
+	r.order = order
+
+	return r.races, nil
+}
+
+func TestListRacesOrder(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		giveOrderBy string
+		expect      racing.RaceOrder
+		expectError string
+	}{
+		{
+			name:   "success_default",
+			expect: racing.RaceOrder{Field: "id"},
+		},
+		{
+			name:        "success_asc",
+			giveOrderBy: "name asc",
+			expect:      racing.RaceOrder{Field: "name"},
+		},
+		{
+			name:        "success_desc",
+			giveOrderBy: " advertised_start_time  desc ",
+			expect:      racing.RaceOrder{Field: "advertised_start_time", Desc: true},
+		},
+		{
+			name:        "unknown_field",
+			giveOrderBy: "visible",
+			expectError: "invalid argument: order_by: must be one of id, meeting_id, name, number, advertised_start_time",
+		},
+		{
+			name:        "unknown_direction",
+			giveOrderBy: "name up",
+			expectError: `invalid argument: order_by: must be a field, optionally followed by "asc" or "desc"`,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			repo := &fakeRacesRepo{}
+
+			_, err := NewRacingService(repo, nil, nil).ListRaces(context.Background(), &racing.ListRacesRequest{OrderBy: tc.giveOrderBy})
+
+			if tc.expectError != "" {
+				assert.EqualError(t, err, tc.expectError, "err")
+				return
+			}
+
+			require.NoError(t, err, "ListRaces")
+			assert.Equal(t, tc.expect, repo.order, "order")
+		})
+	}
+}
+
+func TestListRacesCachedStatus(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+	repo := db.NewMemoryRacesRepo(&racing.Race{Id: 1, AdvertisedStartTime: timestamppb.New(now.Add(time.Minute))})
+
+	service := NewRacingService(cache.NewRacesRepo(repo, 10, time.Hour), nil, nil).(*racingService)
+	service.now = func() time.Time { return now }
+
+	listStatuses := func() map[int64]racing.Race_Status {
+		t.Helper()
+
+		actual, err := service.ListRaces(context.Background(), &racing.ListRacesRequest{})
+		require.NoError(t, err, "ListRaces")
+
+		statuses := map[int64]racing.Race_Status{}
+		for _, race := range actual.GetRaces() {
+			statuses[race.GetId()] = race.GetStatus()
+		}
+
+		return statuses
+	}
+
+	assert.Equal(t, map[int64]racing.Race_Status{1: racing.Race_OPEN}, listStatuses(), "before the start")
+
+	// A race inserted behind the cache's back shows whether the races that follow are listed from the cache.
+	_, err := repo.Insert(context.Background(), &racing.Race{Id: 2, AdvertisedStartTime: timestamppb.New(now)})
+	require.NoError(t, err, "Insert")
+
+	now = now.Add(2 * time.Minute)
+
+	assert.Equal(t, map[int64]racing.Race_Status{1: racing.Race_CLOSED}, listStatuses(), "cached after the start")
+}
+
+func TestListRacesStatus(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name         string
+		giveStart    time.Time
+		expectStatus racing.Race_Status
+	}{
+		{
+			name:         "success_open",
+			giveStart:    now.Add(time.Minute),
+			expectStatus: racing.Race_OPEN,
+		},
+		{
+			name:         "success_closed",
+			giveStart:    now.Add(-time.Minute),
+			expectStatus: racing.Race_CLOSED,
+		},
+		{
+			// A race closes as it starts.
+			name:         "success_starting",
+			giveStart:    now,
+			expectStatus: racing.Race_CLOSED,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			repo := &fakeRacesRepo{races: []*racing.Race{{Id: 1, AdvertisedStartTime: timestamppb.New(tc.giveStart)}}}
+
+			service := NewRacingService(repo, nil, nil).(*racingService)
+			service.now = func() time.Time { return now }
+
+			actual, err := service.ListRaces(context.Background(), &racing.ListRacesRequest{})
+			require.NoError(t, err, "ListRaces")
+
+			if assert.Len(t, actual.GetRaces(), 1, "races") {
+				assert.Equal(t, tc.expectStatus, actual.GetRaces()[0].GetStatus(), "status")
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+const (
+	// ExporterNone disables exporting spans. Trace context is still propagated.
+	ExporterNone = "none"
+	// ExporterStdout writes spans to stdout.
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends spans to an OTLP collector over gRPC.
+	ExporterOTLP = "otlp"
+)
+
+// Config configures how spans are exported.
+type Config struct {
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string
+	// Exporter is one of ExporterNone, ExporterStdout or ExporterOTLP.
+	Exporter string
+	// OTLPEndpoint is the host:port of the OTLP collector, used by ExporterOTLP.
+	OTLPEndpoint string
+	// Writer is where ExporterStdout writes to. Defaults to stdout.
+	Writer io.Writer
+}
+
+// Setup installs the global tracer provider and W3C trace context propagator. The provider is installed whatever the
+// exporter, so that spans are recorded with IDs that are logged and propagated, even when they aren't exported. The
+// returned func flushes any buffered spans and should be called on shutdown.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+
+	switch cfg.Exporter {
+	case ExporterNone, "":
+	case ExporterStdout:
+		opts := []stdouttrace.Option{}
+		if cfg.Writer != nil {
+			opts = append(opts, stdouttrace.WithWriter(cfg.Writer))
+		}
+
+		var err error
+
+		exporter, err = stdouttrace.New(opts...)
+		if err != nil {
+			return nil, err
+		}
+	case ExporterOTLP:
+		var err error
+
+		exporter, err = otlptracegrpc.New(
+			ctx,
+			otlptracegrpc.WithEndpoint(cfg.OTLPEndpoint),
+			otlptracegrpc.WithInsecure(),
+		)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(cfg.ServiceName),
+		)),
+	}
+
+	if exporter != nil {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	provider := sdktrace.NewTracerProvider(opts...)
+
+	otel.SetTracerProvider(provider)
+
+	// Without an exporter there is nothing to flush, and providers without span processors fail to shut down.
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	return provider.Shutdown, nil
+}
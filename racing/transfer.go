@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"git.neds.sh/matty/entain/racing/logging"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"git.neds.sh/matty/entain/racing/transfer"
+)
+
+// runImport runs the import command, creating or updating the races of a file by external ID and reporting on each,
+// e.g.
+//
+//	racing import --dry-run races.csv
+//	racing import --format ndjson - < races.ndjson
+func runImport(logger *logrus.Logger, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+
+	var (
+		format = flags.String("format", "", "Format of the file (csv, json, ndjson); by default its extension")
+		dryRun = flags.Bool("dry-run", false, "Report what the import would do without storing anything")
+	)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a file to import, or - for stdin")
+	}
+
+	path := flags.Arg(0)
+
+	if *format == "" {
+		var err error
+		if *format, err = transfer.FormatOf(path); err != nil {
+			return err
+		}
+	}
+
+	in := io.Reader(os.Stdin)
+
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		in = file
+	}
+
+	rows, err := transfer.Decode(*format, in)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	ctx := commandContext(logging.NewContext(context.Background(), logrus.NewEntry(logger)), "racing import")
+
+	repo, err := openStoredRaces(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	response, err := transfer.Import(ctx, repo, rows, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range response.Rows {
+		fmt.Println(reportRow(row))
+	}
+
+	fmt.Printf("%d created, %d updated, %d invalid\n", response.Created, response.Updated, response.Invalid)
+
+	switch {
+	case response.Invalid > 0:
+		return fmt.Errorf("%d invalid races, nothing was stored", response.Invalid)
+	case !response.Committed:
+		fmt.Println("dry run, nothing was stored")
+	}
+
+	return nil
+}
+
+// reportRow describes the outcome of importing a row.
+func reportRow(row *racing.ImportRaceResult) string {
+	prefix := fmt.Sprintf("row %d (%s): ", row.Row, row.ExternalId)
+
+	switch row.Outcome {
+	case racing.ImportRaceResult_INVALID:
+		return prefix + "invalid: " + strings.Join(row.Errors, "; ")
+	case racing.ImportRaceResult_CREATED:
+		if row.Id == 0 {
+			return prefix + "created"
+		}
+
+		return prefix + fmt.Sprintf("created race %d", row.Id)
+	default:
+		if row.Id == 0 {
+			return prefix + "updated"
+		}
+
+		return prefix + fmt.Sprintf("updated race %d", row.Id)
+	}
+}
+
+// runExport runs the export command, writing the stored races to a file, e.g.
+//
+//	racing export races.csv
+//	racing export --format json --meeting-ids 1,2 -
+func runExport(logger *logrus.Logger, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+
+	var (
+		format     = flags.String("format", "", "Format of the file (csv, json, ndjson); by default its extension, or csv for stdout")
+		meetingIDs = flags.String("meeting-ids", "", "Comma separated IDs of the meetings to export the races of (default all)")
+	)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a file to export to, or - for stdout")
+	}
+
+	path := flags.Arg(0)
+
+	if *format == "" {
+		*format = transfer.FormatCSV
+
+		if path != "-" {
+			var err error
+			if *format, err = transfer.FormatOf(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	filter := &racing.ListRacesRequestFilter{}
+
+	if *meetingIDs != "" {
+		for _, value := range strings.Split(*meetingIDs, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid meeting id %q", value)
+			}
+
+			filter.MeetingIds = append(filter.MeetingIds, id)
+		}
+	}
+
+	ctx := logging.NewContext(context.Background(), logrus.NewEntry(logger))
+
+	repo, err := openStoredRaces(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	races, err := repo.List(ctx, filter, racing.RaceOrder{})
+	if err != nil {
+		return err
+	}
+
+	out := io.Writer(os.Stdout)
+
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		out = file
+	}
+
+	encoder, err := transfer.NewEncoder(*format, out)
+	if err != nil {
+		return err
+	}
+
+	for _, race := range races {
+		if err := encoder.Encode(race); err != nil {
+			return err
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+
+	logger.Infof("exported %d races", len(races))
+
+	return nil
+}
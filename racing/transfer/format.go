@@ -0,0 +1,345 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// Formats of the files races are imported from and exported to.
+const (
+	// FormatCSV is a CSV file with a header row naming the columns, which are those of csvColumns in any order.
+	FormatCSV = "csv"
+	// FormatJSON is a JSON array of races.
+	FormatJSON = "json"
+	// FormatNDJSON is a race per line, as JSON.
+	FormatNDJSON = "ndjson"
+)
+
+// csvColumns are the columns of CSV files. Timestamps are RFC 3339.
+var csvColumns = []string{"id", "external_id", "meeting_id", "name", "number", "visible", "advertised_start_time"}
+
+// jsonOptions encode races with their field names in the proto, as the CSV columns are named.
+var jsonOptions = protojson.MarshalOptions{UseProtoNames: true}
+
+// FormatOf returns the format of the file at path, by its extension.
+func FormatOf(path string) (string, error) {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+
+	switch ext {
+	case FormatCSV, FormatJSON, FormatNDJSON:
+		return ext, nil
+	case "jsonl":
+		return FormatNDJSON, nil
+	default:
+		return "", fmt.Errorf("unknown format of %s", path)
+	}
+}
+
+// Decode reads the races of r, in format, as rows to import. Races that can't be read are returned with the errors
+// found reading them, while a file that can't be read at all returns an error.
+func Decode(format string, r io.Reader) ([]Row, error) {
+	switch format {
+	case FormatCSV:
+		return decodeCSV(r)
+	case FormatJSON:
+		return decodeJSON(r)
+	case FormatNDJSON:
+		return decodeNDJSON(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func decodeCSV(r io.Reader) ([]Row, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int, len(header))
+
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if !contains(csvColumns, name) {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+
+		columns[name] = i
+	}
+
+	var rows []Row
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, decodeRecord(record, columns))
+	}
+}
+
+// decodeRecord reads a race from record, whose fields are at the indexes of columns.
+func decodeRecord(record []string, columns map[string]int) Row {
+	var row Row
+
+	field := func(name string) string {
+		if i, ok := columns[name]; ok {
+			return strings.TrimSpace(record[i])
+		}
+
+		return ""
+	}
+
+	parseInt := func(name string) int64 {
+		value := field(name)
+		if value == "" {
+			return 0
+		}
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			row.Errors = append(row.Errors, fmt.Sprintf("%s: invalid integer %q", name, value))
+		}
+
+		return n
+	}
+
+	row.Race = &racing.Race{
+		Id:         parseInt("id"),
+		ExternalId: field("external_id"),
+		MeetingId:  parseInt("meeting_id"),
+		Name:       field("name"),
+		Number:     parseInt("number"),
+	}
+
+	if value := field("visible"); value != "" {
+		visible, err := strconv.ParseBool(value)
+		if err != nil {
+			row.Errors = append(row.Errors, fmt.Sprintf("visible: invalid boolean %q", value))
+		}
+
+		row.Race.Visible = visible
+	}
+
+	if value := field("advertised_start_time"); value != "" {
+		start, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			row.Errors = append(row.Errors, fmt.Sprintf("advertised_start_time: invalid RFC 3339 time %q", value))
+		} else {
+			row.Race.AdvertisedStartTime = timestamppb.New(start)
+		}
+	}
+
+	return row
+}
+
+func decodeJSON(r io.Reader) ([]Row, error) {
+	var messages []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&messages); err != nil {
+		return nil, err
+	}
+
+	rows := make([]Row, len(messages))
+	for i, message := range messages {
+		rows[i] = decodeRace(message)
+	}
+
+	return rows, nil
+}
+
+func decodeNDJSON(r io.Reader) ([]Row, error) {
+	var rows []Row
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		rows = append(rows, decodeRace(line))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// decodeRace reads a race from its JSON encoding.
+func decodeRace(data []byte) Row {
+	race := &racing.Race{}
+	if err := protojson.Unmarshal(data, race); err != nil {
+		// Keep the external ID if it can be read, so the row can be told apart in the report.
+		var ids struct {
+			ExternalID string `json:"external_id"`
+		}
+
+		_ = json.Unmarshal(data, &ids)
+
+		return Row{Race: &racing.Race{ExternalId: ids.ExternalID}, Errors: []string{err.Error()}}
+	}
+
+	return Row{Race: race}
+}
+
+// Encoder writes races to a file in a format.
+type Encoder interface {
+	// Encode writes race.
+	Encode(race *racing.Race) error
+	// Close finishes the file, without closing the writer it is written to.
+	Close() error
+}
+
+// NewEncoder returns an Encoder writing races to w in format.
+func NewEncoder(format string, w io.Writer) (Encoder, error) {
+	switch format {
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(csvColumns); err != nil {
+			return nil, err
+		}
+
+		return &csvEncoder{writer: writer}, nil
+	case FormatJSON:
+		return &jsonEncoder{w: w}, nil
+	case FormatNDJSON:
+		return &ndjsonEncoder{w: w}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+type csvEncoder struct {
+	writer *csv.Writer
+}
+
+func (e *csvEncoder) Encode(race *racing.Race) error {
+	var start string
+	if race.AdvertisedStartTime != nil {
+		start = race.AdvertisedStartTime.AsTime().Format(time.RFC3339)
+	}
+
+	return e.writer.Write([]string{
+		strconv.FormatInt(race.Id, 10),
+		race.ExternalId,
+		strconv.FormatInt(race.MeetingId, 10),
+		race.Name,
+		strconv.FormatInt(race.Number, 10),
+		strconv.FormatBool(race.Visible),
+		start,
+	})
+}
+
+func (e *csvEncoder) Close() error {
+	e.writer.Flush()
+
+	return e.writer.Error()
+}
+
+type jsonEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonEncoder) Encode(race *racing.Race) error {
+	data, err := marshalRace(race)
+	if err != nil {
+		return err
+	}
+
+	prefix := ",\n  "
+	if e.count == 0 {
+		prefix = "[\n  "
+	}
+
+	e.count++
+
+	_, err = io.WriteString(e.w, prefix+string(data))
+
+	return err
+}
+
+func (e *jsonEncoder) Close() error {
+	end := "\n]\n"
+	if e.count == 0 {
+		end = "[]\n"
+	}
+
+	_, err := io.WriteString(e.w, end)
+
+	return err
+}
+
+type ndjsonEncoder struct {
+	w io.Writer
+}
+
+func (e *ndjsonEncoder) Encode(race *racing.Race) error {
+	data, err := marshalRace(race)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(append(data, '\n'))
+
+	return err
+}
+
+func (*ndjsonEncoder) Close() error {
+	return nil
+}
+
+// marshalRace returns the JSON encoding of race, without the whitespace protojson randomly adds.
+func marshalRace(race *racing.Race) ([]byte, error) {
+	data, err := jsonOptions.Marshal(race)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,197 @@
+package transfer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	start := timestamppb.New(time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC))
+
+	for _, tc := range []struct {
+		name        string
+		giveFormat  string
+		give        string
+		expect      []Row
+		expectError string
+	}{
+		{
+			name:       "success_csv",
+			giveFormat: FormatCSV,
+			give: "external_id,meeting_id,name,number,visible,advertised_start_time\n" +
+				"A,1,Melbourne Cup,7,true,2021-03-04T05:06:07Z\n" +
+				"B,1,\"Sprint, Maiden\",8,,2021-03-04T15:06:07+10:00\n",
+			expect: []Row{
+				{Race: &racing.Race{ExternalId: "A", MeetingId: 1, Name: "Melbourne Cup", Number: 7, Visible: true, AdvertisedStartTime: start}},
+				{Race: &racing.Race{ExternalId: "B", MeetingId: 1, Name: "Sprint, Maiden", Number: 8, AdvertisedStartTime: start}},
+			},
+		},
+		{
+			name:       "success_csv_empty",
+			giveFormat: FormatCSV,
+		},
+		{
+			name:       "csv_invalid_fields",
+			giveFormat: FormatCSV,
+			give:       "external_id,meeting_id,number,visible,advertised_start_time\nA,one,2,maybe,tomorrow\n",
+			expect: []Row{
+				{
+					Race: &racing.Race{ExternalId: "A", Number: 2},
+					Errors: []string{
+						`meeting_id: invalid integer "one"`,
+						`visible: invalid boolean "maybe"`,
+						`advertised_start_time: invalid RFC 3339 time "tomorrow"`,
+					},
+				},
+			},
+		},
+		{
+			name:        "csv_unknown_column",
+			giveFormat:  FormatCSV,
+			give:        "external_id,colour\nA,red\n",
+			expectError: `unknown column "colour"`,
+		},
+		{
+			name:       "success_json",
+			giveFormat: FormatJSON,
+			give: `[{"external_id": "A", "meeting_id": 1, "name": "Melbourne Cup", "number": "7", "visible": true, "advertised_start_time": "2021-03-04T05:06:07Z"},
+				{"externalId": "B", "colour": "red"}]`,
+			expect: []Row{
+				{Race: &racing.Race{ExternalId: "A", MeetingId: 1, Name: "Melbourne Cup", Number: 7, Visible: true, AdvertisedStartTime: start}},
+				{Race: &racing.Race{}, Errors: []string{`unknown field "colour"`}},
+			},
+		},
+		{
+			name:        "json_not_array",
+			giveFormat:  FormatJSON,
+			give:        `{"external_id": "A"}`,
+			expectError: "json: cannot unmarshal object",
+		},
+		{
+			name:       "success_ndjson",
+			giveFormat: FormatNDJSON,
+			give: `{"external_id": "A", "meeting_id": 1, "name": "Melbourne Cup", "number": 7, "visible": true, "advertised_start_time": "2021-03-04T05:06:07Z"}
+
+{"external_id": "B", "number": "eight"}
+`,
+			expect: []Row{
+				{Race: &racing.Race{ExternalId: "A", MeetingId: 1, Name: "Melbourne Cup", Number: 7, Visible: true, AdvertisedStartTime: start}},
+				{Race: &racing.Race{ExternalId: "B"}, Errors: []string{`invalid value for int64 type: "eight"`}},
+			},
+		},
+		{
+			name:        "unknown_format",
+			giveFormat:  "xml",
+			expectError: `unknown format "xml"`,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			actual, actualErr := Decode(tc.giveFormat, strings.NewReader(tc.give))
+
+			// Errors are expected to contain those given, as the messages of JSON errors vary between versions.
+			assert.Empty(t, cmp.Diff(tc.expect, actual, protocmp.Transform(), cmp.Comparer(containsErrors)), "expected vs actual")
+
+			if tc.expectError != "" {
+				require.Error(t, actualErr, "actualErr")
+				assert.Contains(t, actualErr.Error(), tc.expectError, "actualErr")
+			} else {
+				assert.NoError(t, actualErr, "actualErr")
+			}
+		})
+	}
+}
+
+// containsErrors reports whether each of the errors of one row contains the corresponding error of the other.
+func containsErrors(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !strings.Contains(a[i], b[i]) && !strings.Contains(b[i], a[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestEncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	races := []*racing.Race{
+		{Id: 1, ExternalId: "A", MeetingId: 1, Name: "Melbourne Cup", Number: 7, Visible: true, AdvertisedStartTime: timestamppb.New(time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC))},
+		{Id: 2, MeetingId: 2, Name: "Sprint, \"Maiden\"", Number: 8, AdvertisedStartTime: timestamppb.New(time.Date(2021, time.March, 5, 5, 6, 7, 0, time.UTC))},
+	}
+
+	for _, format := range []string{FormatCSV, FormatJSON, FormatNDJSON} {
+		format := format
+
+		t.Run(format, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+
+			encoder, err := NewEncoder(format, &buf)
+			require.NoError(t, err, "NewEncoder")
+
+			for _, race := range races {
+				require.NoError(t, encoder.Encode(race), "Encode")
+			}
+
+			require.NoError(t, encoder.Close(), "Close")
+
+			rows, err := Decode(format, &buf)
+			require.NoError(t, err, "Decode")
+
+			assert.Empty(t, cmp.Diff([]Row{{Race: races[0]}, {Race: races[1]}}, rows, protocmp.Transform()), "expected vs actual")
+		})
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		give        string
+		expect      string
+		expectError string
+	}{
+		{give: "races.csv", expect: FormatCSV},
+		{give: "races.JSON", expect: FormatJSON},
+		{give: "races.ndjson", expect: FormatNDJSON},
+		{give: "races.jsonl", expect: FormatNDJSON},
+		{give: "races.xlsx", expectError: "unknown format of races.xlsx"},
+	} {
+		tc := tc
+
+		t.Run(tc.give, func(t *testing.T) {
+			t.Parallel()
+
+			actual, actualErr := FormatOf(tc.give)
+			assert.Equal(t, tc.expect, actual, "expected vs actual")
+
+			if tc.expectError != "" {
+				assert.EqualError(t, actualErr, tc.expectError, "actualErr")
+			} else {
+				assert.NoError(t, actualErr, "actualErr")
+			}
+		})
+	}
+}
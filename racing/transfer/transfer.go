@@ -0,0 +1,139 @@
+// Package transfer imports and exports races in bulk, as CSV, JSON or NDJSON files, and validates the races imported.
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// Importer creates or updates races by external ID, as the repositories of package db do.
+type Importer interface {
+	Import(ctx context.Context, races []*racing.Race, commit bool) ([]*racing.ImportRaceResult, error)
+}
+
+// Row is a race to import, with the errors found reading it.
+type Row struct {
+	Race   *racing.Race
+	Errors []string
+}
+
+// Import validates rows, and imports those that are valid into repo. The races are only stored if every row is
+// valid and dryRun is unset, so an import is either stored in full or not at all. Each row is reported on in order.
+func Import(ctx context.Context, repo Importer, rows []Row, dryRun bool) (*racing.ImportRacesResponse, error) {
+	response := &racing.ImportRacesResponse{Rows: make([]*racing.ImportRaceResult, len(rows))}
+
+	var (
+		valid     []*racing.Race
+		validRows []int
+	)
+
+	// seen maps the external IDs of the races imported to the rows they were first given in.
+	seen := make(map[string]int, len(rows))
+
+	for i, row := range rows {
+		errs := append([]string(nil), row.Errors...)
+
+		// Fields that couldn't be read aren't validated too, to report them once.
+		for _, err := range validate(row.Race) {
+			if !reported(row.Errors, err) {
+				errs = append(errs, err)
+			}
+		}
+
+		externalID := row.Race.GetExternalId()
+		if first, ok := seen[externalID]; ok && externalID != "" {
+			errs = append(errs, fmt.Sprintf("external_id: duplicates row %d", first))
+		} else {
+			seen[externalID] = i + 1
+		}
+
+		if len(errs) > 0 {
+			response.Invalid++
+			response.Rows[i] = &racing.ImportRaceResult{
+				Row:        int32(i + 1),
+				ExternalId: externalID,
+				Outcome:    racing.ImportRaceResult_INVALID,
+				Errors:     errs,
+			}
+
+			continue
+		}
+
+		valid = append(valid, row.Race)
+		validRows = append(validRows, i)
+	}
+
+	commit := !dryRun && response.Invalid == 0
+
+	// The valid races are imported even if they aren't stored, to report what they would do.
+	results, err := repo.Import(ctx, valid, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, result := range results {
+		result.Row = int32(validRows[i] + 1)
+
+		switch result.Outcome {
+		case racing.ImportRaceResult_CREATED:
+			response.Created++
+		case racing.ImportRaceResult_UPDATED:
+			response.Updated++
+		}
+
+		if !commit {
+			result.Id = 0
+		}
+
+		response.Rows[validRows[i]] = result
+	}
+
+	response.Committed = commit
+
+	return response, nil
+}
+
+// reported reports whether errs include an error of the field err is about.
+func reported(errs []string, err string) bool {
+	field := strings.SplitN(err, ":", 2)[0] + ":"
+
+	for _, e := range errs {
+		if strings.HasPrefix(e, field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate returns a description of each invalid field of race.
+func validate(race *racing.Race) []string {
+	var errs []string
+
+	if race.GetExternalId() == "" {
+		errs = append(errs, "external_id: must be set")
+	}
+
+	if race.GetMeetingId() <= 0 {
+		errs = append(errs, "meeting_id: must be greater than 0")
+	}
+
+	if race.GetName() == "" {
+		errs = append(errs, "name: must be set")
+	}
+
+	if race.GetNumber() <= 0 {
+		errs = append(errs, "number: must be greater than 0")
+	}
+
+	if start := race.GetAdvertisedStartTime(); start == nil {
+		errs = append(errs, "advertised_start_time: must be set")
+	} else if err := start.CheckValid(); err != nil {
+		errs = append(errs, "advertised_start_time: "+err.Error())
+	}
+
+	return errs
+}
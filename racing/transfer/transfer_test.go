@@ -0,0 +1,138 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+func TestImport(t *testing.T) {
+	t.Parallel()
+
+	start := timestamppb.New(time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC))
+	existing := &racing.Race{Id: 1, ExternalId: "A", MeetingId: 1, Name: "A", Number: 1, AdvertisedStartTime: start}
+	unchanged := []*racing.Race{{Id: 1, ExternalId: "A", MeetingId: 1, Name: "A", Number: 1, AdvertisedStartTime: start, Etag: `"1"`}}
+
+	valid := []Row{
+		{Race: &racing.Race{ExternalId: "A", MeetingId: 1, Name: "A renamed", Number: 1, AdvertisedStartTime: start}},
+		{Race: &racing.Race{ExternalId: "B", MeetingId: 1, Name: "B", Number: 2, AdvertisedStartTime: start}},
+	}
+
+	for _, tc := range []struct {
+		name         string
+		giveRows     []Row
+		giveDryRun   bool
+		expect       *racing.ImportRacesResponse
+		expectStored []*racing.Race
+	}{
+		{
+			name:     "success",
+			giveRows: valid,
+			expect: &racing.ImportRacesResponse{
+				Committed: true,
+				Created:   1,
+				Updated:   1,
+				Rows: []*racing.ImportRaceResult{
+					{Row: 1, ExternalId: "A", Outcome: racing.ImportRaceResult_UPDATED, Id: 1},
+					{Row: 2, ExternalId: "B", Outcome: racing.ImportRaceResult_CREATED, Id: 2},
+				},
+			},
+			expectStored: []*racing.Race{
+				{Id: 1, ExternalId: "A", MeetingId: 1, Name: "A renamed", Number: 1, AdvertisedStartTime: start, Etag: `"2"`},
+				{Id: 2, ExternalId: "B", MeetingId: 1, Name: "B", Number: 2, AdvertisedStartTime: start, Etag: `"1"`},
+			},
+		},
+		{
+			name:       "dry_run",
+			giveRows:   valid,
+			giveDryRun: true,
+			expect: &racing.ImportRacesResponse{
+				Created: 1,
+				Updated: 1,
+				Rows: []*racing.ImportRaceResult{
+					{Row: 1, ExternalId: "A", Outcome: racing.ImportRaceResult_UPDATED},
+					{Row: 2, ExternalId: "B", Outcome: racing.ImportRaceResult_CREATED},
+				},
+			},
+			expectStored: unchanged,
+		},
+		{
+			name: "invalid",
+			giveRows: []Row{
+				valid[1],
+				{Race: &racing.Race{ExternalId: "C"}, Errors: []string{"number: invalid integer \"x\""}},
+				{Race: &racing.Race{ExternalId: "B", MeetingId: 1, Name: "B", Number: 2, AdvertisedStartTime: start}},
+				{},
+			},
+			expect: &racing.ImportRacesResponse{
+				Created: 1,
+				Invalid: 3,
+				Rows: []*racing.ImportRaceResult{
+					{Row: 1, ExternalId: "B", Outcome: racing.ImportRaceResult_CREATED},
+					{
+						Row:        2,
+						ExternalId: "C",
+						Outcome:    racing.ImportRaceResult_INVALID,
+						Errors: []string{
+							"number: invalid integer \"x\"",
+							"meeting_id: must be greater than 0",
+							"name: must be set",
+							"advertised_start_time: must be set",
+						},
+					},
+					{Row: 3, ExternalId: "B", Outcome: racing.ImportRaceResult_INVALID, Errors: []string{"external_id: duplicates row 1"}},
+					{
+						Row:     4,
+						Outcome: racing.ImportRaceResult_INVALID,
+						Errors: []string{
+							"external_id: must be set",
+							"meeting_id: must be greater than 0",
+							"name: must be set",
+							"number: must be greater than 0",
+							"advertised_start_time: must be set",
+						},
+					},
+				},
+			},
+			expectStored: unchanged,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			repo := db.NewMemoryRacesRepo(existing)
+
+			actual, err := Import(context.Background(), repo, tc.giveRows, tc.giveDryRun)
+			require.NoError(t, err, "Import")
+
+			assert.Empty(t, cmp.Diff(tc.expect, actual, protocmp.Transform()), "expected vs actual")
+
+			stored, err := repo.List(context.Background(), nil, racing.RaceOrder{})
+			require.NoError(t, err, "List")
+
+			assert.Empty(t, cmp.Diff(tc.expectStored, stored, protocmp.Transform()), "expected vs stored")
+		})
+	}
+}
+
+func TestImportErr(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := Import(ctx, db.NewMemoryRacesRepo(), nil, false)
+	assert.True(t, errors.Is(err, context.Canceled), "err %v", err)
+}
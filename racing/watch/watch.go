@@ -0,0 +1,275 @@
+// Package watch follows changes to races and fans them out to watchers.
+//
+// Races are changed directly in the database, so a Hub polls the repository and publishes the differences between
+// each listing as events. The most recent events are retained so a watcher that reconnects can resume where it left
+// off rather than starting over.
+//
+// Events are only retained in memory, so a sequence is only meaningful to the Hub that published it. Each Hub numbers
+// its events within an epoch of its own, chosen at random, so that a watcher resuming from a sequence published
+// before a restart, or by another instance, starts over instead of resuming from the wrong event.
+package watch
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"git.neds.sh/matty/entain/racing/logging"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// sequenceBits is the number of low bits of a sequence that number the events of an epoch, its high bits being the
+// epoch.
+const sequenceBits = 32
+
+// ErrFellBehind is the error of a Stream that was stopped because it did not keep up with events.
+var ErrFellBehind = errors.New("watcher fell behind")
+
+// Event is a change to races published by a Hub.
+type Event struct {
+	*racing.RaceEvent
+	// Previous is the race as it was before an UPDATED event, so that watchers following some races can tell whether
+	// it was one of them before. It is nil for other events.
+	Previous *racing.Race
+}
+
+// Stream is the stream of events published after a watch started.
+type Stream interface {
+	// Events returns the channel events are received on. It is closed when the stream is stopped.
+	Events() <-chan *Event
+	// Err returns why the stream was stopped, once Events is closed. It is ErrFellBehind if the stream did not keep
+	// up, and nil if it was stopped by Stop.
+	Err() error
+	// Stop stops the stream, closing Events.
+	Stop()
+}
+
+// Lister lists races.
+type Lister interface {
+	List(ctx context.Context, filter *racing.ListRacesRequestFilter, order racing.RaceOrder) ([]*racing.Race, error)
+}
+
+// Hub publishes changes to races to watchers.
+type Hub struct {
+	lister Lister
+	retain int
+	buffer int
+
+	// now is the time the statuses of races are derived at, replaced in tests.
+	now func() time.Time
+
+	mu     sync.Mutex
+	loaded bool
+	// sequence is that of the last event published, starting from the epoch of the Hub in its high bits.
+	sequence uint64
+	races    map[int64]*racing.Race
+	events   []*Event
+	watchers map[*watcher]struct{}
+}
+
+// NewHub creates a Hub following the races listed by lister. The last retain events are kept for resuming, and
+// each watcher may have up to buffer events waiting to be received before it is stopped.
+func NewHub(lister Lister, retain, buffer int) *Hub {
+	return &Hub{
+		lister:   lister,
+		retain:   retain,
+		buffer:   buffer,
+		now:      time.Now,
+		sequence: newEpoch() << sequenceBits,
+		races:    map[int64]*racing.Race{},
+		watchers: map[*watcher]struct{}{},
+	}
+}
+
+// newEpoch returns a random, non-zero epoch.
+func newEpoch() uint64 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// Fall back on the time, which still differs between restarts.
+		return uint64(time.Now().UnixNano())&(1<<sequenceBits-1) | 1
+	}
+
+	return uint64(binary.BigEndian.Uint32(b[:])) | 1
+}
+
+// Run refreshes the races every interval until ctx is done.
+func (h *Hub) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.Refresh(ctx); err != nil {
+				logging.FromContext(ctx).WithError(err).Error("failed refreshing watched races")
+			}
+		}
+	}
+}
+
+// Refresh lists the races and publishes an event for each race created, updated or deleted since the last
+// refresh. The first refresh loads the races without publishing events. Statuses are derived as the races are listed,
+// so a race that closes is published as updated.
+func (h *Hub) Refresh(ctx context.Context) error {
+	races, err := h.lister.List(ctx, nil, racing.RaceOrder{})
+	if err != nil {
+		return err
+	}
+
+	now := h.now()
+	for _, race := range races {
+		race.DeriveStatus(now)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	current := make(map[int64]*racing.Race, len(races))
+	for _, race := range races {
+		current[race.Id] = race
+	}
+
+	if !h.loaded {
+		h.races = current
+		h.loaded = true
+
+		return nil
+	}
+
+	var events []*Event
+
+	for _, race := range races {
+		previous, ok := h.races[race.Id]
+
+		switch {
+		case !ok:
+			events = append(events, &Event{RaceEvent: &racing.RaceEvent{Type: racing.RaceEvent_CREATED, Race: race}})
+		case !proto.Equal(previous, race):
+			events = append(events, &Event{
+				RaceEvent: &racing.RaceEvent{Type: racing.RaceEvent_UPDATED, Race: race},
+				Previous:  previous,
+			})
+		}
+	}
+
+	for id, race := range h.races {
+		if _, ok := current[id]; !ok {
+			events = append(events, &Event{RaceEvent: &racing.RaceEvent{Type: racing.RaceEvent_DELETED, Race: race}})
+		}
+	}
+
+	// Deletions are found by walking a map, so order them for a stable sequence.
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Type != events[j].Type {
+			return events[i].Type < events[j].Type
+		}
+
+		return events[i].Race.Id < events[j].Race.Id
+	})
+
+	h.races = current
+
+	for _, event := range events {
+		h.publish(event)
+	}
+
+	return nil
+}
+
+// publish sequences event and sends it to each watcher. h.mu must be held.
+func (h *Hub) publish(event *Event) {
+	h.sequence++
+	event.Sequence = h.sequence
+
+	h.events = append(h.events, event)
+	if len(h.events) > h.retain {
+		h.events = h.events[len(h.events)-h.retain:]
+	}
+
+	for w := range h.watchers {
+		select {
+		case w.events <- event:
+		default:
+			h.remove(w, ErrFellBehind)
+		}
+	}
+}
+
+// Watch starts watching the races. It returns the events to start with, followed by a Stream of the events after
+// them. The events to start with are those since the event with sequence resumeAfter if it was published by h and
+// they have been retained, and otherwise a snapshot of every race.
+func (h *Hub) Watch(resumeAfter uint64) ([]*Event, Stream) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w := &watcher{hub: h, events: make(chan *Event, h.buffer)}
+	h.watchers[w] = struct{}{}
+
+	if resumeAfter>>sequenceBits == h.sequence>>sequenceBits && resumeAfter <= h.sequence {
+		if resumeAfter == h.sequence {
+			return nil, w
+		}
+
+		if len(h.events) > 0 && h.events[0].Sequence <= resumeAfter+1 {
+			i := sort.Search(len(h.events), func(i int) bool { return h.events[i].Sequence > resumeAfter })
+
+			return append([]*Event(nil), h.events[i:]...), w
+		}
+	}
+
+	snapshot := make([]*Event, 0, len(h.races))
+	for _, race := range h.races {
+		snapshot = append(snapshot, &Event{
+			RaceEvent: &racing.RaceEvent{Sequence: h.sequence, Type: racing.RaceEvent_SNAPSHOT, Race: race},
+		})
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Race.Id < snapshot[j].Race.Id })
+
+	return snapshot, w
+}
+
+// remove stops w with err. h.mu must be held.
+func (h *Hub) remove(w *watcher, err error) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+
+	delete(h.watchers, w)
+
+	w.err = err
+	close(w.events)
+}
+
+// watcher is the Stream of a watch, receiving the events published after it started.
+type watcher struct {
+	hub    *Hub
+	events chan *Event
+	err    error
+}
+
+func (w *watcher) Events() <-chan *Event {
+	return w.events
+}
+
+func (w *watcher) Err() error {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+
+	return w.err
+}
+
+func (w *watcher) Stop() {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+
+	w.hub.remove(w, nil)
+}
@@ -0,0 +1,313 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+type fakeLister struct {
+	mu    sync.Mutex
+	races []*racing.Race
+	err   error
+}
+
+func (l *fakeLister) List(context.Context, *racing.ListRacesRequestFilter, racing.RaceOrder) ([]*racing.Race, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.races, l.err
+}
+
+func (l *fakeLister) set(races ...*racing.Race) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.races = races
+}
+
+// eventSummary is the type and race ID of an event, for comparing events.
+type eventSummary struct {
+	Type racing.RaceEvent_Type
+	ID   int64
+}
+
+func summarise(events []*Event) []eventSummary {
+	var summaries []eventSummary
+	for _, event := range events {
+		summaries = append(summaries, eventSummary{Type: event.Type, ID: event.Race.Id})
+	}
+
+	return summaries
+}
+
+func receive(t *testing.T, w Stream, n int) []*Event {
+	t.Helper()
+
+	var events []*Event
+
+	for i := 0; i < n; i++ {
+		select {
+		case event := <-w.Events():
+			events = append(events, event)
+		default:
+			require.Failf(t, "missing event", "received %d of %d events", i, n)
+		}
+	}
+
+	return events
+}
+
+func TestHubRefresh(t *testing.T) {
+	t.Parallel()
+
+	lister := &fakeLister{}
+	lister.set(&racing.Race{Id: 1, Name: "one"}, &racing.Race{Id: 2, Name: "two"})
+
+	hub := NewHub(lister, 10, 10)
+	require.NoError(t, hub.Refresh(context.Background()), "Refresh")
+
+	snapshot, w := hub.Watch(0)
+	defer w.Stop()
+
+	assert.Equal(t, []eventSummary{
+		{Type: racing.RaceEvent_SNAPSHOT, ID: 1},
+		{Type: racing.RaceEvent_SNAPSHOT, ID: 2},
+	}, summarise(snapshot), "snapshot")
+
+	lister.set(&racing.Race{Id: 2, Name: "two, renamed"}, &racing.Race{Id: 3, Name: "three"})
+	require.NoError(t, hub.Refresh(context.Background()), "Refresh")
+
+	events := receive(t, w, 3)
+
+	assert.Equal(t, []eventSummary{
+		{Type: racing.RaceEvent_CREATED, ID: 3},
+		{Type: racing.RaceEvent_UPDATED, ID: 2},
+		{Type: racing.RaceEvent_DELETED, ID: 1},
+	}, summarise(events), "events")
+
+	base := snapshot[0].Sequence
+	for i, event := range events {
+		assert.Equal(t, base+uint64(i+1), event.Sequence, "sequence")
+	}
+
+	// Updates carry the race as it was before them.
+	assert.Nil(t, events[0].Previous, "previous of created")
+	assert.Equal(t, "two", events[1].Previous.GetName(), "previous of updated")
+	assert.Nil(t, events[2].Previous, "previous of deleted")
+
+	lister.err = errors.New("database is on fire")
+	assert.Error(t, hub.Refresh(context.Background()), "Refresh")
+}
+
+func TestHubRefreshStatus(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+	now := start.Add(-time.Minute)
+
+	lister := &fakeLister{}
+	lister.set(&racing.Race{Id: 1, AdvertisedStartTime: timestamppb.New(start)})
+
+	hub := NewHub(lister, 10, 10)
+	hub.now = func() time.Time { return now }
+	require.NoError(t, hub.Refresh(context.Background()), "Refresh")
+
+	snapshot, w := hub.Watch(0)
+	defer w.Stop()
+
+	assert.Equal(t, racing.Race_OPEN, snapshot[0].Race.GetStatus(), "status before start")
+
+	// The race itself is unchanged, but it closes as it starts.
+	now = start
+	lister.set(&racing.Race{Id: 1, AdvertisedStartTime: timestamppb.New(start)})
+	require.NoError(t, hub.Refresh(context.Background()), "Refresh")
+
+	events := receive(t, w, 1)
+	assert.Equal(t, []eventSummary{{racing.RaceEvent_UPDATED, 1}}, summarise(events), "events")
+	assert.Equal(t, racing.Race_CLOSED, events[0].Race.GetStatus(), "status after start")
+	assert.Equal(t, racing.Race_OPEN, events[0].Previous.GetStatus(), "previous status")
+}
+
+func TestHubWatchResume(t *testing.T) {
+	t.Parallel()
+
+	lister := &fakeLister{}
+	hub := NewHub(lister, 2, 10)
+	require.NoError(t, hub.Refresh(context.Background()), "Refresh")
+
+	for id := int64(1); id <= 4; id++ {
+		races := append([]*racing.Race(nil), lister.races...)
+		lister.set(append(races, &racing.Race{Id: id})...)
+		require.NoError(t, hub.Refresh(context.Background()), "Refresh")
+	}
+
+	// Sequences are given and expected relative to the first of the hub.
+	initial, w := hub.Watch(0)
+	w.Stop()
+
+	base := initial[0].Sequence - 4
+
+	for _, tc := range []struct {
+		name           string
+		giveResume     uint64
+		expectSummary  []eventSummary
+		expectSequence []uint64
+	}{
+		{
+			name:           "success",
+			giveResume:     2,
+			expectSummary:  []eventSummary{{racing.RaceEvent_CREATED, 3}, {racing.RaceEvent_CREATED, 4}},
+			expectSequence: []uint64{3, 4},
+		},
+		{
+			name:       "success_up_to_date",
+			giveResume: 4,
+		},
+		{
+			name:       "success_new_watch",
+			giveResume: 0,
+			expectSummary: []eventSummary{
+				{racing.RaceEvent_SNAPSHOT, 1},
+				{racing.RaceEvent_SNAPSHOT, 2},
+				{racing.RaceEvent_SNAPSHOT, 3},
+				{racing.RaceEvent_SNAPSHOT, 4},
+			},
+			expectSequence: []uint64{4, 4, 4, 4},
+		},
+		{
+			name:       "not_retained",
+			giveResume: 1,
+			expectSummary: []eventSummary{
+				{racing.RaceEvent_SNAPSHOT, 1},
+				{racing.RaceEvent_SNAPSHOT, 2},
+				{racing.RaceEvent_SNAPSHOT, 3},
+				{racing.RaceEvent_SNAPSHOT, 4},
+			},
+			expectSequence: []uint64{4, 4, 4, 4},
+		},
+		{
+			name:       "unknown_sequence",
+			giveResume: 42,
+			expectSummary: []eventSummary{
+				{racing.RaceEvent_SNAPSHOT, 1},
+				{racing.RaceEvent_SNAPSHOT, 2},
+				{racing.RaceEvent_SNAPSHOT, 3},
+				{racing.RaceEvent_SNAPSHOT, 4},
+			},
+			expectSequence: []uint64{4, 4, 4, 4},
+		},
+		{
+			// A sequence of another epoch is from another hub, so doesn't identify an event of this one.
+			name:       "other_epoch",
+			giveResume: 2 + 1<<sequenceBits,
+			expectSummary: []eventSummary{
+				{racing.RaceEvent_SNAPSHOT, 1},
+				{racing.RaceEvent_SNAPSHOT, 2},
+				{racing.RaceEvent_SNAPSHOT, 3},
+				{racing.RaceEvent_SNAPSHOT, 4},
+			},
+			expectSequence: []uint64{4, 4, 4, 4},
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			resume := tc.giveResume
+			if resume > 0 {
+				resume += base
+			}
+
+			actual, w := hub.Watch(resume)
+			defer w.Stop()
+
+			var sequences []uint64
+			for _, event := range actual {
+				sequences = append(sequences, event.Sequence-base)
+			}
+
+			assert.Equal(t, tc.expectSummary, summarise(actual), "events")
+			assert.Equal(t, tc.expectSequence, sequences, "sequences")
+		})
+	}
+}
+
+func TestHubWatchResumeOtherHub(t *testing.T) {
+	t.Parallel()
+
+	lister := &fakeLister{}
+
+	// The hubs stand for racing before and after a restart.
+	previous := NewHub(lister, 10, 10)
+	require.NoError(t, previous.Refresh(context.Background()), "Refresh")
+
+	_, w := previous.Watch(0)
+	defer w.Stop()
+
+	lister.set(&racing.Race{Id: 1})
+	require.NoError(t, previous.Refresh(context.Background()), "Refresh")
+
+	last := receive(t, w, 1)[0]
+
+	// The new hub publishes as many events, so that its sequences would otherwise coincide with the previous one's,
+	// and resuming would miss the race it created.
+	hub := NewHub(lister, 10, 10)
+	require.NoError(t, hub.Refresh(context.Background()), "Refresh")
+
+	lister.set(&racing.Race{Id: 1}, &racing.Race{Id: 2})
+	require.NoError(t, hub.Refresh(context.Background()), "Refresh")
+
+	actual, w := hub.Watch(last.Sequence)
+	defer w.Stop()
+
+	assert.Equal(t, []eventSummary{
+		{racing.RaceEvent_SNAPSHOT, 1},
+		{racing.RaceEvent_SNAPSHOT, 2},
+	}, summarise(actual), "events")
+}
+
+func TestWatcherFellBehind(t *testing.T) {
+	t.Parallel()
+
+	lister := &fakeLister{}
+	hub := NewHub(lister, 10, 1)
+	require.NoError(t, hub.Refresh(context.Background()), "Refresh")
+
+	_, w := hub.Watch(0)
+
+	lister.set(&racing.Race{Id: 1}, &racing.Race{Id: 2})
+	require.NoError(t, hub.Refresh(context.Background()), "Refresh")
+
+	receive(t, w, 1)
+
+	_, ok := <-w.Events()
+	assert.False(t, ok, "Events closed")
+	assert.ErrorIs(t, w.Err(), ErrFellBehind, "Err")
+
+	// Stopping a watcher that was already removed is a no-op.
+	w.Stop()
+}
+
+func TestWatcherStop(t *testing.T) {
+	t.Parallel()
+
+	hub := NewHub(&fakeLister{}, 10, 10)
+	require.NoError(t, hub.Refresh(context.Background()), "Refresh")
+
+	_, w := hub.Watch(0)
+	w.Stop()
+
+	_, ok := <-w.Events()
+	assert.False(t, ok, "Events closed")
+	assert.NoError(t, w.Err(), "Err")
+}
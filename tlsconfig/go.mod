@@ -0,0 +1,8 @@
+module git.neds.sh/matty/entain/tlsconfig
+
+go 1.16
+
+require (
+	github.com/sirupsen/logrus v1.8.1
+	github.com/stretchr/testify v1.7.0
+)
@@ -0,0 +1,246 @@
+// Package tlsconfig builds TLS configurations from PEM files that are reloaded when they change on disk, so
+// certificates can be rotated without a restart. It is a module of its own, shared by the api and racing services.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultReloadInterval is how often the services check their TLS files for changes.
+const DefaultReloadInterval = time.Minute
+
+// Files are the PEM files a TLS configuration is loaded from.
+type Files struct {
+	// CertFile and KeyFile are the certificate chain and private key presented to peers. They are required for
+	// servers and optional for clients.
+	CertFile string
+	KeyFile  string
+	// CAFile is a bundle of CA certificates peers are verified against. Servers require and verify client
+	// certificates (mutual TLS) when it is set. Clients verify servers against the system roots when it is not.
+	CAFile string
+}
+
+// Reloader holds the certificates loaded from Files, reloading them when the files change.
+type Reloader struct {
+	files Files
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// NewReloader loads files.
+func NewReloader(files Files) (*Reloader, error) {
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, errors.New("a certificate and key must be given together")
+	}
+
+	r := &Reloader{files: files}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads the files again. The previously loaded certificates are kept if any of them are invalid.
+func (r *Reloader) Reload() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+
+	var cert *tls.Certificate
+
+	if r.files.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading key pair: %w", err)
+		}
+
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+
+	if r.files.CAFile != "" {
+		b, err := os.ReadFile(r.files.CAFile)
+		if err != nil {
+			return fmt.Errorf("reading ca bundle: %w", err)
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in %s", r.files.CAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = cert
+	r.pool = pool
+	r.modTimes = modTimes
+
+	return nil
+}
+
+// Run checks the files for changes every interval, reloading them when they change, until ctx is done. Reloads, and
+// failures to reload, are logged to logger.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration, logger logrus.FieldLogger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := r.changed()
+		if err != nil {
+			logger.WithError(err).Warn("failed checking tls files")
+			continue
+		}
+
+		if !changed {
+			continue
+		}
+
+		if err := r.Reload(); err != nil {
+			logger.WithError(err).Error("failed reloading tls files")
+			continue
+		}
+
+		logger.Info("reloaded tls files")
+	}
+}
+
+// ServerConfig returns a configuration for servers. Clients must present a certificate signed by the CA bundle
+// if one was given.
+func (r *Reloader) ServerConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			if cert == nil {
+				return nil, errors.New("no server certificate")
+			}
+
+			return cert, nil
+		},
+	}
+
+	if r.files.CAFile != "" {
+		// Verification is done by VerifyConnection, against the CA bundle loaded at the time.
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			_, pool := r.current()
+
+			return verify(cs, pool, "", x509.ExtKeyUsageClientAuth)
+		}
+	}
+
+	return cfg
+}
+
+// ClientConfig returns a configuration for clients connecting to serverName. The client certificate, if one
+// was given, is presented to servers that ask for it.
+func (r *Reloader) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+
+			return cert, nil
+		},
+		// Verification is done by VerifyConnection, against the CA bundle loaded at the time.
+		InsecureSkipVerify: true, //nolint:gosec
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, pool := r.current()
+
+			return verify(cs, pool, cs.ServerName, x509.ExtKeyUsageServerAuth)
+		},
+	}
+}
+
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, r.pool
+}
+
+// changed reports whether any of the files have been modified since they were loaded.
+func (r *Reloader) changed() (bool, error) {
+	modTimes, err := r.stat()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for name, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[name]) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (r *Reloader) stat() (map[string]time.Time, error) {
+	modTimes := map[string]time.Time{}
+
+	for _, name := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if name == "" {
+			continue
+		}
+
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+
+		modTimes[name] = info.ModTime()
+	}
+
+	return modTimes, nil
+}
+
+// verify verifies the peer certificate chain in cs against roots, or the system roots if roots is nil.
+func verify(cs tls.ConnectionState, roots *x509.CertPool, dnsName string, usage x509.ExtKeyUsage) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no peer certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       dnsName,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+
+	return err
+}
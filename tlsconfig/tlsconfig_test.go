@@ -0,0 +1,260 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshake(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	ca := newCA(t, "ca")
+	otherCA := newCA(t, "other")
+
+	serverCert := ca.issue(t, "racing", x509.ExtKeyUsageServerAuth)
+	clientCert := ca.issue(t, "api", x509.ExtKeyUsageClientAuth)
+	otherClientCert := otherCA.issue(t, "api", x509.ExtKeyUsageClientAuth)
+
+	for _, tc := range []struct {
+		name          string
+		giveServer    Files
+		giveClient    Files
+		expectErrored bool
+	}{
+		{
+			name:       "tls",
+			giveServer: writeFiles(t, dir, "tls_server", serverCert, nil),
+			giveClient: writeFiles(t, dir, "tls_client", nil, ca),
+		},
+		{
+			name:       "mtls",
+			giveServer: writeFiles(t, dir, "mtls_server", serverCert, ca),
+			giveClient: writeFiles(t, dir, "mtls_client", clientCert, ca),
+		},
+		{
+			name:          "mtls_no_client_cert",
+			giveServer:    writeFiles(t, dir, "no_client_cert_server", serverCert, ca),
+			giveClient:    writeFiles(t, dir, "no_client_cert_client", nil, ca),
+			expectErrored: true,
+		},
+		{
+			name:          "mtls_untrusted_client_cert",
+			giveServer:    writeFiles(t, dir, "untrusted_client_server", serverCert, ca),
+			giveClient:    writeFiles(t, dir, "untrusted_client_client", otherClientCert, ca),
+			expectErrored: true,
+		},
+		{
+			name:          "untrusted_server_cert",
+			giveServer:    writeFiles(t, dir, "untrusted_server_server", serverCert, nil),
+			giveClient:    writeFiles(t, dir, "untrusted_server_client", nil, otherCA),
+			expectErrored: true,
+		},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, err := NewReloader(tc.giveServer)
+			require.NoError(t, err, "NewReloader server")
+
+			client, err := NewReloader(tc.giveClient)
+			require.NoError(t, err, "NewReloader client")
+
+			_, actualErr := handshake(t, server.ServerConfig(), client.ClientConfig("racing"))
+
+			if tc.expectErrored {
+				assert.Error(t, actualErr, "actualErr")
+			} else {
+				assert.NoError(t, actualErr, "actualErr")
+			}
+		})
+	}
+}
+
+func TestReloaderReload(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ca := newCA(t, "ca")
+
+	serverFiles := writeFiles(t, dir, "server", ca.issue(t, "racing", x509.ExtKeyUsageServerAuth), nil)
+
+	server, err := NewReloader(serverFiles)
+	require.NoError(t, err, "NewReloader server")
+
+	client, err := NewReloader(writeFiles(t, dir, "client", nil, ca))
+	require.NoError(t, err, "NewReloader client")
+
+	before, err := handshake(t, server.ServerConfig(), client.ClientConfig("racing"))
+	require.NoError(t, err, "handshake before")
+
+	rotated := ca.issue(t, "racing", x509.ExtKeyUsageServerAuth)
+	writeFiles(t, dir, "server", rotated, nil)
+
+	// Make sure the modification time changes even on file systems with a coarse resolution.
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(serverFiles.CertFile, future, future), "os.Chtimes")
+
+	changed, err := server.changed()
+	require.NoError(t, err, "changed")
+	assert.True(t, changed, "changed")
+
+	require.NoError(t, server.Reload(), "Reload")
+
+	after, err := handshake(t, server.ServerConfig(), client.ClientConfig("racing"))
+	require.NoError(t, err, "handshake after")
+
+	assert.NotEqual(t, before.SerialNumber, after.SerialNumber, "serial number")
+	assert.Equal(t, rotated.leaf.SerialNumber, after.SerialNumber, "serial number")
+
+	// An invalid file is rejected, and the rotated certificate kept.
+	require.NoError(t, os.WriteFile(serverFiles.KeyFile, []byte("invalid"), 0o600), "os.WriteFile")
+	assert.Error(t, server.Reload(), "Reload invalid")
+
+	kept, err := handshake(t, server.ServerConfig(), client.ClientConfig("racing"))
+	require.NoError(t, err, "handshake kept")
+
+	assert.Equal(t, rotated.leaf.SerialNumber, kept.SerialNumber, "serial number")
+}
+
+func TestNewReloaderInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewReloader(Files{CertFile: "cert.pem"})
+	assert.EqualError(t, err, "a certificate and key must be given together")
+
+	_, err = NewReloader(Files{CAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err, "missing file")
+}
+
+// handshake completes a TLS handshake between server and client, returning the certificate the server presented.
+func handshake(t *testing.T, server, client *tls.Config) (*x509.Certificate, error) {
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	require.NoError(t, err, "tls.Listen")
+	t.Cleanup(func() { _ = lis.Close() })
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// The client only learns it was rejected once it reads.
+		if err := conn.(*tls.Conn).Handshake(); err == nil {
+			_, _ = conn.Write([]byte{0})
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", lis.Addr().String(), client)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		return nil, err
+	}
+
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+type keyPair struct {
+	leaf *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T, name string) *keyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "ecdsa.GenerateKey")
+
+	template := &x509.Certificate{
+		SerialNumber:          newSerialNumber(t),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err, "x509.CreateCertificate")
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err, "x509.ParseCertificate")
+
+	return &keyPair{leaf: leaf, key: key}
+}
+
+func (ca *keyPair) issue(t *testing.T, name string, usage x509.ExtKeyUsage) *keyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "ecdsa.GenerateKey")
+
+	template := &x509.Certificate{
+		SerialNumber: newSerialNumber(t),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.leaf, &key.PublicKey, ca.key)
+	require.NoError(t, err, "x509.CreateCertificate")
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err, "x509.ParseCertificate")
+
+	return &keyPair{leaf: leaf, key: key}
+}
+
+func newSerialNumber(t *testing.T) *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	require.NoError(t, err, "rand.Int")
+
+	return serial
+}
+
+// writeFiles writes cert and ca, either of which may be nil, to PEM files in dir named after prefix.
+func writeFiles(t *testing.T, dir, prefix string, cert, ca *keyPair) Files {
+	var files Files
+
+	if cert != nil {
+		keyDER, err := x509.MarshalECPrivateKey(cert.key)
+		require.NoError(t, err, "x509.MarshalECPrivateKey")
+
+		files.CertFile = writePEM(t, filepath.Join(dir, prefix+"_cert.pem"), "CERTIFICATE", cert.leaf.Raw)
+		files.KeyFile = writePEM(t, filepath.Join(dir, prefix+"_key.pem"), "EC PRIVATE KEY", keyDER)
+	}
+
+	if ca != nil {
+		files.CAFile = writePEM(t, filepath.Join(dir, prefix+"_ca.pem"), "CERTIFICATE", ca.leaf.Raw)
+	}
+
+	return files
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) string {
+	b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(path, b, 0o600), "os.WriteFile")
+
+	return path
+}